@@ -1,16 +1,147 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
 	_ "gorm.io/driver/sqlite"
 
 	"codingtest/server"
 )
 
+const usage = `Usage:
+  codingtest [flags]               start the server
+  codingtest config print [flags]  print the effective configuration (secrets are masked)
+  codingtest analyze [-all] [flags] analyze the sentiment and topics of feedback comments that haven't been analyzed yet
+                                   (-all re-analyzes every comment, e.g. after upgrading)
+  codingtest import <users|sessions|feedback> <file> [flags]
+                                   import records from a CSV (.csv) or NDJSON file and print a report of the rows
+                                   that could not be imported
+
+Run "codingtest -h" to list the available flags.`
+
 func main() {
-	r := server.SetupRouter()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		if len(args) < 2 || args[1] != "print" {
+			fmt.Fprintln(os.Stderr, usage)
+			os.Exit(2)
+		}
+		printConfig(args[2:])
+		return
+	}
+	if len(args) > 0 && args[0] == "analyze" {
+		analyze(args[1:])
+		return
+	}
+	if len(args) > 0 && args[0] == "import" {
+		importFile(args[1:])
+		return
+	}
+	serve(args)
+}
+
+// loadConfig loads the configuration, exiting with a helpful message if it is invalid
+func loadConfig(args []string) *server.Config {
+	cfg, err := server.LoadConfig(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return cfg
+}
 
-	err := r.Run(server.GetBindAddress())
+// printConfig writes the effective configuration to stdout as YAML
+func printConfig(args []string) {
+	out, err := loadConfig(args).Masked().YAML()
 	if err != nil {
 		panic(err)
 	}
+	fmt.Print(out)
+}
+
+// analyze backfills the sentiment and topics of existing feedback
+func analyze(args []string) {
+	all := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "-all" || arg == "--all" {
+			all = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	cfg := loadConfig(rest)
+	updated, err := server.RunAnalysisBackfill(context.Background(), cfg, all)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "updated": updated}).Error("Failed to analyze feedback")
+		os.Exit(1)
+	}
+	log.WithField("updated", updated).Info("Analyzed feedback")
+}
+
+// importFile imports users, sessions or feedback from a file and prints the report as JSON
+func importFile(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, usage)
+		os.Exit(2)
+	}
+	cfg := loadConfig(args[2:])
+	report, err := server.ImportFile(context.Background(), cfg, args[0], args[1])
+	// The report also covers the rows processed before a failed import
+	if report.Kind != "" {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	}
+	if err != nil {
+		log.WithField("error", err.Error()).Error("Failed to import records")
+		os.Exit(1)
+	}
+	if report.Failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// serve runs the server until it receives SIGTERM or SIGINT, then shuts down gracefully
+func serve(args []string) {
+	cfg := loadConfig(args)
+	app := server.NewApp(cfg)
+	srv, err := server.NewHTTPServer(cfg.Server, app.Router)
+	if err != nil {
+		panic(err)
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if err := server.ListenAndServe(srv); err != nil && err != http.ErrServerClosed {
+			serveErr <- err
+		}
+	}()
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
+		panic(err)
+	case sig := <-quit:
+		log.WithField("signal", sig.String()).Info("Shutting down server")
+	}
+
+	// Stop accepting new connections and give in-flight requests until the deadline to finish
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.WithField("error", err.Error()).Error("Server did not drain connections before the shutdown deadline")
+	}
+	// Flush background work and close the database pool
+	if err := app.Close(ctx); err != nil {
+		log.WithField("error", err.Error()).Error("Failed to release resources during shutdown")
+	}
+	log.Info("Server stopped")
 }
@@ -4,11 +4,16 @@ go 1.13
 
 require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0
-	github.com/gin-gonic/gin v1.6.3
+	github.com/gin-contrib/sse v0.1.0
+	// v1.7 is the first release that allows a route parameter next to static routes (POST /users/:id/token alongside
+	// /users/create, GET /sessions/:id alongside /sessions/feedback) and that has Engine.SetTrustedProxies
+	github.com/gin-gonic/gin v1.7.7
+	github.com/gorilla/websocket v1.4.2
 	github.com/satori/go.uuid v1.2.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.4.0
-	golang.org/x/sys v0.0.0-20200625212154-ddb9806d33ae // indirect
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	gopkg.in/yaml.v2 v2.2.8
 	gorm.io/driver/sqlite v1.1.3
 	gorm.io/gorm v1.20.2
 )
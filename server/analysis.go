@@ -0,0 +1,416 @@
+package server
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// ContextKeyAnalyzer is the key name for the comment Analyzer within the Gin context
+const ContextKeyAnalyzer = "analyzer"
+
+// Sentiments of a SessionFeedback comment - feedback created before comments were analyzed has an empty sentiment until
+// the backfill command is run
+const (
+	SentimentPositive = "positive"
+	SentimentNeutral  = "neutral"
+	SentimentNegative = "negative"
+)
+
+// sentimentIsValid checks if the given value is one of the sentiments
+func sentimentIsValid(sentiment string) bool {
+	switch sentiment {
+	case SentimentPositive, SentimentNeutral, SentimentNegative:
+		return true
+	}
+	return false
+}
+
+// Analysis is the outcome of analyzing a comment
+type Analysis struct {
+	Sentiment string
+	// From -1 (most negative) to 1 (most positive)
+	SentimentScore float64
+	// Topics mentioned by the comment (e.g., lag, matchmaking), sorted by name
+	Topics []string
+}
+
+// Analyzer extracts the sentiment and topics of a feedback comment
+//
+// The default implementation is the LexiconAnalyzer - other implementations (e.g., one backed by an external language
+// service) can be plugged in with addAnalysisMiddleware.
+type Analyzer interface {
+	Analyze(comment string) Analysis
+}
+
+// sentimentLexicon scores words from -3 (very negative) to 3 (very positive)
+var sentimentLexicon = map[string]float64{
+	// Positive
+	"amazing": 3, "awesome": 3, "best": 3, "brilliant": 3, "excellent": 3, "fantastic": 3, "incredible": 3, "love": 3,
+	"loved": 3, "perfect": 3, "outstanding": 3, "superb": 3, "masterpiece": 3,
+	"great": 2, "fun": 2, "enjoy": 2, "enjoyed": 2, "enjoyable": 2, "addictive": 2, "beautiful": 2, "exciting": 2,
+	"happy": 2, "liked": 2, "nice": 2, "smooth": 2, "solid": 2, "satisfying": 2, "thanks": 2, "thank": 2,
+	"wonderful": 2, "polished": 2, "balanced": 2, "responsive": 2, "friendly": 2, "impressive": 2, "intense": 1,
+	"good": 1, "better": 1, "cool": 1, "decent": 1, "fair": 1, "fine": 1, "improved": 1, "okay": 1, "ok": 1, "stable": 1,
+	"win": 1, "won": 1, "fast": 1, "helpful": 1, "glad": 1, "clean": 1,
+	// Negative
+	"awful": -3, "garbage": -3, "hate": -3, "hated": -3, "horrible": -3, "terrible": -3, "trash": -3, "unplayable": -3,
+	"worst": -3, "disgusting": -3, "pathetic": -3, "abysmal": -3,
+	"bad": -2, "boring": -2, "broken": -2, "buggy": -2, "cheater": -2, "cheaters": -2, "cheating": -2, "crash": -2,
+	"crashed": -2, "crashes": -2, "crashing": -2, "disappointed": -2, "disappointing": -2, "frustrating": -2,
+	"frustrated": -2, "lag": -2, "laggy": -2, "lagging": -2, "ruined": -2, "stupid": -2, "toxic": -2, "unfair": -2,
+	"unbalanced": -2, "useless": -2, "waste": -2, "annoying": -2, "angry": -2, "rage": -2, "sucks": -2, "sucked": -2,
+	"overpowered": -1, "bug": -1, "bugs": -1, "slow": -1, "stutter": -1, "stuttering": -1, "freeze": -2, "froze": -2,
+	"frozen": -2, "disconnect": -2, "disconnected": -2, "confusing": -1, "lose": -1, "lost": -1, "meh": -1, "weird": -1,
+	"problem": -1, "problems": -1, "issue": -1, "issues": -1, "worse": -2, "glitch": -1, "glitches": -1, "glitchy": -2,
+	"rude": -2, "unresponsive": -2, "nerf": -1, "grind": -1, "grindy": -2,
+}
+
+// sentimentNegators flip the sentiment of the words that follow them (e.g., "not fun")
+var sentimentNegators = map[string]bool{
+	"not": true, "no": true, "never": true, "nothing": true, "without": true, "hardly": true, "barely": true,
+	"don't": true, "doesn't": true, "didn't": true, "isn't": true, "wasn't": true, "aren't": true, "weren't": true,
+	"can't": true, "cannot": true, "couldn't": true, "won't": true, "wouldn't": true, "shouldn't": true,
+	"dont": true, "doesnt": true, "didnt": true, "isnt": true, "wasnt": true, "cant": true, "wont": true,
+}
+
+// sentimentIntensifiers strengthen the sentiment of the word that follows them (e.g., "very fun")
+var sentimentIntensifiers = map[string]float64{
+	"very": 1.5, "really": 1.5, "so": 1.5, "extremely": 1.8, "super": 1.5, "incredibly": 1.8, "totally": 1.5,
+	"absolutely": 1.8, "too": 1.3, "way": 1.3, "completely": 1.5, "pretty": 1.2, "quite": 1.2, "somewhat": 0.7,
+	"slightly": 0.6, "bit": 0.7, "kinda": 0.7,
+}
+
+// Tuning of the LexiconAnalyzer
+const (
+	// negationWindow is the number of words after a negator whose sentiment is flipped
+	negationWindow = 3
+	// negationFactor dampens flipped words - "not bad" is less positive than "good"
+	negationFactor = -0.75
+	// sentimentNormalization controls how quickly the summed word scores approach -1 or 1
+	sentimentNormalization = 15
+	// sentimentThreshold is the smallest score (in either direction) that is not neutral
+	sentimentThreshold = 0.05
+)
+
+// topicKeywords maps every topic to the words that mention it
+var topicKeywords = map[string][]string{
+	"balance":     {"balance", "balanced", "balancing", "unbalanced", "imbalanced", "overpowered", "op", "underpowered", "nerf", "nerfed", "buff", "buffed", "meta"},
+	"bugs":        {"bug", "bugs", "buggy", "glitch", "glitches", "glitchy", "broken", "exploit", "exploits"},
+	"cheating":    {"cheat", "cheats", "cheater", "cheaters", "cheating", "hack", "hacks", "hacker", "hackers", "hacking", "aimbot", "wallhack", "wallhacks"},
+	"crashes":     {"crash", "crashed", "crashes", "crashing", "freeze", "froze", "frozen", "freezing"},
+	"lag":         {"lag", "laggy", "lagging", "latency", "ping", "rubberband", "rubberbanding", "desync", "delay"},
+	"maps":        {"map", "maps", "level", "levels", "spawn", "spawns", "spawning", "layout"},
+	"matchmaking": {"matchmaking", "matchmaker", "queue", "queues", "queued", "mmr", "elo", "rank", "ranked", "teammates", "lobby", "lobbies"},
+	"monetization": {"price", "prices", "expensive", "paywall", "microtransactions", "lootbox", "lootboxes", "p2w", "pay2win", "shop",
+		"skins", "battlepass"},
+	"performance": {"fps", "framerate", "frames", "stutter", "stuttering", "performance", "optimization", "optimized", "slow", "loading"},
+	"servers":     {"server", "servers", "disconnect", "disconnected", "disconnects", "dc", "kicked", "timeout", "connection"},
+	"toxicity":    {"toxic", "toxicity", "rude", "insult", "insults", "harassment", "harassed", "flame", "flaming", "griefing", "griefer", "trolls", "troll"},
+}
+
+// LexiconAnalyzer scores sentiment by summing the lexicon scores of a comment's words (handling negation and intensifiers)
+// and finds topics by keyword - it needs no external service or model
+type LexiconAnalyzer struct {
+	topics map[string]string
+}
+
+// NewLexiconAnalyzer creates a LexiconAnalyzer using the built-in lexicon and topic keywords
+func NewLexiconAnalyzer() *LexiconAnalyzer {
+	a := &LexiconAnalyzer{topics: map[string]string{}}
+	for topic, keywords := range topicKeywords {
+		for _, keyword := range keywords {
+			a.topics[keyword] = topic
+		}
+	}
+	return a
+}
+
+// analysisClauses splits a comment into clauses of lowercase words (keeping apostrophes so that "don't" is a single
+// word) - negation and intensifiers don't carry over from one clause to the next
+func analysisClauses(comment string) [][]string {
+	var clauses [][]string
+	for _, clause := range strings.FieldsFunc(strings.ToLower(comment), func(r rune) bool {
+		return strings.ContainsRune(",.;:!?()\n", r)
+	}) {
+		words := strings.FieldsFunc(clause, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '\''
+		})
+		if len(words) > 0 {
+			clauses = append(clauses, words)
+		}
+	}
+	return clauses
+}
+
+// Analyze scores the sentiment of the comment and finds the topics it mentions
+func (a *LexiconAnalyzer) Analyze(comment string) Analysis {
+	var sum float64
+	topics := map[string]bool{}
+	for _, clause := range analysisClauses(comment) {
+		negated := 0
+		intensity := 1.0
+		for _, word := range clause {
+			word = strings.Trim(word, "'")
+			if topic, ok := a.topics[word]; ok {
+				topics[topic] = true
+			}
+			if sentimentNegators[word] {
+				negated = negationWindow
+				continue
+			}
+			if factor, ok := sentimentIntensifiers[word]; ok {
+				intensity *= factor
+				continue
+			}
+			if score, ok := sentimentLexicon[word]; ok {
+				score *= intensity
+				if negated > 0 {
+					score *= negationFactor
+				}
+				sum += score
+			}
+			intensity = 1
+			if negated > 0 {
+				negated--
+			}
+		}
+	}
+
+	analysis := Analysis{Sentiment: SentimentNeutral}
+	if sum != 0 {
+		analysis.SentimentScore = math.Round(sum/math.Sqrt(sum*sum+sentimentNormalization)*1000) / 1000
+	}
+	if analysis.SentimentScore >= sentimentThreshold {
+		analysis.Sentiment = SentimentPositive
+	} else if analysis.SentimentScore <= -sentimentThreshold {
+		analysis.Sentiment = SentimentNegative
+	}
+	for topic := range topics {
+		analysis.Topics = append(analysis.Topics, topic)
+	}
+	sort.Strings(analysis.Topics)
+	return analysis
+}
+
+// FeedbackTopic database model representing a topic mentioned by the comment of SessionFeedback
+type FeedbackTopic struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"-"`
+	// FK
+	SessionFeedbackID uuid.UUID `gorm:"uniqueIndex:idx_feedback_topics_topic" json:"-"`
+	Topic             string    `gorm:"not null;uniqueIndex:idx_feedback_topics_topic;index" json:"topic"`
+}
+
+// applyAnalysis stores the analysis on the feedback (the topics are saved with the feedback)
+func applyAnalysis(sessionFeedback *SessionFeedback, analysis Analysis) {
+	sessionFeedback.Sentiment = analysis.Sentiment
+	sessionFeedback.SentimentScore = analysis.SentimentScore
+	sessionFeedback.Topics = nil
+	for _, topic := range analysis.Topics {
+		sessionFeedback.Topics = append(sessionFeedback.Topics, FeedbackTopic{ID: uuid.NewV4(), SessionFeedbackID: sessionFeedback.ID, Topic: topic})
+	}
+}
+
+// analysisBackfillBatchSize is the number of SessionFeedback records analyzed per transaction by BackfillAnalysis
+const analysisBackfillBatchSize = 100
+
+// BackfillAnalysis analyzes the comments of feedback that has not been analyzed yet (or every feedback when all is
+// true, e.g. after the lexicon changed) and returns the number of updated records
+//
+// Updated records get a new updated_at, so their ETags and the versions of the listings they appear in change, and are
+// audited as updates by source. The given list cache (nil when there is none in this process) is invalidated once the
+// backfill is done.
+func BackfillAnalysis(ctx context.Context, db *gorm.DB, source AuditSource, analyzer Analyzer, all bool, cache *ListCache) (updated int, err error) {
+	if cache != nil {
+		defer func() {
+			if updated > 0 {
+				cache.Invalidate()
+			}
+		}()
+	}
+	db = db.WithContext(ctx)
+	// Page by ID rather than offset, since updated records drop out of the "not analyzed" condition
+	last := ""
+	for {
+		var batch []SessionFeedback
+		query := db.Preload("Topics").Where("id > ?", last).Order("id").Limit(analysisBackfillBatchSize)
+		if !all {
+			query = query.Where("sentiment = ''")
+		}
+		if err := query.Find(&batch).Error; err != nil {
+			return updated, err
+		}
+		if len(batch) == 0 {
+			return updated, nil
+		}
+		err := db.Transaction(func(tx *gorm.DB) error {
+			for i := range batch {
+				before := batch[i]
+				applyAnalysis(&batch[i], analyzer.Analyze(batch[i].Comment))
+				if err := tx.Model(&batch[i]).Select("sentiment", "sentiment_score", "updated_at").Updates(&batch[i]).Error; err != nil {
+					return err
+				}
+				if err := tx.Where("session_feedback_id = ?", batch[i].ID).Delete(&FeedbackTopic{}).Error; err != nil {
+					return err
+				}
+				if len(batch[i].Topics) > 0 {
+					if err := tx.Create(&batch[i].Topics).Error; err != nil {
+						return err
+					}
+				}
+				if err := appendAudit(tx, source, AuditActionUpdate, AuditResourceSessionFeedback, batch[i].ID, &before, &batch[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return updated, err
+		}
+		updated += len(batch)
+		last = batch[len(batch)-1].ID.String()
+	}
+}
+
+// RunAnalysisBackfill opens the configured database and runs BackfillAnalysis with the LexiconAnalyzer
+//
+// The list caches of the running servers are separate processes - their listings pick up the new analysis once they
+// expire (list_cache.ttl), and clients revalidating with an ETag get the new analysis right away.
+func RunAnalysisBackfill(ctx context.Context, cfg *Config, all bool) (int, error) {
+	db := initDB(cfg.Database)
+	sqlDB, err := db.DB()
+	if err != nil {
+		return 0, err
+	}
+	defer sqlDB.Close()
+	return BackfillAnalysis(ctx, db, AuditSource{Actor: AuditActorCLI}, NewLexiconAnalyzer(), all, nil)
+}
+
+// adds the comment analyzer to the context, it can be retrieved in routes by using GetAnalyzer
+func addAnalysisMiddleware(r *gin.Engine, analyzer Analyzer) {
+	r.Use(func(c *gin.Context) {
+		c.Set(ContextKeyAnalyzer, analyzer)
+	})
+}
+
+// GetAnalyzer retrieves the comment analyzer from the request context
+func GetAnalyzer(c *gin.Context) Analyzer {
+	value, ok := c.Get(ContextKeyAnalyzer)
+	if !ok {
+		panic("analyzer not found in context")
+	}
+	analyzer, ok := value.(Analyzer)
+	if !ok {
+		panic("analyzer was not the correct type")
+	}
+	return analyzer
+}
+
+// FeedbackStats summarizes the feedback matching the filters of GET /feedback/stats
+type FeedbackStats struct {
+	Count         int64   `json:"count"`
+	AverageRating float64 `json:"averageRating"`
+	// Number of feedback per rating ("1" - "5")
+	Ratings   map[string]int64 `json:"ratings"`
+	Sentiment SentimentStats   `json:"sentiment"`
+	// The most mentioned topics, most mentioned first
+	Topics []TopicCount `json:"topics"`
+}
+
+// SentimentStats summarizes the sentiment of analyzed feedback
+type SentimentStats struct {
+	Positive int64 `json:"positive"`
+	Neutral  int64 `json:"neutral"`
+	Negative int64 `json:"negative"`
+	// Feedback that hasn't been analyzed yet (see the analyze command)
+	Unanalyzed   int64   `json:"unanalyzed"`
+	AverageScore float64 `json:"averageScore"`
+}
+
+// TopicCount is the number of feedback mentioning a topic
+type TopicCount struct {
+	Topic string `json:"topic"`
+	Count int64  `json:"count"`
+}
+
+// getFeedbackStats handles GET /feedback/stats - summarizes the ratings, sentiment and topics of the feedback the caller
+// may see, accepting the same filters as GET /sessions/feedback
+func getFeedbackStats(c *gin.Context) {
+	filter, err := parseSessionFeedbackFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	matching := func() *gorm.DB {
+		return GetDB(c).Model(&SessionFeedback{}).Scopes(visibleFeedback(c), filter.scope)
+	}
+	stats := FeedbackStats{Ratings: map[string]int64{}, Topics: []TopicCount{}}
+
+	var totals struct {
+		Count         int64
+		AverageRating float64
+		AverageScore  float64
+	}
+	if err := matching().Select("count(*) AS count, coalesce(avg(session_feedbacks.rating), 0) AS average_rating, " +
+		"coalesce(avg(CASE WHEN session_feedbacks.sentiment <> '' THEN session_feedbacks.sentiment_score END), 0) AS average_score").
+		Scan(&totals).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	stats.Count = totals.Count
+	stats.AverageRating = math.Round(totals.AverageRating*100) / 100
+	stats.Sentiment.AverageScore = math.Round(totals.AverageScore*1000) / 1000
+
+	var ratings []struct {
+		Rating int
+		Count  int64
+	}
+	if err := matching().Select("session_feedbacks.rating AS rating, count(*) AS count").Group("session_feedbacks.rating").Scan(&ratings).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for rating := 1; rating <= 5; rating++ {
+		stats.Ratings[strconv.Itoa(rating)] = 0
+	}
+	for _, row := range ratings {
+		stats.Ratings[strconv.Itoa(row.Rating)] = row.Count
+	}
+
+	var sentiments []struct {
+		Sentiment string
+		Count     int64
+	}
+	if err := matching().Select("session_feedbacks.sentiment AS sentiment, count(*) AS count").Group("session_feedbacks.sentiment").Scan(&sentiments).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	for _, row := range sentiments {
+		switch row.Sentiment {
+		case SentimentPositive:
+			stats.Sentiment.Positive = row.Count
+		case SentimentNeutral:
+			stats.Sentiment.Neutral = row.Count
+		case SentimentNegative:
+			stats.Sentiment.Negative = row.Count
+		default:
+			stats.Sentiment.Unanalyzed += row.Count
+		}
+	}
+
+	if err := matching().Select("feedback_topics.topic AS topic, count(*) AS count").
+		Joins("JOIN feedback_topics ON feedback_topics.session_feedback_id = session_feedbacks.id").
+		Group("feedback_topics.topic").Order("count DESC").Order("topic").Limit(20).
+		Scan(&stats.Topics).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"stats": &stats})
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type GetFeedbackStatsJSON struct {
+	Stats FeedbackStats `json:"stats"`
+}
+
+// TestLexiconAnalyzer ensures sentiment handles negation and intensifiers and topics are found by keyword
+func TestLexiconAnalyzer(t *testing.T) {
+	analyzer := NewLexiconAnalyzer()
+	for comment, sentiment := range map[string]string{
+		"":                               SentimentNeutral,
+		"We played on the docks map":     SentimentNeutral,
+		"Great match, really fun!":       SentimentPositive,
+		"Terrible lag, the game crashed": SentimentNegative,
+		"Not fun at all":                 SentimentNegative,
+		"It wasn't bad":                  SentimentPositive,
+		"Didn't crash once, awesome":     SentimentPositive,
+	} {
+		assert.Equal(t, sentiment, analyzer.Analyze(comment).Sentiment, comment)
+	}
+
+	fun := analyzer.Analyze("fun").SentimentScore
+	assert.Greater(t, analyzer.Analyze("very fun").SentimentScore, fun)
+	assert.Less(t, analyzer.Analyze("not fun").SentimentScore, 0.0)
+	assert.InDelta(t, -1, analyzer.Analyze("awful terrible horrible garbage trash, worst game ever").SentimentScore, 0.05)
+
+	analysis := analyzer.Analyze("Matchmaking keeps putting me with cheaters using an aimbot, and the LAG is unreal")
+	assert.Equal(t, []string{"cheating", "lag", "matchmaking"}, analysis.Topics)
+	assert.Empty(t, analyzer.Analyze("Good game").Topics)
+}
+
+// TestFeedbackAnalysis ensures comments are analyzed on creation, can be filtered by sentiment and topic, and are summarized by the stats endpoint
+func (s *RouteTestSuite) TestFeedbackAnalysis() {
+	session := s.createSession()
+	laggy := s.createFeedback(session, s.createUser(), 2, "Terrible lag and the server disconnected me")
+	s.Equal(SentimentNegative, laggy.Sentiment)
+	s.Less(laggy.SentimentScore, 0.0)
+	s.Require().Len(laggy.Topics, 2)
+	s.Equal("lag", laggy.Topics[0].Topic)
+	s.Equal("servers", laggy.Topics[1].Topic)
+	s.createFeedback(session, s.createUser(), 1, "So much lag, unplayable")
+	happy := s.createFeedback(session, s.createUser(), 5, "Great maps, really fun")
+	s.createFeedback(session, s.createUser(), 4, "")
+
+	get := func(query string) []SessionFeedback {
+		w := s.request("GET", "/sessions/feedback?sessionId="+session.ID.String()+query, nil)
+		s.Require().Equal(200, w.Code, w.Body.String())
+		var response GetFeedbackJSON
+		s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Feedback
+	}
+	s.Len(get("&sentiment=negative"), 2)
+	if feedback := get("&sentiment=positive"); s.Len(feedback, 1) {
+		s.Equal(happy.ID, feedback[0].ID)
+	}
+	s.Len(get("&sentiment=neutral"), 1)
+	s.Len(get("&topic=lag"), 2)
+	if feedback := get("&topic=lag&topic=servers"); s.Len(feedback, 1) {
+		s.Equal(laggy.ID, feedback[0].ID)
+	}
+	s.Equal(http.StatusBadRequest, s.request("GET", "/sessions/feedback?sentiment=angry", nil).Code)
+
+	var response GetFeedbackStatsJSON
+	w := s.request("GET", "/feedback/stats?sessionId="+session.ID.String(), nil)
+	s.Equal(200, w.Code, w.Body.String())
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	stats := response.Stats
+	s.Equal(int64(4), stats.Count)
+	s.Equal(3.0, stats.AverageRating)
+	s.Equal(map[string]int64{"1": 1, "2": 1, "3": 0, "4": 1, "5": 1}, stats.Ratings)
+	s.Equal(int64(1), stats.Sentiment.Positive)
+	s.Equal(int64(1), stats.Sentiment.Neutral)
+	s.Equal(int64(2), stats.Sentiment.Negative)
+	s.Less(stats.Sentiment.AverageScore, 0.0)
+	s.Require().NotEmpty(stats.Topics)
+	s.Equal(TopicCount{Topic: "lag", Count: 2}, stats.Topics[0])
+
+	w = s.request("GET", "/feedback/stats?sessionId="+session.ID.String()+"&sentiment=positive", nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Equal(int64(1), response.Stats.Count)
+	s.Equal([]TopicCount{{Topic: "maps", Count: 1}}, response.Stats.Topics)
+	s.Equal(http.StatusBadRequest, s.request("GET", "/feedback/stats?rating=0", nil).Code)
+}
+
+// TestBackfillAnalysis ensures the backfill analyzes feedback that hasn't been analyzed and re-analyzes everything with all
+func TestBackfillAnalysis(t *testing.T) {
+	db := initMockDB()
+	var ids []uuid.UUID
+	for i := 0; i < analysisBackfillBatchSize+5; i++ {
+		feedback := SessionFeedback{ID: uuid.NewV4(), Rating: 1, Comment: "Constant lag", ModerationStatus: ModerationApproved}
+		assert.NoError(t, db.Create(&feedback).Error)
+		ids = append(ids, feedback.ID)
+	}
+	analyzed := SessionFeedback{ID: uuid.NewV4(), Rating: 5, Comment: "Fun", ModerationStatus: ModerationApproved, Sentiment: SentimentPositive, SentimentScore: 0.5}
+	assert.NoError(t, db.Create(&analyzed).Error)
+
+	var before SessionFeedback
+	assert.NoError(t, db.First(&before, "id = ?", ids[0]).Error)
+	cache := NewListCache(ListCacheConfig{TTL: time.Minute, MaxEntries: 10})
+	cache.put("listing", 0, listCacheEntry{etag: `W/"stale"`})
+
+	time.Sleep(2 * time.Millisecond)
+	updated, err := BackfillAnalysis(context.Background(), db, AuditSource{Actor: AuditActorCLI}, NewLexiconAnalyzer(), false, cache)
+	assert.NoError(t, err)
+	assert.Equal(t, len(ids), updated)
+	_, _, cached := cache.get("listing")
+	assert.False(t, cached)
+
+	// The new analysis changes the ETag of the feedback
+	var feedback SessionFeedback
+	assert.NoError(t, db.Preload("Topics").First(&feedback, "id = ?", ids[0]).Error)
+	assert.Equal(t, SentimentNegative, feedback.Sentiment)
+	assert.True(t, feedback.UpdatedAt.After(before.UpdatedAt))
+	assert.NotEqual(t, resourceETag(before.ID, before.UpdatedAt), resourceETag(feedback.ID, feedback.UpdatedAt))
+	if assert.Len(t, feedback.Topics, 1) {
+		assert.Equal(t, "lag", feedback.Topics[0].Topic)
+	}
+	// Every update is audited, with the previous analysis as the before snapshot
+	var entries []AuditEntry
+	assert.NoError(t, db.Where("action = ? AND resource_type = ?", AuditActionUpdate, AuditResourceSessionFeedback).Find(&entries).Error)
+	assert.Len(t, entries, len(ids))
+	var entry AuditEntry
+	assert.NoError(t, db.Where("resource_id = ?", ids[0].String()).First(&entry).Error)
+	assert.Equal(t, AuditActorCLI, entry.Actor)
+	assert.NotContains(t, string(entry.Before), SentimentNegative)
+	assert.Contains(t, string(entry.After), SentimentNegative)
+
+	updated, err = BackfillAnalysis(context.Background(), db, AuditSource{Actor: AuditActorCLI}, NewLexiconAnalyzer(), false, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, updated)
+
+	// Re-analyzing replaces the topics instead of duplicating them
+	updated, err = BackfillAnalysis(context.Background(), db, AuditSource{Actor: AuditActorCLI}, NewLexiconAnalyzer(), true, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, len(ids)+1, updated)
+	var topics int64
+	assert.NoError(t, db.Model(&FeedbackTopic{}).Count(&topics).Error)
+	assert.Equal(t, int64(len(ids)), topics)
+}
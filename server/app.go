@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// App bundles the router together with the resources it owns so they can be released when the server shuts down
+type App struct {
+	Config *Config
+	Router *gin.Engine
+	DB     *gorm.DB
+	Tracer *Tracer
+	// Events passes the published domain events to in-process handlers (when outbox.sinks has bus)
+	Events *EventBus
+
+	// shutdownHooks flush background work - they are run in reverse order of registration before the DB is closed
+	shutdownHooks []func(ctx context.Context) error
+}
+
+// setTrustedProxies only takes the client IP from the X-Forwarded-For and X-Real-Ip headers of requests sent by the given
+// proxies - gin trusts every proxy by default, which would let any client choose the IP it is rate limited and audited as
+func setTrustedProxies(r *gin.Engine, proxies []string) error {
+	if len(proxies) == 0 {
+		proxies = nil
+	}
+	return r.SetTrustedProxies(proxies)
+}
+
+// NewApp completes setup of the router, middleware, db middleware and routes using the given configuration
+func NewApp(cfg *Config) *App {
+	tracer, err := NewTracerFromConfig(cfg.Tracing)
+	if err != nil {
+		panic(err)
+	}
+	moderator, err := NewBlocklistModerator(cfg.Moderation)
+	if err != nil {
+		panic(err)
+	}
+	db := initDB(cfg.Database)
+	if err := registerTracingCallbacks(db, tracer); err != nil {
+		panic(err)
+	}
+	limiter, err := newRateLimiter(cfg.RateLimit, NewMemoryRateLimitStore())
+	if err != nil {
+		panic(err)
+	}
+	searcher, err := newFeedbackSearcher(db)
+	if err != nil {
+		panic(err)
+	}
+	bus := NewEventBus()
+	sinks, err := newOutboxSinks(cfg.Outbox, db, bus)
+	if err != nil {
+		panic(err)
+	}
+
+	r := gin.Default()
+	if err := setTrustedProxies(r, cfg.Server.TrustedProxies); err != nil {
+		panic(err)
+	}
+	addMiddleware(r)
+	addRequestIDMiddleware(r)
+	addConfigMiddleware(r, cfg)
+	addTracingMiddleware(r, tracer)
+	addAuthMiddleware(r, cfg.Auth)
+	addDatabaseMiddleware(r, db)
+	addUserAuthMiddleware(r)
+	addRateLimitMiddleware(r, limiter)
+	addIdempotencyMiddleware(r, cfg.Idempotency)
+	addModerationMiddleware(r, moderator)
+	addSearchMiddleware(r, searcher)
+	addAnalysisMiddleware(r, NewLexiconAnalyzer())
+	addListCacheMiddleware(r, NewListCache(cfg.ListCache))
+	addFeedbackHubMiddleware(r, NewFeedbackHub())
+	addRoutes(r)
+
+	app := &App{
+		Config: cfg,
+		Router: r,
+		DB:     db,
+		Tracer: tracer,
+		Events: bus,
+	}
+	app.OnShutdown(tracer.Shutdown)
+	webhooks := NewWebhookDispatcher(db, cfg.Webhook)
+	webhooks.Start()
+	app.OnShutdown(webhooks.Shutdown)
+	outbox := NewOutboxDispatcher(db, cfg.Outbox, sinks...)
+	outbox.Start()
+	app.OnShutdown(outbox.Shutdown)
+	return app
+}
+
+// OnShutdown registers a hook used to flush buffered background work when the server shuts down
+func (a *App) OnShutdown(hook func(ctx context.Context) error) {
+	a.shutdownHooks = append(a.shutdownHooks, hook)
+}
+
+// Close runs the shutdown hooks and then closes the database connection pool
+//
+// Every hook is run even if an earlier one fails; the first error encountered is returned.
+func (a *App) Close(ctx context.Context) error {
+	var firstErr error
+	for i := len(a.shutdownHooks) - 1; i >= 0; i-- {
+		if err := a.shutdownHooks[i](ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	sqlDB, err := a.DB.DB()
+	if err == nil {
+		err = sqlDB.Close()
+	}
+	if err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestAppClose ensures shutdown hooks run in reverse order (even after a failure) before the database is closed
+func TestAppClose(t *testing.T) {
+	app := &App{DB: initMockDB()}
+	var order []int
+	app.OnShutdown(func(ctx context.Context) error {
+		order = append(order, 1)
+		return nil
+	})
+	app.OnShutdown(func(ctx context.Context) error {
+		order = append(order, 2)
+		return errors.New("flush failed")
+	})
+
+	err := app.Close(context.Background())
+	assert.EqualError(t, err, "flush failed")
+	assert.Equal(t, []int{2, 1}, order)
+
+	sqlDB, err := app.DB.DB()
+	assert.NoError(t, err)
+	assert.Error(t, sqlDB.Ping())
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+	// AuditActionImport is recorded for every imported record, with the record as the after snapshot
+	AuditActionImport = "import"
+	// AuditActionErase is recorded when the data of a user is erased, with the UserErasure as the after snapshot
+	AuditActionErase = "erase"
+)
+
+// Types of the resources recorded in the audit log
+const (
+	AuditResourceUser             = "user"
+	AuditResourceSession          = "session"
+	AuditResourceSessionFeedback  = "sessionFeedback"
+	AuditResourceFeedbackReport   = "feedbackReport"
+	AuditResourceFeedbackResponse = "feedbackResponse"
+	AuditResourceFeedbackForm     = "feedbackForm"
+	AuditResourceWebhook          = "webhook"
+)
+
+// Actors of changes that aren't made by an ops team member or on behalf of a player
+const (
+	AuditActorAnonymous = "anonymous"
+	AuditActorCLI       = "cli"
+)
+
+// maxAuditEntries is the most audit entries listed at once
+const maxAuditEntries = 500
+
+// errAuditAppendOnly is returned when something attempts to change or remove an audit entry
+var errAuditAppendOnly = errors.New("audit entries can't be updated or deleted")
+
+// AuditSnapshot is the JSON of a resource at the time of a change - stored as text, and rendered as JSON (null if empty)
+type AuditSnapshot string
+
+// MarshalJSON implements json.Marshaler
+func (s AuditSnapshot) MarshalJSON() ([]byte, error) {
+	if s == "" {
+		return []byte("null"), nil
+	}
+	return []byte(s), nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (s *AuditSnapshot) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		*s = ""
+		return nil
+	}
+	*s = AuditSnapshot(data)
+	return nil
+}
+
+// AuditEntry database model representing a change made to a resource - entries are append-only
+type AuditEntry struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	// Who made the change: "ops:<API key name>", "game-server:<API key name>", "user:<user ID>" (authenticated by the
+	// user token), "claimed-user:<X-User-ID>" (as claimed by the client), "cli" or "anonymous"
+	Actor        string `gorm:"not null;index" json:"actor"`
+	IP           string `json:"ip,omitempty"`
+	Action       string `gorm:"not null;index" json:"action"`
+	ResourceType string `gorm:"not null;index:idx_audit_entries_resource" json:"resourceType"`
+	ResourceID   string `gorm:"index:idx_audit_entries_resource" json:"resourceId,omitempty"`
+	// The resource before and after the change (null for creations and deletions respectively)
+	Before    AuditSnapshot `gorm:"type:text" json:"before"`
+	After     AuditSnapshot `gorm:"type:text" json:"after"`
+	RequestID string        `gorm:"index" json:"requestId,omitempty"`
+	CreatedAt time.Time     `gorm:"index" json:"createdAt"`
+}
+
+// BeforeUpdate keeps audit entries from being changed
+func (AuditEntry) BeforeUpdate(tx *gorm.DB) error {
+	return errAuditAppendOnly
+}
+
+// BeforeDelete keeps audit entries from being removed
+func (AuditEntry) BeforeDelete(tx *gorm.DB) error {
+	return errAuditAppendOnly
+}
+
+// AuditSource describes where a change comes from
+type AuditSource struct {
+	Actor     string
+	IP        string
+	RequestID string
+}
+
+// requestAuditSource describes the caller of a request - a player is only audited as user:<USER_ID> when authenticated
+// by their token, as anyone can send X-User-ID (which is audited as claimed-user:<USER_ID>)
+func requestAuditSource(c *gin.Context) AuditSource {
+	source := AuditSource{Actor: AuditActorAnonymous, IP: c.ClientIP(), RequestID: GetRequestID(c)}
+	if identity := GetIdentity(c); identity != nil {
+		source.Actor = identity.Role + ":" + identity.Name
+	} else if userID := c.GetHeader(UserIDHeader); userID != "" {
+		source.Actor = "claimed-user:" + userID
+	}
+	return source
+}
+
+// auditSnapshot renders a resource for the audit log (nil renders as null)
+func auditSnapshot(resource interface{}) (AuditSnapshot, error) {
+	if resource == nil {
+		return "", nil
+	}
+	data, err := json.Marshal(resource)
+	return AuditSnapshot(data), err
+}
+
+// appendAudit adds an entry to the audit log - call it with the transaction that saves the change, so that the entry is
+// only recorded if the change is
+func appendAudit(tx *gorm.DB, source AuditSource, action string, resourceType string, resourceID uuid.UUID, before, after interface{}) error {
+	entry := AuditEntry{
+		ID:           uuid.NewV4(),
+		Actor:        source.Actor,
+		IP:           source.IP,
+		Action:       action,
+		ResourceType: resourceType,
+		RequestID:    source.RequestID,
+		// Kept in UTC so that since and until compare correctly in the database
+		CreatedAt: time.Now().UTC(),
+	}
+	if resourceID != uuid.Nil {
+		entry.ResourceID = resourceID.String()
+	}
+	var err error
+	if entry.Before, err = auditSnapshot(before); err != nil {
+		return err
+	}
+	if entry.After, err = auditSnapshot(after); err != nil {
+		return err
+	}
+	return tx.Create(&entry).Error
+}
+
+// recordAudit adds an entry for a change made by the caller of the request to the audit log
+func recordAudit(tx *gorm.DB, c *gin.Context, action string, resourceType string, resourceID uuid.UUID, before, after interface{}) error {
+	return appendAudit(tx, requestAuditSource(c), action, resourceType, resourceID, before, after)
+}
+
+// parseAuditTime parses a since/until query parameter
+func parseAuditTime(c *gin.Context, name string) (time.Time, bool, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return time.Time{}, false, nil
+	}
+	value, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("%s must be an RFC 3339 time", name)
+	}
+	return value.UTC(), true, nil
+}
+
+// getAuditLog handles GET /audit - lists audit entries, newest first
+//
+// Accepts the actor, action, resourceType, resourceId and requestId filters, since (inclusive) and until (exclusive)
+// RFC 3339 times, and limit (100 by default). Older entries are paged through by passing the createdAt of the last
+// entry as until.
+func getAuditLog(c *gin.Context) {
+	query := GetDB(c).Model(&AuditEntry{})
+	filters := map[string]string{
+		"actor":        "actor",
+		"action":       "action",
+		"resourceType": "resource_type",
+		"resourceId":   "resource_id",
+		"requestId":    "request_id",
+	}
+	for param, column := range filters {
+		if value := c.Query(param); value != "" {
+			query = query.Where(column+" = ?", value)
+		}
+	}
+	since, ok, err := parseAuditTime(c, "since")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if ok {
+		query = query.Where("created_at >= ?", since)
+	}
+	until, ok, err := parseAuditTime(c, "until")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if ok {
+		query = query.Where("created_at < ?", until)
+	}
+	limit := 100
+	if raw := c.Query("limit"); raw != "" {
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxAuditEntries {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Limit must be an integer from 1 through %d", maxAuditEntries)})
+			return
+		}
+	}
+	var entries []AuditEntry
+	if err := query.Order("created_at DESC").Limit(limit).Find(&entries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": &entries})
+}
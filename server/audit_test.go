@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+// auditLog lists the audit entries matching the given query
+func (s *RouteTestSuite) auditLog(query string) []AuditEntry {
+	w := s.request("GET", "/audit?"+query, nil, APIKeyHeader, testOpsAPIKey)
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Entries []AuditEntry `json:"entries"`
+	}
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Entries
+}
+
+// TestRequestID ensures every response has a request ID, reusing a valid one sent by the client
+func (s *RouteTestSuite) TestRequestID() {
+	w := s.request("GET", "/ping", nil, RequestIDHeader, "lb-1234")
+	s.Equal("lb-1234", w.Header().Get(RequestIDHeader))
+	w = s.request("GET", "/ping", nil, RequestIDHeader, "not valid")
+	_, err := uuid.FromString(w.Header().Get(RequestIDHeader))
+	s.NoError(err)
+	_, err = uuid.FromString(s.request("GET", "/ping", nil).Header().Get(RequestIDHeader))
+	s.NoError(err)
+}
+
+// TestAuditLog ensures changes are recorded with their actor, snapshots and request ID, and can be filtered
+func (s *RouteTestSuite) TestAuditLog() {
+	s.Equal(http.StatusUnauthorized, s.request("GET", "/audit", nil).Code)
+
+	w := s.request("POST", "/sessions/create", nil, UserIDHeader, "player-1", RequestIDHeader, "create-session")
+	s.Require().Equal(http.StatusOK, w.Code)
+	var created CreateSessionJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &created))
+	entries := s.auditLog("requestId=create-session")
+	s.Require().Len(entries, 1)
+	s.Equal("claimed-user:player-1", entries[0].Actor)
+	s.Equal(AuditActionCreate, entries[0].Action)
+	s.Equal(AuditResourceSession, entries[0].ResourceType)
+	s.Equal(created.Session.ID.String(), entries[0].ResourceID)
+	s.Empty(entries[0].Before)
+	var after Session
+	s.Require().NoError(json.Unmarshal([]byte(entries[0].After), &after))
+	s.Equal(created.Session.ID, after.ID)
+
+	// Only players authenticated by their token are audited as users
+	player := s.createUser()
+	s.Require().Equal(http.StatusOK, s.request("POST", "/sessions/create", nil, UserTokenHeader, s.userToken(player), RequestIDHeader, "token-session").Code)
+	entries = s.auditLog("requestId=token-session")
+	s.Require().Len(entries, 1)
+	s.Equal("user:"+player.ID.String(), entries[0].Actor)
+
+	// Updates have both snapshots
+	feedback := s.createFeedback(created.Session, s.createUser(), 3, "")
+	path := "/ops/feedback/" + feedback.ID.String() + "/moderation"
+	etag := s.etag("/feedback/"+feedback.ID.String(), APIKeyHeader, testOpsAPIKey)
+	w = s.request("PUT", path, gin.H{"status": ModerationRejected}, APIKeyHeader, testOpsAPIKey, "If-Match", etag)
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	entries = s.auditLog("action=update&resourceId=" + feedback.ID.String())
+	s.Require().Len(entries, 1)
+	s.Equal("ops:tester", entries[0].Actor)
+	var before, updated SessionFeedback
+	s.Require().NoError(json.Unmarshal([]byte(entries[0].Before), &before))
+	s.Require().NoError(json.Unmarshal([]byte(entries[0].After), &updated))
+	s.Equal(ModerationApproved, before.ModerationStatus)
+	s.Equal(ModerationRejected, updated.ModerationStatus)
+
+	// Deletions keep the deleted record, while rejected deletions aren't recorded
+	user := s.createUser()
+	s.Equal(http.StatusPreconditionFailed, s.request("DELETE", "/users?id="+user.ID.String(), nil, "If-Match", `"stale"`).Code)
+	etag = s.etag("/users/" + user.ID.String())
+	s.Equal(http.StatusOK, s.request("DELETE", "/users?id="+user.ID.String(), nil, APIKeyHeader, testOpsAPIKey, "If-Match", etag).Code)
+	entries = s.auditLog("resourceType=user&resourceId=" + user.ID.String())
+	s.Require().Len(entries, 2)
+	s.Equal(AuditActionDelete, entries[0].Action)
+	s.Equal("ops:tester", entries[0].Actor)
+	s.Contains(string(entries[0].Before), user.ID.String())
+	s.Empty(entries[0].After)
+	s.Equal(AuditActionCreate, entries[1].Action)
+	s.Equal(AuditActorAnonymous, entries[1].Actor)
+
+	// Time filters and limits
+	s.Len(s.auditLog("limit=2"), 2)
+	s.Empty(s.auditLog("since=" + url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))))
+	s.Len(s.auditLog("resourceId="+user.ID.String()+"&until="+url.QueryEscape(entries[0].CreatedAt.Format(time.RFC3339Nano))), 1)
+	s.Equal(http.StatusBadRequest, s.request("GET", "/audit?since=yesterday", nil, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusBadRequest, s.request("GET", "/audit?limit=0", nil, APIKeyHeader, testOpsAPIKey).Code)
+}
+
+// TestAuditAppendOnly ensures audit entries can't be changed or removed
+func (s *RouteTestSuite) TestAuditAppendOnly() {
+	s.createUser()
+	s.Error(s.db.Model(&AuditEntry{}).Where("1 = 1").Update("actor", "someone else").Error)
+	s.Error(s.db.Where("1 = 1").Delete(&AuditEntry{}).Error)
+	s.Len(s.auditLog("actor="+AuditActorAnonymous), 1)
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ContextKeyIdentity is the key name for the authenticated caller within the Gin context
+const ContextKeyIdentity = "identity"
+
+// APIKeyHeader is the header API keys can be passed in (alternatively, use "Authorization: Bearer <key>")
+const APIKeyHeader = "X-API-Key"
+
+// UserTokenHeader is the header players authenticate with, passing the token issued for them by POST /users/:id/token
+const UserTokenHeader = "X-User-Token"
+
+// UserIDHeader identifies the player a request claims to be made on behalf of - unlike UserTokenHeader, anyone can set it
+const UserIDHeader = "X-User-ID"
+
+// Roles an authenticated caller can have
+const (
+	RoleOps = "ops"
+	// RoleGameServer callers are game servers, which issue the user tokens
+	RoleGameServer = "game-server"
+	// RoleUser callers are players authenticated by a user token
+	RoleUser = "user"
+)
+
+// Identity describes the caller authenticated by an API key or a user token
+type Identity struct {
+	// Name of the API key owner (e.g., the ops staff member), or the ID of the player
+	Name string
+	Role string
+	// The authenticated player (RoleUser only)
+	UserID uuid.UUID
+}
+
+// apiKey is an API key parsed from the configuration
+type apiKey struct {
+	name string
+	key  string
+	role string
+}
+
+// parseAPIKeys parses "name:key" entries into API keys with the given role
+func parseAPIKeys(entries []string, role string) []apiKey {
+	var keys []apiKey
+	for _, entry := range entries {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		keys = append(keys, apiKey{name: parts[0], key: parts[1], role: role})
+	}
+	return keys
+}
+
+// requestAPIKey gets the API key sent with the request, if any
+func requestAPIKey(c *gin.Context) string {
+	if key := c.GetHeader(APIKeyHeader); key != "" {
+		return key
+	}
+	if auth := c.GetHeader("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+// authenticate middleware - identifies callers that send an API key; requests without a key continue anonymously,
+// while requests with an unknown key are rejected
+func authenticate(cfg AuthConfig) gin.HandlerFunc {
+	keys := append(parseAPIKeys(cfg.OpsAPIKeys, RoleOps), parseAPIKeys(cfg.GameServerAPIKeys, RoleGameServer)...)
+	return func(c *gin.Context) {
+		sent := requestAPIKey(c)
+		if sent == "" {
+			return
+		}
+		for _, key := range keys {
+			if subtle.ConstantTimeCompare([]byte(sent), []byte(key.key)) == 1 {
+				c.Set(ContextKeyIdentity, &Identity{Name: key.name, Role: key.role})
+				return
+			}
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+	}
+}
+
+// GetIdentity retrieves the authenticated caller from the request context (nil for anonymous requests)
+func GetIdentity(c *gin.Context) *Identity {
+	value, ok := c.Get(ContextKeyIdentity)
+	if !ok {
+		return nil
+	}
+	identity, _ := value.(*Identity)
+	return identity
+}
+
+// isOps reports whether the request was made with an ops API key
+func isOps(c *gin.Context) bool {
+	identity := GetIdentity(c)
+	return identity != nil && identity.Role == RoleOps
+}
+
+// authenticatedUserID gets the ID of the player authenticated by a user token (uuid.Nil for other callers)
+func authenticatedUserID(c *gin.Context) uuid.UUID {
+	if identity := GetIdentity(c); identity != nil && identity.Role == RoleUser {
+		return identity.UserID
+	}
+	return uuid.Nil
+}
+
+// newUserToken generates a user token, returning it with the hash that is stored
+func newUserToken() (string, string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", err
+	}
+	token := hex.EncodeToString(secret)
+	return token, hashUserToken(token), nil
+}
+
+// hashUserToken hashes a user token - only the hashes of the tokens are stored
+func hashUserToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// authenticateUser middleware - identifies players that send a user token; requests with an unknown token are rejected
+// (callers already authenticated by an API key are left as is)
+func authenticateUser() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader(UserTokenHeader)
+		if token == "" || GetIdentity(c) != nil {
+			return
+		}
+		var user User
+		if err := GetDB(c).Where("token_hash = ?", hashUserToken(token)).Find(&user).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if user.ID == uuid.Nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid user token"})
+			return
+		}
+		c.Set(ContextKeyIdentity, &Identity{Name: user.ID.String(), Role: RoleUser, UserID: user.ID})
+	}
+}
+
+// requireTokenIssuer middleware - rejects requests for a user token that weren't made with an ops or game server API key
+// (or, when mutual TLS is configured, with a verified client certificate), so that nobody else can replace the token of
+// a player
+func requireTokenIssuer() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if identity := GetIdentity(c); identity != nil && (identity.Role == RoleOps || identity.Role == RoleGameServer) {
+			return
+		}
+		if GetConfig(c).Server.TLS.ClientCAFile != "" && c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0 {
+			return
+		}
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "A game server API key is required to issue user tokens"})
+	}
+}
+
+// requireOps middleware - rejects requests that were not made with an ops API key
+func requireOps() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isOps(c) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "An ops API key is required for this route"})
+			return
+		}
+	}
+}
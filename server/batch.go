@@ -0,0 +1,333 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Modes of the batch create endpoints
+const (
+	// BatchModeAtomic creates every item or none of them (the default)
+	BatchModeAtomic = "atomic"
+	// BatchModePartial creates the valid items and reports the invalid ones
+	BatchModePartial = "partial"
+)
+
+// maxBatchSize is the number of items a batch create request may contain
+const maxBatchSize = 100
+
+// inputError is an error caused by invalid input - its message is safe to show to the client, and in batches and
+// imports it only fails the item it was returned for
+type inputError struct {
+	err error
+}
+
+func (e inputError) Error() string {
+	return e.err.Error()
+}
+
+// invalidInput creates an inputError
+func invalidInput(format string, args ...interface{}) error {
+	return inputError{fmt.Errorf(format, args...)}
+}
+
+// errBatchRolledBack rolls back an atomic batch with invalid items
+var errBatchRolledBack = errors.New("batch rolled back")
+
+// CreateUsersBatchInput is the body of POST /users/create/batch
+type CreateUsersBatchInput struct {
+	// The number of users to create
+	Count int `json:"count"`
+}
+
+// CreateSessionsBatchInput is the body of POST /sessions/create/batch
+type CreateSessionsBatchInput struct {
+	Mode     string               `json:"mode"`
+	Sessions []CreateSessionInput `json:"sessions"`
+}
+
+// CreateSessionFeedbackBatchInput is the body of POST /sessions/feedback/create/batch
+type CreateSessionFeedbackBatchInput struct {
+	Mode     string                       `json:"mode"`
+	Feedback []CreateSessionFeedbackInput `json:"feedback"`
+}
+
+// CreateSessionWithFeedbackInput is the body of POST /sessions/create/with-feedback - the feedback items leave out the
+// sessionId, as they are all for the new session
+type CreateSessionWithFeedbackInput struct {
+	Session  CreateSessionInput           `json:"session"`
+	Feedback []CreateSessionFeedbackInput `json:"feedback"`
+}
+
+// BatchItemResult is the outcome of a single item of a batch, in the order the items were given
+type BatchItemResult struct {
+	Index int `json:"index"`
+	// False for invalid items, and for valid items of an atomic batch that was rolled back
+	Created bool `json:"created"`
+	// Why the item is invalid
+	Error           string           `json:"error,omitempty"`
+	User            *User            `json:"user,omitempty"`
+	Session         *Session         `json:"session,omitempty"`
+	SessionFeedback *SessionFeedback `json:"sessionFeedback,omitempty"`
+}
+
+// batchOutcome collects the results of a batch
+type batchOutcome struct {
+	mode    string
+	results []BatchItemResult
+	created int
+	failed  int
+}
+
+// validateBatch checks the mode and size of a batch, returning the mode to use
+func validateBatch(mode string, size int) (string, error) {
+	switch mode {
+	case "":
+		mode = BatchModeAtomic
+	case BatchModeAtomic, BatchModePartial:
+	default:
+		return "", fmt.Errorf("Mode must be atomic or partial")
+	}
+	if size == 0 {
+		return "", fmt.Errorf("At least one item is required")
+	}
+	if size > maxBatchSize {
+		return "", fmt.Errorf("At most %d items can be created at once", maxBatchSize)
+	}
+	return mode, nil
+}
+
+// runBatch creates the items of a batch in a single transaction - each item is created within a savepoint by the create
+// function, which fills in the result and returns an inputError for an invalid item
+//
+// In atomic mode the whole batch is rolled back if any item is invalid, while in partial mode only the invalid items
+// are skipped. Any other error rolls back the whole batch in both modes and is returned.
+func runBatch(db *gorm.DB, mode string, size int, create func(tx *gorm.DB, index int, result *BatchItemResult) error) (batchOutcome, error) {
+	outcome := batchOutcome{mode: mode, results: make([]BatchItemResult, 0, size)}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for i := 0; i < size; i++ {
+			result := BatchItemResult{Index: i}
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				return create(tx, i, &result)
+			})
+			if _, ok := err.(inputError); ok {
+				result = BatchItemResult{Index: i, Error: err.Error()}
+				outcome.failed++
+			} else if err != nil {
+				return err
+			} else {
+				result.Created = true
+			}
+			outcome.results = append(outcome.results, result)
+		}
+		if mode == BatchModeAtomic && outcome.failed > 0 {
+			return errBatchRolledBack
+		}
+		return nil
+	})
+	if err == errBatchRolledBack {
+		// Nothing was created, so only the errors are reported
+		for i, result := range outcome.results {
+			outcome.results[i] = BatchItemResult{Index: result.Index, Error: result.Error}
+		}
+		return outcome, nil
+	}
+	if err != nil {
+		return outcome, err
+	}
+	outcome.created = size - outcome.failed
+	return outcome, nil
+}
+
+// respondBatch writes the outcome of a batch - a rolled back atomic batch is a bad request, while a partial batch
+// succeeds with the invalid items listed in the results
+func respondBatch(c *gin.Context, outcome batchOutcome) {
+	size := len(outcome.results)
+	status := http.StatusOK
+	message := fmt.Sprintf("Created %d of %d items", outcome.created, size)
+	if outcome.mode == BatchModeAtomic && outcome.failed > 0 {
+		status = http.StatusBadRequest
+		message = fmt.Sprintf("No items were created - %d of %d items are invalid", outcome.failed, size)
+	}
+	c.JSON(status, gin.H{
+		"success": outcome.failed == 0,
+		"message": message,
+		"created": outcome.created,
+		"failed":  outcome.failed,
+		"results": outcome.results,
+	})
+}
+
+// CreateUsersBatch handles POST /users/create/batch - creates the given number of users at once
+func CreateUsersBatch(c *gin.Context) {
+	var input CreateUsersBatchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mode, err := validateBatch("", input.Count)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	outcome, err := runBatch(GetDB(c), mode, input.Count, func(tx *gorm.DB, index int, result *BatchItemResult) error {
+		user := User{ID: uuid.NewV4()}
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		result.User = &user
+		return recordAudit(tx, c, AuditActionCreate, AuditResourceUser, user.ID, nil, &user)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondBatch(c, outcome)
+}
+
+// CreateSessionsBatch handles POST /sessions/create/batch - creates several sessions at once, linking each to a form
+// the same way CreateSession does
+func CreateSessionsBatch(c *gin.Context) {
+	var input CreateSessionsBatchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mode, err := validateBatch(input.Mode, len(input.Sessions))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	outcome, err := runBatch(GetDB(c), mode, len(input.Sessions), func(tx *gorm.DB, index int, result *BatchItemResult) error {
+		_, err := createBatchSession(tx, c, input.Sessions[index], result)
+		return err
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	respondBatch(c, outcome)
+}
+
+// CreateSessionFeedbackBatch handles POST /sessions/feedback/create/batch - creates the feedback of several users at
+// once (e.g., every player of a match), validating each item like CreateSessionFeedback
+//
+// The session and users must already exist, and a user can still only leave one feedback per session - a second item
+// for the same session and user in the batch is invalid.
+func CreateSessionFeedbackBatch(c *gin.Context) {
+	var input CreateSessionFeedbackBatchInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mode, err := validateBatch(input.Mode, len(input.Feedback))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	builder := newFeedbackBuilder(GetConfig(c).Feedback, GetModerator(c), GetAnalyzer(c))
+	outcome, err := runBatch(GetDB(c), mode, len(input.Feedback), func(tx *gorm.DB, index int, result *BatchItemResult) error {
+		return createBatchFeedback(tx, c, builder, input.Feedback[index], result)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	publishBatchFeedback(c, outcome)
+	respondBatch(c, outcome)
+}
+
+// CreateSessionWithFeedback handles POST /sessions/create/with-feedback - creates a session along with the feedback of
+// its players in a single atomic batch, so a match is never left without the feedback sent for it
+//
+// The first result is the session and result i + 1 is feedback item i - if the session or any feedback item is
+// invalid, nothing is created.
+func CreateSessionWithFeedback(c *gin.Context) {
+	var input CreateSessionWithFeedbackInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mode, err := validateBatch("", len(input.Feedback))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	builder := newFeedbackBuilder(GetConfig(c).Feedback, GetModerator(c), GetAnalyzer(c))
+	var session Session
+	outcome, err := runBatch(GetDB(c), mode, len(input.Feedback)+1, func(tx *gorm.DB, index int, result *BatchItemResult) error {
+		if index == 0 {
+			var err error
+			session, err = createBatchSession(tx, c, input.Session, result)
+			return err
+		}
+		if session.ID == uuid.Nil {
+			return invalidInput("Session is invalid")
+		}
+		feedback := input.Feedback[index-1]
+		if feedback.SessionID != uuid.Nil && feedback.SessionID != session.ID {
+			return invalidInput("SessionID must be left out - the feedback is for the new session")
+		}
+		feedback.SessionID = session.ID
+		return createBatchFeedback(tx, c, builder, feedback, result)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	publishBatchFeedback(c, outcome)
+	respondBatch(c, outcome)
+}
+
+// createBatchSession creates a session within a batch, with its audit entry and event
+func createBatchSession(tx *gorm.DB, c *gin.Context, input CreateSessionInput, result *BatchItemResult) (Session, error) {
+	session, err := newSession(tx, input)
+	if err != nil {
+		return Session{}, err
+	}
+	if err := tx.Create(&session).Error; err != nil {
+		return Session{}, err
+	}
+	result.Session = &session
+	if err := recordAudit(tx, c, AuditActionCreate, AuditResourceSession, session.ID, nil, &session); err != nil {
+		return Session{}, err
+	}
+	return session, recordEvent(tx, AggregateSession, session.ID, EventSessionCreated, gin.H{"session": &session})
+}
+
+// createBatchFeedback creates a feedback within a batch, with its audit entry and event
+func createBatchFeedback(tx *gorm.DB, c *gin.Context, builder *feedbackBuilder, input CreateSessionFeedbackInput, result *BatchItemResult) error {
+	sessionFeedback, err := builder.build(tx, input)
+	if err != nil {
+		return err
+	}
+	if err := tx.Create(&sessionFeedback).Error; err != nil {
+		return err
+	}
+	if err := tx.Scopes(feedbackDetails).Where("id = ?", sessionFeedback.ID).Find(&sessionFeedback).Error; err != nil {
+		return err
+	}
+	result.SessionFeedback = &sessionFeedback
+	if err := recordAudit(tx, c, AuditActionCreate, AuditResourceSessionFeedback, sessionFeedback.ID, nil, &sessionFeedback); err != nil {
+		return err
+	}
+	return recordEvent(tx, AggregateSessionFeedback, sessionFeedback.ID, EventFeedbackCreated, gin.H{"sessionFeedback": &sessionFeedback})
+}
+
+// publishBatchFeedback invalidates the cached lists and publishes the feedback created by a batch
+func publishBatchFeedback(c *gin.Context, outcome batchOutcome) {
+	if outcome.created == 0 {
+		return
+	}
+	GetListCache(c).Invalidate()
+	for _, result := range outcome.results {
+		if result.Created && result.SessionFeedback != nil {
+			publishFeedback(c, *result.SessionFeedback)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+type CreateBatchJSON struct {
+	Success bool              `json:"success"`
+	Message string            `json:"message"`
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []BatchItemResult `json:"results"`
+}
+
+// batch sends a batch create request and returns the response
+func (s *RouteTestSuite) batch(path string, body gin.H, code int) CreateBatchJSON {
+	w := s.request("POST", path, body)
+	s.Require().Equal(code, w.Code, w.Body.String())
+	var response CreateBatchJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response
+}
+
+// TestCreateUsersAndSessionsBatch ensures users and sessions can be created in batches
+func (s *RouteTestSuite) TestCreateUsersAndSessionsBatch() {
+	response := s.batch("/users/create/batch", gin.H{"count": 3}, 200)
+	s.True(response.Success)
+	s.Equal(3, response.Created)
+	s.Require().Len(response.Results, 3)
+	for i, result := range response.Results {
+		s.Equal(i, result.Index)
+		s.True(result.Created)
+		s.Require().NotNil(result.User)
+		s.NotEqual(uuid.Nil, result.User.ID)
+	}
+	s.Equal(http.StatusBadRequest, s.request("POST", "/users/create/batch", gin.H{"count": 0}).Code)
+	s.Equal(http.StatusBadRequest, s.request("POST", "/users/create/batch", gin.H{"count": maxBatchSize + 1}).Code)
+
+	s.createForm(ctfForm)
+	sessions := []gin.H{{"gameMode": "ctf"}, {"feedbackFormId": uuid.NewV4()}, {}}
+	response = s.batch("/sessions/create/batch", gin.H{"sessions": sessions}, http.StatusBadRequest)
+	s.False(response.Success)
+	s.Equal(0, response.Created)
+	s.Equal(1, response.Failed)
+	s.Require().Len(response.Results, 3)
+	s.False(response.Results[0].Created)
+	s.Nil(response.Results[0].Session)
+	s.Equal("FeedbackForm does not exist", response.Results[1].Error)
+	var sessionsResponse GetSessionJSON
+	s.Require().NoError(json.Unmarshal(s.request("GET", "/sessions", nil).Body.Bytes(), &sessionsResponse))
+	s.Empty(sessionsResponse.Sessions)
+
+	response = s.batch("/sessions/create/batch", gin.H{"sessions": sessions, "mode": BatchModePartial}, 200)
+	s.False(response.Success)
+	s.Equal(2, response.Created)
+	s.Equal(1, response.Failed)
+	s.Require().NotNil(response.Results[0].Session)
+	s.NotNil(response.Results[0].Session.FeedbackFormID)
+	s.False(response.Results[1].Created)
+	s.True(response.Results[2].Created)
+	s.Equal(http.StatusBadRequest, s.request("POST", "/sessions/create/batch", gin.H{"sessions": sessions, "mode": "some"}).Code)
+}
+
+// TestCreateSessionFeedbackBatch ensures the feedback of a match can be created at once, respecting the one feedback per user per session rule
+func (s *RouteTestSuite) TestCreateSessionFeedbackBatch() {
+	session := s.createSession()
+	first, second, third := s.createUser(), s.createUser(), s.createUser()
+	s.createFeedback(session, third, 3, "")
+	feedback := []gin.H{
+		{"sessionId": session.ID, "userId": first.ID, "rating": 5, "comment": "Great match", "tags": []string{"Close-Game"}},
+		{"sessionId": session.ID, "userId": second.ID, "rating": 2, "scores": gin.H{"performance": 1}},
+		{"sessionId": session.ID, "userId": first.ID, "rating": 4},
+		{"sessionId": session.ID, "userId": third.ID, "rating": 4},
+		{"sessionId": session.ID, "userId": uuid.NewV4(), "rating": 4},
+		{"sessionId": session.ID, "userId": second.ID, "rating": 0},
+	}
+
+	countFeedback := func() int {
+		var response GetFeedbackJSON
+		s.Require().NoError(json.Unmarshal(s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil).Body.Bytes(), &response))
+		return len(response.Feedback)
+	}
+
+	response := s.batch("/sessions/feedback/create/batch", gin.H{"feedback": feedback}, http.StatusBadRequest)
+	s.Equal(0, response.Created)
+	s.Equal(4, response.Failed)
+	s.Require().Len(response.Results, 6)
+	s.Empty(response.Results[0].Error)
+	s.Equal("This user has already provided feedback for the given session", response.Results[2].Error)
+	s.Equal("This user has already provided feedback for the given session", response.Results[3].Error)
+	s.Equal("User does not exist", response.Results[4].Error)
+	s.NotEmpty(response.Results[5].Error)
+	s.Equal(1, countFeedback())
+
+	response = s.batch("/sessions/feedback/create/batch", gin.H{"feedback": feedback, "mode": BatchModePartial}, 200)
+	s.Equal(2, response.Created)
+	s.Equal(4, response.Failed)
+	s.Require().NotNil(response.Results[0].SessionFeedback)
+	created := response.Results[0].SessionFeedback
+	s.Equal(first.ID, created.UserID)
+	s.Equal(SentimentPositive, created.Sentiment)
+	s.Require().Len(created.Tags, 1)
+	s.Equal("close-game", created.Tags[0].Tag)
+	s.Require().NotNil(response.Results[1].SessionFeedback)
+	s.Require().Len(response.Results[1].SessionFeedback.Scores, 1)
+	s.Equal(3, countFeedback())
+
+	// Every item was already created
+	response = s.batch("/sessions/feedback/create/batch", gin.H{"feedback": feedback[:2], "mode": BatchModePartial}, 200)
+	s.Equal(0, response.Created)
+	s.Equal(2, response.Failed)
+	s.Equal(http.StatusBadRequest, s.request("POST", "/sessions/feedback/create/batch", gin.H{"feedback": []gin.H{}}).Code)
+}
+
+// TestCreateSessionWithFeedback ensures a session and its feedback are created together, or not at all when a feedback
+// item is invalid
+func (s *RouteTestSuite) TestCreateSessionWithFeedback() {
+	s.createForm(ctfForm)
+	first, second := s.createUser(), s.createUser()
+	countSessions := func() int {
+		var response GetSessionJSON
+		s.Require().NoError(json.Unmarshal(s.request("GET", "/sessions", nil).Body.Bytes(), &response))
+		return len(response.Sessions)
+	}
+	countAudit := func() int64 {
+		var count int64
+		s.Require().NoError(s.db.Model(&AuditEntry{}).Where("action = ?", AuditActionCreate).Count(&count).Error)
+		return count
+	}
+	audited := countAudit()
+
+	feedback := []gin.H{
+		{"userId": first.ID, "rating": 5, "answers": gin.H{"flag_balance": 4}},
+		{"userId": second.ID, "rating": 6, "answers": gin.H{"flag_balance": 2}},
+	}
+	response := s.batch("/sessions/create/with-feedback", gin.H{"session": gin.H{"gameMode": "ctf"}, "feedback": feedback}, http.StatusBadRequest)
+	s.False(response.Success)
+	s.Equal(0, response.Created)
+	s.Equal(1, response.Failed)
+	s.Require().Len(response.Results, 3)
+	s.Nil(response.Results[0].Session)
+	s.Empty(response.Results[1].Error)
+	s.Nil(response.Results[1].SessionFeedback)
+	s.Equal(2, response.Results[2].Index)
+	s.NotEmpty(response.Results[2].Error)
+	s.Equal(0, countSessions())
+	var count int64
+	s.Require().NoError(s.db.Model(&SessionFeedback{}).Count(&count).Error)
+	s.Equal(int64(0), count)
+	s.Equal(audited, countAudit())
+
+	feedback[1]["rating"] = 2
+	response = s.batch("/sessions/create/with-feedback", gin.H{"session": gin.H{"gameMode": "ctf"}, "feedback": feedback}, http.StatusOK)
+	s.True(response.Success)
+	s.Equal(3, response.Created)
+	s.Require().NotNil(response.Results[0].Session)
+	session := response.Results[0].Session
+	s.NotNil(session.FeedbackFormID)
+	for _, result := range response.Results[1:] {
+		s.Require().NotNil(result.SessionFeedback)
+		s.Equal(session.ID, result.SessionFeedback.SessionID)
+	}
+	s.Len(response.Results[1].SessionFeedback.Answers, 1)
+	s.Equal(1, countSessions())
+
+	// The feedback can only be for the new session, and a session needs feedback to be created this way
+	other := s.createSession()
+	response = s.batch("/sessions/create/with-feedback", gin.H{"feedback": []gin.H{{"sessionId": other.ID, "userId": first.ID, "rating": 3}}}, http.StatusBadRequest)
+	s.Equal("SessionID must be left out - the feedback is for the new session", response.Results[1].Error)
+	s.Equal(http.StatusBadRequest, s.request("POST", "/sessions/create/with-feedback", gin.H{"session": gin.H{}}).Code)
+}
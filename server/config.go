@@ -0,0 +1,564 @@
+package server
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the complete, typed configuration of the service
+//
+// Values are loaded in the following order of precedence (later sources override earlier ones):
+//  1. the defaults returned by DefaultConfig
+//  2. a YAML config file (see LoadConfig for how the file is located)
+//  3. environment variables (named by the `env` tag of each field)
+//  4. command line flags (named after the YAML path of each field, e.g., -server.port)
+//
+// Fields tagged with `secret:"true"` are masked when the configuration is printed.
+type Config struct {
+	Server      ServerConfig      `yaml:"server"`
+	Database    DatabaseConfig    `yaml:"database"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	Auth        AuthConfig        `yaml:"auth"`
+	Moderation  ModerationConfig  `yaml:"moderation"`
+	Feedback    FeedbackConfig    `yaml:"feedback"`
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	RateLimit   RateLimitConfig   `yaml:"rate_limit"`
+	ListCache   ListCacheConfig   `yaml:"list_cache"`
+	Stream      StreamConfig      `yaml:"stream"`
+	Webhook     WebhookConfig     `yaml:"webhook"`
+	Outbox      OutboxConfig      `yaml:"outbox"`
+	Privacy     PrivacyConfig     `yaml:"privacy"`
+}
+
+// ServerConfig configures the HTTP server
+type ServerConfig struct {
+	Host              string        `yaml:"host" env:"HOST" usage:"interface to bind to (empty binds to all interfaces)"`
+	Port              int           `yaml:"port" env:"PORT" usage:"port to listen on"`
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"READ_TIMEOUT" usage:"maximum duration for reading an entire request"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"READ_HEADER_TIMEOUT" usage:"maximum duration for reading request headers"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"WRITE_TIMEOUT" usage:"maximum duration before timing out writes of the response"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"IDLE_TIMEOUT" usage:"maximum time to wait for the next request on a keep-alive connection"`
+	ShutdownTimeout   time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" usage:"time given to in-flight requests to finish on shutdown"`
+	H2C               bool          `yaml:"h2c" env:"H2C" usage:"serve HTTP/2 over plain TCP (h2c) for internal deployments - only used without TLS"`
+	// Without trusted proxies the client IP is the remote address, so clients can't choose the IP they are rate limited
+	// and audited as by sending an X-Forwarded-For header
+	TrustedProxies []string  `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" usage:"comma-separated IPs or CIDRs of the reverse proxies whose X-Forwarded-For and X-Real-Ip headers are trusted for the client IP (none by default)"`
+	TLS            TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig configures TLS for the HTTP server - TLS is enabled when a certificate and key are given
+type TLSConfig struct {
+	CertFile       string        `yaml:"cert_file" env:"TLS_CERT_FILE" usage:"path to the PEM encoded server certificate (chain)"`
+	KeyFile        string        `yaml:"key_file" env:"TLS_KEY_FILE" usage:"path to the PEM encoded server private key"`
+	ClientCAFile   string        `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE" usage:"path to the PEM encoded CA bundle used to verify client certificates (enables mutual TLS for game server routes)"`
+	ReloadInterval time.Duration `yaml:"reload_interval" env:"TLS_RELOAD_INTERVAL" usage:"how often the certificate files are checked for changes"`
+}
+
+// Enabled reports whether TLS has been configured
+func (t TLSConfig) Enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// DatabaseConfig configures the database connection
+type DatabaseConfig struct {
+	Driver          string        `yaml:"driver" env:"DATABASE_DRIVER" usage:"database driver (only sqlite is supported)"`
+	DSN             string        `yaml:"dsn" env:"DATABASE_DSN" secret:"true" usage:"data source name passed to the driver"`
+	MaxOpenConns    int           `yaml:"max_open_conns" env:"DATABASE_MAX_OPEN_CONNS" usage:"maximum number of open connections (0 is unlimited)"`
+	MaxIdleConns    int           `yaml:"max_idle_conns" env:"DATABASE_MAX_IDLE_CONNS" usage:"maximum number of idle connections"`
+	ConnMaxLifetime time.Duration `yaml:"conn_max_lifetime" env:"DATABASE_CONN_MAX_LIFETIME" usage:"maximum amount of time a connection may be reused (0 is forever)"`
+	PingTimeout     time.Duration `yaml:"ping_timeout" env:"DATABASE_PING_TIMEOUT" usage:"how long the readiness probe waits for the database to answer a ping"`
+}
+
+// TracingConfig configures where trace spans are exported
+type TracingConfig struct {
+	Exporter     string `yaml:"exporter" env:"TRACE_EXPORTER" usage:"span exporter: none, stdout, file or otlp"`
+	File         string `yaml:"file" env:"TRACE_FILE" usage:"file spans are appended to when the exporter is file"`
+	OTLPEndpoint string `yaml:"otlp_endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT" usage:"OTLP/HTTP collector endpoint when the exporter is otlp"`
+}
+
+// AuthConfig configures the API keys accepted by the service
+type AuthConfig struct {
+	OpsAPIKeys []string `yaml:"ops_api_keys" env:"OPS_API_KEYS" secret:"true" usage:"comma-separated name:key pairs granting access to the ops routes"`
+	// Without mutual TLS, game servers identify themselves with these keys to issue user tokens
+	GameServerAPIKeys []string `yaml:"game_server_api_keys" env:"GAME_SERVER_API_KEYS" secret:"true" usage:"comma-separated name:key pairs of the game servers allowed to issue user tokens"`
+}
+
+// ModerationConfig configures the default (blocklist) comment moderator
+type ModerationConfig struct {
+	BlockedWords    []string `yaml:"blocked_words" env:"MODERATION_BLOCKED_WORDS" usage:"comma-separated words (matched case-insensitively as whole words) that flag a comment"`
+	BlockedPatterns []string `yaml:"blocked_patterns" env:"MODERATION_BLOCKED_PATTERNS" usage:"comma-separated regular expressions that flag a comment"`
+	FlaggedStatus   string   `yaml:"flagged_status" env:"MODERATION_FLAGGED_STATUS" usage:"status given to flagged comments: pending (queued for review) or rejected"`
+	ReportThreshold int      `yaml:"report_threshold" env:"MODERATION_REPORT_THRESHOLD" usage:"number of player reports after which feedback is hidden automatically (0 disables)"`
+}
+
+// FeedbackConfig configures what players can submit with their feedback
+type FeedbackConfig struct {
+	Dimensions []string `yaml:"dimensions" env:"FEEDBACK_DIMENSIONS" usage:"comma-separated dimensions players can score from 1 to 5 in addition to the overall rating"`
+	MaxTags    int      `yaml:"max_tags" env:"FEEDBACK_MAX_TAGS" usage:"maximum number of tags per feedback"`
+}
+
+// IdempotencyConfig configures how long responses to requests sent with an Idempotency-Key are kept
+type IdempotencyConfig struct {
+	TTL time.Duration `yaml:"ttl" env:"IDEMPOTENCY_TTL" usage:"how long the response to a request with an Idempotency-Key is replayed to retries (0 disables idempotency keys)"`
+	// The body is read into memory to hash it, so larger requests sent with an Idempotency-Key are rejected
+	MaxBodySize int64 `yaml:"max_body_size" env:"IDEMPOTENCY_MAX_BODY_SIZE" usage:"largest body (in bytes) of a request sent with an Idempotency-Key"`
+}
+
+// RateLimitConfig configures the rate limits of each route
+type RateLimitConfig struct {
+	Rules []string `yaml:"rules" env:"RATE_LIMIT_RULES" usage:"comma-separated \"<class> <method> <path> <requests>/<period>\" rules (class is ops, user or ip; method and path may be *)"`
+}
+
+// ListCacheConfig configures the in-process cache of feedback listings
+type ListCacheConfig struct {
+	TTL        time.Duration `yaml:"ttl" env:"LIST_CACHE_TTL" usage:"how long feedback listings are cached in memory (0 disables the cache)"`
+	MaxEntries int           `yaml:"max_entries" env:"LIST_CACHE_MAX_ENTRIES" usage:"maximum number of cached feedback listings"`
+}
+
+// StreamConfig configures the live feedback stream
+type StreamConfig struct {
+	Heartbeat   time.Duration `yaml:"heartbeat" env:"STREAM_HEARTBEAT" usage:"how often idle feedback streams send a comment to keep the connection open"`
+	MaxDuration time.Duration `yaml:"max_duration" env:"STREAM_MAX_DURATION" usage:"how long a feedback stream stays open before the client has to reconnect (must be shorter than server.write_timeout)"`
+}
+
+// WebhookConfig configures the delivery of webhook events
+type WebhookConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval" env:"WEBHOOK_POLL_INTERVAL" usage:"how often pending webhook deliveries are sent (0 disables delivery)"`
+	Timeout      time.Duration `yaml:"timeout" env:"WEBHOOK_TIMEOUT" usage:"time allowed for a webhook receiver to respond"`
+	MaxAttempts  int           `yaml:"max_attempts" env:"WEBHOOK_MAX_ATTEMPTS" usage:"number of attempts before a webhook delivery is given up"`
+	RetryBackoff time.Duration `yaml:"retry_backoff" env:"WEBHOOK_RETRY_BACKOFF" usage:"delay before the first retry of a webhook delivery (doubled after every attempt)"`
+	MaxBackoff   time.Duration `yaml:"max_backoff" env:"WEBHOOK_MAX_BACKOFF" usage:"longest delay between two attempts of a webhook delivery"`
+}
+
+// OutboxConfig configures the publishing of domain events
+type OutboxConfig struct {
+	PollInterval time.Duration `yaml:"poll_interval" env:"OUTBOX_POLL_INTERVAL" usage:"how often recorded events are published to the sinks (0 disables publishing)"`
+	Sinks        []string      `yaml:"sinks" env:"OUTBOX_SINKS" usage:"comma-separated sinks events are published to (webhooks, stdout, file or bus)"`
+	File         string        `yaml:"file" env:"OUTBOX_FILE" usage:"file the file sink appends events to, as NDJSON"`
+	RetryBackoff time.Duration `yaml:"retry_backoff" env:"OUTBOX_RETRY_BACKOFF" usage:"delay before an event is published again after a sink failed (doubled after every attempt)"`
+	MaxBackoff   time.Duration `yaml:"max_backoff" env:"OUTBOX_MAX_BACKOFF" usage:"longest delay between two attempts to publish an event"`
+}
+
+// PrivacyConfig configures how player data requests are handled
+type PrivacyConfig struct {
+	ErasurePolicy string `yaml:"erasure_policy" env:"PRIVACY_ERASURE_POLICY" usage:"what happens to the feedback of an erased user when the request doesn't say: anonymize or delete"`
+}
+
+// DefaultConfig returns the configuration used when nothing else is specified
+func DefaultConfig() *Config {
+	return &Config{
+		Server: ServerConfig{
+			Port:              8080,
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			ShutdownTimeout:   20 * time.Second,
+			TLS: TLSConfig{
+				ReloadInterval: 10 * time.Second,
+			},
+		},
+		Database: DatabaseConfig{
+			Driver:       "sqlite",
+			DSN:          "test.db",
+			MaxIdleConns: 2,
+			PingTimeout:  2 * time.Second,
+		},
+		Tracing: TracingConfig{
+			Exporter:     "none",
+			File:         "traces.json",
+			OTLPEndpoint: "http://localhost:4318",
+		},
+		Moderation: ModerationConfig{
+			FlaggedStatus:   ModerationPending,
+			ReportThreshold: 3,
+		},
+		Feedback: FeedbackConfig{
+			Dimensions: []string{"matchmaking", "performance", "balance"},
+			MaxTags:    10,
+		},
+		Idempotency: IdempotencyConfig{
+			TTL:         24 * time.Hour,
+			MaxBodySize: 10 << 20,
+		},
+		RateLimit: RateLimitConfig{
+			Rules: []string{
+				"ip * * 600/1m",
+				"ip POST /users/create 20/1m",
+				"ip POST /sessions/feedback/create 30/1m",
+				"user POST /sessions/feedback/create 5/1m",
+			},
+		},
+		ListCache: ListCacheConfig{
+			MaxEntries: 1000,
+		},
+		Stream: StreamConfig{
+			Heartbeat:   15 * time.Second,
+			MaxDuration: 25 * time.Second,
+		},
+		Webhook: WebhookConfig{
+			PollInterval: time.Second,
+			Timeout:      10 * time.Second,
+			MaxAttempts:  8,
+			RetryBackoff: 30 * time.Second,
+			MaxBackoff:   time.Hour,
+		},
+		Outbox: OutboxConfig{
+			PollInterval: 500 * time.Millisecond,
+			Sinks:        []string{OutboxSinkWebhooks, OutboxSinkBus},
+			File:         "events.ndjson",
+			RetryBackoff: 5 * time.Second,
+			MaxBackoff:   5 * time.Minute,
+		},
+		Privacy: PrivacyConfig{
+			ErasurePolicy: ErasurePolicyAnonymize,
+		},
+	}
+}
+
+// Address returns the address the server binds to (e.g., ":8080")
+func (s ServerConfig) Address() string {
+	return s.Host + ":" + strconv.Itoa(s.Port)
+}
+
+// defaultConfigFile is loaded when it exists and no other config file was specified
+const defaultConfigFile = "config.yaml"
+
+// LoadConfig builds the effective configuration from defaults, a config file, the environment and the given command line arguments
+//
+// The config file is the one passed with -config, or the CONFIG_FILE environment variable, or config.yaml (only if it exists).
+func LoadConfig(args []string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	fs := flag.NewFlagSet("codingtest", flag.ContinueOnError)
+	configFile := fs.String("config", "", "path to a YAML config file")
+	flagValues := map[string]*string{}
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(path string, field reflect.StructField, value reflect.Value) {
+		usage := field.Tag.Get("usage")
+		if current := formatConfigValue(value); current != "" {
+			usage = fmt.Sprintf("%s (default %s)", usage, current)
+		}
+		flagValues[path] = fs.String(path, "", usage)
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	path := *configFile
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		if _, err := os.Stat(defaultConfigFile); err == nil {
+			path = defaultConfigFile
+		}
+	}
+	if path != "" {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(contents, cfg); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	var errs []string
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(path string, field reflect.StructField, value reflect.Value) {
+		name := field.Tag.Get("env")
+		if name == "" {
+			return
+		}
+		if raw, found := os.LookupEnv(name); found {
+			if err := setConfigValue(value, raw); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	})
+
+	setFlags := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	walkConfig(reflect.ValueOf(cfg).Elem(), "", func(path string, field reflect.StructField, value reflect.Value) {
+		if !setFlags[path] {
+			return
+		}
+		if err := setConfigValue(value, *flagValues[path]); err != nil {
+			errs = append(errs, fmt.Sprintf("-%s: %v", path, err))
+		}
+	})
+	if len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, "; "))
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate checks that the configuration is usable, reporting every problem found
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Server.Port < 1 || c.Server.Port > 65535 {
+		problems = append(problems, "server.port must be between 1 and 65535")
+	}
+	durations := map[string]time.Duration{
+		"server.read_timeout":        c.Server.ReadTimeout,
+		"server.read_header_timeout": c.Server.ReadHeaderTimeout,
+		"server.write_timeout":       c.Server.WriteTimeout,
+		"server.idle_timeout":        c.Server.IdleTimeout,
+		"server.shutdown_timeout":    c.Server.ShutdownTimeout,
+		"server.tls.reload_interval": c.Server.TLS.ReloadInterval,
+		"database.conn_max_lifetime": c.Database.ConnMaxLifetime,
+		"idempotency.ttl":            c.Idempotency.TTL,
+		"list_cache.ttl":             c.ListCache.TTL,
+		"webhook.poll_interval":      c.Webhook.PollInterval,
+		"outbox.poll_interval":       c.Outbox.PollInterval,
+	}
+	for name, duration := range durations {
+		if duration < 0 {
+			problems = append(problems, name+" must not be negative")
+		}
+	}
+	if c.Server.TLS.Enabled() && (c.Server.TLS.CertFile == "" || c.Server.TLS.KeyFile == "") {
+		problems = append(problems, "server.tls.cert_file and server.tls.key_file must both be set to enable TLS")
+	}
+	if c.Server.TLS.ClientCAFile != "" && !c.Server.TLS.Enabled() {
+		problems = append(problems, "server.tls.client_ca_file requires TLS to be enabled")
+	}
+	for _, proxy := range c.Server.TrustedProxies {
+		if _, _, err := net.ParseCIDR(proxy); err != nil && net.ParseIP(proxy) == nil {
+			problems = append(problems, fmt.Sprintf("server.trusted_proxies: %q is not an IP or CIDR", proxy))
+		}
+	}
+	if c.Server.H2C && c.Server.TLS.Enabled() {
+		problems = append(problems, "server.h2c cannot be combined with TLS (HTTP/2 is negotiated automatically over TLS)")
+	}
+	if c.Database.Driver != "sqlite" {
+		problems = append(problems, "database.driver must be sqlite")
+	}
+	if c.Database.DSN == "" {
+		problems = append(problems, "database.dsn is required")
+	}
+	if c.Database.MaxOpenConns < 0 || c.Database.MaxIdleConns < 0 {
+		problems = append(problems, "database.max_open_conns and database.max_idle_conns must not be negative")
+	}
+	if c.Idempotency.MaxBodySize <= 0 {
+		problems = append(problems, "idempotency.max_body_size must be positive")
+	}
+	if c.Stream.Heartbeat <= 0 || c.Stream.MaxDuration <= 0 {
+		problems = append(problems, "stream.heartbeat and stream.max_duration must be positive")
+	} else if c.Server.WriteTimeout > 0 && c.Stream.MaxDuration >= c.Server.WriteTimeout {
+		problems = append(problems, "stream.max_duration must be shorter than server.write_timeout")
+	}
+	if c.Webhook.Timeout <= 0 || c.Webhook.RetryBackoff <= 0 || c.Webhook.MaxBackoff <= 0 {
+		problems = append(problems, "webhook.timeout, webhook.retry_backoff and webhook.max_backoff must be positive")
+	}
+	if c.Webhook.MaxAttempts < 1 {
+		problems = append(problems, "webhook.max_attempts must be at least 1")
+	}
+	if c.Outbox.RetryBackoff <= 0 || c.Outbox.MaxBackoff <= 0 {
+		problems = append(problems, "outbox.retry_backoff and outbox.max_backoff must be positive")
+	}
+	for _, sink := range c.Outbox.Sinks {
+		switch sink {
+		case OutboxSinkWebhooks, OutboxSinkStdout, OutboxSinkBus:
+		case OutboxSinkFile:
+			if c.Outbox.File == "" {
+				problems = append(problems, "outbox.file is required when outbox.sinks has file")
+			}
+		default:
+			problems = append(problems, "outbox.sinks must only contain webhooks, stdout, file or bus")
+		}
+	}
+	if !erasurePolicyIsValid(c.Privacy.ErasurePolicy) {
+		problems = append(problems, "privacy.erasure_policy must be anonymize or delete")
+	}
+	if c.ListCache.MaxEntries < 0 {
+		problems = append(problems, "list_cache.max_entries must not be negative")
+	}
+	if c.Database.PingTimeout <= 0 {
+		problems = append(problems, "database.ping_timeout must be positive")
+	}
+	switch c.Tracing.Exporter {
+	case "none", "stdout":
+	case "file":
+		if c.Tracing.File == "" {
+			problems = append(problems, "tracing.file is required when tracing.exporter is file")
+		}
+	case "otlp":
+		if c.Tracing.OTLPEndpoint == "" {
+			problems = append(problems, "tracing.otlp_endpoint is required when tracing.exporter is otlp")
+		}
+	default:
+		problems = append(problems, "tracing.exporter must be one of none, stdout, file or otlp")
+	}
+	for name, entries := range map[string][]string{"auth.ops_api_keys": c.Auth.OpsAPIKeys, "auth.game_server_api_keys": c.Auth.GameServerAPIKeys} {
+		for _, entry := range entries {
+			if parts := strings.SplitN(entry, ":", 2); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				problems = append(problems, name+" entries must be in the form name:key")
+				break
+			}
+		}
+	}
+	for _, pattern := range c.Moderation.BlockedPatterns {
+		if _, err := regexp.Compile(pattern); err != nil {
+			problems = append(problems, fmt.Sprintf("moderation.blocked_patterns: %v", err))
+		}
+	}
+	if c.Moderation.FlaggedStatus != ModerationPending && c.Moderation.FlaggedStatus != ModerationRejected {
+		problems = append(problems, "moderation.flagged_status must be pending or rejected")
+	}
+	if c.Moderation.ReportThreshold < 0 {
+		problems = append(problems, "moderation.report_threshold must not be negative")
+	}
+	for _, dimension := range c.Feedback.Dimensions {
+		if !tagPattern.MatchString(dimension) {
+			problems = append(problems, "feedback.dimensions must only contain lowercase letters, digits, dashes and underscores")
+			break
+		}
+	}
+	if c.Feedback.MaxTags < 0 {
+		problems = append(problems, "feedback.max_tags must not be negative")
+	}
+	for _, rule := range c.RateLimit.Rules {
+		if _, err := parseRateLimitRule(rule); err != nil {
+			problems = append(problems, fmt.Sprintf("rate_limit.rules: %v", err))
+		}
+	}
+	if len(problems) > 0 {
+		// Map iteration order is random - sort so the message is stable
+		sort.Strings(problems)
+		return errors.New("invalid configuration: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Masked returns a copy of the configuration with every secret replaced by asterisks
+func (c *Config) Masked() *Config {
+	masked := *c
+	walkConfig(reflect.ValueOf(&masked).Elem(), "", func(path string, field reflect.StructField, value reflect.Value) {
+		if field.Tag.Get("secret") != "true" {
+			return
+		}
+		switch value.Kind() {
+		case reflect.String:
+			if value.String() != "" {
+				value.SetString("********")
+			}
+		case reflect.Slice:
+			// Replace the slice rather than its elements - the copy shares its backing array with the original
+			items := make([]string, value.Len())
+			for i := range items {
+				items[i] = "********"
+			}
+			value.Set(reflect.ValueOf(items))
+		}
+	})
+	return &masked
+}
+
+// YAML renders the configuration as YAML
+func (c *Config) YAML() (string, error) {
+	out, err := yaml.Marshal(c)
+	return string(out), err
+}
+
+// walkConfig calls fn for every leaf field of the config struct v, with the dotted YAML path of the field
+func walkConfig(v reflect.Value, prefix string, fn func(path string, field reflect.StructField, value reflect.Value)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		path := name
+		if prefix != "" {
+			path = prefix + "." + name
+		}
+		value := v.Field(i)
+		if value.Kind() == reflect.Struct && value.Type() != reflect.TypeOf(time.Time{}) {
+			walkConfig(value, path, fn)
+			continue
+		}
+		fn(path, field, value)
+	}
+}
+
+// setConfigValue parses raw into the config field value (supports strings, numbers, booleans, durations and comma-separated string lists)
+func setConfigValue(value reflect.Value, raw string) error {
+	if value.Type() == reflect.TypeOf(time.Duration(0)) {
+		duration, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(duration))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(raw)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			return err
+		}
+		value.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return err
+		}
+		value.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(b)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			return fmt.Errorf("cannot set %s from a string", value.Type())
+		}
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		value.Set(reflect.ValueOf(items))
+	default:
+		return fmt.Errorf("cannot set %s from a string", value.Type())
+	}
+	return nil
+}
+
+// formatConfigValue renders a config field value the way it would be written in a flag or environment variable
+func formatConfigValue(value reflect.Value) string {
+	if duration, ok := value.Interface().(time.Duration); ok {
+		return duration.String()
+	}
+	if items, ok := value.Interface().([]string); ok {
+		return strings.Join(items, ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
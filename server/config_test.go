@@ -0,0 +1,100 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeConfigFile writes contents to a temporary YAML file and returns its path (the caller removes the file)
+func writeConfigFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "config-*.yaml")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+// TestLoadConfigDefaults ensures the defaults are used when nothing else is given
+func TestLoadConfigDefaults(t *testing.T) {
+	cfg, err := LoadConfig(nil)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultConfig(), cfg)
+	assert.Equal(t, ":8080", cfg.Server.Address())
+}
+
+// TestLoadConfigPrecedence ensures flags override environment variables, which override the config file
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, `
+server:
+  port: 9000
+  read_timeout: 7s
+database:
+  dsn: file.db
+tracing:
+  exporter: stdout
+`)
+	defer os.Remove(path)
+	os.Setenv("PORT", "9100")
+	os.Setenv("DATABASE_DSN", "env.db")
+	defer os.Unsetenv("PORT")
+	defer os.Unsetenv("DATABASE_DSN")
+
+	cfg, err := LoadConfig([]string{"-config", path, "-server.port", "9200"})
+	require.NoError(t, err)
+	assert.Equal(t, 9200, cfg.Server.Port)
+	assert.Equal(t, 7*time.Second, cfg.Server.ReadTimeout)
+	assert.Equal(t, "env.db", cfg.Database.DSN)
+	assert.Equal(t, "stdout", cfg.Tracing.Exporter)
+	// Values that were never overridden keep their defaults
+	assert.Equal(t, DefaultConfig().Server.WriteTimeout, cfg.Server.WriteTimeout)
+}
+
+// TestLoadConfigInvalid ensures unknown keys, unparseable values and invalid settings are rejected
+func TestLoadConfigInvalid(t *testing.T) {
+	path := writeConfigFile(t, "server:\n  prot: 80\n")
+	defer os.Remove(path)
+	_, err := LoadConfig([]string{"-config", path})
+	assert.Error(t, err)
+
+	_, err = LoadConfig([]string{"-server.read_timeout", "soon"})
+	assert.Error(t, err)
+
+	_, err = LoadConfig([]string{"-server.port", "70000", "-tracing.exporter", "jaeger"})
+	assert.EqualError(t, err, "invalid configuration: server.port must be between 1 and 65535; tracing.exporter must be one of none, stdout, file or otlp")
+
+	_, err = LoadConfig([]string{"-server.tls.cert_file", "server.pem", "-server.h2c", "true"})
+	assert.EqualError(t, err, "invalid configuration: server.h2c cannot be combined with TLS (HTTP/2 is negotiated automatically over TLS); server.tls.cert_file and server.tls.key_file must both be set to enable TLS")
+
+	_, err = LoadConfig([]string{"-feedback.dimensions", "matchmaking,Map Design"})
+	assert.EqualError(t, err, "invalid configuration: feedback.dimensions must only contain lowercase letters, digits, dashes and underscores")
+
+	_, err = LoadConfig([]string{"-idempotency.ttl", "-1h"})
+	assert.EqualError(t, err, "invalid configuration: idempotency.ttl must not be negative")
+	_, err = LoadConfig([]string{"-list_cache.max_entries", "-1"})
+	assert.EqualError(t, err, "invalid configuration: list_cache.max_entries must not be negative")
+	_, err = LoadConfig([]string{"-stream.max_duration", "1m"})
+	assert.EqualError(t, err, "invalid configuration: stream.max_duration must be shorter than server.write_timeout")
+	_, err = LoadConfig([]string{"-webhook.max_attempts", "0"})
+	assert.EqualError(t, err, "invalid configuration: webhook.max_attempts must be at least 1")
+	_, err = LoadConfig([]string{"-outbox.sinks", "webhooks,kafka"})
+	assert.EqualError(t, err, "invalid configuration: outbox.sinks must only contain webhooks, stdout, file or bus")
+	_, err = LoadConfig([]string{"-privacy.erasure_policy", "forget"})
+	assert.EqualError(t, err, "invalid configuration: privacy.erasure_policy must be anonymize or delete")
+}
+
+// TestConfigMasked ensures secrets are masked in the printed configuration without modifying the original
+func TestConfigMasked(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Database.DSN = "file:secret.db?_auth_pass=hunter2"
+	out, err := cfg.Masked().YAML()
+	require.NoError(t, err)
+	assert.Contains(t, out, "dsn: '********'")
+	assert.NotContains(t, out, "hunter2")
+	assert.Equal(t, "file:secret.db?_auth_pass=hunter2", cfg.Database.DSN)
+}
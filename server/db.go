@@ -1,6 +1,9 @@
 package server
 
 import (
+	"encoding/json"
+	"fmt"
+	"strings"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -24,6 +27,8 @@ type Counter struct {
 type User struct {
 	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
 	CustomModel
+	// Hash of the token the player authenticates with (see IssueUserToken)
+	TokenHash       string            `gorm:"index" json:"-"`
 	SessionFeedback []SessionFeedback `json:"sessionFeedback"`
 }
 
@@ -31,6 +36,10 @@ type User struct {
 type Session struct {
 	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
 	CustomModel
+	// The game mode that was played (optional)
+	GameMode string `json:"gameMode,omitempty"`
+	// FK - the FeedbackForm players answer for this session (optional)
+	FeedbackFormID  *uuid.UUID        `gorm:"type:uuid" json:"feedbackFormId,omitempty"`
 	SessionFeedback []SessionFeedback `json:"feedback"`
 }
 
@@ -43,6 +52,20 @@ type CreateSessionFeedbackInput struct {
 	UserID  uuid.UUID `json:"userId"`
 	Rating  int       `json:"rating"`
 	Comment string    `json:"comment"`
+	// Optional 1 - 5 scores for the configured feedback dimensions (e.g., {"matchmaking": 4})
+	Scores map[string]int `json:"scores"`
+	// Optional free-form tags (e.g., ["lag", "great-map"])
+	Tags []string `json:"tags"`
+	// Answers to the session's FeedbackForm keyed by question key (see FeedbackAnswer for the expected values)
+	Answers map[string]json.RawMessage `json:"answers"`
+}
+
+// CreateSessionInput represents the (optional) fields accepted when the session endpoint is hit with a POST request
+type CreateSessionInput struct {
+	// Links the session to the latest FeedbackForm of the game mode (if there is one)
+	GameMode string `json:"gameMode"`
+	// Links the session to a specific FeedbackForm version instead
+	FeedbackFormID uuid.UUID `json:"feedbackFormId"`
 }
 
 // Input type modeling the expected input in the POST body when deleting a resource
@@ -58,25 +81,96 @@ type SessionFeedback struct {
 	Rating int `gorm:"not null" json:"rating"`
 	// An optional comment where the player can describe their experience in a small comment
 	Comment string `json:"comment"`
+	// One of pending, approved, rejected or hidden - only approved feedback is returned by public reads
+	ModerationStatus string `gorm:"not null;default:approved;index" json:"moderationStatus"`
+	// Why the feedback was flagged (or a note left by the ops team member who reviewed it)
+	ModerationReason string `json:"moderationReason,omitempty"`
 	// FK
 	SessionID uuid.UUID
 	// FK
 	UserID uuid.UUID
+	// Replies from the ops team (only public replies are embedded in public reads)
+	Responses []FeedbackResponse `json:"responses,omitempty"`
+	// Scores for the individual feedback dimensions (e.g., matchmaking, performance)
+	Scores []FeedbackScore `json:"scores,omitempty"`
+	Tags   []FeedbackTag   `json:"tags,omitempty"`
+	// Answers to the session's FeedbackForm
+	Answers []FeedbackAnswer `json:"answers,omitempty"`
+	// One of positive, neutral or negative - empty until the comment has been analyzed (see Analyzer)
+	Sentiment string `gorm:"not null;default:'';index" json:"sentiment"`
+	// From -1 (most negative) to 1 (most positive)
+	SentimentScore float64 `gorm:"not null;default:0" json:"sentimentScore"`
+	// Topics mentioned by the comment (e.g., lag, matchmaking)
+	Topics []FeedbackTopic `json:"topics,omitempty"`
 }
 
-func initDB() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open("test.db"), &gorm.Config{})
-	if err != nil {
-		panic("failed to connect database")
+// sqliteTimeFormats are the formats the SQLite driver writes time.Time values in
+//
+// Values are only converted back to time.Time automatically when read from a column declared as a datetime - aggregates
+// such as max(created_at) come back as strings and need to be parsed with parseSQLiteTime.
+var sqliteTimeFormats = []string{
+	"2006-01-02 15:04:05.999999999-07:00",
+	"2006-01-02T15:04:05.999999999-07:00",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+}
+
+// parseSQLiteTime parses a time stored by the SQLite driver
+func parseSQLiteTime(value string) (time.Time, error) {
+	for _, format := range sqliteTimeFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t, nil
+		}
 	}
+	return time.Time{}, fmt.Errorf("unrecognized time format: %q", value)
+}
 
-	// Migrate the schema
-	err = db.AutoMigrate(
+// isUniqueViolation reports whether an insert failed because of a unique index
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// migrationModels lists every model that is migrated at startup (and checked by the readiness probe)
+func migrationModels() []interface{} {
+	return []interface{}{
 		&Counter{},
 		&User{},
 		&Session{},
 		&SessionFeedback{},
-	)
+		&FeedbackReport{},
+		&FeedbackResponse{},
+		&FeedbackScore{},
+		&FeedbackTag{},
+		&FeedbackForm{},
+		&FormQuestion{},
+		&FeedbackAnswer{},
+		&FeedbackTopic{},
+		&IdempotencyKey{},
+		&WebhookSubscription{},
+		&WebhookDelivery{},
+		&OutboxEvent{},
+		&AuditEntry{},
+		&UserErasure{},
+	}
+}
+
+func initDB(cfg DatabaseConfig) *gorm.DB {
+	db, err := gorm.Open(sqlite.Open(cfg.DSN), &gorm.Config{})
+	if err != nil {
+		panic("failed to connect database")
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		panic(err)
+	}
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	// Migrate the schema
+	err = db.AutoMigrate(migrationModels()...)
 	if err != nil {
 		panic(err)
 	}
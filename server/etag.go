@@ -0,0 +1,76 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+// resourceETag derives the ETag of a record from its ID and the time it was last updated
+func resourceETag(id uuid.UUID, updatedAt time.Time) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%d", id, updatedAt.UnixNano())))
+	return fmt.Sprintf(`"%x"`, hash[:16])
+}
+
+// etagListMatches checks if an If-Match or If-None-Match header value (a list of ETags, or *) contains the given ETag -
+// weak comparison ignores the W/ prefix, while strong comparison never matches weak ETags
+func etagListMatches(header string, etag string, weak bool) bool {
+	if weak {
+		etag = strings.TrimPrefix(etag, "W/")
+	} else if strings.HasPrefix(etag, "W/") {
+		return strings.TrimSpace(header) == "*"
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag header of a single-resource read and responds with a 304 if the client's copy (sent in
+// If-None-Match) is current - the handler must return when it reports true
+func notModified(c *gin.Context, etag string) bool {
+	c.Header("ETag", etag)
+	if header := c.GetHeader("If-None-Match"); header != "" && etagListMatches(header, etag, true) {
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// preconditionMet checks the If-Match header of an update or delete against the current ETag of the record, responding
+// with a 428 if it's missing or a 412 if the record changed since the client read it - the handler must return when it
+// reports false
+func preconditionMet(c *gin.Context, etag string) bool {
+	header := c.GetHeader("If-Match")
+	if header == "" {
+		c.JSON(http.StatusPreconditionRequired, gin.H{"error": "An If-Match header with the ETag of the resource is required"})
+		return false
+	}
+	if !etagListMatches(header, etag, false) {
+		preconditionFailed(c, etag)
+		return false
+	}
+	return true
+}
+
+// preconditionFailed responds with a 412 and the current ETag of the record (if known)
+func preconditionFailed(c *gin.Context, etag string) {
+	if etag != "" {
+		c.Header("ETag", etag)
+	}
+	c.JSON(http.StatusPreconditionFailed, gin.H{"error": "The resource was modified since it was read - reload it and try again"})
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// etag reads a single resource and returns its ETag
+func (s *RouteTestSuite) etag(path string, headers ...string) string {
+	w := s.request("GET", path, nil, headers...)
+	s.Require().Equal(200, w.Code, w.Body.String())
+	etag := w.Header().Get("ETag")
+	s.Require().NotEmpty(etag)
+	return etag
+}
+
+// TestResourceETag ensures ETags change with the record and If-Match/If-None-Match lists are compared correctly
+func TestResourceETag(t *testing.T) {
+	id := uuid.NewV4()
+	now := time.Now()
+	etag := resourceETag(id, now)
+	assert.Equal(t, etag, resourceETag(id, now))
+	assert.NotEqual(t, etag, resourceETag(id, now.Add(time.Millisecond)))
+	assert.NotEqual(t, etag, resourceETag(uuid.NewV4(), now))
+
+	assert.True(t, etagListMatches(etag, etag, false))
+	assert.True(t, etagListMatches(`"other", `+etag, etag, false))
+	assert.True(t, etagListMatches("*", etag, false))
+	assert.False(t, etagListMatches(`"other"`, etag, false))
+	// Weak ETags only match with weak comparison (If-None-Match)
+	assert.True(t, etagListMatches("W/"+etag, etag, true))
+	assert.False(t, etagListMatches("W/"+etag, etag, false))
+}
+
+// TestSingleResourceReads ensures users, sessions and feedback can be read one at a time, with conditional GETs
+func (s *RouteTestSuite) TestSingleResourceReads() {
+	user := s.createUser()
+	session := s.createSession()
+	clean := s.createFeedback(session, user, 5, "Great game")
+	flagged := s.createFeedback(session, s.createUser(), 1, "cheater!")
+
+	w := s.request("GET", "/users/"+user.ID.String(), nil)
+	s.Require().Equal(200, w.Code)
+	var userResponse struct {
+		User User `json:"user"`
+	}
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &userResponse))
+	s.Equal(user.ID, userResponse.User.ID)
+	etag := w.Header().Get("ETag")
+	s.Equal(resourceETag(user.ID, userResponse.User.UpdatedAt), etag)
+
+	w = s.request("GET", "/users/"+user.ID.String(), nil, "If-None-Match", etag)
+	s.Equal(http.StatusNotModified, w.Code)
+	s.Empty(w.Body.String())
+	s.Equal(etag, w.Header().Get("ETag"))
+	s.Equal(http.StatusNotModified, s.request("GET", "/users/"+user.ID.String(), nil, "If-None-Match", "W/"+etag).Code)
+	s.Equal(200, s.request("GET", "/users/"+user.ID.String(), nil, "If-None-Match", `"stale"`).Code)
+	s.Equal(http.StatusNotFound, s.request("GET", "/users/"+uuid.NewV4().String(), nil).Code)
+	s.Equal(http.StatusBadRequest, s.request("GET", "/users/nope", nil).Code)
+
+	etag = s.etag("/sessions/" + session.ID.String())
+	s.Equal(http.StatusNotModified, s.request("GET", "/sessions/"+session.ID.String(), nil, "If-None-Match", etag).Code)
+	s.Equal(http.StatusNotFound, s.request("GET", "/sessions/"+uuid.NewV4().String(), nil).Code)
+
+	// Feedback that isn't approved is only visible to ops
+	s.etag("/feedback/" + clean.ID.String())
+	s.Equal(http.StatusNotFound, s.request("GET", "/feedback/"+flagged.ID.String(), nil).Code)
+	etag = s.etag("/feedback/"+flagged.ID.String(), APIKeyHeader, testOpsAPIKey)
+
+	// Replying to the feedback changes its ETag
+	path := "/ops/feedback/" + flagged.ID.String() + "/responses"
+	s.Require().Equal(200, s.request("POST", path, gin.H{"body": "Thanks, we're looking into it"}, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(200, s.request("GET", "/feedback/"+flagged.ID.String(), nil, APIKeyHeader, testOpsAPIKey, "If-None-Match", etag).Code)
+}
+
+// TestUpdatesRequireIfMatch ensures updates and deletes are rejected unless they're based on the current version of the record
+func (s *RouteTestSuite) TestUpdatesRequireIfMatch() {
+	session := s.createSession()
+	flagged := s.createFeedback(session, s.createUser(), 1, "cheater!")
+	path := "/ops/feedback/" + flagged.ID.String() + "/moderation"
+	etag := s.etag("/feedback/"+flagged.ID.String(), APIKeyHeader, testOpsAPIKey)
+
+	w := s.request("PUT", path, gin.H{"status": ModerationHidden}, APIKeyHeader, testOpsAPIKey)
+	s.Equal(http.StatusPreconditionRequired, w.Code)
+
+	w = s.request("PUT", path, gin.H{"status": ModerationHidden}, APIKeyHeader, testOpsAPIKey, "If-Match", etag)
+	s.Require().Equal(200, w.Code, w.Body.String())
+	updated := w.Header().Get("ETag")
+	s.NotEqual(etag, updated)
+	s.Equal(updated, s.etag("/feedback/"+flagged.ID.String(), APIKeyHeader, testOpsAPIKey))
+
+	// A second ops tool still holding the old version can't clobber the change
+	w = s.request("PUT", path, gin.H{"status": ModerationApproved}, APIKeyHeader, testOpsAPIKey, "If-Match", etag)
+	s.Equal(http.StatusPreconditionFailed, w.Code)
+	s.Equal(updated, w.Header().Get("ETag"))
+	s.Equal(http.StatusPreconditionFailed, s.request("DELETE", "/sessions/feedback?id="+flagged.ID.String(), nil, "If-Match", etag).Code)
+	s.Equal(http.StatusPreconditionRequired, s.request("DELETE", "/sessions/feedback?id="+flagged.ID.String(), nil).Code)
+	s.Equal(200, s.request("DELETE", "/sessions/feedback?id="+flagged.ID.String(), nil, "If-Match", updated).Code)
+	s.Equal(http.StatusNotFound, s.request("GET", "/feedback/"+flagged.ID.String(), nil, APIKeyHeader, testOpsAPIKey).Code)
+
+	user := s.createUser()
+	s.Equal(http.StatusPreconditionRequired, s.request("DELETE", "/users?id="+user.ID.String(), nil).Code)
+	s.Equal(200, s.request("DELETE", "/users?id="+user.ID.String(), nil, "If-Match", s.etag("/users/"+user.ID.String())).Code)
+	s.Equal(200, s.request("DELETE", "/sessions?id="+session.ID.String(), nil, "If-Match", "*").Code)
+	s.Equal(http.StatusNotFound, s.request("GET", "/sessions/"+session.ID.String(), nil).Code)
+}
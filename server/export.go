@@ -0,0 +1,332 @@
+package server
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Formats of the session feedback listing
+const (
+	FormatJSON   = "json"
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// Content types of the session feedback listing formats
+const (
+	contentTypeCSV    = "text/csv"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// exportFlushRows is the number of rows written between flushes of a streamed export
+const exportFlushRows = 100
+
+// Separators used to pack the related records of a SessionFeedback into a single column of the export query - ASCII
+// unit/record separators can't appear in tags, topics, dimensions or JSON encoded answers
+const (
+	exportUnitSeparator   = "\x1f"
+	exportRecordSeparator = "\x1e"
+)
+
+// feedbackFormat picks the format of the session feedback listing - the format query parameter wins, otherwise the
+// Accept header is used (falling back to JSON)
+func feedbackFormat(c *gin.Context) (string, error) {
+	if format := c.Query("format"); format != "" {
+		switch format {
+		case FormatJSON, FormatCSV, FormatNDJSON:
+			return format, nil
+		}
+		return "", fmt.Errorf("Format must be one of json, csv or ndjson")
+	}
+	switch c.NegotiateFormat(gin.MIMEJSON, contentTypeCSV, contentTypeNDJSON) {
+	case contentTypeCSV:
+		return FormatCSV, nil
+	case contentTypeNDJSON:
+		return FormatNDJSON, nil
+	}
+	return FormatJSON, nil
+}
+
+// SessionFeedbackGetterRows opens a cursor over the SessionFeedback records matching the given filter - every row can be
+// scanned into a feedbackExportRow
+type SessionFeedbackGetterRows func(c *gin.Context, filter SessionFeedbackFilter) (*sql.Rows, error)
+
+// feedbackExportRow is a SessionFeedback record with its related records packed into strings, as read by the export query
+type feedbackExportRow struct {
+	ID               uuid.UUID
+	SessionID        uuid.UUID
+	UserID           uuid.UUID
+	Rating           int
+	Comment          string
+	ModerationStatus string
+	Sentiment        string
+	SentimentScore   float64
+	CreatedAt        time.Time
+	// dimension<US>score pairs separated by <RS>
+	Scores string
+	// Tags separated by <RS>
+	Tags string
+	// Topics separated by <RS>
+	Topics string
+	// question<US>JSON value pairs separated by <RS>
+	Answers string
+}
+
+// feedbackExportColumns selects the columns of a feedbackExportRow - related records are packed with group_concat so
+// that a single cursor can be streamed without loading every record into memory
+var feedbackExportColumns = strings.Join([]string{
+	"session_feedbacks.id AS id",
+	"session_feedbacks.session_id AS session_id",
+	"session_feedbacks.user_id AS user_id",
+	"session_feedbacks.rating AS rating",
+	"session_feedbacks.comment AS comment",
+	"session_feedbacks.moderation_status AS moderation_status",
+	"session_feedbacks.sentiment AS sentiment",
+	"session_feedbacks.sentiment_score AS sentiment_score",
+	"session_feedbacks.created_at AS created_at",
+	"coalesce((SELECT group_concat(dimension || char(31) || score, char(30)) FROM feedback_scores WHERE feedback_scores.session_feedback_id = session_feedbacks.id), '') AS scores",
+	"coalesce((SELECT group_concat(tag, char(30)) FROM feedback_tags WHERE feedback_tags.session_feedback_id = session_feedbacks.id), '') AS tags",
+	"coalesce((SELECT group_concat(topic, char(30)) FROM feedback_topics WHERE feedback_topics.session_feedback_id = session_feedbacks.id), '') AS topics",
+	"coalesce((SELECT group_concat(question_key || char(31) || value, char(30)) FROM feedback_answers WHERE feedback_answers.session_feedback_id = session_feedbacks.id), '') AS answers",
+}, ", ")
+
+// getSessionFeedbackRows opens a cursor over the SessionFeedback records matching the given filter, oldest first
+func getSessionFeedbackRows(c *gin.Context, filter SessionFeedbackFilter) (*sql.Rows, error) {
+	return GetDB(c).Model(&SessionFeedback{}).
+		Select(feedbackExportColumns).
+		Scopes(visibleFeedback(c), filter.scope).
+		Order("session_feedbacks.created_at").
+		Order("session_feedbacks.id").
+		Rows()
+}
+
+// splitExportList unpacks a list packed by the export query
+func splitExportList(packed string) []string {
+	if packed == "" {
+		return []string{}
+	}
+	list := strings.Split(packed, exportRecordSeparator)
+	sort.Strings(list)
+	return list
+}
+
+// splitExportPairs unpacks key/value pairs packed by the export query
+func splitExportPairs(packed string) map[string]string {
+	pairs := map[string]string{}
+	for _, pair := range splitExportList(packed) {
+		parts := strings.SplitN(pair, exportUnitSeparator, 2)
+		if len(parts) == 2 {
+			pairs[parts[0]] = parts[1]
+		}
+	}
+	return pairs
+}
+
+// FeedbackExportRecord is a single line of the NDJSON export
+type FeedbackExportRecord struct {
+	ID               uuid.UUID                  `json:"id"`
+	SessionID        uuid.UUID                  `json:"sessionId"`
+	UserID           uuid.UUID                  `json:"userId"`
+	Rating           int                        `json:"rating"`
+	Comment          string                     `json:"comment"`
+	ModerationStatus string                     `json:"moderationStatus"`
+	Sentiment        string                     `json:"sentiment"`
+	SentimentScore   float64                    `json:"sentimentScore"`
+	CreatedAt        time.Time                  `json:"createdAt"`
+	Scores           map[string]int             `json:"scores"`
+	Tags             []string                   `json:"tags"`
+	Topics           []string                   `json:"topics"`
+	Answers          map[string]json.RawMessage `json:"answers"`
+}
+
+// record converts the row to a FeedbackExportRecord
+func (r feedbackExportRow) record() FeedbackExportRecord {
+	record := FeedbackExportRecord{
+		ID:               r.ID,
+		SessionID:        r.SessionID,
+		UserID:           r.UserID,
+		Rating:           r.Rating,
+		Comment:          r.Comment,
+		ModerationStatus: r.ModerationStatus,
+		Sentiment:        r.Sentiment,
+		SentimentScore:   r.SentimentScore,
+		CreatedAt:        r.CreatedAt,
+		Scores:           map[string]int{},
+		Tags:             splitExportList(r.Tags),
+		Topics:           splitExportList(r.Topics),
+		Answers:          map[string]json.RawMessage{},
+	}
+	for dimension, score := range splitExportPairs(r.Scores) {
+		record.Scores[dimension], _ = strconv.Atoi(score)
+	}
+	for question, value := range splitExportPairs(r.Answers) {
+		record.Answers[question] = json.RawMessage(value)
+	}
+	return record
+}
+
+// feedbackExportWriter writes exported rows in one of the streaming formats
+type feedbackExportWriter interface {
+	Write(row feedbackExportRow) error
+	Flush() error
+}
+
+// ndjsonExportWriter writes one JSON object per line
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+}
+
+// Write implements feedbackExportWriter
+func (w ndjsonExportWriter) Write(row feedbackExportRow) error {
+	return w.encoder.Encode(row.record())
+}
+
+// Flush implements feedbackExportWriter
+func (w ndjsonExportWriter) Flush() error {
+	return nil
+}
+
+// csvFormulaPrefixes are the first characters that make spreadsheet applications evaluate a cell as a formula
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvText neutralizes a player-written cell that a spreadsheet application would evaluate as a formula, by prefixing it
+// with a single quote - a cell that already starts with quotes before a formula gets one more, so that csvUnquote gives
+// back the original cell
+func csvText(value string) string {
+	if csvQuotedFormula(value) {
+		return "'" + value
+	}
+	return value
+}
+
+// csvUnquote reverses csvText, removing the single quote it added before a formula
+func csvUnquote(value string) string {
+	if strings.HasPrefix(value, "'") && csvQuotedFormula(value) {
+		return value[1:]
+	}
+	return value
+}
+
+// csvQuotedFormula checks if a cell starts with a formula prefix, after any single quotes
+func csvQuotedFormula(value string) bool {
+	value = strings.TrimLeft(value, "'")
+	return value != "" && strings.IndexByte(csvFormulaPrefixes, value[0]) >= 0
+}
+
+// csvExportWriter writes a header row followed by one row per feedback - every configured dimension gets its own score
+// column, tags and topics are separated by semicolons and the answers are a JSON object
+//
+// The player-written cells (comment, tags and answers) are passed through csvText, so that opening an export in a
+// spreadsheet doesn't run formulas injected by players.
+type csvExportWriter struct {
+	writer     *csv.Writer
+	dimensions []string
+}
+
+// newCSVExportWriter creates a csvExportWriter and writes the header row
+func newCSVExportWriter(out io.Writer, dimensions []string) (*csvExportWriter, error) {
+	w := &csvExportWriter{writer: csv.NewWriter(out), dimensions: dimensions}
+	header := []string{"id", "sessionId", "userId", "rating", "comment", "moderationStatus", "sentiment", "sentimentScore", "createdAt"}
+	for _, dimension := range dimensions {
+		header = append(header, "score_"+dimension)
+	}
+	header = append(header, "tags", "topics", "answers")
+	return w, w.writer.Write(header)
+}
+
+// Write implements feedbackExportWriter
+func (w *csvExportWriter) Write(row feedbackExportRow) error {
+	record := row.record()
+	answers, err := json.Marshal(record.Answers)
+	if err != nil {
+		return err
+	}
+	line := []string{
+		record.ID.String(),
+		record.SessionID.String(),
+		record.UserID.String(),
+		strconv.Itoa(record.Rating),
+		csvText(record.Comment),
+		record.ModerationStatus,
+		record.Sentiment,
+		strconv.FormatFloat(record.SentimentScore, 'f', -1, 64),
+		record.CreatedAt.UTC().Format(time.RFC3339),
+	}
+	for _, dimension := range w.dimensions {
+		score := ""
+		if value, ok := record.Scores[dimension]; ok {
+			score = strconv.Itoa(value)
+		}
+		line = append(line, score)
+	}
+	line = append(line, csvText(strings.Join(record.Tags, ";")), csvText(strings.Join(record.Topics, ";")), csvText(string(answers)))
+	return w.writer.Write(line)
+}
+
+// Flush implements feedbackExportWriter
+func (w *csvExportWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// exportSessionFeedback streams the SessionFeedback records matching the filter as CSV or NDJSON - rows are written as
+// they are read from the database cursor, so exports of any size use a constant amount of memory
+func exportSessionFeedback(c *gin.Context, sfg SessionFeedbackGetter, filter SessionFeedbackFilter, format string) {
+	rows, err := sfg.rows(c, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	var writer feedbackExportWriter
+	if format == FormatCSV {
+		c.Header("Content-Type", contentTypeCSV+"; charset=utf-8")
+		c.Header("Content-Disposition", `attachment; filename="feedback.csv"`)
+		c.Status(http.StatusOK)
+		writer, err = newCSVExportWriter(c.Writer, GetConfig(c).Feedback.Dimensions)
+	} else {
+		c.Header("Content-Type", contentTypeNDJSON)
+		c.Status(http.StatusOK)
+		writer = ndjsonExportWriter{encoder: json.NewEncoder(c.Writer)}
+	}
+
+	written := 0
+	for err == nil && rows.Next() {
+		var row feedbackExportRow
+		if err = GetDB(c).ScanRows(rows, &row); err != nil {
+			break
+		}
+		if err = writer.Write(row); err != nil {
+			break
+		}
+		if written++; written%exportFlushRows == 0 {
+			if err = writer.Flush(); err == nil {
+				c.Writer.Flush()
+			}
+		}
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	// The status has already been sent, so a failed export can only be logged (the client sees a truncated body)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err.Error(), "rows": written}).Error("Failed to export session feedback")
+		c.Abort()
+	}
+}
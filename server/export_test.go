@@ -0,0 +1,129 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestCSVFormulaCells ensures player-written cells can't be evaluated as formulas by spreadsheet applications
+func TestCSVFormulaCells(t *testing.T) {
+	for _, formula := range []string{"=HYPERLINK(\"http://evil.example\")", "+1+1", "-2+3", "@SUM(A1)", "\tcmd", "\rcmd"} {
+		assert.Equal(t, "'"+formula, csvText(formula))
+	}
+	for _, text := range []string{"", "Great game", "1 = 1", "'quoted", "'"} {
+		assert.Equal(t, text, csvText(text))
+		assert.Equal(t, text, csvUnquote(text))
+	}
+	for _, text := range []string{"=1+2", "'=1+2", "''-lag", "@SUM(A1)"} {
+		assert.Equal(t, text, csvUnquote(csvText(text)))
+	}
+	assert.Equal(t, "''=1+2", csvText("'=1+2"))
+
+	var out bytes.Buffer
+	w, err := newCSVExportWriter(&out, []string{"balance"})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(feedbackExportRow{Rating: 1, Comment: "=1+2", SentimentScore: -0.5, Tags: "-lag"}))
+	require.NoError(t, w.Flush())
+	lines, err := csv.NewReader(&out).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "'=1+2", lines[1][4])
+	assert.Equal(t, "-0.5", lines[1][7])
+	assert.Equal(t, "'-lag", lines[1][10])
+}
+
+// TestExportSessionFeedback ensures feedback can be exported as CSV and NDJSON, honoring the filters
+func (s *RouteTestSuite) TestExportSessionFeedback() {
+	session := s.createSession()
+	w := s.request("POST", "/sessions/feedback/create", gin.H{
+		"sessionId": session.ID,
+		"userId":    s.createUser().ID,
+		"rating":    2,
+		"comment":   "Laggy, \"unplayable\" at times",
+		"scores":    gin.H{"performance": 1, "balance": 4},
+		"tags":      []string{"lag", "evening"},
+	})
+	s.Require().Equal(200, w.Code, w.Body.String())
+	var created CreateSessionFeedbackJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &created))
+	s.createFeedback(session, s.createUser(), 5, "Great")
+	s.createFeedback(session, s.createUser(), 2, "What a cheater")
+
+	// CSV
+	w = s.request("GET", "/sessions/feedback?format=csv&rating=2&sessionId="+session.ID.String(), nil)
+	s.Equal(200, w.Code)
+	s.Equal("text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	lines, err := csv.NewReader(w.Body).ReadAll()
+	s.Require().NoError(err)
+	s.Require().Len(lines, 2)
+	s.Equal([]string{"id", "sessionId", "userId", "rating", "comment", "moderationStatus", "sentiment", "sentimentScore", "createdAt",
+		"score_matchmaking", "score_performance", "score_balance", "tags", "topics", "answers"}, lines[0])
+	row := lines[1]
+	s.Equal(created.SessionFeedback.ID.String(), row[0])
+	s.Equal("2", row[3])
+	s.Equal("Laggy, \"unplayable\" at times", row[4])
+	s.Equal(SentimentNegative, row[6])
+	s.Equal([]string{"", "1", "4"}, row[9:12])
+	s.Equal("evening;lag", row[12])
+	s.Equal("lag", row[13])
+	s.Equal("{}", row[14])
+
+	// NDJSON through the Accept header
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil, "Accept", "application/x-ndjson")
+	s.Equal(200, w.Code)
+	s.Equal("application/x-ndjson", w.Header().Get("Content-Type"))
+	var records []FeedbackExportRecord
+	scanner := bufio.NewScanner(strings.NewReader(w.Body.String()))
+	for scanner.Scan() {
+		var record FeedbackExportRecord
+		s.Require().NoError(json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	// The flagged comment is only exported for ops
+	s.Require().Len(records, 2)
+	s.Equal(created.SessionFeedback.ID, records[0].ID)
+	s.Equal(map[string]int{"performance": 1, "balance": 4}, records[0].Scores)
+	s.Equal([]string{"evening", "lag"}, records[0].Tags)
+	s.Equal("Great", records[1].Comment)
+	s.Empty(records[1].Tags)
+
+	w = s.request("GET", "/sessions/feedback?format=ndjson&sessionId="+session.ID.String(), nil, APIKeyHeader, testOpsAPIKey)
+	s.Equal(3, strings.Count(w.Body.String(), "\n"))
+
+	s.Equal(http.StatusBadRequest, s.request("GET", "/sessions/feedback?format=xml", nil).Code)
+	w = s.request("GET", "/sessions/feedback?format=json", nil)
+	s.Equal(200, w.Code)
+	s.Contains(w.Header().Get("Content-Type"), "application/json")
+}
+
+// TestExportFormAnswers ensures form answers are exported as JSON
+func (s *RouteTestSuite) TestExportFormAnswers() {
+	s.createForm(ctfForm)
+	var sessionResponse CreateSessionJSON
+	w := s.request("POST", "/sessions/create", gin.H{"gameMode": "ctf"})
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &sessionResponse))
+	w = s.request("POST", "/sessions/feedback/create", gin.H{
+		"sessionId": sessionResponse.Session.ID,
+		"userId":    s.createUser().ID,
+		"rating":    4,
+		"answers":   gin.H{"flag_balance": 3, "roles": []string{"support"}, "ideas": "More maps\nplease"},
+	})
+	s.Require().Equal(200, w.Code, w.Body.String())
+
+	w = s.request("GET", "/sessions/feedback?format=ndjson&sessionId="+sessionResponse.Session.ID.String(), nil)
+	var record FeedbackExportRecord
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &record))
+	s.Len(record.Answers, 3)
+	s.JSONEq(`3`, string(record.Answers["flag_balance"]))
+	s.JSONEq(`["support"]`, string(record.Answers["roles"]))
+	s.JSONEq(`"More maps\nplease"`, string(record.Answers["ideas"]))
+}
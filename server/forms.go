@@ -0,0 +1,386 @@
+package server
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Types of FormQuestion
+const (
+	// QuestionTypeRating questions are answered with a number from 1 through 5
+	QuestionTypeRating = "rating"
+	// QuestionTypeSingleChoice questions are answered with one of the question's options
+	QuestionTypeSingleChoice = "single_choice"
+	// QuestionTypeMultiChoice questions are answered with a list of the question's options
+	QuestionTypeMultiChoice = "multi_choice"
+	// QuestionTypeFreeText questions are answered with a string
+	QuestionTypeFreeText = "free_text"
+)
+
+// maxFreeTextAnswerLength is the longest answer accepted for a free_text question
+const maxFreeTextAnswerLength = 2000
+
+// questionTypeIsValid checks if the given value is one of the question types
+func questionTypeIsValid(questionType string) bool {
+	switch questionType {
+	case QuestionTypeRating, QuestionTypeSingleChoice, QuestionTypeMultiChoice, QuestionTypeFreeText:
+		return true
+	}
+	return false
+}
+
+// FeedbackForm database model representing the questions asked after a session of a given game mode
+//
+// Forms are never modified - posting a form for a game mode that already has one creates the next version, so the
+// answers of older sessions always match the form they were given.
+type FeedbackForm struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	CustomModel
+	GameMode string `gorm:"not null;uniqueIndex:idx_feedback_forms_version" json:"gameMode"`
+	// Starts at 1 and increases with every form posted for the game mode
+	Version   int            `gorm:"not null;uniqueIndex:idx_feedback_forms_version" json:"version"`
+	Questions []FormQuestion `json:"questions"`
+}
+
+// FormQuestion database model representing a single question of a FeedbackForm
+type FormQuestion struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"-"`
+	// FK
+	FeedbackFormID uuid.UUID `gorm:"index" json:"-"`
+	// Identifies the question in submitted answers (unique within the form)
+	Key string `gorm:"not null" json:"key"`
+	// Order of the question within the form
+	Position int    `gorm:"not null" json:"-"`
+	Type     string `gorm:"not null" json:"type"`
+	Prompt   string `gorm:"not null" json:"prompt"`
+	Required bool   `gorm:"not null" json:"required"`
+	// The choices of single_choice and multi_choice questions
+	Options StringList `json:"options,omitempty"`
+}
+
+// FeedbackAnswer database model representing the answer to a FormQuestion given with SessionFeedback
+type FeedbackAnswer struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"-"`
+	// FK
+	SessionFeedbackID uuid.UUID `gorm:"uniqueIndex:idx_feedback_answers_question" json:"-"`
+	// Key of the FormQuestion being answered
+	QuestionKey string `gorm:"not null;uniqueIndex:idx_feedback_answers_question" json:"question"`
+	// Position of the question within the form
+	Position int `gorm:"not null" json:"-"`
+	// The answer as JSON - a number for rating questions, a string for single_choice and free_text questions and a list of
+	// strings for multi_choice questions
+	Value JSONValue `gorm:"not null" json:"value"`
+}
+
+// StringList is a list of strings stored as a JSON array
+type StringList []string
+
+// Value implements driver.Valuer
+func (l StringList) Value() (driver.Value, error) {
+	if l == nil {
+		return "[]", nil
+	}
+	encoded, err := json.Marshal([]string(l))
+	return string(encoded), err
+}
+
+// Scan implements sql.Scanner
+func (l *StringList) Scan(value interface{}) error {
+	var raw []byte
+	switch v := value.(type) {
+	case string:
+		raw = []byte(v)
+	case []byte:
+		raw = v
+	case nil:
+		*l = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into StringList", value)
+	}
+	var list []string
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// JSONValue is a raw JSON value stored as text
+type JSONValue []byte
+
+// MarshalJSON implements json.Marshaler
+func (v JSONValue) MarshalJSON() ([]byte, error) {
+	if len(v) == 0 {
+		return []byte("null"), nil
+	}
+	return v, nil
+}
+
+// UnmarshalJSON implements json.Unmarshaler
+func (v *JSONValue) UnmarshalJSON(data []byte) error {
+	*v = append((*v)[:0], data...)
+	return nil
+}
+
+// Value implements driver.Valuer
+func (v JSONValue) Value() (driver.Value, error) {
+	return string(v), nil
+}
+
+// Scan implements sql.Scanner
+func (v *JSONValue) Scan(value interface{}) error {
+	switch s := value.(type) {
+	case string:
+		*v = JSONValue(s)
+	case []byte:
+		*v = append(JSONValue(nil), s...)
+	case nil:
+		*v = nil
+	default:
+		return fmt.Errorf("cannot scan %T into JSONValue", value)
+	}
+	return nil
+}
+
+// CreateFeedbackFormInput represents the fields expected when the feedback form endpoint is hit with a POST request
+type CreateFeedbackFormInput struct {
+	GameMode  string              `json:"gameMode"`
+	Questions []FormQuestionInput `json:"questions"`
+}
+
+// FormQuestionInput represents a single question of a CreateFeedbackFormInput
+type FormQuestionInput struct {
+	Key      string   `json:"key"`
+	Type     string   `json:"type"`
+	Prompt   string   `json:"prompt"`
+	Required bool     `json:"required"`
+	Options  []string `json:"options"`
+}
+
+// validateFeedbackFormInput checks a CreateFeedbackFormInput, returning a message that is safe to show to the client
+func validateFeedbackFormInput(input CreateFeedbackFormInput) error {
+	if !tagPattern.MatchString(input.GameMode) {
+		return fmt.Errorf("gameMode must only contain lowercase letters, digits, dashes and underscores")
+	}
+	if len(input.Questions) == 0 {
+		return fmt.Errorf("A form needs at least one question")
+	}
+	keys := map[string]bool{}
+	for i, question := range input.Questions {
+		if !tagPattern.MatchString(question.Key) {
+			return fmt.Errorf("Question %d: key must only contain lowercase letters, digits, dashes and underscores", i+1)
+		}
+		if keys[question.Key] {
+			return fmt.Errorf("Question %d: key %q is used more than once", i+1, question.Key)
+		}
+		keys[question.Key] = true
+		if !questionTypeIsValid(question.Type) {
+			return fmt.Errorf("Question %d: type must be one of rating, single_choice, multi_choice or free_text", i+1)
+		}
+		if strings.TrimSpace(question.Prompt) == "" {
+			return fmt.Errorf("Question %d: prompt must be defined", i+1)
+		}
+		choice := question.Type == QuestionTypeSingleChoice || question.Type == QuestionTypeMultiChoice
+		if !choice && len(question.Options) > 0 {
+			return fmt.Errorf("Question %d: only single_choice and multi_choice questions have options", i+1)
+		}
+		if choice {
+			if len(question.Options) < 2 {
+				return fmt.Errorf("Question %d: choice questions need at least two options", i+1)
+			}
+			options := map[string]bool{}
+			for _, option := range question.Options {
+				if strings.TrimSpace(option) == "" || options[option] {
+					return fmt.Errorf("Question %d: options must be unique and not empty", i+1)
+				}
+				options[option] = true
+			}
+		}
+	}
+	return nil
+}
+
+// CreateFeedbackForm handles POST /ops/forms - creates the next version of the form for a game mode
+func CreateFeedbackForm(c *gin.Context) {
+	var input CreateFeedbackFormInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateFeedbackFormInput(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	form := FeedbackForm{ID: uuid.NewV4(), GameMode: input.GameMode}
+	for i, question := range input.Questions {
+		form.Questions = append(form.Questions, FormQuestion{
+			ID:       uuid.NewV4(),
+			Key:      question.Key,
+			Position: i,
+			Type:     question.Type,
+			Prompt:   question.Prompt,
+			Required: question.Required,
+			Options:  question.Options,
+		})
+	}
+	err := GetDB(c).Transaction(func(tx *gorm.DB) error {
+		var latest struct{ Version int }
+		if err := tx.Model(&FeedbackForm{}).Select("coalesce(max(version), 0) AS version").Where("game_mode = ?", form.GameMode).Scan(&latest).Error; err != nil {
+			return err
+		}
+		form.Version = latest.Version + 1
+		if err := tx.Create(&form).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, c, AuditActionCreate, AuditResourceFeedbackForm, form.ID, nil, &form)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Feedback form created", "form": &form})
+}
+
+// formQuestions is a preload condition returning the questions of a form in order
+func formQuestions(db *gorm.DB) *gorm.DB {
+	return db.Order("position")
+}
+
+// getFeedbackForms handles GET /forms - lists feedback forms, newest version first, optionally filtered by the gameMode
+// and version query parameters
+func getFeedbackForms(c *gin.Context) {
+	db := GetDB(c).Preload("Questions", formQuestions)
+	if gameMode := c.Query("gameMode"); gameMode != "" {
+		db = db.Where("game_mode = ?", gameMode)
+	}
+	if version := c.Query("version"); version != "" {
+		versionInt, err := strconv.Atoi(version)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Version must be an integer"})
+			return
+		}
+		db = db.Where("version = ?", versionInt)
+	}
+	var forms []FeedbackForm
+	if err := db.Order("game_mode").Order("version DESC").Find(&forms).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"forms": &forms})
+}
+
+// findFeedbackForm gets the form with the given ID, or the latest form for the given game mode when no ID is given -
+// the returned form has a nil ID when there is no such form
+func findFeedbackForm(db *gorm.DB, id uuid.UUID, gameMode string) (FeedbackForm, error) {
+	var form FeedbackForm
+	db = db.Preload("Questions", formQuestions)
+	if id != uuid.Nil {
+		db = db.Where("id = ?", id)
+	} else {
+		db = db.Where("game_mode = ?", gameMode).Order("version DESC").Limit(1)
+	}
+	err := db.Find(&form).Error
+	return form, err
+}
+
+// validateAnswers checks the answers submitted with SessionFeedback against the session's form (nil when the session has
+// no form) and builds the FeedbackAnswer records - the returned error message is safe to show to the client
+func validateAnswers(form *FeedbackForm, answers map[string]json.RawMessage) ([]FeedbackAnswer, error) {
+	if form == nil {
+		if len(answers) > 0 {
+			return nil, fmt.Errorf("This session does not have a feedback form - answers cannot be given")
+		}
+		return nil, nil
+	}
+	questions := map[string]bool{}
+	for _, question := range form.Questions {
+		questions[question.Key] = true
+	}
+	for key := range answers {
+		if !questions[key] {
+			return nil, fmt.Errorf("Unknown question %q", key)
+		}
+	}
+	var records []FeedbackAnswer
+	for _, question := range form.Questions {
+		raw, ok := answers[question.Key]
+		if !ok || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+			if question.Required {
+				return nil, fmt.Errorf("Question %q must be answered", question.Key)
+			}
+			continue
+		}
+		value, err := validateAnswer(question, raw)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid answer to %q - %s", question.Key, err.Error())
+		}
+		records = append(records, FeedbackAnswer{ID: uuid.NewV4(), QuestionKey: question.Key, Position: question.Position, Value: value})
+	}
+	return records, nil
+}
+
+// validateAnswer checks a single answer against its question, returning the answer re-encoded as compact JSON
+func validateAnswer(question FormQuestion, raw json.RawMessage) (JSONValue, error) {
+	var value interface{}
+	switch question.Type {
+	case QuestionTypeRating:
+		var rating int
+		if err := json.Unmarshal(raw, &rating); err != nil || !ratingIsValid(rating) {
+			return nil, fmt.Errorf("must be an integer from 1 through 5")
+		}
+		value = rating
+	case QuestionTypeSingleChoice:
+		var choice string
+		if err := json.Unmarshal(raw, &choice); err != nil || !containsString(question.Options, choice) {
+			return nil, fmt.Errorf("must be one of %s", strings.Join(question.Options, ", "))
+		}
+		value = choice
+	case QuestionTypeMultiChoice:
+		var choices []string
+		if err := json.Unmarshal(raw, &choices); err != nil {
+			return nil, fmt.Errorf("must be a list of options")
+		}
+		seen := map[string]bool{}
+		for _, choice := range choices {
+			if !containsString(question.Options, choice) || seen[choice] {
+				return nil, fmt.Errorf("must be a list of unique options from %s", strings.Join(question.Options, ", "))
+			}
+			seen[choice] = true
+		}
+		if question.Required && len(choices) == 0 {
+			return nil, fmt.Errorf("at least one option must be chosen")
+		}
+		value = choices
+	case QuestionTypeFreeText:
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil || len(text) > maxFreeTextAnswerLength {
+			return nil, fmt.Errorf("must be a string of at most %d characters", maxFreeTextAnswerLength)
+		}
+		if question.Required && strings.TrimSpace(text) == "" {
+			return nil, fmt.Errorf("must not be empty")
+		}
+		value = text
+	}
+	encoded, err := json.Marshal(value)
+	return JSONValue(encoded), err
+}
+
+// containsString checks if the given list contains the given value
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
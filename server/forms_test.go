@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type CreateFeedbackFormJSON struct {
+	Form FeedbackForm `json:"form"`
+}
+
+type GetFeedbackFormsJSON struct {
+	Forms []FeedbackForm `json:"forms"`
+}
+
+// ctfForm is a valid form for the "ctf" game mode
+var ctfForm = gin.H{
+	"gameMode": "ctf",
+	"questions": []gin.H{
+		{"key": "flag_balance", "type": QuestionTypeRating, "prompt": "How balanced were the flag positions?", "required": true},
+		{"key": "favorite_map", "type": QuestionTypeSingleChoice, "prompt": "Favorite map?", "options": []string{"docks", "canyon"}},
+		{"key": "roles", "type": QuestionTypeMultiChoice, "prompt": "Which roles did you play?", "options": []string{"attack", "defense", "support"}},
+		{"key": "ideas", "type": QuestionTypeFreeText, "prompt": "Anything else?"},
+	},
+}
+
+// createForm creates a FeedbackForm through the API
+func (s *RouteTestSuite) createForm(form gin.H) FeedbackForm {
+	w := s.request("POST", "/ops/forms", form, APIKeyHeader, testOpsAPIKey)
+	s.Require().Equal(200, w.Code, w.Body.String())
+	var response CreateFeedbackFormJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Form
+}
+
+// TestCreateFeedbackForm ensures forms are validated and versioned per game mode
+func (s *RouteTestSuite) TestCreateFeedbackForm() {
+	s.Equal(http.StatusUnauthorized, s.request("POST", "/ops/forms", ctfForm).Code)
+	for _, invalid := range []gin.H{
+		{"gameMode": "ctf"},
+		{"gameMode": "Capture The Flag", "questions": ctfForm["questions"]},
+		{"gameMode": "ctf", "questions": []gin.H{{"key": "a", "type": "slider", "prompt": "?"}}},
+		{"gameMode": "ctf", "questions": []gin.H{{"key": "a", "type": QuestionTypeRating, "prompt": ""}}},
+		{"gameMode": "ctf", "questions": []gin.H{{"key": "a", "type": QuestionTypeRating, "prompt": "?"}, {"key": "a", "type": QuestionTypeFreeText, "prompt": "?"}}},
+		{"gameMode": "ctf", "questions": []gin.H{{"key": "a", "type": QuestionTypeSingleChoice, "prompt": "?", "options": []string{"only"}}}},
+		{"gameMode": "ctf", "questions": []gin.H{{"key": "a", "type": QuestionTypeRating, "prompt": "?", "options": []string{"x", "y"}}}},
+	} {
+		s.Equal(http.StatusBadRequest, s.request("POST", "/ops/forms", invalid, APIKeyHeader, testOpsAPIKey).Code, invalid)
+	}
+
+	first := s.createForm(ctfForm)
+	s.Equal(1, first.Version)
+	s.Require().Len(first.Questions, 4)
+	s.Equal("flag_balance", first.Questions[0].Key)
+	s.Equal([]string{"docks", "canyon"}, []string(first.Questions[1].Options))
+	second := s.createForm(gin.H{"gameMode": "ctf", "questions": []gin.H{{"key": "fun", "type": QuestionTypeRating, "prompt": "Fun?"}}})
+	s.Equal(2, second.Version)
+	s.createForm(gin.H{"gameMode": "deathmatch", "questions": []gin.H{{"key": "fun", "type": QuestionTypeRating, "prompt": "Fun?"}}})
+
+	var response GetFeedbackFormsJSON
+	w := s.request("GET", "/forms?gameMode=ctf", nil)
+	s.Equal(200, w.Code)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.Forms, 2)
+	s.Equal(2, response.Forms[0].Version)
+	s.Equal(1, response.Forms[1].Version)
+	s.Len(response.Forms[1].Questions, 4)
+
+	w = s.request("GET", "/forms?gameMode=ctf&version=1", nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.Forms, 1)
+	s.Equal(first.ID, response.Forms[0].ID)
+	s.Equal(http.StatusBadRequest, s.request("GET", "/forms?version=latest", nil).Code)
+}
+
+// TestFeedbackFormAnswers ensures answers are validated against the form linked to the session and returned with the feedback
+func (s *RouteTestSuite) TestFeedbackFormAnswers() {
+	first := s.createForm(ctfForm)
+	var sessionResponse CreateSessionJSON
+	w := s.request("POST", "/sessions/create", gin.H{"gameMode": "ctf"})
+	s.Require().Equal(200, w.Code, w.Body.String())
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &sessionResponse))
+	session := sessionResponse.Session
+	s.Require().NotNil(session.FeedbackFormID)
+	s.Equal(first.ID, *session.FeedbackFormID)
+
+	// A new version doesn't change the form of existing sessions
+	s.createForm(gin.H{"gameMode": "ctf", "questions": []gin.H{{"key": "fun", "type": QuestionTypeRating, "prompt": "Fun?"}}})
+	s.Equal(http.StatusBadRequest, s.request("POST", "/sessions/create", gin.H{"feedbackFormId": session.ID}).Code)
+
+	user := s.createUser()
+	submit := func(answers gin.H) *http.Response {
+		return s.request("POST", "/sessions/feedback/create", gin.H{
+			"sessionId": session.ID,
+			"userId":    user.ID,
+			"rating":    4,
+			"answers":   answers,
+		}).Result()
+	}
+	for _, invalid := range []gin.H{
+		{},
+		{"flag_balance": 3, "fun": 5},
+		{"flag_balance": 0},
+		{"flag_balance": "3"},
+		{"flag_balance": 3, "favorite_map": "moon"},
+		{"flag_balance": 3, "roles": []string{"attack", "attack"}},
+		{"flag_balance": 3, "roles": "attack"},
+		{"flag_balance": 3, "ideas": 42},
+	} {
+		s.Equal(http.StatusBadRequest, submit(invalid).StatusCode, invalid)
+	}
+
+	w = s.request("POST", "/sessions/feedback/create", gin.H{
+		"sessionId": session.ID,
+		"userId":    user.ID,
+		"rating":    4,
+		"answers":   gin.H{"roles": []string{"defense", "attack"}, "flag_balance": 2, "favorite_map": "docks"},
+	})
+	s.Require().Equal(200, w.Code, w.Body.String())
+	var response CreateSessionFeedbackJSON
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.SessionFeedback.Answers, 3)
+	s.Equal("flag_balance", response.SessionFeedback.Answers[0].QuestionKey)
+	s.JSONEq(`2`, string(response.SessionFeedback.Answers[0].Value))
+	s.JSONEq(`"docks"`, string(response.SessionFeedback.Answers[1].Value))
+	s.JSONEq(`["defense","attack"]`, string(response.SessionFeedback.Answers[2].Value))
+
+	var feedbackResponse GetFeedbackJSON
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &feedbackResponse))
+	s.Require().Len(feedbackResponse.Feedback, 1)
+	s.Len(feedbackResponse.Feedback[0].Answers, 3)
+
+	// Sessions without a form don't accept answers
+	plain := s.createSession()
+	w = s.request("POST", "/sessions/feedback/create", gin.H{
+		"sessionId": plain.ID,
+		"userId":    user.ID,
+		"rating":    4,
+		"answers":   gin.H{"flag_balance": 2},
+	})
+	s.Equal(http.StatusBadRequest, w.Code)
+}
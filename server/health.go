@@ -0,0 +1,108 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// Build information - overridden at build time with -ldflags "-X codingtest/server.Version=... -X codingtest/server.Commit=..."
+var (
+	Version = "dev"
+	Commit  = "unknown"
+)
+
+// startTime is used to report the uptime of the process
+var startTime = time.Now()
+
+// healthz handles the liveness probe - if the process can answer at all, it is alive
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz handles the readiness probe - the service is only ready when the database is reachable and fully migrated
+func readyz(c *gin.Context) {
+	db := GetDB(c)
+	checks := gin.H{"database": "ok", "migrations": "ok"}
+	ready := true
+
+	if err := pingDB(c.Request.Context(), db, GetConfig(c).Database.PingTimeout); err != nil {
+		checks["database"] = err.Error()
+		ready = false
+	} else if err := checkMigrations(db); err != nil {
+		checks["migrations"] = err.Error()
+		ready = false
+	}
+
+	if !ready {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": checks})
+}
+
+// pingDB pings the database, giving up after the given timeout
+func pingDB(ctx context.Context, db *gorm.DB, timeout time.Duration) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return sqlDB.PingContext(ctx)
+}
+
+// checkMigrations ensures every table and column of the migrated models exists in the database
+func checkMigrations(db *gorm.DB) error {
+	migrator := db.Migrator()
+	for _, model := range migrationModels() {
+		stmt := &gorm.Statement{DB: db}
+		if err := stmt.Parse(model); err != nil {
+			return err
+		}
+		if !migrator.HasTable(model) {
+			return fmt.Errorf("table %s has not been migrated", stmt.Schema.Table)
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" {
+				continue
+			}
+			if !migrator.HasColumn(model, field.DBName) {
+				return fmt.Errorf("column %s.%s has not been migrated", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+	return nil
+}
+
+// status reports build information, uptime and database connection pool statistics
+func status(c *gin.Context) {
+	db := GetDB(c)
+	database := gin.H{"driver": db.Dialector.Name()}
+	if sqlDB, err := db.DB(); err == nil {
+		stats := sqlDB.Stats()
+		database["pool"] = gin.H{
+			"maxOpenConnections": stats.MaxOpenConnections,
+			"openConnections":    stats.OpenConnections,
+			"inUse":              stats.InUse,
+			"idle":               stats.Idle,
+			"waitCount":          stats.WaitCount,
+			"waitDuration":       stats.WaitDuration.String(),
+			"maxIdleClosed":      stats.MaxIdleClosed,
+			"maxLifetimeClosed":  stats.MaxLifetimeClosed,
+		}
+	}
+	uptime := time.Since(startTime)
+	c.JSON(http.StatusOK, gin.H{
+		"version":       Version,
+		"commit":        Commit,
+		"startedAt":     startTime,
+		"uptime":        uptime.Round(time.Second).String(),
+		"uptimeSeconds": int64(uptime.Seconds()),
+		"database":      database,
+	})
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm/clause"
+)
+
+// IdempotencyKeyHeader is the header clients send to make a POST request safe to retry
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader is set on responses replayed for a retried request
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength is the longest Idempotency-Key accepted
+const maxIdempotencyKeyLength = 255
+
+// ContextKeyIdempotencyUnstored is set within the Gin context by handlers whose response must not be stored
+const ContextKeyIdempotencyUnstored = "idempotencyUnstored"
+
+// IdempotencyKey stores the response to a POST request sent with an Idempotency-Key, so that retries of the request get
+// the same response instead of repeating its effects
+type IdempotencyKey struct {
+	// Hash of the caller and the Idempotency-Key, so that callers can't use (or block) each other's keys
+	Key string `gorm:"primaryKey;size:255"`
+	// Hash of the caller, method, URL and body of the original request
+	RequestHash string `gorm:"not null"`
+	// 0 while the original request is still being handled
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+// idempotencyRecorder copies the response body while it is written to the client
+type idempotencyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *idempotencyRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *idempotencyRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// idempotencyCaller identifies the caller a key belongs to - its role and name when it is authenticated, otherwise its
+// IP address
+func idempotencyCaller(c *gin.Context) string {
+	if identity := GetIdentity(c); identity != nil {
+		return identity.Role + ":" + identity.Name
+	}
+	return "ip:" + c.ClientIP()
+}
+
+// idempotencyStoredKey is the key a caller's Idempotency-Key is stored under
+func idempotencyStoredKey(caller string, key string) string {
+	hash := sha256.Sum256([]byte(caller + "\x00" + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// idempotencyRequestHash identifies a request by its caller, method, URL and body - a key can only be replayed for
+// the same request
+func idempotencyRequestHash(caller string, c *gin.Context, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(caller))
+	hash.Write([]byte{0})
+	hash.Write([]byte(c.Request.Method + " " + c.Request.URL.RequestURI()))
+	hash.Write([]byte{0})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// idempotency middleware - POST requests sent with an Idempotency-Key are handled once, and retries within the TTL
+// replay the stored response
+//
+// Keys are scoped by caller (see idempotencyCaller). Reusing a key for a different request is rejected with a 422, and a
+// retry sent while the original request is still being handled gets a 409. Server errors (5xx) are not stored, so the
+// request can be retried with the same key, and neither are the responses of handlers that call skipIdempotencyStore.
+// The body is read into memory to hash it, so requests with a body larger than maxBodySize are rejected with a 413.
+func idempotency(ttl time.Duration, maxBodySize int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if c.Request.Method != http.MethodPost || key == "" || ttl <= 0 {
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be at most 255 characters"})
+			return
+		}
+		var body []byte
+		if c.Request.Body != nil {
+			var err error
+			if body, err = ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, maxBodySize)); err != nil {
+				if int64(len(body)) >= maxBodySize {
+					c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": fmt.Sprintf("Requests with an Idempotency-Key must have a body of at most %d bytes", maxBodySize)})
+					return
+				}
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			c.Request.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		caller := idempotencyCaller(c)
+		hash := idempotencyRequestHash(caller, c, body)
+		storedKey := idempotencyStoredKey(caller, key)
+
+		db := GetDB(c)
+		now := time.Now()
+		// Expired keys are purged here rather than by a background job - the expiry is indexed, so this is cheap
+		if err := db.Where("expires_at <= ?", now).Delete(&IdempotencyKey{}).Error; err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		record := IdempotencyKey{Key: storedKey, RequestHash: hash, ExpiresAt: now.Add(ttl)}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&record)
+		if result.Error != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": result.Error.Error()})
+			return
+		}
+		if result.RowsAffected == 0 {
+			// The key has been used before
+			var existing IdempotencyKey
+			if err := db.Where("key = ?", storedKey).Find(&existing).Error; err != nil {
+				c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+			switch {
+			case existing.RequestHash != hash:
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "This Idempotency-Key was already used for a different request"})
+			case existing.StatusCode == 0:
+				c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is still being handled - retry later"})
+			default:
+				c.Header(IdempotentReplayedHeader, "true")
+				c.Data(existing.StatusCode, existing.ContentType, existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		stored := false
+		defer func() {
+			// Releases the key when the handler panicked or the response couldn't be stored, so it can be retried
+			if !stored {
+				db.Delete(&record)
+			}
+		}()
+		recorder := &idempotencyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+
+		status := recorder.Status()
+		if status >= http.StatusInternalServerError || c.GetBool(ContextKeyIdempotencyUnstored) {
+			return
+		}
+		err := db.Model(&record).Updates(IdempotencyKey{
+			StatusCode:  status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			Body:        recorder.body.Bytes(),
+		}).Error
+		// The response has already been sent, so a failure can only be logged
+		if err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "key": key}).Error("Failed to store the response to an idempotent request")
+			return
+		}
+		stored = true
+	}
+}
+
+// skipIdempotencyStore keeps the response to the request from being stored (and replayed), for responses holding
+// secrets - the key is released instead, so a retry is handled again
+func skipIdempotencyStore(c *gin.Context) {
+	c.Set(ContextKeyIdempotencyUnstored, true)
+}
+
+// adds the idempotency middleware - it needs the database and the caller's identity, so it must be added after them
+func addIdempotencyMiddleware(r *gin.Engine, cfg IdempotencyConfig) {
+	r.Use(idempotency(cfg.TTL, cfg.MaxBodySize))
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestIdempotencyKey ensures retried POST requests replay the original response instead of creating duplicates
+func (s *RouteTestSuite) TestIdempotencyKey() {
+	first := s.request("POST", "/users/create", nil, IdempotencyKeyHeader, "create-user-1")
+	s.Require().Equal(200, first.Code)
+	s.Empty(first.Header().Get(IdempotentReplayedHeader))
+	retry := s.request("POST", "/users/create", nil, IdempotencyKeyHeader, "create-user-1")
+	s.Equal(200, retry.Code)
+	s.Equal("true", retry.Header().Get(IdempotentReplayedHeader))
+	s.Equal(first.Body.String(), retry.Body.String())
+	s.Contains(retry.Header().Get("Content-Type"), "application/json")
+	s.createUser()
+
+	var users GetUserJSON
+	s.Require().NoError(json.Unmarshal(s.request("GET", "/users", nil).Body.Bytes(), &users))
+	s.Len(users.Users, 2)
+
+	// The key can't be reused for a different request
+	s.Equal(http.StatusUnprocessableEntity, s.request("POST", "/sessions/create", nil, IdempotencyKeyHeader, "create-user-1").Code)
+	s.Equal(200, s.request("POST", "/sessions/create", gin.H{"gameMode": "ctf"}, IdempotencyKeyHeader, "create-session-1").Code)
+	s.Equal(http.StatusUnprocessableEntity, s.request("POST", "/sessions/create", gin.H{"gameMode": "deathmatch"}, IdempotencyKeyHeader, "create-session-1").Code)
+
+	// Keys are scoped by caller, so another caller's request with the same key is handled on its own
+	w := s.request("POST", "/users/create", nil, IdempotencyKeyHeader, "create-user-1", APIKeyHeader, testOpsAPIKey)
+	s.Equal(200, w.Code)
+	s.Empty(w.Header().Get(IdempotentReplayedHeader))
+	s.NotEqual(first.Body.String(), w.Body.String())
+	s.Equal(http.StatusUnprocessableEntity, s.request("POST", "/sessions/create", nil, IdempotencyKeyHeader, "create-user-1", APIKeyHeader, testOpsAPIKey).Code)
+	var keys []IdempotencyKey
+	s.Require().NoError(s.db.Find(&keys).Error)
+	for _, key := range keys {
+		s.NotEqual("create-user-1", key.Key)
+	}
+
+	// Issued tokens are never stored, so retries issue a new token
+	user := users.Users[0]
+	var tokens []string
+	for i := 0; i < 2; i++ {
+		w = s.request("POST", "/users/"+user.ID.String()+"/token", nil, IdempotencyKeyHeader, "token-1", APIKeyHeader, testGameServerAPIKey)
+		s.Require().Equal(200, w.Code)
+		s.Empty(w.Header().Get(IdempotentReplayedHeader))
+		var response struct {
+			Token string `json:"token"`
+		}
+		s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+		var stored int64
+		s.Require().NoError(s.db.Model(&IdempotencyKey{}).Where("body LIKE ?", "%"+response.Token+"%").Count(&stored).Error)
+		s.Zero(stored)
+		tokens = append(tokens, response.Token)
+	}
+	s.NotEqual(tokens[0], tokens[1])
+
+	// Client errors are replayed too
+	invalid := gin.H{"sessionId": users.Users[0].ID, "userId": users.Users[0].ID, "rating": 0}
+	s.Equal(http.StatusBadRequest, s.request("POST", "/sessions/feedback/create", invalid, IdempotencyKeyHeader, "feedback-1").Code)
+	w = s.request("POST", "/sessions/feedback/create", invalid, IdempotencyKeyHeader, "feedback-1")
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Equal("true", w.Header().Get(IdempotentReplayedHeader))
+
+	s.Equal(http.StatusBadRequest, s.request("POST", "/users/create", nil, IdempotencyKeyHeader, strings.Repeat("k", maxIdempotencyKeyLength+1)).Code)
+}
+
+// TestIdempotencyExpiryAndErrors ensures server errors and expired keys don't block retries, and concurrent retries are rejected
+func TestIdempotencyExpiryAndErrors(t *testing.T) {
+	db := initMockDB()
+	calls := 0
+	status := http.StatusInternalServerError
+	var release chan bool
+	r := gin.New()
+	r.Use(func(c *gin.Context) { c.Set(ContextKeyDB, db) })
+	r.Use(idempotency(50*time.Millisecond, 1<<10))
+	r.POST("/", func(c *gin.Context) {
+		calls++
+		if release != nil {
+			<-release
+		}
+		c.JSON(status, gin.H{"calls": calls})
+	})
+	send := func(key string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader("{}"))
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set(IdempotencyKeyHeader, key)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusInternalServerError, send("a").Code)
+	status = http.StatusOK
+	assert.Equal(t, `{"calls":2}`, send("a").Body.String())
+	assert.Equal(t, `{"calls":2}`, send("a").Body.String())
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(t, `{"calls":3}`, send("a").Body.String())
+
+	// Anonymous callers are told apart by their IP address
+	req, _ := http.NewRequest("POST", "/", strings.NewReader("{}"))
+	req.RemoteAddr = "192.0.2.2:1234"
+	req.Header.Set(IdempotencyKeyHeader, "a")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	assert.Equal(t, `{"calls":4}`, w.Body.String())
+	assert.Equal(t, `{"calls":3}`, send("a").Body.String())
+
+	release = make(chan bool)
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- send("b") }()
+	// Wait for the first request to be handled before retrying
+	for i := 0; i < 100; i++ {
+		var count int64
+		db.Model(&IdempotencyKey{}).Where("status_code = 0").Count(&count)
+		if count > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, http.StatusConflict, send("b").Code)
+	close(release)
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+
+	// Bodies are read into memory to be hashed, so large ones are rejected without handling the request
+	release = nil
+	calls = 0
+	for size, code := range map[int]int{1 << 10: http.StatusOK, 1<<10 + 1: http.StatusRequestEntityTooLarge} {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", size)))
+		req.Header.Set(IdempotencyKeyHeader, fmt.Sprintf("size-%d", size))
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code, size)
+	}
+	assert.Equal(t, 1, calls)
+}
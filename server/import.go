@@ -0,0 +1,474 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Kinds of records that can be imported
+const (
+	ImportUsers    = "users"
+	ImportSessions = "sessions"
+	ImportFeedback = "feedback"
+)
+
+// Limits of imports
+const (
+	// importBatchSize is the number of rows inserted per transaction
+	importBatchSize = 500
+	// maxImportErrors is the number of row errors listed in an ImportReport (the failed count is always exact)
+	maxImportErrors = 1000
+	// maxImportLineLength is the longest NDJSON line accepted
+	maxImportLineLength = 1 << 20
+)
+
+// ImportReport summarizes an import
+type ImportReport struct {
+	Kind     string `json:"kind"`
+	Imported int    `json:"imported"`
+	Failed   int    `json:"failed"`
+	// The first maxImportErrors row errors
+	Errors []ImportRowError `json:"errors"`
+	// Set when more rows failed than are listed in Errors
+	ErrorsTruncated bool `json:"errorsTruncated,omitempty"`
+}
+
+// ImportRowError describes why a row was not imported
+type ImportRowError struct {
+	// 1-based row number (not counting the CSV header)
+	Row   int    `json:"row"`
+	Error string `json:"error"`
+}
+
+// addError records a failed row
+func (r *ImportReport) addError(row int, err error) {
+	r.Failed++
+	if len(r.Errors) >= maxImportErrors {
+		r.ErrorsTruncated = true
+		return
+	}
+	r.Errors = append(r.Errors, ImportRowError{Row: row, Error: err.Error()})
+}
+
+// ImportUserInput represents a row of a user import
+type ImportUserInput struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt *time.Time `json:"createdAt"`
+}
+
+// ImportSessionInput represents a row of a session import
+type ImportSessionInput struct {
+	ID uuid.UUID `json:"id"`
+	CreateSessionInput
+	CreatedAt *time.Time `json:"createdAt"`
+}
+
+// ImportSessionFeedbackInput represents a row of a feedback import - the same fields as CreateSessionFeedbackInput,
+// plus the original creation time
+type ImportSessionFeedbackInput struct {
+	CreateSessionFeedbackInput
+	CreatedAt *time.Time `json:"createdAt"`
+}
+
+// importRowDecoder reads the rows of an import one at a time - Next returns io.EOF after the last row, and errors that
+// only affect the current row are returned as inputError
+type importRowDecoder interface {
+	Next() (json.RawMessage, error)
+}
+
+// ndjsonRowDecoder reads one JSON object per line, skipping blank lines
+type ndjsonRowDecoder struct {
+	scanner *bufio.Scanner
+}
+
+func newNDJSONRowDecoder(r io.Reader) *ndjsonRowDecoder {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineLength)
+	return &ndjsonRowDecoder{scanner: scanner}
+}
+
+// Next implements importRowDecoder
+func (d *ndjsonRowDecoder) Next() (json.RawMessage, error) {
+	for d.scanner.Scan() {
+		line := strings.TrimSpace(d.scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !json.Valid([]byte(line)) {
+			return nil, inputError{fmt.Errorf("Invalid JSON")}
+		}
+		return json.RawMessage(line), nil
+	}
+	if err := d.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// csvRowDecoder reads CSV rows (with a header row naming the fields) and converts them to JSON objects, so that they are
+// decoded and validated exactly like NDJSON rows - the columns written by the CSV export are accepted:
+//   - rating (and every score_<DIMENSION> column) is a number
+//   - tags is a list separated by semicolons
+//   - answers is a JSON object
+//   - the quote that csvText adds before a formula in the player-written cells (comment, tags and answers) is removed
+//   - empty cells are left out
+type csvRowDecoder struct {
+	reader *csv.Reader
+	header []string
+}
+
+func newCSVRowDecoder(r io.Reader) (*csvRowDecoder, error) {
+	reader := csv.NewReader(r)
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("The CSV file is empty - a header row is required")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &csvRowDecoder{reader: reader, header: header}, nil
+}
+
+// Next implements importRowDecoder
+func (d *csvRowDecoder) Next() (json.RawMessage, error) {
+	record, err := d.reader.Read()
+	if err != nil {
+		if _, ok := err.(*csv.ParseError); ok {
+			return nil, inputError{err}
+		}
+		return nil, err
+	}
+	row := map[string]interface{}{}
+	scores := map[string]interface{}{}
+	for i, column := range d.header {
+		value := record[i]
+		if value == "" {
+			continue
+		}
+		switch column {
+		case "comment", "tags", "answers":
+			value = csvUnquote(value)
+		}
+		switch {
+		case column == "rating":
+			row[column] = csvNumber(value)
+		case strings.HasPrefix(column, "score_"):
+			scores[strings.TrimPrefix(column, "score_")] = csvNumber(value)
+		case column == "tags":
+			row[column] = strings.Split(value, ";")
+		case column == "answers":
+			if !json.Valid([]byte(value)) {
+				return nil, inputError{fmt.Errorf("answers must be a JSON object")}
+			}
+			row[column] = json.RawMessage(value)
+		default:
+			row[column] = value
+		}
+	}
+	if len(scores) > 0 {
+		row["scores"] = scores
+	}
+	return json.Marshal(row)
+}
+
+// csvNumber converts a CSV cell to a number, leaving it as a string (which fails validation) if it isn't one
+func csvNumber(value string) interface{} {
+	if number, err := strconv.Atoi(value); err == nil {
+		return number
+	}
+	return value
+}
+
+// newImportRowDecoder creates the decoder for the given format (csv or ndjson)
+func newImportRowDecoder(format string, r io.Reader) (importRowDecoder, error) {
+	if format == FormatCSV {
+		return newCSVRowDecoder(r)
+	}
+	return newNDJSONRowDecoder(r), nil
+}
+
+// importer inserts the rows of an import, validating them with the same rules as the create handlers
+type importer struct {
+	db *gorm.DB
+	// Who the imported records are audited as
+	source   AuditSource
+	kind     string
+	report   ImportReport
+	feedback *feedbackBuilder
+}
+
+// importRow is a decoded row waiting to be inserted - rows that could not be decoded keep their error, so that the
+// report lists errors in row order
+type importRow struct {
+	number int
+	data   json.RawMessage
+	err    error
+}
+
+// importRecords imports every row read from r, inserting them in batched transactions - rows that fail validation or
+// can't be inserted are listed in the report, while the other rows are still imported
+//
+// Every imported record is audited (as an import by source) and records its event, in the savepoint of its row. An
+// error is only returned when the import could not continue (e.g., the database is unavailable); the report then
+// covers the rows processed before the error.
+func importRecords(ctx context.Context, db *gorm.DB, source AuditSource, cfg *Config, moderator Moderator, analyzer Analyzer, kind string, format string, r io.Reader) (ImportReport, error) {
+	imp := &importer{
+		db:       db.WithContext(ctx),
+		source:   source,
+		kind:     kind,
+		report:   ImportReport{Kind: kind, Errors: []ImportRowError{}},
+		feedback: newFeedbackBuilder(cfg.Feedback, moderator, analyzer),
+	}
+	decoder, err := newImportRowDecoder(format, r)
+	if err != nil {
+		return imp.report, err
+	}
+	var batch []importRow
+	for number := 1; ; number++ {
+		data, err := decoder.Next()
+		if err == io.EOF {
+			break
+		}
+		if _, ok := err.(inputError); !ok && err != nil {
+			return imp.report, err
+		}
+		batch = append(batch, importRow{number: number, data: data, err: err})
+		if len(batch) == importBatchSize {
+			if err := imp.insertBatch(batch); err != nil {
+				return imp.report, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		if err := imp.insertBatch(batch); err != nil {
+			return imp.report, err
+		}
+	}
+	return imp.report, nil
+}
+
+// insertBatch inserts a batch of rows in a single transaction - each row is inserted within a savepoint, so a row that
+// fails to insert doesn't roll back the rest of the batch
+func (imp *importer) insertBatch(batch []importRow) error {
+	imported := 0
+	var failed []importRow
+	err := imp.db.Transaction(func(tx *gorm.DB) error {
+		for _, row := range batch {
+			rowErr := row.err
+			if rowErr == nil {
+				rowErr = tx.Transaction(func(tx *gorm.DB) error {
+					return imp.insertRow(tx, row.data)
+				})
+			}
+			if rowErr == nil {
+				imported++
+				continue
+			}
+			if _, ok := rowErr.(inputError); !ok {
+				return rowErr
+			}
+			failed = append(failed, importRow{number: row.number, err: rowErr})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	imp.report.Imported += imported
+	for _, row := range failed {
+		imp.report.addError(row.number, row.err)
+	}
+	return nil
+}
+
+// insertRow validates and inserts a single row - invalid rows (and rows the database rejects, e.g. duplicate IDs) are
+// reported as inputError, any other error aborts the import
+func (imp *importer) insertRow(tx *gorm.DB, data json.RawMessage) error {
+	var err error
+	switch imp.kind {
+	case ImportUsers:
+		err = imp.insertUser(tx, data)
+	case ImportSessions:
+		err = imp.insertSession(tx, data)
+	default:
+		err = imp.insertSessionFeedback(tx, data)
+	}
+	return err
+}
+
+// decodeImportRow decodes a row into the input struct - unknown fields are ignored, so the export can be re-imported
+func decodeImportRow(data json.RawMessage, input interface{}) error {
+	if err := json.Unmarshal(data, input); err != nil {
+		return invalidInput("%s", err.Error())
+	}
+	return nil
+}
+
+// createRow inserts a record, reporting database errors as row errors (e.g., a duplicate ID)
+func createRow(tx *gorm.DB, record interface{}) error {
+	if err := tx.Create(record).Error; err != nil {
+		return invalidInput("%s", err.Error())
+	}
+	return nil
+}
+
+func (imp *importer) insertUser(tx *gorm.DB, data json.RawMessage) error {
+	var input ImportUserInput
+	if err := decodeImportRow(data, &input); err != nil {
+		return err
+	}
+	user := User{ID: input.ID}
+	if user.ID == uuid.Nil {
+		user.ID = uuid.NewV4()
+	}
+	if input.CreatedAt != nil {
+		user.CreatedAt = *input.CreatedAt
+	}
+	if err := createRow(tx, &user); err != nil {
+		return err
+	}
+	return appendAudit(tx, imp.source, AuditActionImport, AuditResourceUser, user.ID, nil, &user)
+}
+
+func (imp *importer) insertSession(tx *gorm.DB, data json.RawMessage) error {
+	var input ImportSessionInput
+	if err := decodeImportRow(data, &input); err != nil {
+		return err
+	}
+	session, err := newSession(tx, input.CreateSessionInput)
+	if err != nil {
+		return err
+	}
+	if input.ID != uuid.Nil {
+		session.ID = input.ID
+	}
+	if input.CreatedAt != nil {
+		session.CreatedAt = *input.CreatedAt
+	}
+	if err := createRow(tx, &session); err != nil {
+		return err
+	}
+	if err := appendAudit(tx, imp.source, AuditActionImport, AuditResourceSession, session.ID, nil, &session); err != nil {
+		return err
+	}
+	return recordEvent(tx, AggregateSession, session.ID, EventSessionCreated, gin.H{"session": &session})
+}
+
+func (imp *importer) insertSessionFeedback(tx *gorm.DB, data json.RawMessage) error {
+	var input ImportSessionFeedbackInput
+	if err := decodeImportRow(data, &input); err != nil {
+		return err
+	}
+	// Unlike the create handler, the session and user must already exist (import them first)
+	sessionFeedback, err := imp.feedback.build(tx, input.CreateSessionFeedbackInput)
+	if err != nil {
+		return err
+	}
+	if input.ID != uuid.Nil {
+		sessionFeedback.ID = input.ID
+	}
+	if input.CreatedAt != nil {
+		sessionFeedback.CreatedAt = *input.CreatedAt
+	}
+	if err := createRow(tx, &sessionFeedback); err != nil {
+		return err
+	}
+	if err := appendAudit(tx, imp.source, AuditActionImport, AuditResourceSessionFeedback, sessionFeedback.ID, nil, &sessionFeedback); err != nil {
+		return err
+	}
+	return recordEvent(tx, AggregateSessionFeedback, sessionFeedback.ID, EventFeedbackCreated, gin.H{"sessionFeedback": &sessionFeedback})
+}
+
+// importKindIsValid checks if the given value is one of the import kinds
+func importKindIsValid(kind string) bool {
+	switch kind {
+	case ImportUsers, ImportSessions, ImportFeedback:
+		return true
+	}
+	return false
+}
+
+// ImportFile imports the rows of the given CSV or NDJSON file (picked by its extension) into the configured database
+func ImportFile(ctx context.Context, cfg *Config, kind string, path string) (ImportReport, error) {
+	if !importKindIsValid(kind) {
+		return ImportReport{}, fmt.Errorf("unknown import kind %q - must be one of users, sessions or feedback", kind)
+	}
+	moderator, err := NewBlocklistModerator(cfg.Moderation)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return ImportReport{}, err
+	}
+	defer file.Close()
+	format := FormatNDJSON
+	if strings.HasSuffix(strings.ToLower(path), ".csv") {
+		format = FormatCSV
+	}
+	db := initDB(cfg.Database)
+	sqlDB, err := db.DB()
+	if err != nil {
+		return ImportReport{}, err
+	}
+	defer sqlDB.Close()
+	// Makes sure the search index triggers exist, so that imported comments can be searched
+	if _, err := newFeedbackSearcher(db); err != nil {
+		return ImportReport{}, err
+	}
+	return importRecords(ctx, db, AuditSource{Actor: AuditActorCLI}, cfg, moderator, NewLexiconAnalyzer(), kind, format, file)
+}
+
+// importFormat picks the format of an import request - the format query parameter wins, otherwise the Content-Type
+// header is used (text/csv for CSV, anything else is read as NDJSON)
+func importFormat(c *gin.Context) (string, error) {
+	if format := c.Query("format"); format != "" {
+		if format != FormatCSV && format != FormatNDJSON {
+			return "", fmt.Errorf("Format must be csv or ndjson")
+		}
+		return format, nil
+	}
+	if c.ContentType() == contentTypeCSV {
+		return FormatCSV, nil
+	}
+	return FormatNDJSON, nil
+}
+
+// ImportRecords handles POST /ops/import/:kind - imports users, sessions or feedback from a CSV or NDJSON body and
+// returns an ImportReport listing the rows that could not be imported
+func ImportRecords(c *gin.Context) {
+	kind := c.Param("kind")
+	if !importKindIsValid(kind) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Unknown import kind - must be one of users, sessions or feedback"})
+		return
+	}
+	format, err := importFormat(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	report, err := importRecords(c.Request.Context(), GetDB(c), requestAuditSource(c), GetConfig(c), GetModerator(c), GetAnalyzer(c), kind, format, c.Request.Body)
+	// Batches imported before an error are kept
+	if kind == ImportFeedback && report.Imported > 0 {
+		GetListCache(c).Invalidate()
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error(), "report": &report})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"report": &report})
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type ImportRecordsJSON struct {
+	Report ImportReport `json:"report"`
+}
+
+// importBody sends a raw import request as the ops team and returns the report
+func (s *RouteTestSuite) importBody(kind string, contentType string, body string) ImportReport {
+	req, err := http.NewRequest("POST", "/ops/import/"+kind, strings.NewReader(body))
+	s.Require().NoError(err)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set(APIKeyHeader, testOpsAPIKey)
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	s.Require().Equal(200, w.Code, w.Body.String())
+	var response ImportRecordsJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Report
+}
+
+// TestImportNDJSON ensures users, sessions and feedback can be imported from NDJSON, with invalid rows reported while the rest are imported
+func (s *RouteTestSuite) TestImportNDJSON() {
+	s.Equal(http.StatusUnauthorized, s.request("POST", "/ops/import/users", nil).Code)
+	s.Equal(http.StatusNotFound, s.request("POST", "/ops/import/reports", nil, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusBadRequest, s.request("POST", "/ops/import/users?format=xml", nil, APIKeyHeader, testOpsAPIKey).Code)
+
+	userID, sessionID, feedbackID := uuid.NewV4(), uuid.NewV4(), uuid.NewV4()
+	report := s.importBody(ImportUsers, contentTypeNDJSON, fmt.Sprintf("{\"id\": %q, \"createdAt\": \"2020-01-02T03:04:05Z\"}\n\n{}\n{\"id\": %q}\n", userID, userID))
+	s.Equal(2, report.Imported)
+	s.Equal(1, report.Failed)
+	s.Require().Len(report.Errors, 1)
+	s.Equal(3, report.Errors[0].Row)
+
+	report = s.importBody(ImportSessions, contentTypeNDJSON, fmt.Sprintf("{\"id\": %q}\n{\"feedbackFormId\": %q}\n", sessionID, uuid.NewV4()))
+	s.Equal(1, report.Imported)
+	s.Require().Len(report.Errors, 1)
+	s.Equal(ImportRowError{Row: 2, Error: "FeedbackForm does not exist"}, report.Errors[0])
+
+	createdAt := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	lines := []string{
+		fmt.Sprintf(`{"id": %q, "sessionId": %q, "userId": %q, "rating": 2, "comment": "Terrible lag", "tags": ["Lag"], "scores": {"performance": 1}, "createdAt": %q}`,
+			feedbackID, sessionID, userID, createdAt.Format(time.RFC3339)),
+		`not json`,
+		fmt.Sprintf(`{"sessionId": %q, "userId": %q, "rating": 4}`, sessionID, userID),
+		fmt.Sprintf(`{"sessionId": %q, "userId": %q, "rating": 4}`, sessionID, uuid.NewV4()),
+		fmt.Sprintf(`{"sessionId": %q, "userId": %q, "rating": 9}`, sessionID, userID),
+		fmt.Sprintf(`{"sessionId": %q, "userId": %q, "rating": 4, "scores": {"fun": 3}}`, uuid.NewV4(), userID),
+	}
+	report = s.importBody(ImportFeedback, contentTypeNDJSON, strings.Join(lines, "\n"))
+	s.Equal(ImportFeedback, report.Kind)
+	s.Equal(1, report.Imported)
+	s.Equal(5, report.Failed)
+	s.Require().Len(report.Errors, 5)
+	s.Equal(2, report.Errors[0].Row)
+	s.Equal(ImportRowError{Row: 3, Error: "This user has already provided feedback for the given session"}, report.Errors[1])
+	s.Equal(ImportRowError{Row: 4, Error: "User does not exist"}, report.Errors[2])
+	s.Equal(5, report.Errors[3].Row)
+	s.Contains(report.Errors[4].Error, "Unknown feedback dimension")
+
+	// Imported feedback goes through the same moderation, normalization and analysis as created feedback
+	w := s.request("GET", "/sessions/feedback?sessionId="+sessionID.String(), nil)
+	var response GetFeedbackJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.Feedback, 1)
+	feedback := response.Feedback[0]
+	s.Equal(feedbackID, feedback.ID)
+	s.True(createdAt.Equal(feedback.CreatedAt))
+	s.Equal(SentimentNegative, feedback.Sentiment)
+	s.Require().Len(feedback.Tags, 1)
+	s.Equal("lag", feedback.Tags[0].Tag)
+	s.Require().Len(feedback.Scores, 1)
+	s.Equal(1, feedback.Scores[0].Score)
+
+	// Every imported record is audited and records its event, while the failed rows leave no trace
+	entries := s.auditLog("action=" + AuditActionImport)
+	s.Len(entries, 4)
+	for _, entry := range entries {
+		s.Equal("ops:tester", entry.Actor)
+		s.NotEqual(uuid.Nil.String(), entry.ResourceID)
+		s.Empty(entry.Before)
+	}
+	entries = s.auditLog("action=" + AuditActionImport + "&resourceType=" + AuditResourceSessionFeedback)
+	s.Require().Len(entries, 1)
+	s.Equal(feedbackID.String(), entries[0].ResourceID)
+	s.Contains(string(entries[0].After), "Terrible lag")
+	var events []OutboxEvent
+	s.Require().NoError(s.db.Order("sequence").Find(&events).Error)
+	s.Require().Len(events, 2)
+	s.Equal(sessionID, events[0].AggregateID)
+	s.Equal(EventSessionCreated, events[0].Event)
+	s.Equal(feedbackID, events[1].AggregateID)
+	s.Equal(EventFeedbackCreated, events[1].Event)
+}
+
+// TestImportCSV ensures feedback exported as CSV can be imported, with form answers validated against the session's form
+func (s *RouteTestSuite) TestImportCSV() {
+	s.createForm(ctfForm)
+	var sessionResponse CreateSessionJSON
+	w := s.request("POST", "/sessions/create", gin.H{"gameMode": "ctf"})
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &sessionResponse))
+	session := sessionResponse.Session
+	first, second, third := s.createUser(), s.createUser(), s.createUser()
+
+	body := "id,sessionId,userId,rating,comment,moderationStatus,topics,score_balance,tags,answers\n" +
+		fmt.Sprintf("%s,%s,%s,5,\"Fun, fair maps\",approved,maps,4,clean;fair,\"{\"\"flag_balance\"\": 5}\"\n", uuid.NewV4(), session.ID, first.ID) +
+		fmt.Sprintf(",%s,%s,3,,,,,,\"{\"\"roles\"\": [\"\"support\"\"]}\"\n", session.ID, second.ID) +
+		fmt.Sprintf(",%s,%s,three,,,,,,\n", session.ID, third.ID) +
+		"too,few\n"
+	report := s.importBody(ImportFeedback, contentTypeCSV, body)
+	s.Equal(1, report.Imported)
+	s.Require().Len(report.Errors, 3)
+	s.Equal(2, report.Errors[0].Row)
+	s.Contains(report.Errors[0].Error, "flag_balance")
+	s.Equal(3, report.Errors[1].Row)
+	s.Equal(4, report.Errors[2].Row)
+
+	w = s.request("GET", "/sessions/feedback?format=ndjson&sessionId="+session.ID.String(), nil)
+	var record FeedbackExportRecord
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &record))
+	s.Equal(first.ID, record.UserID)
+	s.Equal("Fun, fair maps", record.Comment)
+	s.Equal(map[string]int{"balance": 4}, record.Scores)
+	s.Equal([]string{"clean", "fair"}, record.Tags)
+	s.JSONEq(`5`, string(record.Answers["flag_balance"]))
+
+	// The format query parameter overrides the Content-Type
+	report = s.importBody(ImportUsers, "text/plain", "id\n"+uuid.NewV4().String()+"\n")
+	s.Equal(0, report.Imported)
+	s.Equal(2, report.Failed)
+	req, _ := http.NewRequest("POST", "/ops/import/users?format=csv", strings.NewReader("id\n"+uuid.NewV4().String()+"\n"))
+	req.Header.Set(APIKeyHeader, testOpsAPIKey)
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	s.Contains(w.Body.String(), `"imported":1`)
+}
+
+// TestImportCSVExport ensures feedback exported as CSV is imported back unchanged, including the player-written cells that
+// were quoted as formulas by the export
+func (s *RouteTestSuite) TestImportCSVExport() {
+	s.createForm(ctfForm)
+	var sessionResponse CreateSessionJSON
+	w := s.request("POST", "/sessions/create", gin.H{"gameMode": "ctf"})
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &sessionResponse))
+	session := sessionResponse.Session
+	w = s.request("POST", "/sessions/feedback/create", gin.H{
+		"sessionId": session.ID,
+		"userId":    s.createUser().ID,
+		"rating":    2,
+		"comment":   "=1+2 maps, '@all of them",
+		"scores":    gin.H{"balance": 4},
+		"tags":      []string{"-lag", "evening"},
+		"answers":   gin.H{"flag_balance": 5, "roles": []string{"support"}, "ideas": "-more maps"},
+	})
+	s.Require().Equal(200, w.Code, w.Body.String())
+
+	w = s.request("GET", "/sessions/feedback?format=csv&sessionId="+session.ID.String(), nil, APIKeyHeader, testOpsAPIKey)
+	lines, err := csv.NewReader(w.Body).ReadAll()
+	s.Require().NoError(err)
+	s.Require().Len(lines, 2)
+	s.Equal("'=1+2 maps, '@all of them", lines[1][4])
+	s.Equal("'-lag;evening", lines[1][12])
+
+	// Imported again as another player's feedback, so it doesn't collide with the exported one
+	lines[1][0], lines[1][2] = "", s.createUser().ID.String()
+	var body strings.Builder
+	s.Require().NoError(csv.NewWriter(&body).WriteAll(lines))
+	report := s.importBody(ImportFeedback, contentTypeCSV, body.String())
+	s.Equal(1, report.Imported, report.Errors)
+
+	w = s.request("GET", "/sessions/feedback?format=ndjson&sessionId="+session.ID.String(), nil, APIKeyHeader, testOpsAPIKey)
+	records := strings.Split(strings.TrimSpace(w.Body.String()), "\n")
+	s.Require().Len(records, 2)
+	var exported, imported FeedbackExportRecord
+	s.Require().NoError(json.Unmarshal([]byte(records[0]), &exported))
+	s.Require().NoError(json.Unmarshal([]byte(records[1]), &imported))
+	s.Equal("=1+2 maps, '@all of them", imported.Comment)
+	s.Equal(exported.Comment, imported.Comment)
+	s.Equal([]string{"-lag", "evening"}, imported.Tags)
+	s.Equal(exported.Scores, imported.Scores)
+	s.Equal(exported.Answers, imported.Answers)
+	s.JSONEq(`"-more maps"`, string(imported.Answers["ideas"]))
+}
+
+// TestImportBatches ensures imports larger than a batch are fully inserted
+func TestImportBatches(t *testing.T) {
+	db := initMockDB()
+	var lines []string
+	for i := 0; i < importBatchSize+5; i++ {
+		lines = append(lines, "{}")
+	}
+	lines = append(lines, `{"id": "not-a-uuid"}`)
+	cfg := DefaultConfig()
+	moderator, err := NewBlocklistModerator(cfg.Moderation)
+	assert.NoError(t, err)
+	report, err := importRecords(context.Background(), db, AuditSource{Actor: AuditActorCLI}, cfg, moderator, NewLexiconAnalyzer(), ImportUsers, FormatNDJSON, strings.NewReader(strings.Join(lines, "\n")))
+	assert.NoError(t, err)
+	assert.Equal(t, importBatchSize+5, report.Imported)
+	assert.Equal(t, 1, report.Failed)
+	var users int64
+	assert.NoError(t, db.Model(&User{}).Count(&users).Error)
+	assert.Equal(t, int64(importBatchSize+5), users)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
+)
+
+// ContextKeyListCache is the key name for the ListCache within the Gin context
+const ContextKeyListCache = "listCache"
+
+// listVersion identifies the state of the records matching a list query - any insert, update or delete of a matching
+// record changes the count or the latest update time
+type listVersion struct {
+	Count int64
+	// Zero when there are no records
+	LastModified time.Time
+}
+
+// queryListVersion gets the version of the records matched by the query - the query function must return a new query
+// on the model each time it's called
+func queryListVersion(query func() *gorm.DB) (listVersion, error) {
+	var version listVersion
+	if err := query().Count(&version.Count).Error; err != nil {
+		return version, err
+	}
+	if version.Count == 0 {
+		return version, nil
+	}
+	var latest []time.Time
+	if err := query().Order("updated_at DESC").Limit(1).Pluck("updated_at", &latest).Error; err != nil {
+		return version, err
+	}
+	if len(latest) > 0 {
+		version.LastModified = latest[0]
+	}
+	return version, nil
+}
+
+// listETag derives the (weak) ETag of a list response from the version of the listed records and everything else the
+// response depends on (the route, the query string, the response format and what the caller may see)
+func listETag(c *gin.Context, version listVersion, format string) string {
+	hash := sha256.Sum256([]byte(strings.Join([]string{
+		c.FullPath(),
+		c.Request.URL.Query().Encode(),
+		format,
+		fmt.Sprint(isOps(c)),
+		fmt.Sprint(version.Count),
+		fmt.Sprint(version.LastModified.UnixNano()),
+	}, "\x00")))
+	return fmt.Sprintf(`W/"%x"`, hash[:16])
+}
+
+// listNotModified sets the ETag and Last-Modified headers of a list response and responds with a 304 if the client's
+// copy (sent in If-None-Match) is current - the handler must return when it reports true
+//
+// If-Modified-Since is ignored: deleting a record doesn't change the latest update time, so only the ETag (which also
+// covers the number of records) tells whether a list changed.
+func listNotModified(c *gin.Context, etag string, lastModified time.Time) bool {
+	if !lastModified.IsZero() {
+		c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+	return notModified(c, etag)
+}
+
+// ListCache keeps rendered feedback listings in memory so that polling clients don't hit the database - entries are
+// dropped when they expire and the whole cache is invalidated whenever feedback changes through this instance
+//
+// Changes made by other instances (or the CLI) are only seen once the entries expire, so the TTL bounds how stale a
+// listing can be. A zero TTL disables the cache.
+type ListCache struct {
+	ttl        time.Duration
+	maxEntries int
+	mu         sync.Mutex
+	entries    map[string]listCacheEntry
+	// Incremented by Invalidate, so that listings read before an invalidation aren't stored after it
+	generation uint64
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// listCacheEntry is a rendered listing
+type listCacheEntry struct {
+	etag         string
+	lastModified time.Time
+	body         []byte
+	expires      time.Time
+}
+
+// NewListCache creates an empty ListCache
+func NewListCache(cfg ListCacheConfig) *ListCache {
+	return &ListCache{ttl: cfg.TTL, maxEntries: cfg.MaxEntries, entries: map[string]listCacheEntry{}, now: time.Now}
+}
+
+// enabled reports whether listings are cached
+func (l *ListCache) enabled() bool {
+	return l.ttl > 0 && l.maxEntries > 0
+}
+
+// get returns the cached listing with the given key, along with the current generation to pass to put
+func (l *ListCache) get(key string) (listCacheEntry, uint64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	entry, ok := l.entries[key]
+	if ok && !l.now().Before(entry.expires) {
+		delete(l.entries, key)
+		ok = false
+	}
+	return entry, l.generation, ok
+}
+
+// put stores a listing, unless the cache was invalidated since the given generation was read with get
+func (l *ListCache) put(key string, generation uint64, entry listCacheEntry) {
+	if !l.enabled() {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if generation != l.generation {
+		return
+	}
+	now := l.now()
+	if len(l.entries) >= l.maxEntries {
+		for key, entry := range l.entries {
+			if !now.Before(entry.expires) {
+				delete(l.entries, key)
+			}
+		}
+	}
+	// Still full - make room by dropping any entry
+	for key := range l.entries {
+		if len(l.entries) < l.maxEntries {
+			break
+		}
+		delete(l.entries, key)
+	}
+	entry.expires = now.Add(l.ttl)
+	l.entries[key] = entry
+}
+
+// Invalidate drops every cached listing - call it whenever feedback is created, changed or deleted
+func (l *ListCache) Invalidate() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.generation++
+	if len(l.entries) > 0 {
+		l.entries = map[string]listCacheEntry{}
+	}
+}
+
+// listCacheKey identifies a listing by the route, the query string and what the caller may see
+func listCacheKey(c *gin.Context) string {
+	return fmt.Sprintf("%s?%s|ops=%t", c.FullPath(), c.Request.URL.Query().Encode(), isOps(c))
+}
+
+// GetListCache retrieves the ListCache from the request context
+func GetListCache(c *gin.Context) *ListCache {
+	value, ok := c.Get(ContextKeyListCache)
+	if !ok {
+		panic("list cache not found in context")
+	}
+	cache, ok := value.(*ListCache)
+	if !ok {
+		panic("list cache was not the correct type")
+	}
+	return cache
+}
+
+// adds the ListCache to the context, it can be retrieved in routes by using GetListCache
+func addListCacheMiddleware(r *gin.Engine, cache *ListCache) {
+	r.Use(func(c *gin.Context) {
+		c.Set(ContextKeyListCache, cache)
+	})
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestListCache ensures listings expire, are dropped on invalidation and aren't stored when invalidated while being read
+func TestListCache(t *testing.T) {
+	now := time.Now()
+	cache := NewListCache(ListCacheConfig{TTL: time.Minute, MaxEntries: 2})
+	cache.now = func() time.Time { return now }
+
+	_, generation, ok := cache.get("a")
+	assert.False(t, ok)
+	cache.put("a", generation, listCacheEntry{etag: `W/"a"`, body: []byte("{}")})
+	entry, _, ok := cache.get("a")
+	assert.True(t, ok)
+	assert.Equal(t, `W/"a"`, entry.etag)
+
+	now = now.Add(time.Minute)
+	_, _, ok = cache.get("a")
+	assert.False(t, ok)
+
+	// A listing read before an invalidation isn't stored after it
+	_, generation, _ = cache.get("a")
+	cache.Invalidate()
+	cache.put("a", generation, listCacheEntry{etag: `W/"stale"`})
+	_, generation, ok = cache.get("a")
+	assert.False(t, ok)
+
+	cache.put("a", generation, listCacheEntry{})
+	cache.put("b", generation, listCacheEntry{})
+	cache.put("c", generation, listCacheEntry{})
+	assert.Len(t, cache.entries, 2)
+	cache.Invalidate()
+	assert.Empty(t, cache.entries)
+
+	disabled := NewListCache(ListCacheConfig{MaxEntries: 10})
+	disabled.put("a", 0, listCacheEntry{})
+	_, _, ok = disabled.get("a")
+	assert.False(t, ok)
+}
+
+// TestFeedbackListConditionalGet ensures feedback listings have an ETag that changes whenever the listed feedback changes
+func (s *RouteTestSuite) TestFeedbackListConditionalGet() {
+	session := s.createSession()
+	first := s.createFeedback(session, s.createUser(), 5, "Great game")
+	path := "/sessions/feedback?sessionId=" + session.ID.String()
+
+	w := s.request("GET", path, nil)
+	s.Require().Equal(200, w.Code)
+	etag := w.Header().Get("ETag")
+	s.Regexp(`^W/"[0-9a-f]{32}"$`, etag)
+	s.NotEmpty(w.Header().Get("Last-Modified"))
+	var response GetFeedbackJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Len(response.Feedback, 1)
+
+	// Served from the cache the second time
+	w = s.request("GET", path, nil)
+	s.Equal(etag, w.Header().Get("ETag"))
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Len(response.Feedback, 1)
+	w = s.request("GET", path, nil, "If-None-Match", etag)
+	s.Equal(http.StatusNotModified, w.Code)
+	s.Empty(w.Body.String())
+
+	// Other filters, formats and callers get other ETags
+	s.NotEqual(etag, s.request("GET", path+"&rating=5", nil).Header().Get("ETag"))
+	s.NotEqual(etag, s.request("GET", path+"&format=csv", nil).Header().Get("ETag"))
+	s.NotEqual(etag, s.request("GET", path, nil, APIKeyHeader, testOpsAPIKey).Header().Get("ETag"))
+	s.Equal(http.StatusNotModified, s.request("GET", path+"&format=csv", nil, "If-None-Match", s.request("GET", path+"&format=csv", nil).Header().Get("ETag")).Code)
+
+	// Creating feedback changes the listing
+	second := s.createFeedback(session, s.createUser(), 4, "")
+	w = s.request("GET", path, nil, "If-None-Match", etag)
+	s.Require().Equal(200, w.Code)
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Len(response.Feedback, 2)
+	etag = w.Header().Get("ETag")
+
+	// So do moderation and deletes
+	moderation := "/ops/feedback/" + second.ID.String() + "/moderation"
+	ifMatch := s.etag("/feedback/" + second.ID.String())
+	s.Require().Equal(200, s.request("PUT", moderation, gin.H{"status": ModerationApproved, "reason": "ok"}, APIKeyHeader, testOpsAPIKey, "If-Match", ifMatch).Code)
+	w = s.request("GET", path, nil, "If-None-Match", etag)
+	s.Require().Equal(200, w.Code)
+	etag = w.Header().Get("ETag")
+	s.Require().Equal(200, s.request("DELETE", "/sessions/feedback?id="+first.ID.String(), nil, "If-Match", "*").Code)
+	w = s.request("GET", path, nil, "If-None-Match", etag)
+	s.Require().Equal(200, w.Code)
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.Feedback, 1)
+	s.Equal(second.ID, response.Feedback[0].ID)
+}
+
+// TestResourceListConditionalGet ensures the user and session listings support If-None-Match
+func (s *RouteTestSuite) TestResourceListConditionalGet() {
+	for _, path := range []string{"/users", "/sessions"} {
+		etag := s.request("GET", path, nil).Header().Get("ETag")
+		s.NotEmpty(etag)
+		s.Equal(http.StatusNotModified, s.request("GET", path, nil, "If-None-Match", etag).Code)
+		s.createSession()
+		s.createUser()
+		w := s.request("GET", path, nil, "If-None-Match", etag)
+		s.Equal(200, w.Code)
+		s.NotEqual(etag, w.Header().Get("ETag"))
+		s.NotEmpty(w.Header().Get("Last-Modified"))
+	}
+}
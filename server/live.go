@@ -0,0 +1,287 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Types of the messages sent over the live sessions WebSocket
+const (
+	// LiveMessageSubscribe (client) starts receiving rating updates for the given sessions
+	LiveMessageSubscribe = "subscribe"
+	// LiveMessageUnsubscribe (client) stops receiving rating updates for the given sessions
+	LiveMessageUnsubscribe = "unsubscribe"
+	// LiveMessagePing (client) is answered with a pong, for clients that can't send WebSocket pings
+	LiveMessagePing = "ping"
+	// LiveMessagePong (server) answers a ping
+	LiveMessagePong = "pong"
+	// LiveMessageSubscribed (server) confirms a subscription, with the current stats of the sessions
+	LiveMessageSubscribed = "subscribed"
+	// LiveMessageUnsubscribed (server) confirms an unsubscription
+	LiveMessageUnsubscribed = "unsubscribed"
+	// LiveMessageRating (server) reports new feedback for a subscribed session, with the updated stats of the session
+	LiveMessageRating = "rating"
+	// LiveMessageError (server) reports an invalid message - the connection stays open
+	LiveMessageError = "error"
+)
+
+const (
+	// liveWriteWait is the time allowed to write a message to the client
+	liveWriteWait = 10 * time.Second
+	// livePongWait is the time allowed between two messages (or pongs) from the client
+	livePongWait = 60 * time.Second
+	// livePingPeriod is how often the server pings the client - must be shorter than livePongWait
+	livePingPeriod = livePongWait * 9 / 10
+	// liveSendBuffer is the number of messages queued for a client - clients that fall further behind are disconnected
+	liveSendBuffer = 64
+	// maxLiveMessageSize is the largest message accepted from a client
+	maxLiveMessageSize = 64 * 1024
+	// maxLiveSessions is the number of sessions a connection can be subscribed to at once
+	maxLiveSessions = 100
+)
+
+// LiveRequest is a message sent by the client
+type LiveRequest struct {
+	Type       string   `json:"type"`
+	SessionIDs []string `json:"sessionIds"`
+}
+
+// LiveSessionStats summarizes the ratings of a session (every feedback counts, whatever its moderation status)
+type LiveSessionStats struct {
+	SessionID     uuid.UUID `json:"sessionId"`
+	Count         int64     `json:"count"`
+	AverageRating float64   `json:"averageRating"`
+}
+
+// LiveMessage is a message sent by the server - only the fields relevant to its type are set
+type LiveMessage struct {
+	Type       string             `json:"type"`
+	Sessions   []LiveSessionStats `json:"sessions,omitempty"`
+	SessionIDs []uuid.UUID        `json:"sessionIds,omitempty"`
+	FeedbackID *uuid.UUID         `json:"feedbackId,omitempty"`
+	Rating     int                `json:"rating,omitempty"`
+	Error      string             `json:"error,omitempty"`
+}
+
+// liveUpgrader upgrades live session requests - the default origin check rejects cross-site browser connections
+var liveUpgrader = websocket.Upgrader{
+	HandshakeTimeout: liveWriteWait,
+	ReadBufferSize:   1024,
+	WriteBufferSize:  1024,
+}
+
+// errLiveSlowConsumer disconnects clients that don't read their messages fast enough
+var errLiveSlowConsumer = errors.New("Too many unread messages - reconnect and subscribe again")
+
+// liveConnection is a live sessions WebSocket - reads and writes each have their own goroutine, while the handler's
+// goroutine handles the requests and the feedback published to the hub
+type liveConnection struct {
+	c        *gin.Context
+	conn     *websocket.Conn
+	requests chan []byte
+	send     chan LiveMessage
+	done     chan struct{}
+	sessions map[uuid.UUID]bool
+}
+
+// liveSessionStats gets the rating stats of a session
+func liveSessionStats(c *gin.Context, sessionID uuid.UUID) (LiveSessionStats, error) {
+	var totals struct {
+		Count         int64
+		AverageRating float64
+	}
+	err := GetDB(c).Model(&SessionFeedback{}).Where("session_id = ?", sessionID).
+		Select("count(*) AS count, coalesce(avg(rating), 0) AS average_rating").Scan(&totals).Error
+	return LiveSessionStats{
+		SessionID:     sessionID,
+		Count:         totals.Count,
+		AverageRating: math.Round(totals.AverageRating*100) / 100,
+	}, err
+}
+
+// liveSessions handles GET /ops/live - a WebSocket over which the ops team subscribes to sessions and receives their
+// ratings (with the running count and average) as feedback is created
+//
+// Clients send JSON messages of the form {"type": "subscribe", "sessionIds": [...]} (or unsubscribe, or ping), and
+// receive the LiveMessage types above. The server pings the client every livePingPeriod and disconnects it if nothing
+// is received for livePongWait. Clients that fall behind by liveSendBuffer messages are disconnected with a 1013 (try
+// again later) close code.
+func liveSessions(c *gin.Context) {
+	if !websocket.IsWebSocketUpgrade(c.Request) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "This endpoint only accepts WebSocket connections"})
+		return
+	}
+	conn, err := liveUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already responded
+		return
+	}
+	live := &liveConnection{
+		c:        c,
+		conn:     conn,
+		requests: make(chan []byte),
+		send:     make(chan LiveMessage, liveSendBuffer),
+		done:     make(chan struct{}),
+		sessions: map[uuid.UUID]bool{},
+	}
+	hub := GetFeedbackHub(c)
+	subscription := hub.Subscribe()
+	defer hub.Unsubscribe(subscription)
+	go live.readPump()
+	go live.writePump()
+	err = live.run(subscription)
+	close(live.done)
+	code, reason := websocket.CloseNormalClosure, ""
+	if err == errLiveSlowConsumer {
+		code, reason = websocket.CloseTryAgainLater, err.Error()
+	} else if err != nil {
+		log.WithFields(log.Fields{"error": err.Error()}).Error("Live sessions connection failed")
+		code, reason = websocket.CloseInternalServerErr, "Internal error"
+	}
+	conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(liveWriteWait))
+	conn.Close()
+}
+
+// run handles the requests of the client and the published feedback until the client disconnects, returning why the
+// connection must be closed
+func (l *liveConnection) run(subscription *feedbackSubscription) error {
+	for {
+		select {
+		case data, ok := <-l.requests:
+			if !ok {
+				return nil
+			}
+			if err := l.handle(data); err != nil {
+				return err
+			}
+		case record, ok := <-subscription.records:
+			if !ok {
+				return errLiveSlowConsumer
+			}
+			if !l.sessions[record.SessionID] {
+				continue
+			}
+			stats, err := liveSessionStats(l.c, record.SessionID)
+			if err != nil {
+				return err
+			}
+			id := record.ID
+			message := LiveMessage{Type: LiveMessageRating, Sessions: []LiveSessionStats{stats}, FeedbackID: &id, Rating: record.Rating}
+			if err := l.enqueue(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handle handles a message from the client - invalid messages are answered with an error message
+func (l *liveConnection) handle(data []byte) error {
+	var request LiveRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		return l.enqueue(LiveMessage{Type: LiveMessageError, Error: "Messages must be JSON objects"})
+	}
+	var sessionIDs []uuid.UUID
+	for _, raw := range request.SessionIDs {
+		id, err := uuid.FromString(raw)
+		if err != nil {
+			return l.enqueue(LiveMessage{Type: LiveMessageError, Error: fmt.Sprintf("Invalid Session ID %q", raw)})
+		}
+		sessionIDs = append(sessionIDs, id)
+	}
+	switch request.Type {
+	case LiveMessageSubscribe:
+		added := 0
+		for _, id := range sessionIDs {
+			if !l.sessions[id] {
+				added++
+			}
+		}
+		if len(l.sessions)+added > maxLiveSessions {
+			return l.enqueue(LiveMessage{Type: LiveMessageError, Error: fmt.Sprintf("At most %d sessions can be subscribed to at once", maxLiveSessions)})
+		}
+		message := LiveMessage{Type: LiveMessageSubscribed, Sessions: []LiveSessionStats{}}
+		for _, id := range sessionIDs {
+			// Subscribed first, so that feedback created while the stats are read is reported afterwards
+			l.sessions[id] = true
+			stats, err := liveSessionStats(l.c, id)
+			if err != nil {
+				return err
+			}
+			message.Sessions = append(message.Sessions, stats)
+		}
+		return l.enqueue(message)
+	case LiveMessageUnsubscribe:
+		for _, id := range sessionIDs {
+			delete(l.sessions, id)
+		}
+		return l.enqueue(LiveMessage{Type: LiveMessageUnsubscribed, SessionIDs: sessionIDs})
+	case LiveMessagePing:
+		return l.enqueue(LiveMessage{Type: LiveMessagePong})
+	}
+	return l.enqueue(LiveMessage{Type: LiveMessageError, Error: "Type must be one of subscribe, unsubscribe or ping"})
+}
+
+// enqueue queues a message for the client without blocking
+func (l *liveConnection) enqueue(message LiveMessage) error {
+	select {
+	case l.send <- message:
+		return nil
+	default:
+		return errLiveSlowConsumer
+	}
+}
+
+// readPump reads the messages of the client until the connection fails or is closed
+func (l *liveConnection) readPump() {
+	defer close(l.requests)
+	l.conn.SetReadLimit(maxLiveMessageSize)
+	l.conn.SetReadDeadline(time.Now().Add(livePongWait))
+	l.conn.SetPongHandler(func(string) error {
+		return l.conn.SetReadDeadline(time.Now().Add(livePongWait))
+	})
+	for {
+		_, data, err := l.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		l.conn.SetReadDeadline(time.Now().Add(livePongWait))
+		select {
+		case l.requests <- data:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// writePump writes the queued messages and pings to the client until the connection is done
+func (l *liveConnection) writePump() {
+	ping := time.NewTicker(livePingPeriod)
+	defer ping.Stop()
+	for {
+		select {
+		case message := <-l.send:
+			l.conn.SetWriteDeadline(time.Now().Add(liveWriteWait))
+			if err := l.conn.WriteJSON(message); err != nil {
+				// The read pump notices the closed connection and ends the handler
+				l.conn.Close()
+				return
+			}
+		case <-ping.C:
+			if err := l.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(liveWriteWait)); err != nil {
+				l.conn.Close()
+				return
+			}
+		case <-l.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	uuid "github.com/satori/go.uuid"
+)
+
+// dialLive opens a live sessions WebSocket on a test server
+func (s *RouteTestSuite) dialLive(server *httptest.Server) *websocket.Conn {
+	header := http.Header{}
+	header.Set(APIKeyHeader, testOpsAPIKey)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ops/live", header)
+	s.Require().NoError(err)
+	return conn
+}
+
+// sendLive sends a message and returns the next message received
+func (s *RouteTestSuite) sendLive(conn *websocket.Conn, request interface{}) LiveMessage {
+	s.Require().NoError(conn.WriteJSON(request))
+	return s.readLive(conn)
+}
+
+// readLive waits for the next message
+func (s *RouteTestSuite) readLive(conn *websocket.Conn) LiveMessage {
+	s.Require().NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	var message LiveMessage
+	s.Require().NoError(conn.ReadJSON(&message))
+	return message
+}
+
+// TestLiveSessions ensures ops can subscribe to sessions and receive their ratings as feedback is created
+func (s *RouteTestSuite) TestLiveSessions() {
+	server := httptest.NewServer(s.router)
+	defer server.Close()
+
+	// The endpoint requires an ops API key and a WebSocket connection
+	_, resp, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ops/live", nil)
+	s.Require().Error(err)
+	s.Equal(http.StatusUnauthorized, resp.StatusCode)
+	s.Equal(http.StatusBadRequest, s.request("GET", "/ops/live", nil, APIKeyHeader, testOpsAPIKey).Code)
+
+	session, other := s.createSession(), s.createSession()
+	s.createFeedback(session, s.createUser(), 4, "")
+	conn := s.dialLive(server)
+	defer conn.Close()
+
+	message := s.sendLive(conn, gin.H{"type": LiveMessageSubscribe, "sessionIds": []uuid.UUID{session.ID}})
+	s.Equal(LiveMessageSubscribed, message.Type)
+	s.Equal([]LiveSessionStats{{SessionID: session.ID, Count: 1, AverageRating: 4}}, message.Sessions)
+
+	// Feedback for other sessions isn't sent, and flagged feedback still counts
+	s.createFeedback(other, s.createUser(), 1, "")
+	feedback := s.createFeedback(session, s.createUser(), 1, "cheater!")
+	message = s.readLive(conn)
+	s.Equal(LiveMessageRating, message.Type)
+	s.Require().NotNil(message.FeedbackID)
+	s.Equal(feedback.ID, *message.FeedbackID)
+	s.Equal(1, message.Rating)
+	s.Equal([]LiveSessionStats{{SessionID: session.ID, Count: 2, AverageRating: 2.5}}, message.Sessions)
+
+	message = s.sendLive(conn, gin.H{"type": LiveMessageUnsubscribe, "sessionIds": []uuid.UUID{session.ID}})
+	s.Equal(LiveMessageUnsubscribed, message.Type)
+	s.Equal([]uuid.UUID{session.ID}, message.SessionIDs)
+	s.createFeedback(session, s.createUser(), 5, "")
+	s.Equal(LiveMessagePong, s.sendLive(conn, gin.H{"type": LiveMessagePing}).Type)
+
+	// Invalid messages are reported without closing the connection
+	s.Equal("Invalid Session ID \"nope\"", s.sendLive(conn, gin.H{"type": LiveMessageSubscribe, "sessionIds": []string{"nope"}}).Error)
+	s.Equal(LiveMessageError, s.sendLive(conn, gin.H{"type": "watch"}).Type)
+	s.Require().NoError(conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+	s.Equal("Messages must be JSON objects", s.readLive(conn).Error)
+	tooMany := make([]uuid.UUID, maxLiveSessions+1)
+	for i := range tooMany {
+		tooMany[i] = uuid.NewV4()
+	}
+	s.Equal(LiveMessageError, s.sendLive(conn, gin.H{"type": LiveMessageSubscribe, "sessionIds": tooMany}).Type)
+	s.Equal(LiveMessagePong, s.sendLive(conn, gin.H{"type": LiveMessagePing}).Type)
+}
+
+// TestLiveSessionsSlowConsumer ensures clients that stop reading are disconnected instead of buffering without limit
+func (s *RouteTestSuite) TestLiveSessionsSlowConsumer() {
+	server := httptest.NewServer(s.router)
+	defer server.Close()
+	session := s.createSession()
+	conn := s.dialLive(server)
+	defer conn.Close()
+	s.Equal(LiveMessageSubscribed, s.sendLive(conn, gin.H{"type": LiveMessageSubscribe, "sessionIds": []uuid.UUID{session.ID}}).Type)
+
+	// Published straight to the hub, faster than the connection can handle
+	var hub *FeedbackHub
+	s.router.GET("/test/hub", func(c *gin.Context) { hub = GetFeedbackHub(c) })
+	s.request("GET", "/test/hub", nil)
+	s.Require().NotNil(hub)
+	for i := 0; i < 10*(feedbackStreamBuffer+liveSendBuffer); i++ {
+		hub.Publish(SessionFeedback{ID: uuid.NewV4(), SessionID: session.ID, Rating: 3})
+	}
+
+	s.Require().NoError(conn.SetReadDeadline(time.Now().Add(5 * time.Second)))
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			s.True(websocket.IsCloseError(err, websocket.CloseTryAgainLater), err.Error())
+			return
+		}
+	}
+}
@@ -75,6 +75,17 @@ func Logger() gin.HandlerFunc {
 		case http.StatusBadRequest:
 			logLevel = Info
 			message = "Bad request from client"
+		case http.StatusUnauthorized:
+			fallthrough
+		case http.StatusForbidden:
+			logLevel = Info
+			message = "Unauthorized request from client"
+		case http.StatusConflict:
+			logLevel = Info
+			message = "Request conflicts with an existing resource"
+		case http.StatusServiceUnavailable:
+			logLevel = Warn
+			message = "Service unavailable"
 		default:
 			logLevel = Warn
 			message = "Encountered unexpected status"
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// ContextKeyModerator is the key name for the comment Moderator within the Gin context
+const ContextKeyModerator = "moderator"
+
+// Moderation statuses of a SessionFeedback record - only approved feedback is returned by public reads
+const (
+	// ModerationPending feedback has been flagged and is waiting for an ops review
+	ModerationPending = "pending"
+	// ModerationApproved feedback is publicly visible
+	ModerationApproved = "approved"
+	// ModerationRejected feedback was reviewed and rejected
+	ModerationRejected = "rejected"
+	// ModerationHidden feedback was approved at some point but has since been hidden
+	ModerationHidden = "hidden"
+)
+
+// moderationStatusIsValid checks if the given value is one of the moderation statuses
+func moderationStatusIsValid(status string) bool {
+	switch status {
+	case ModerationPending, ModerationApproved, ModerationRejected, ModerationHidden:
+		return true
+	}
+	return false
+}
+
+// ModerationResult is the outcome of moderating a comment
+type ModerationResult struct {
+	Status string
+	// Reason explains why the comment was not approved (empty for approved comments)
+	Reason string
+}
+
+// Moderator decides whether a feedback comment can be published
+//
+// The default implementation is the BlocklistModerator - other implementations (e.g., one backed by an external
+// moderation service) can be plugged in with addModerationMiddleware.
+type Moderator interface {
+	Moderate(comment string) ModerationResult
+}
+
+// BlocklistModerator flags comments containing a blocked word (case-insensitive, whole words only) or matching a blocked regex
+type BlocklistModerator struct {
+	words         *regexp.Regexp
+	patterns      []*regexp.Regexp
+	flaggedStatus string
+}
+
+// NewBlocklistModerator creates a BlocklistModerator from the moderation config
+func NewBlocklistModerator(cfg ModerationConfig) (*BlocklistModerator, error) {
+	m := &BlocklistModerator{flaggedStatus: cfg.FlaggedStatus}
+	var quoted []string
+	for _, word := range cfg.BlockedWords {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) > 0 {
+		m.words = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	}
+	for _, pattern := range cfg.BlockedPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+// Moderate approves the comment unless it contains a blocked word or matches a blocked pattern
+func (m *BlocklistModerator) Moderate(comment string) ModerationResult {
+	if comment == "" {
+		return ModerationResult{Status: ModerationApproved}
+	}
+	if m.words != nil {
+		if word := m.words.FindString(comment); word != "" {
+			return ModerationResult{Status: m.flaggedStatus, Reason: "Contains blocked word \"" + strings.ToLower(word) + "\""}
+		}
+	}
+	for _, pattern := range m.patterns {
+		if pattern.MatchString(comment) {
+			return ModerationResult{Status: m.flaggedStatus, Reason: "Matches blocked pattern " + pattern.String()}
+		}
+	}
+	return ModerationResult{Status: ModerationApproved}
+}
+
+// moderateFeedback moderates everything the player wrote in SessionFeedback - the comment, then the answers to the
+// free_text questions of the form (nil when the session has no form) - returning the first result that isn't approved
+func moderateFeedback(moderator Moderator, comment string, form *FeedbackForm, answers []FeedbackAnswer) ModerationResult {
+	result := moderator.Moderate(comment)
+	if result.Status != ModerationApproved || form == nil {
+		return result
+	}
+	freeText := map[string]bool{}
+	for _, question := range form.Questions {
+		if question.Type == QuestionTypeFreeText {
+			freeText[question.Key] = true
+		}
+	}
+	for _, answer := range answers {
+		var text string
+		if !freeText[answer.QuestionKey] || json.Unmarshal(answer.Value, &text) != nil {
+			continue
+		}
+		if result := moderator.Moderate(text); result.Status != ModerationApproved {
+			result.Reason = fmt.Sprintf("Answer to %q: %s", answer.QuestionKey, result.Reason)
+			return result
+		}
+	}
+	return result
+}
+
+// adds the comment moderator to the context, it can be retrieved in routes by using GetModerator
+func addModerationMiddleware(r *gin.Engine, moderator Moderator) {
+	r.Use(func(c *gin.Context) {
+		c.Set(ContextKeyModerator, moderator)
+	})
+}
+
+// GetModerator retrieves the comment moderator from the request context
+func GetModerator(c *gin.Context) Moderator {
+	value, ok := c.Get(ContextKeyModerator)
+	if !ok {
+		panic("moderator not found in context")
+	}
+	moderator, ok := value.(Moderator)
+	if !ok {
+		panic("moderator was not the correct type")
+	}
+	return moderator
+}
+
+// visibleFeedback is a scope limiting SessionFeedback queries to what the caller may see - ops see everything
+// (optionally filtered with the moderationStatus query parameter), everyone else only sees approved feedback
+func visibleFeedback(c *gin.Context) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if isOps(c) {
+			if status := c.Query("moderationStatus"); status != "" {
+				return db.Where("moderation_status = ?", status)
+			}
+			return db
+		}
+		return db.Where("moderation_status = ?", ModerationApproved)
+	}
+}
+
+// getModerationQueue handles GET /ops/moderation/queue - lists feedback with the given moderation status (defaults to pending), oldest first
+func getModerationQueue(c *gin.Context) {
+	status := c.DefaultQuery("status", ModerationPending)
+	if !moderationStatusIsValid(status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be one of pending, approved, rejected or hidden"})
+		return
+	}
+	var records []SessionFeedback
+	if err := GetDB(c).Where("moderation_status = ?", status).Order("created_at").Find(&records).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"feedback": &records})
+}
+
+// UpdateModerationInput represents the fields expected when an ops team member reviews a SessionFeedback record
+type UpdateModerationInput struct {
+	Status string `json:"status"`
+	// An optional note explaining the decision
+	Reason string `json:"reason"`
+}
+
+// UpdateModeration handles PUT /ops/feedback/:id/moderation - sets the moderation status of a SessionFeedback record
+func UpdateModeration(c *gin.Context) {
+	var input UpdateModerationInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !moderationStatusIsValid(input.Status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be one of pending, approved, rejected or hidden"})
+		return
+	}
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SessionFeedback ID"})
+		return
+	}
+	var sessionFeedback SessionFeedback
+	if err := GetDB(c).Where("id = ?", id).Find(&sessionFeedback).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if sessionFeedback.ID == uuid.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "SessionFeedback does not exist"})
+		return
+	}
+	if !preconditionMet(c, resourceETag(sessionFeedback.ID, sessionFeedback.UpdatedAt)) {
+		return
+	}
+	before := sessionFeedback
+	sessionFeedback.ModerationStatus = input.Status
+	sessionFeedback.ModerationReason = input.Reason
+	var result *gorm.DB
+	err = GetDB(c).Transaction(func(tx *gorm.DB) error {
+		// Select the columns so that an empty reason still clears the previous one - the update only applies if the
+		// record wasn't updated since it was read
+		result = tx.Model(&sessionFeedback).Where("updated_at = ?", before.UpdatedAt).
+			Select("moderation_status", "moderation_reason", "updated_at").Updates(&sessionFeedback)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return recordAudit(tx, c, AuditActionUpdate, AuditResourceSessionFeedback, sessionFeedback.ID, &before, &sessionFeedback)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		preconditionFailed(c, "")
+		return
+	}
+	GetListCache(c).Invalidate()
+	c.Header("ETag", resourceETag(sessionFeedback.ID, sessionFeedback.UpdatedAt))
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Moderation status updated", "sessionFeedback": &sessionFeedback})
+}
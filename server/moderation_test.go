@@ -0,0 +1,124 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestBlocklistModerator ensures blocked words only match whole words and blocked patterns are applied
+func TestBlocklistModerator(t *testing.T) {
+	moderator, err := NewBlocklistModerator(ModerationConfig{
+		BlockedWords:    []string{"noob", "trash"},
+		BlockedPatterns: []string{`\d{3}-\d{4}`},
+		FlaggedStatus:   ModerationRejected,
+	})
+	assert.NoError(t, err)
+
+	assert.Equal(t, ModerationResult{Status: ModerationApproved}, moderator.Moderate(""))
+	assert.Equal(t, ModerationResult{Status: ModerationApproved}, moderator.Moderate("Great match, no lag"))
+	// Words are only matched as whole words
+	assert.Equal(t, ModerationApproved, moderator.Moderate("I left my trashcan outside").Status)
+
+	result := moderator.Moderate("What a NOOB")
+	assert.Equal(t, ModerationRejected, result.Status)
+	assert.Equal(t, `Contains blocked word "noob"`, result.Reason)
+
+	assert.Equal(t, ModerationRejected, moderator.Moderate("call me 555-1234").Status)
+
+	_, err = NewBlocklistModerator(ModerationConfig{BlockedPatterns: []string{"("}})
+	assert.Error(t, err)
+}
+
+// TestFlaggedFeedbackIsHiddenFromPublicReads ensures only approved feedback is returned to callers without an ops API key
+func (s *RouteTestSuite) TestFlaggedFeedbackIsHiddenFromPublicReads() {
+	session := s.createSession()
+	clean := s.createFeedback(session, s.createUser(), 5, "Great game")
+	flagged := s.createFeedback(session, s.createUser(), 1, "Total cheater on the other team")
+	linked := s.createFeedback(session, s.createUser(), 2, "see http://spam.example")
+	s.Equal(ModerationApproved, clean.ModerationStatus)
+	s.Equal(ModerationPending, flagged.ModerationStatus)
+	s.Equal(ModerationPending, linked.ModerationStatus)
+
+	var response GetFeedbackJSON
+	w := s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil)
+	s.Equal(200, w.Code)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.Feedback, 1)
+	s.Equal(clean.ID, response.Feedback[0].ID)
+
+	// Ops see everything, and can filter by moderation status
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil, APIKeyHeader, testOpsAPIKey)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Len(response.Feedback, 3)
+	w = s.request("GET", "/sessions/feedback?moderationStatus=pending", nil, "Authorization", "Bearer "+testOpsAPIKey)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Len(response.Feedback, 2)
+}
+
+// TestFreeTextAnswerModeration ensures free-text answers are moderated like comments, for single and batch feedback
+func (s *RouteTestSuite) TestFreeTextAnswerModeration() {
+	s.createForm(ctfForm)
+	w := s.request("POST", "/sessions/create", gin.H{"gameMode": "ctf"})
+	s.Require().Equal(200, w.Code, w.Body.String())
+	var created CreateSessionJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &created))
+	session := created.Session
+
+	feedback := func(ideas string) gin.H {
+		return gin.H{"sessionId": session.ID, "userId": s.createUser().ID, "rating": 3, "answers": gin.H{"flag_balance": 3, "ideas": ideas}}
+	}
+	w = s.request("POST", "/sessions/feedback/create", feedback("Ban that cheater"))
+	s.Require().Equal(200, w.Code, w.Body.String())
+	var response CreateSessionFeedbackJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Equal(ModerationPending, response.SessionFeedback.ModerationStatus)
+	s.Equal(`Answer to "ideas": Contains blocked word "cheater"`, response.SessionFeedback.ModerationReason)
+
+	batch := s.batch("/sessions/feedback/create/batch", gin.H{"feedback": []gin.H{feedback("More maps please"), feedback("see http://spam.example")}}, 200)
+	s.Require().Len(batch.Results, 2)
+
+	// Only the feedback with clean answers is public
+	var listed GetFeedbackJSON
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &listed))
+	s.Require().Len(listed.Feedback, 1)
+	s.Contains(string(listed.Feedback[0].Answers[1].Value), "More maps please")
+}
+
+// TestModerationQueue ensures ops can review flagged feedback, and that approved feedback becomes public
+func (s *RouteTestSuite) TestModerationQueue() {
+	session := s.createSession()
+	flagged := s.createFeedback(session, s.createUser(), 1, "cheater!")
+
+	// The queue requires an ops API key, and unknown keys are rejected outright
+	s.Equal(http.StatusUnauthorized, s.request("GET", "/ops/moderation/queue", nil).Code)
+	s.Equal(http.StatusUnauthorized, s.request("GET", "/ops/moderation/queue", nil, APIKeyHeader, "wrong").Code)
+
+	var response GetFeedbackJSON
+	w := s.request("GET", "/ops/moderation/queue", nil, APIKeyHeader, testOpsAPIKey)
+	s.Equal(200, w.Code)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.Feedback, 1)
+	s.Equal(flagged.ID, response.Feedback[0].ID)
+	s.Equal(`Contains blocked word "cheater"`, response.Feedback[0].ModerationReason)
+
+	path := "/ops/feedback/" + flagged.ID.String() + "/moderation"
+	s.Equal(http.StatusBadRequest, s.request("PUT", path, gin.H{"status": "maybe"}, APIKeyHeader, testOpsAPIKey).Code)
+	etag := s.etag("/feedback/"+flagged.ID.String(), APIKeyHeader, testOpsAPIKey)
+	w = s.request("PUT", path, gin.H{"status": ModerationApproved}, APIKeyHeader, testOpsAPIKey, "If-Match", etag)
+	s.Equal(200, w.Code)
+
+	w = s.request("GET", "/ops/moderation/queue", nil, APIKeyHeader, testOpsAPIKey)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Len(response.Feedback, 0)
+
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.Feedback, 1)
+	s.Equal(ModerationApproved, response.Feedback[0].ModerationStatus)
+	s.Empty(response.Feedback[0].ModerationReason)
+}
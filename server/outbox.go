@@ -0,0 +1,213 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Domain events recorded in the outbox
+const (
+	// EventFeedbackCreated is recorded when a SessionFeedback record is created
+	EventFeedbackCreated = "feedback.created"
+	// EventFeedbackDeleted is recorded when a SessionFeedback record is deleted
+	EventFeedbackDeleted = "feedback.deleted"
+	// EventSessionCreated is recorded when a Session is created
+	EventSessionCreated = "session.created"
+)
+
+// Types of the aggregates events are recorded for
+const (
+	AggregateSession         = "session"
+	AggregateSessionFeedback = "sessionFeedback"
+)
+
+const (
+	// outboxBatchSize is the most events published per poll
+	outboxBatchSize = 100
+	// outboxLease is how long an event being published is hidden from other dispatchers
+	outboxLease = time.Minute
+)
+
+// OutboxEvent database model representing a domain event, recorded in the same transaction as the change it describes
+// and published to the sinks by the OutboxDispatcher
+type OutboxEvent struct {
+	// Sequence orders the events - the events of an aggregate are published in this order
+	Sequence      uint64    `gorm:"primarykey"`
+	EventID       uuid.UUID `gorm:"type:uuid;not null;uniqueIndex"`
+	AggregateType string    `gorm:"not null"`
+	AggregateID   uuid.UUID `gorm:"type:uuid;not null;index"`
+	Event         string    `gorm:"not null"`
+	// JSON of the event's data
+	Payload   string `gorm:"not null"`
+	CreatedAt time.Time
+	// Number of failed attempts to publish the event
+	Attempts      int `gorm:"not null;default:0"`
+	NextAttemptAt time.Time
+	LastError     string
+	PublishedAt   *time.Time `gorm:"index"`
+}
+
+// EventEnvelope is the JSON representation of an event written by the stdout and file sinks
+type EventEnvelope struct {
+	ID            uuid.UUID       `json:"id"`
+	Sequence      uint64          `json:"sequence"`
+	AggregateType string          `json:"aggregateType"`
+	AggregateID   uuid.UUID       `json:"aggregateId"`
+	Event         string          `json:"event"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// Envelope returns the JSON representation of the event
+func (e OutboxEvent) Envelope() EventEnvelope {
+	return EventEnvelope{
+		ID:            e.EventID,
+		Sequence:      e.Sequence,
+		AggregateType: e.AggregateType,
+		AggregateID:   e.AggregateID,
+		Event:         e.Event,
+		CreatedAt:     e.CreatedAt,
+		Data:          json.RawMessage(e.Payload),
+	}
+}
+
+// recordEvent adds an event to the outbox - call it with the transaction that saves the change, so that the event is
+// only recorded (and always recorded) if the change is
+func recordEvent(tx *gorm.DB, aggregateType string, aggregateID uuid.UUID, event string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	return tx.Create(&OutboxEvent{
+		EventID:       uuid.NewV4(),
+		AggregateType: aggregateType,
+		AggregateID:   aggregateID,
+		Event:         event,
+		Payload:       string(payload),
+		CreatedAt:     now,
+		NextAttemptAt: now,
+	}).Error
+}
+
+// exponentialBackoff is the delay before the next attempt after the given number of attempts - base doubled after
+// every attempt, up to max
+func exponentialBackoff(base, max time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	return delay
+}
+
+// OutboxDispatcher publishes the events of the outbox to the sinks in the background
+//
+// Delivery is at least once: an event is retried (with exponential backoff) until every sink accepted it in the same
+// attempt, so sinks may see an event more than once. The events of an aggregate are published in the order they were
+// recorded - an event waits until the earlier events of its aggregate are published, while other aggregates go on.
+type OutboxDispatcher struct {
+	db    *gorm.DB
+	cfg   OutboxConfig
+	sinks []OutboxSink
+	// now is replaced in tests - times are kept in UTC so that they compare correctly in the database
+	now func() time.Time
+
+	*poller
+}
+
+// NewOutboxDispatcher creates a dispatcher - call Start to publish events in the background
+func NewOutboxDispatcher(db *gorm.DB, cfg OutboxConfig, sinks ...OutboxSink) *OutboxDispatcher {
+	return &OutboxDispatcher{
+		db:     db,
+		cfg:    cfg,
+		sinks:  sinks,
+		now:    func() time.Time { return time.Now().UTC() },
+		poller: newPoller(),
+	}
+}
+
+// Start publishes the due events every poll interval until Shutdown is called (a zero interval disables publishing)
+func (d *OutboxDispatcher) Start() {
+	d.start(d.cfg.PollInterval, func(ctx context.Context) {
+		if _, err := d.dispatchDue(ctx); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Failed to publish outbox events")
+		}
+	})
+}
+
+// Shutdown stops the dispatcher, then closes the sinks that hold resources (e.g., files)
+func (d *OutboxDispatcher) Shutdown(ctx context.Context) error {
+	err := d.poller.Shutdown(ctx)
+	for _, sink := range d.sinks {
+		if closer, ok := sink.(io.Closer); ok {
+			if closeErr := closer.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	}
+	return err
+}
+
+// dispatchDue publishes the events that are due and whose aggregate has no earlier unpublished event, returning how
+// many were published
+func (d *OutboxDispatcher) dispatchDue(ctx context.Context) (int, error) {
+	var due []OutboxEvent
+	err := d.db.Where("published_at IS NULL AND next_attempt_at <= ?", d.now()).
+		Where("NOT EXISTS (SELECT 1 FROM outbox_events AS earlier WHERE earlier.aggregate_id = outbox_events.aggregate_id" +
+			" AND earlier.sequence < outbox_events.sequence AND earlier.published_at IS NULL)").
+		Order("sequence").Limit(outboxBatchSize).Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+	published := 0
+	for _, event := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		// Claimed like webhook deliveries, so that dispatchers of other instances skip it
+		result := d.db.Model(&OutboxEvent{}).
+			Where("sequence = ? AND published_at IS NULL AND next_attempt_at = ?", event.Sequence, event.NextAttemptAt).
+			Update("next_attempt_at", d.now().Add(outboxLease))
+		if result.Error != nil {
+			return published, result.Error
+		}
+		if result.RowsAffected == 0 {
+			continue
+		}
+		ok, err := d.publish(ctx, event)
+		if err != nil {
+			return published, err
+		}
+		if ok {
+			published++
+		}
+	}
+	return published, nil
+}
+
+// publish sends an event to every sink and records the outcome, reporting whether every sink accepted it - only
+// database errors are returned
+func (d *OutboxDispatcher) publish(ctx context.Context, event OutboxEvent) (bool, error) {
+	for _, sink := range d.sinks {
+		if err := sink.Publish(ctx, event); err != nil {
+			log.WithFields(log.Fields{"error": err.Error(), "sink": sink.Name(), "event": event.EventID}).Warn("Failed to publish outbox event")
+			return false, d.db.Model(&OutboxEvent{}).Where("sequence = ?", event.Sequence).Updates(map[string]interface{}{
+				"attempts":        event.Attempts + 1,
+				"last_error":      fmt.Sprintf("%s: %s", sink.Name(), err.Error()),
+				"next_attempt_at": d.now().Add(exponentialBackoff(d.cfg.RetryBackoff, d.cfg.MaxBackoff, event.Attempts+1)),
+			}).Error
+		}
+	}
+	return true, d.db.Model(&OutboxEvent{}).Where("sequence = ?", event.Sequence).
+		Updates(map[string]interface{}{"published_at": d.now(), "last_error": ""}).Error
+}
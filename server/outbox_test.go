@@ -0,0 +1,138 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testOutboxConfig is the configuration of the dispatchers of the tests - they are driven by dispatchDue
+func testOutboxConfig() OutboxConfig {
+	return OutboxConfig{RetryBackoff: time.Minute, MaxBackoff: time.Hour}
+}
+
+// publishEvents publishes the recorded events to the given sinks, returning how many were published
+func (s *RouteTestSuite) publishEvents(sinks ...OutboxSink) int {
+	published, err := NewOutboxDispatcher(s.db, testOutboxConfig(), sinks...).dispatchDue(context.Background())
+	s.Require().NoError(err)
+	return published
+}
+
+// TestWriterSink ensures the stdout and file sinks write one envelope per line
+func TestWriterSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := newWriterSink(OutboxSinkStdout, &out)
+	event := OutboxEvent{Sequence: 7, Event: EventSessionCreated, AggregateType: AggregateSession, Payload: `{"session":{}}`}
+	require.NoError(t, sink.Publish(context.Background(), event))
+	require.NoError(t, sink.Publish(context.Background(), event))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	var envelope EventEnvelope
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &envelope))
+	assert.Equal(t, uint64(7), envelope.Sequence)
+	assert.Equal(t, EventSessionCreated, envelope.Event)
+	assert.JSONEq(t, `{"session":{}}`, string(envelope.Data))
+
+	dir, err := ioutil.TempDir("", "outbox")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := testOutboxConfig()
+	cfg.Sinks = []string{OutboxSinkFile}
+	cfg.File = filepath.Join(dir, "events.ndjson")
+	sinks, err := newOutboxSinks(cfg, nil, NewEventBus())
+	require.NoError(t, err)
+	require.Len(t, sinks, 1)
+	require.NoError(t, sinks[0].Publish(context.Background(), event))
+	require.NoError(t, NewOutboxDispatcher(nil, cfg, sinks...).Shutdown(context.Background()))
+	written, err := ioutil.ReadFile(cfg.File)
+	require.NoError(t, err)
+	assert.Equal(t, lines[0]+"\n", string(written))
+
+	_, err = newOutboxSinks(OutboxConfig{Sinks: []string{"kafka"}}, nil, NewEventBus())
+	assert.Error(t, err)
+}
+
+// TestOutbox ensures events are recorded with the changes they describe and published in order per aggregate, retrying
+// failed events
+func (s *RouteTestSuite) TestOutbox() {
+	session := s.createSession()
+	feedback := s.createFeedback(session, s.createUser(), 2, "")
+	etag := s.etag("/feedback/"+feedback.ID.String(), APIKeyHeader, testOpsAPIKey)
+	s.Equal(200, s.request("DELETE", "/sessions/feedback?id="+feedback.ID.String(), nil, "If-Match", etag).Code)
+
+	// The bus fails the first attempt to publish the feedback's creation, which holds back its deletion
+	var received []OutboxEvent
+	failed := false
+	bus := NewEventBus()
+	bus.Subscribe(func(ctx context.Context, event OutboxEvent) error {
+		if event.Event == EventFeedbackCreated && !failed {
+			failed = true
+			return errors.New("unavailable")
+		}
+		received = append(received, event)
+		return nil
+	})
+	now := time.Now().UTC()
+	dispatcher := NewOutboxDispatcher(s.db, testOutboxConfig(), bus)
+	dispatcher.now = func() time.Time { return now }
+	dispatch := func() int {
+		published, err := dispatcher.dispatchDue(context.Background())
+		s.Require().NoError(err)
+		return published
+	}
+	s.Equal(1, dispatch())
+	s.Equal(0, dispatch())
+	var pending OutboxEvent
+	s.Require().NoError(s.db.Where("event = ?", EventFeedbackCreated).Find(&pending).Error)
+	s.Equal(1, pending.Attempts)
+	s.Equal("bus: unavailable", pending.LastError)
+
+	now = now.Add(time.Minute)
+	s.Equal(1, dispatch())
+	s.Equal(1, dispatch())
+	s.Equal(0, dispatch())
+	s.Require().Len(received, 3)
+	s.Equal(EventSessionCreated, received[0].Event)
+	s.Equal(session.ID, received[0].AggregateID)
+	s.Equal(EventFeedbackCreated, received[1].Event)
+	s.Equal(EventFeedbackDeleted, received[2].Event)
+	s.Equal(feedback.ID, received[2].AggregateID)
+	s.True(received[1].Sequence < received[2].Sequence)
+	var data struct {
+		SessionFeedback SessionFeedback `json:"sessionFeedback"`
+	}
+	s.Require().NoError(json.Unmarshal([]byte(received[1].Payload), &data))
+	s.Equal(feedback.ID, data.SessionFeedback.ID)
+	s.Equal(2, data.SessionFeedback.Rating)
+}
+
+// TestOutboxTransactions ensures events are only recorded for the changes that are saved
+func (s *RouteTestSuite) TestOutboxTransactions() {
+	count := func() int64 {
+		var count int64
+		s.Require().NoError(s.db.Model(&OutboxEvent{}).Count(&count).Error)
+		return count
+	}
+	sessions := []gin.H{{}, {"feedbackFormId": "7f9c1d3e-0000-4000-8000-000000000000"}}
+	s.batch("/sessions/create/batch", gin.H{"sessions": sessions}, 400)
+	s.Equal(int64(0), count())
+	s.batch("/sessions/create/batch", gin.H{"sessions": sessions, "mode": BatchModePartial}, 200)
+	s.Equal(int64(1), count())
+
+	// A rejected delete records nothing
+	feedback := s.createFeedback(s.createSession(), s.createUser(), 4, "")
+	s.Equal(int64(3), count())
+	s.Equal(412, s.request("DELETE", "/sessions/feedback?id="+feedback.ID.String(), nil, "If-Match", `"stale"`).Code)
+	s.Equal(int64(3), count())
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"gorm.io/gorm"
+)
+
+// Names of the sinks the outbox can publish to
+const (
+	OutboxSinkWebhooks = "webhooks"
+	OutboxSinkStdout   = "stdout"
+	OutboxSinkFile     = "file"
+	OutboxSinkBus      = "bus"
+)
+
+// OutboxSink is a destination of the events of the outbox
+type OutboxSink interface {
+	// Name identifies the sink in logs and errors
+	Name() string
+	// Publish delivers an event - events are published again after any sink fails, so sinks must tolerate duplicates
+	Publish(ctx context.Context, event OutboxEvent) error
+}
+
+// newOutboxSinks creates the sinks named in the configuration
+func newOutboxSinks(cfg OutboxConfig, db *gorm.DB, bus *EventBus) ([]OutboxSink, error) {
+	var sinks []OutboxSink
+	for _, name := range cfg.Sinks {
+		switch name {
+		case OutboxSinkWebhooks:
+			sinks = append(sinks, newWebhookSink(db))
+		case OutboxSinkStdout:
+			sinks = append(sinks, newWriterSink(OutboxSinkStdout, os.Stdout))
+		case OutboxSinkFile:
+			file, err := os.OpenFile(cfg.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return nil, err
+			}
+			sinks = append(sinks, newWriterSink(OutboxSinkFile, file))
+		case OutboxSinkBus:
+			sinks = append(sinks, bus)
+		default:
+			return nil, fmt.Errorf("unknown outbox sink %q", name)
+		}
+	}
+	return sinks, nil
+}
+
+// webhookSink queues the deliveries of events to the webhooks subscribed to them - the WebhookDispatcher sends them
+type webhookSink struct {
+	db *gorm.DB
+}
+
+// newWebhookSink creates a sink queuing webhook deliveries in the given database
+func newWebhookSink(db *gorm.DB) *webhookSink {
+	return &webhookSink{db: db}
+}
+
+// Name implements OutboxSink
+func (s *webhookSink) Name() string {
+	return OutboxSinkWebhooks
+}
+
+// Publish implements OutboxSink
+func (s *webhookSink) Publish(ctx context.Context, event OutboxEvent) error {
+	return queueWebhookDeliveries(s.db.WithContext(ctx), event)
+}
+
+// writerSink writes events as NDJSON (one EventEnvelope per line)
+type writerSink struct {
+	name string
+	mu   sync.Mutex
+	w    io.Writer
+}
+
+// newWriterSink creates a sink writing to w - w is closed with the sink if it's an io.Closer
+func newWriterSink(name string, w io.Writer) *writerSink {
+	return &writerSink{name: name, w: w}
+}
+
+// Name implements OutboxSink
+func (s *writerSink) Name() string {
+	return s.name
+}
+
+// Publish implements OutboxSink
+func (s *writerSink) Publish(ctx context.Context, event OutboxEvent) error {
+	line, err := json.Marshal(event.Envelope())
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// Close closes the underlying writer, unless it's stdout
+func (s *writerSink) Close() error {
+	if closer, ok := s.w.(io.Closer); ok && s.w != os.Stdout {
+		return closer.Close()
+	}
+	return nil
+}
+
+// EventHandler handles the events published to an EventBus - an error makes the event be published again later
+type EventHandler func(ctx context.Context, event OutboxEvent) error
+
+// EventBus is an in-process sink, passing events to the handlers subscribed to it (e.g., by code embedding the server)
+type EventBus struct {
+	mu       sync.RWMutex
+	handlers []EventHandler
+}
+
+// NewEventBus creates a bus without handlers
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe adds a handler called with every event, in order, on the dispatcher's goroutine
+func (b *EventBus) Subscribe(handler EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Name implements OutboxSink
+func (b *EventBus) Name() string {
+	return OutboxSinkBus
+}
+
+// Publish implements OutboxSink - the handlers after a failing handler aren't called
+func (b *EventBus) Publish(ctx context.Context, event OutboxEvent) error {
+	b.mu.RLock()
+	handlers := b.handlers
+	b.mu.RUnlock()
+	for _, handler := range handlers {
+		if err := handler(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
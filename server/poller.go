@@ -0,0 +1,66 @@
+package server
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// poller runs a function periodically in the background until it's shut down
+type poller struct {
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// newPoller creates a poller - call start to run it
+func newPoller() *poller {
+	return &poller{done: make(chan struct{})}
+}
+
+// start calls poll every interval (a zero interval disables polling) - the context passed to poll is cancelled on
+// shutdown, so that work in flight can be abandoned and picked up again later
+func (p *poller) start(interval time.Duration, poll func(ctx context.Context)) {
+	if interval <= 0 {
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ctx, cancel := context.WithCancel(context.Background())
+				go func() {
+					select {
+					case <-p.done:
+						cancel()
+					case <-ctx.Done():
+					}
+				}()
+				poll(ctx)
+				cancel()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+}
+
+// Shutdown stops the poller, waiting for the current poll to finish
+func (p *poller) Shutdown(ctx context.Context) error {
+	p.stopOnce.Do(func() { close(p.done) })
+	stopped := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
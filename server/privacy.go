@@ -0,0 +1,434 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Policies applied to the feedback of an erased user
+const (
+	// ErasurePolicyAnonymize keeps the ratings, scores and choice answers of the feedback for the statistics, but removes
+	// the comment, tags and free-text answers, and unlinks the feedback from the user
+	ErasurePolicyAnonymize = "anonymize"
+	// ErasurePolicyDelete deletes the feedback with everything attached to it
+	ErasurePolicyDelete = "delete"
+)
+
+// erasurePolicyIsValid checks if the given value is one of the erasure policies
+func erasurePolicyIsValid(policy string) bool {
+	return policy == ErasurePolicyAnonymize || policy == ErasurePolicyDelete
+}
+
+// FormatZIP is the format of user data exports packed as a ZIP archive (one JSON file per kind of record)
+const FormatZIP = "zip"
+
+// erasedData replaces the snapshots, event payloads and webhook payloads holding the data of an erased user
+const erasedData = `{"erased":true}`
+
+// UserDataExport is everything stored about a user, as returned by GET /users/:id/export
+type UserDataExport struct {
+	ExportedAt time.Time `json:"exportedAt"`
+	User       User      `json:"user"`
+	// The feedback left by the user, with its details and every reply from the ops team
+	SessionFeedback []SessionFeedback `json:"sessionFeedback"`
+	// The reports the user filed against other players' feedback
+	Reports []FeedbackReport `json:"reports"`
+}
+
+// UserErasure database model recording that the data of a user was erased - users are only erased once
+type UserErasure struct {
+	ID     uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	UserID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex" json:"userId"`
+	// Either anonymize or delete
+	Policy string `gorm:"not null" json:"policy"`
+	// Number of SessionFeedback records that were anonymized or deleted
+	FeedbackCount int64 `gorm:"not null" json:"feedbackCount"`
+	// Number of reports filed by the user that were anonymized or deleted
+	ReportCount int64 `gorm:"not null" json:"reportCount"`
+	// The actor who requested the erasure (see AuditEntry)
+	RequestedBy string    `gorm:"not null" json:"requestedBy"`
+	RequestID   string    `json:"requestId,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// EraseUserInput represents the (optional) fields accepted when the erasure endpoint is hit with a POST request
+type EraseUserInput struct {
+	// Either anonymize or delete (defaults to privacy.erasure_policy)
+	Policy string `json:"policy"`
+}
+
+// findUserErasure looks up the erasure of a user (nil if the user wasn't erased)
+func findUserErasure(db *gorm.DB, userID uuid.UUID) (*UserErasure, error) {
+	var erasure UserErasure
+	if err := db.Where("user_id = ?", userID).Find(&erasure).Error; err != nil {
+		return nil, err
+	}
+	if erasure.ID == uuid.Nil {
+		return nil, nil
+	}
+	return &erasure, nil
+}
+
+// userNotFound responds to a request for a user that doesn't exist - with a 410 if the user was erased
+func userNotFound(c *gin.Context, userID uuid.UUID) {
+	erasure, err := findUserErasure(GetDB(c), userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if erasure != nil {
+		c.JSON(http.StatusGone, gin.H{"error": "The data of this user was erased", "erasure": erasure})
+		return
+	}
+	c.JSON(http.StatusNotFound, gin.H{"error": "User does not exist"})
+}
+
+// loadUserData collects everything stored about a user
+func loadUserData(db *gorm.DB, user User) (UserDataExport, error) {
+	export := UserDataExport{
+		ExportedAt:      time.Now().UTC(),
+		User:            user,
+		SessionFeedback: []SessionFeedback{},
+		Reports:         []FeedbackReport{},
+	}
+	err := db.Scopes(feedbackDetails).
+		Preload("Responses", func(db *gorm.DB) *gorm.DB { return db.Order("created_at") }).
+		Where("user_id = ?", user.ID).
+		Order("created_at").
+		Find(&export.SessionFeedback).Error
+	if err != nil {
+		return export, err
+	}
+	err = db.Where("reporter_id = ?", user.ID).Order("created_at").Find(&export.Reports).Error
+	return export, err
+}
+
+// zipUserData packs an export into a ZIP archive holding user.json, session_feedback.json and reports.json
+func zipUserData(export UserDataExport) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"user.json", gin.H{"exportedAt": export.ExportedAt, "user": export.User}},
+		{"session_feedback.json", export.SessionFeedback},
+		{"reports.json", export.Reports},
+	}
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// exportUserData handles GET /users/:id/export - responds with everything stored about a user, as JSON or (with
+// ?format=zip) as a ZIP archive
+func exportUserData(c *gin.Context) {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User ID"})
+		return
+	}
+	format := c.DefaultQuery("format", FormatJSON)
+	if format != FormatJSON && format != FormatZIP {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Format must be json or zip"})
+		return
+	}
+	var user User
+	if err := GetDB(c).Where("id = ?", id).Find(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user.ID == uuid.Nil {
+		userNotFound(c, id)
+		return
+	}
+	export, err := loadUserData(GetDB(c), user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if format == FormatJSON {
+		c.JSON(http.StatusOK, &export)
+		return
+	}
+	archive, err := zipUserData(export)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="user-%s.zip"`, user.ID))
+	c.Data(http.StatusOK, "application/zip", archive)
+}
+
+// eraseUser erases the data of a user according to the policy, recording the erasure and redacting the audit log,
+// events and webhook deliveries holding the erased data
+//
+// The user row is always deleted. Call it within a transaction.
+func eraseUser(tx *gorm.DB, source AuditSource, user User, policy string) (UserErasure, error) {
+	erasure := UserErasure{
+		ID:          uuid.NewV4(),
+		UserID:      user.ID,
+		Policy:      policy,
+		RequestedBy: source.Actor,
+		RequestID:   source.RequestID,
+		CreatedAt:   time.Now().UTC(),
+	}
+	var feedbackIDs, reportIDs []uuid.UUID
+	if err := tx.Model(&SessionFeedback{}).Where("user_id = ?", user.ID).Pluck("id", &feedbackIDs).Error; err != nil {
+		return erasure, err
+	}
+	if err := tx.Model(&FeedbackReport{}).Where("reporter_id = ?", user.ID).Pluck("id", &reportIDs).Error; err != nil {
+		return erasure, err
+	}
+	erasure.FeedbackCount = int64(len(feedbackIDs))
+	erasure.ReportCount = int64(len(reportIDs))
+	// Every record whose audit snapshots hold the erased data
+	erased := append([]uuid.UUID{user.ID}, feedbackIDs...)
+	erased = append(erased, reportIDs...)
+	// The records removed by the delete policy, audited and announced once their data is redacted
+	var deletedFeedback []SessionFeedback
+	var deletedResponseIDs, deletedReportIDs []uuid.UUID
+
+	switch policy {
+	case ErasurePolicyAnonymize:
+		// Answers to free_text questions are written by the player, like the comment
+		freeText := "EXISTS (SELECT 1 FROM session_feedbacks JOIN sessions ON sessions.id = session_feedbacks.session_id " +
+			"JOIN form_questions ON form_questions.feedback_form_id = sessions.feedback_form_id " +
+			"WHERE session_feedbacks.id = feedback_answers.session_feedback_id AND form_questions.key = feedback_answers.question_key AND form_questions.type = ?)"
+		if err := tx.Where("session_feedback_id IN ?", feedbackIDs).Where(freeText, QuestionTypeFreeText).Delete(&FeedbackAnswer{}).Error; err != nil {
+			return erasure, err
+		}
+		if err := tx.Where("session_feedback_id IN ?", feedbackIDs).Delete(&FeedbackTag{}).Error; err != nil {
+			return erasure, err
+		}
+		// Each record gets its own random user ID, so the anonymized feedback can't be linked back together
+		for _, id := range feedbackIDs {
+			changes := map[string]interface{}{"comment": "", "moderation_reason": "", "user_id": uuid.NewV4()}
+			if err := tx.Model(&SessionFeedback{}).Where("id = ?", id).Updates(changes).Error; err != nil {
+				return erasure, err
+			}
+		}
+		for _, id := range reportIDs {
+			changes := map[string]interface{}{"details": "", "reporter_id": uuid.NewV4()}
+			if err := tx.Model(&FeedbackReport{}).Where("id = ?", id).Updates(changes).Error; err != nil {
+				return erasure, err
+			}
+		}
+	case ErasurePolicyDelete:
+		// The replies and reports attached to the deleted feedback go with it
+		var responseIDs, feedbackReportIDs []uuid.UUID
+		if err := tx.Model(&FeedbackResponse{}).Where("session_feedback_id IN ?", feedbackIDs).Pluck("id", &responseIDs).Error; err != nil {
+			return erasure, err
+		}
+		if err := tx.Model(&FeedbackReport{}).Where("session_feedback_id IN ?", feedbackIDs).Pluck("id", &feedbackReportIDs).Error; err != nil {
+			return erasure, err
+		}
+		erased = append(erased, responseIDs...)
+		erased = append(erased, feedbackReportIDs...)
+		if err := tx.Select("id", "session_id").Where("id IN ?", feedbackIDs).Find(&deletedFeedback).Error; err != nil {
+			return erasure, err
+		}
+		deletedResponseIDs = responseIDs
+		deletedReportIDs = uniqueIDs(append(append([]uuid.UUID{}, reportIDs...), feedbackReportIDs...))
+		for _, model := range []interface{}{&FeedbackScore{}, &FeedbackTag{}, &FeedbackAnswer{}, &FeedbackTopic{}, &FeedbackResponse{}, &FeedbackReport{}} {
+			if err := tx.Where("session_feedback_id IN ?", feedbackIDs).Delete(model).Error; err != nil {
+				return erasure, err
+			}
+		}
+		if err := tx.Where("reporter_id = ?", user.ID).Delete(&FeedbackReport{}).Error; err != nil {
+			return erasure, err
+		}
+		if err := tx.Where("id IN ?", feedbackIDs).Delete(&SessionFeedback{}).Error; err != nil {
+			return erasure, err
+		}
+	default:
+		return erasure, fmt.Errorf("unknown erasure policy %q", policy)
+	}
+	if err := tx.Where("id = ?", user.ID).Delete(&User{}).Error; err != nil {
+		return erasure, err
+	}
+	if err := redactErasedData(tx, user.ID, erased, feedbackIDs); err != nil {
+		return erasure, err
+	}
+	if err := recordErasedDeletions(tx, source, deletedFeedback, deletedResponseIDs, deletedReportIDs); err != nil {
+		return erasure, err
+	}
+	if err := tx.Create(&erasure).Error; err != nil {
+		return erasure, err
+	}
+	// The erased data isn't kept in the audit log - the entry only records the erasure
+	return erasure, appendAudit(tx, source, AuditActionErase, AuditResourceUser, user.ID, nil, &erasure)
+}
+
+// redactErasedData replaces the copies of erased data kept by the audit log, the outbox and the webhook deliveries
+func redactErasedData(tx *gorm.DB, userID uuid.UUID, erased []uuid.UUID, feedbackIDs []uuid.UUID) error {
+	resourceIDs := make([]string, len(erased))
+	for i, id := range erased {
+		resourceIDs[i] = id.String()
+	}
+	// Audit entries are append-only - the redaction is the one change allowed, so it is made with raw SQL, which doesn't
+	// run the hooks of AuditEntry. The entries themselves are kept, so the log still shows what happened and when.
+	err := tx.Exec(`UPDATE audit_entries SET "before" = CASE WHEN "before" = '' THEN '' ELSE ? END, "after" = CASE WHEN "after" = '' THEN '' ELSE ? END WHERE resource_id IN ?`,
+		erasedData, erasedData, resourceIDs).Error
+	if err != nil {
+		return err
+	}
+	for _, role := range []string{"user", "claimed-user"} {
+		if err := tx.Exec(`UPDATE audit_entries SET actor = ? WHERE actor = ?`, role+":erased", role+":"+userID.String()).Error; err != nil {
+			return err
+		}
+	}
+	// Deliveries that weren't sent yet are given up, as their payload is gone
+	events := tx.Model(&OutboxEvent{}).Select("event_id").Where("aggregate_type = ? AND aggregate_id IN ?", AggregateSessionFeedback, feedbackIDs)
+	err = tx.Model(&WebhookDelivery{}).Where("event_id IN (?)", events).Updates(map[string]interface{}{
+		"payload":    "",
+		"status":     gorm.Expr("CASE WHEN status = ? THEN ? ELSE status END", WebhookDeliveryPending, WebhookDeliveryFailed),
+		"last_error": gorm.Expr("CASE WHEN status = ? THEN ? ELSE last_error END", WebhookDeliveryPending, "User data was erased"),
+	}).Error
+	if err != nil {
+		return err
+	}
+	return tx.Model(&OutboxEvent{}).Where("aggregate_type = ? AND aggregate_id IN ?", AggregateSessionFeedback, feedbackIDs).Update("payload", erasedData).Error
+}
+
+// recordErasedDeletions audits the records deleted by the delete policy and records a feedback.deleted event for each
+// deleted feedback - the snapshots and payloads only hold IDs, as the rest is the erased data
+func recordErasedDeletions(tx *gorm.DB, source AuditSource, feedback []SessionFeedback, responseIDs []uuid.UUID, reportIDs []uuid.UUID) error {
+	deleted := map[string][]uuid.UUID{AuditResourceFeedbackResponse: responseIDs, AuditResourceFeedbackReport: reportIDs}
+	for _, sessionFeedback := range feedback {
+		deleted[AuditResourceSessionFeedback] = append(deleted[AuditResourceSessionFeedback], sessionFeedback.ID)
+	}
+	for _, resourceType := range []string{AuditResourceFeedbackResponse, AuditResourceFeedbackReport, AuditResourceSessionFeedback} {
+		for _, id := range deleted[resourceType] {
+			if err := appendAudit(tx, source, AuditActionDelete, resourceType, id, json.RawMessage(erasedData), nil); err != nil {
+				return err
+			}
+		}
+	}
+	for _, sessionFeedback := range feedback {
+		payload := gin.H{"erased": true, "sessionFeedback": gin.H{"id": sessionFeedback.ID, "sessionId": sessionFeedback.SessionID}}
+		if err := recordEvent(tx, AggregateSessionFeedback, sessionFeedback.ID, EventFeedbackDeleted, payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uniqueIDs removes the repeated IDs of a list, keeping the first of each
+func uniqueIDs(ids []uuid.UUID) []uuid.UUID {
+	seen := map[uuid.UUID]bool{}
+	unique := ids[:0]
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// EraseUser handles POST /users/:id/erasure - erases the data of a user according to the requested policy (or
+// privacy.erasure_policy)
+//
+// Erasing a user again responds with the original erasure, whatever the requested policy.
+func EraseUser(c *gin.Context) {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User ID"})
+		return
+	}
+	// The body is optional - the policy defaults to the configured one
+	var input EraseUserInput
+	if c.Request.Body != nil && c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if input.Policy == "" {
+		input.Policy = GetConfig(c).Privacy.ErasurePolicy
+	}
+	if !erasurePolicyIsValid(input.Policy) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Policy must be anonymize or delete"})
+		return
+	}
+
+	var erasure UserErasure
+	var previous *UserErasure
+	exists := true
+	err = GetDB(c).Transaction(func(tx *gorm.DB) error {
+		var err error
+		if previous, err = findUserErasure(tx, id); err != nil || previous != nil {
+			return err
+		}
+		var user User
+		if err := tx.Where("id = ?", id).Find(&user).Error; err != nil {
+			return err
+		}
+		if user.ID == uuid.Nil {
+			exists = false
+			return nil
+		}
+		erasure, err = eraseUser(tx, requestAuditSource(c), user, input.Policy)
+		return err
+	})
+	if err != nil {
+		// A concurrent request may have erased the user first
+		if previous, _ = findUserErasure(GetDB(c), id); previous == nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	if previous != nil {
+		c.JSON(http.StatusOK, gin.H{"success": true, "message": "User was already erased", "erasure": previous})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "User does not exist"})
+		return
+	}
+	GetListCache(c).Invalidate()
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "User erased", "erasure": &erasure})
+}
+
+// getUserErasure handles GET /users/:id/erasure - responds with the erasure of a user
+func getUserErasure(c *gin.Context) {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User ID"})
+		return
+	}
+	erasure, err := findUserErasure(GetDB(c), id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if erasure == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User was not erased"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"erasure": erasure})
+}
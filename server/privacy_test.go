@@ -0,0 +1,229 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+// playerData creates a user with feedback answering a form (with a tag, a free-text answer and a reply from the ops
+// team) and a report filed against another player's feedback
+func (s *RouteTestSuite) playerData() (User, SessionFeedback, FeedbackReport) {
+	s.createForm(ctfForm)
+	w := s.request("POST", "/sessions/create", gin.H{"gameMode": "ctf"})
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var created CreateSessionJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &created))
+
+	user := s.createUser()
+	w = s.request("POST", "/sessions/feedback/create", gin.H{
+		"sessionId": created.Session.ID,
+		"userId":    user.ID,
+		"rating":    4,
+		"comment":   "I'm Sam from Lyon, the lag was terrible",
+		"tags":      []string{"sam-lyon"},
+		"answers":   gin.H{"flag_balance": 3, "ideas": "Add me as sam#1234"},
+	})
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var response CreateSessionFeedbackJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	feedback := response.SessionFeedback
+	w = s.request("POST", "/ops/feedback/"+feedback.ID.String()+"/responses", gin.H{"body": "Sorry about that!", "visibility": ResponseVisibilityPrivate}, APIKeyHeader, testOpsAPIKey)
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+
+	other := s.createFeedback(s.createSession(), s.createUser(), 1, "")
+	w = s.request("POST", "/feedback/"+other.ID.String()+"/reports", gin.H{"reason": ReportReasonSpam, "details": "Sam here, they spammed"}, UserTokenHeader, s.userToken(user))
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var reported struct {
+		Report FeedbackReport `json:"report"`
+	}
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &reported))
+	return user, feedback, reported.Report
+}
+
+// eraseUser erases a user through the API
+func (s *RouteTestSuite) eraseUser(user User, body interface{}) (UserErasure, string) {
+	w := s.request("POST", "/users/"+user.ID.String()+"/erasure", body, APIKeyHeader, testOpsAPIKey)
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Message string      `json:"message"`
+		Erasure UserErasure `json:"erasure"`
+	}
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Erasure, response.Message
+}
+
+// TestUserDataExport ensures everything stored about a user is exported, as JSON or as a ZIP archive
+func (s *RouteTestSuite) TestUserDataExport() {
+	user, feedback, report := s.playerData()
+	path := "/users/" + user.ID.String() + "/export"
+	s.Equal(http.StatusUnauthorized, s.request("GET", path, nil).Code)
+
+	w := s.request("GET", path, nil, APIKeyHeader, testOpsAPIKey)
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var export UserDataExport
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &export))
+	s.Equal(user.ID, export.User.ID)
+	s.Require().Len(export.SessionFeedback, 1)
+	s.Equal(feedback.ID, export.SessionFeedback[0].ID)
+	s.Len(export.SessionFeedback[0].Answers, 2)
+	s.Len(export.SessionFeedback[0].Tags, 1)
+	s.Require().Len(export.SessionFeedback[0].Responses, 1)
+	s.Equal(ResponseVisibilityPrivate, export.SessionFeedback[0].Responses[0].Visibility)
+	s.Require().Len(export.Reports, 1)
+	s.Equal(report.ID, export.Reports[0].ID)
+
+	w = s.request("GET", path+"?format=zip", nil, APIKeyHeader, testOpsAPIKey)
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	s.Equal("application/zip", w.Header().Get("Content-Type"))
+	s.Contains(w.Header().Get("Content-Disposition"), "user-"+user.ID.String()+".zip")
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	s.Require().NoError(err)
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		r, err := file.Open()
+		s.Require().NoError(err)
+		files[file.Name], err = ioutil.ReadAll(r)
+		s.Require().NoError(err)
+		r.Close()
+	}
+	s.Len(files, 3)
+	s.Contains(string(files["user.json"]), user.ID.String())
+	var archived []SessionFeedback
+	s.Require().NoError(json.Unmarshal(files["session_feedback.json"], &archived))
+	s.Require().Len(archived, 1)
+	s.Equal(feedback.Comment, archived[0].Comment)
+	s.Contains(string(files["reports.json"]), report.ID.String())
+
+	s.Equal(http.StatusBadRequest, s.request("GET", path+"?format=csv", nil, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusNotFound, s.request("GET", "/users/"+uuid.NewV4().String()+"/export", nil, APIKeyHeader, testOpsAPIKey).Code)
+}
+
+// TestUserErasure ensures anonymized users can't be traced back to their feedback, in the database or the audit log, and
+// that erasures are only made once
+func (s *RouteTestSuite) TestUserErasure() {
+	user, feedback, report := s.playerData()
+	s.Require().Equal(http.StatusOK, s.request("POST", "/sessions/create", nil, UserIDHeader, user.ID.String()).Code)
+	path := "/users/" + user.ID.String() + "/erasure"
+	s.Equal(http.StatusUnauthorized, s.request("POST", path, nil).Code)
+	s.Equal(http.StatusBadRequest, s.request("POST", path, gin.H{"policy": "forget"}, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusNotFound, s.request("GET", path, nil, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusNotFound, s.request("POST", "/users/"+uuid.NewV4().String()+"/erasure", nil, APIKeyHeader, testOpsAPIKey).Code)
+
+	erasure, message := s.eraseUser(user, nil)
+	s.Equal("User erased", message)
+	s.Equal(ErasurePolicyAnonymize, erasure.Policy)
+	s.Equal(int64(1), erasure.FeedbackCount)
+	s.Equal(int64(1), erasure.ReportCount)
+	s.Equal("ops:tester", erasure.RequestedBy)
+
+	// The rating and the structured answers are kept, but nothing the player wrote or links them to the feedback
+	var anonymized SessionFeedback
+	s.Require().NoError(s.db.Scopes(feedbackDetails).Preload("Responses").Where("id = ?", feedback.ID).Find(&anonymized).Error)
+	s.Equal(4, anonymized.Rating)
+	s.Empty(anonymized.Comment)
+	s.Empty(anonymized.Tags)
+	s.NotEqual(user.ID, anonymized.UserID)
+	s.NotEqual(uuid.Nil, anonymized.UserID)
+	s.Require().Len(anonymized.Answers, 1)
+	s.Equal("flag_balance", anonymized.Answers[0].QuestionKey)
+	s.Len(anonymized.Responses, 1)
+	var anonymizedReport FeedbackReport
+	s.Require().NoError(s.db.Where("id = ?", report.ID).Find(&anonymizedReport).Error)
+	s.Equal(ReportReasonSpam, anonymizedReport.Reason)
+	s.Empty(anonymizedReport.Details)
+	s.NotEqual(user.ID, anonymizedReport.ReporterID)
+
+	// The history is kept, without the erased data
+	for _, id := range []uuid.UUID{user.ID, feedback.ID, report.ID} {
+		for _, entry := range s.auditLog("resourceId=" + id.String()) {
+			if entry.Action != AuditActionErase {
+				s.NotContains(string(entry.Before)+string(entry.After), "Sam", entry)
+			}
+		}
+	}
+	// The actors are redacted too, whether the player was authenticated or only claimed to be them
+	s.Empty(s.auditLog("actor=user:" + user.ID.String()))
+	s.Empty(s.auditLog("actor=claimed-user:" + user.ID.String()))
+	s.Len(s.auditLog("actor=user:erased"), 1)
+	s.Len(s.auditLog("actor=claimed-user:erased"), 1)
+	entries := s.auditLog("action=" + AuditActionErase)
+	s.Require().Len(entries, 1)
+	s.Equal(user.ID.String(), entries[0].ResourceID)
+	s.Empty(entries[0].Before)
+	s.Contains(string(entries[0].After), ErasurePolicyAnonymize)
+	var event OutboxEvent
+	s.Require().NoError(s.db.Where("aggregate_id = ? AND event = ?", feedback.ID, EventFeedbackCreated).Find(&event).Error)
+	s.Equal(erasedData, event.Payload)
+
+	// Erasing again changes nothing, whatever the policy
+	again, message := s.eraseUser(user, gin.H{"policy": ErasurePolicyDelete})
+	s.Equal("User was already erased", message)
+	s.Equal(erasure.ID, again.ID)
+	s.Equal(ErasurePolicyAnonymize, again.Policy)
+	s.Len(s.auditLog("action="+AuditActionErase), 1)
+	var count int64
+	s.Require().NoError(s.db.Model(&SessionFeedback{}).Where("id = ?", feedback.ID).Count(&count).Error)
+	s.Equal(int64(1), count)
+
+	s.Equal(http.StatusOK, s.request("GET", path, nil, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusGone, s.request("GET", "/users/"+user.ID.String(), nil).Code)
+	s.Equal(http.StatusGone, s.request("GET", "/users/"+user.ID.String()+"/export", nil, APIKeyHeader, testOpsAPIKey).Code)
+}
+
+// TestUserErasureDelete ensures the delete policy removes the feedback with everything attached to it, and gives up the
+// webhook deliveries carrying it
+func (s *RouteTestSuite) TestUserErasureDelete() {
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+	webhook, _ := s.createWebhook(gin.H{"url": receiver.URL, "events": []string{EventFeedbackCreated}})
+	user, feedback, report := s.playerData()
+	s.createFeedback(s.createSession(), s.createUser(), 5, "")
+	s.publishEvents(newWebhookSink(s.db))
+	s.Require().Len(s.webhookDeliveries(webhook, "?status="+WebhookDeliveryPending), 3)
+	s.Equal(http.StatusOK, s.request("POST", "/feedback/"+feedback.ID.String()+"/reports", gin.H{"reason": ReportReasonOffTopic}, UserTokenHeader, s.userToken(s.createUser())).Code)
+
+	var response FeedbackResponse
+	s.Require().NoError(s.db.Where("session_feedback_id = ?", feedback.ID).First(&response).Error)
+
+	erasure, _ := s.eraseUser(user, gin.H{"policy": ErasurePolicyDelete})
+	s.Equal(ErasurePolicyDelete, erasure.Policy)
+	count := func(model interface{}, query string, args ...interface{}) int64 {
+		var count int64
+		s.Require().NoError(s.db.Model(model).Where(query, args...).Count(&count).Error)
+		return count
+	}
+	s.Equal(int64(0), count(&User{}, "id = ?", user.ID))
+	s.Equal(int64(0), count(&SessionFeedback{}, "id = ?", feedback.ID))
+	s.Equal(int64(2), count(&SessionFeedback{}, "1 = 1"))
+	for _, model := range []interface{}{&FeedbackAnswer{}, &FeedbackTag{}, &FeedbackResponse{}, &FeedbackReport{}} {
+		s.Equal(int64(0), count(model, "session_feedback_id = ?", feedback.ID), model)
+	}
+	s.Equal(int64(0), count(&FeedbackReport{}, "id = ?", report.ID))
+
+	failed := s.webhookDeliveries(webhook, "?status="+WebhookDeliveryFailed)
+	s.Require().Len(failed, 1)
+	s.Equal("User data was erased", failed[0].LastError)
+	s.Len(s.webhookDeliveries(webhook, "?status="+WebhookDeliveryPending), 2)
+
+	// Every deleted record is audited and the deleted feedback is announced, without the erased data
+	for resourceType, id := range map[string]uuid.UUID{AuditResourceSessionFeedback: feedback.ID, AuditResourceFeedbackResponse: response.ID, AuditResourceFeedbackReport: report.ID} {
+		entries := s.auditLog("action=" + AuditActionDelete + "&resourceId=" + id.String())
+		s.Require().Len(entries, 1, resourceType)
+		s.Equal(resourceType, entries[0].ResourceType)
+		s.Equal(erasedData, string(entries[0].Before))
+		s.Empty(entries[0].After)
+	}
+	s.Len(s.auditLog("action="+AuditActionDelete+"&resourceType="+AuditResourceFeedbackReport), 2)
+	var event OutboxEvent
+	s.Require().NoError(s.db.Where("aggregate_id = ? AND event = ?", feedback.ID, EventFeedbackDeleted).Find(&event).Error)
+	s.Contains(event.Payload, feedback.ID.String())
+	s.Contains(event.Payload, feedback.SessionID.String())
+	s.NotContains(event.Payload, "Sam")
+	s.NotContains(event.Payload, user.ID.String())
+}
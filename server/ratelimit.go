@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// Identity classes rate limits are configured for
+const (
+	// RateLimitClassOps limits requests made with an ops API key, per key
+	RateLimitClassOps = "ops"
+	// RateLimitClassUser limits requests made by a player authenticated by their user token, per player
+	RateLimitClassUser = "user"
+	// RateLimitClassIP limits every request without an ops API key, per client IP
+	RateLimitClassIP = "ip"
+)
+
+// RateLimit allows Requests requests per Period - tokens are refilled continuously, and up to Requests can be used at once
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// RateLimitStatus is the state of a token bucket after taking a token from it
+type RateLimitStatus struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Time until the bucket is full again
+	Reset time.Duration
+	// Time until the next request is allowed (0 when the request was allowed)
+	RetryAfter time.Duration
+}
+
+// RateLimitStore keeps the token buckets of the rate limiter - the in-memory store only limits a single instance, so
+// deployments running several instances can plug in a shared store instead
+type RateLimitStore interface {
+	// Take takes a token from the bucket with the given key, creating a full bucket if there is none
+	Take(ctx context.Context, key string, limit RateLimit) (RateLimitStatus, error)
+}
+
+// memoryStoreSweepInterval is the number of Take calls between sweeps of the buckets that are full again
+const memoryStoreSweepInterval = 1000
+
+// MemoryRateLimitStore keeps token buckets in memory
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// tokenBucket is the state of a single bucket
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+	limit   RateLimit
+}
+
+// NewMemoryRateLimitStore creates an empty MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: map[string]*tokenBucket{}, now: time.Now}
+}
+
+// Take implements RateLimitStore
+func (s *MemoryRateLimitStore) Take(ctx context.Context, key string, limit RateLimit) (RateLimitStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	s.sweep(now)
+
+	capacity := float64(limit.Requests)
+	// Tokens refilled per nanosecond
+	rate := capacity / float64(limit.Period)
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: capacity, updated: now, limit: limit}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(capacity, bucket.tokens+float64(now.Sub(bucket.updated))*rate)
+	bucket.updated = now
+
+	status := RateLimitStatus{Limit: limit.Requests}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		status.Allowed = true
+	} else {
+		status.RetryAfter = time.Duration((1 - bucket.tokens) / rate)
+	}
+	status.Remaining = int(bucket.tokens)
+	status.Reset = time.Duration((capacity - bucket.tokens) / rate)
+	return status, nil
+}
+
+// sweep forgets the buckets that have been refilled completely (they are recreated full when needed) - the caller
+// must hold the lock
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	if s.calls++; s.calls%memoryStoreSweepInterval != 0 {
+		return
+	}
+	for key, bucket := range s.buckets {
+		if now.Sub(bucket.updated) >= bucket.limit.Period {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// rateLimitRule limits the requests of an identity class to a route (method and path may be * to match any)
+type rateLimitRule struct {
+	class  string
+	method string
+	path   string
+	limit  RateLimit
+}
+
+// parseRateLimitRule parses a rule of the form "<CLASS> <METHOD> <PATH> <REQUESTS>/<PERIOD>", e.g.
+// "ip POST /users/create 10/1m" - the path is the route as registered (e.g., /ops/feedback/:id/moderation)
+func parseRateLimitRule(raw string) (rateLimitRule, error) {
+	fields := strings.Fields(raw)
+	if len(fields) != 4 {
+		return rateLimitRule{}, fmt.Errorf("rule %q must be in the form \"<class> <method> <path> <requests>/<period>\"", raw)
+	}
+	rule := rateLimitRule{class: fields[0], method: strings.ToUpper(fields[1]), path: fields[2]}
+	switch rule.class {
+	case RateLimitClassOps, RateLimitClassUser, RateLimitClassIP:
+	default:
+		return rule, fmt.Errorf("rule %q: class must be one of ops, user or ip", raw)
+	}
+	if rule.path != "*" && !strings.HasPrefix(rule.path, "/") {
+		return rule, fmt.Errorf("rule %q: path must start with / (or be *)", raw)
+	}
+	parts := strings.SplitN(fields[3], "/", 2)
+	if len(parts) != 2 {
+		return rule, fmt.Errorf("rule %q: limit must be in the form <requests>/<period>, e.g. 10/1m", raw)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 1 {
+		return rule, fmt.Errorf("rule %q: requests must be a positive number", raw)
+	}
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return rule, fmt.Errorf("rule %q: period must be a positive duration, e.g. 1m", raw)
+	}
+	rule.limit = RateLimit{Requests: requests, Period: period}
+	return rule, nil
+}
+
+// matches checks if the rule applies to the given class and route
+func (r rateLimitRule) matches(class string, method string, path string) bool {
+	return r.class == class && (r.method == "*" || r.method == method) && (r.path == "*" || r.path == path)
+}
+
+// specificity ranks matching rules - an exact path beats an exact method, which beats wildcards
+func (r rateLimitRule) specificity() int {
+	specificity := 0
+	if r.path != "*" {
+		specificity += 2
+	}
+	if r.method != "*" {
+		specificity++
+	}
+	return specificity
+}
+
+// key is the bucket key of the rule for the given identity - routes matched by a wildcard rule share its bucket
+func (r rateLimitRule) key(id string) string {
+	return r.class + ":" + id + ":" + r.method + " " + r.path
+}
+
+// rateLimiter limits requests according to the configured rules
+type rateLimiter struct {
+	rules []rateLimitRule
+	store RateLimitStore
+}
+
+// newRateLimiter parses the configured rules
+func newRateLimiter(cfg RateLimitConfig, store RateLimitStore) (*rateLimiter, error) {
+	limiter := &rateLimiter{store: store}
+	for _, raw := range cfg.Rules {
+		rule, err := parseRateLimitRule(raw)
+		if err != nil {
+			return nil, err
+		}
+		limiter.rules = append(limiter.rules, rule)
+	}
+	return limiter, nil
+}
+
+// rule finds the most specific rule for the given class and route (nil if the route isn't limited for the class)
+func (l *rateLimiter) rule(class string, method string, path string) *rateLimitRule {
+	var best *rateLimitRule
+	for i, rule := range l.rules {
+		if rule.matches(class, method, path) && (best == nil || rule.specificity() > best.specificity()) {
+			best = &l.rules[i]
+		}
+	}
+	return best
+}
+
+// rateLimitIdentities lists the class and ID of every identity the request is limited as - requests with an ops API key
+// are only limited per key, while other requests are always limited per IP and also per player when they are
+// authenticated by a user token (the X-User-ID header is ignored, as anyone could use it to drain a player's bucket)
+func rateLimitIdentities(c *gin.Context) [][2]string {
+	if identity := GetIdentity(c); identity != nil && identity.Role == RoleOps {
+		return [][2]string{{RateLimitClassOps, identity.Name}}
+	}
+	identities := [][2]string{{RateLimitClassIP, c.ClientIP()}}
+	if userID := authenticatedUserID(c); userID != uuid.Nil {
+		identities = append(identities, [2]string{RateLimitClassUser, userID.String()})
+	}
+	return identities
+}
+
+// rateLimit middleware - takes a token from every bucket the request is limited by, rejecting the request with a 429
+// when one of them is empty
+//
+// The RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset (seconds) headers describe the most restrictive bucket.
+// Store errors are logged and the request is allowed, so that an unavailable store doesn't take the service down.
+func rateLimit(limiter *rateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := c.FullPath()
+		if route == "" {
+			return
+		}
+		var strictest *RateLimitStatus
+		for _, identity := range rateLimitIdentities(c) {
+			rule := limiter.rule(identity[0], c.Request.Method, route)
+			if rule == nil {
+				continue
+			}
+			status, err := limiter.store.Take(c.Request.Context(), rule.key(identity[1]), rule.limit)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err.Error(), "class": identity[0]}).Error("Failed to check the rate limit")
+				continue
+			}
+			if strictest == nil || (strictest.Allowed && (!status.Allowed || status.Remaining < strictest.Remaining)) {
+				strictest = &status
+			}
+		}
+		if strictest == nil {
+			return
+		}
+		c.Header("RateLimit-Limit", strconv.Itoa(strictest.Limit))
+		c.Header("RateLimit-Remaining", strconv.Itoa(strictest.Remaining))
+		c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(strictest.Reset)))
+		if !strictest.Allowed {
+			retryAfter := ceilSeconds(strictest.RetryAfter)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": fmt.Sprintf("Too many requests - retry in %d seconds", retryAfter)})
+		}
+	}
+}
+
+// ceilSeconds rounds a duration up to whole seconds
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// adds the rate limiting middleware - it needs the caller's identity, so it must be added after the auth middlewares
+// (including the user auth middleware)
+func addRateLimitMiddleware(r *gin.Engine, limiter *rateLimiter) {
+	r.Use(rateLimit(limiter))
+}
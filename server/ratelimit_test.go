@@ -0,0 +1,146 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestMemoryRateLimitStore ensures tokens are taken and refilled continuously
+func TestMemoryRateLimitStore(t *testing.T) {
+	now := time.Now()
+	store := NewMemoryRateLimitStore()
+	store.now = func() time.Time { return now }
+	limit := RateLimit{Requests: 2, Period: time.Minute}
+
+	status, err := store.Take(context.Background(), "a", limit)
+	assert.NoError(t, err)
+	assert.Equal(t, RateLimitStatus{Allowed: true, Limit: 2, Remaining: 1, Reset: 30 * time.Second}, status)
+	status, _ = store.Take(context.Background(), "a", limit)
+	assert.True(t, status.Allowed)
+	assert.Equal(t, 0, status.Remaining)
+	status, _ = store.Take(context.Background(), "a", limit)
+	assert.False(t, status.Allowed)
+	assert.Equal(t, 30*time.Second, status.RetryAfter)
+	assert.Equal(t, time.Minute, status.Reset)
+
+	// Other keys have their own bucket
+	status, _ = store.Take(context.Background(), "b", limit)
+	assert.True(t, status.Allowed)
+
+	now = now.Add(30 * time.Second)
+	status, _ = store.Take(context.Background(), "a", limit)
+	assert.True(t, status.Allowed)
+	status, _ = store.Take(context.Background(), "a", limit)
+	assert.False(t, status.Allowed)
+}
+
+// TestParseRateLimitRule ensures malformed rules are rejected
+func TestParseRateLimitRule(t *testing.T) {
+	rule, err := parseRateLimitRule("user post /sessions/feedback/create 5/1m")
+	assert.NoError(t, err)
+	assert.Equal(t, rateLimitRule{class: RateLimitClassUser, method: "POST", path: "/sessions/feedback/create", limit: RateLimit{Requests: 5, Period: time.Minute}}, rule)
+	for _, invalid := range []string{
+		"ip POST /users/create",
+		"admin POST /users/create 5/1m",
+		"ip POST users/create 5/1m",
+		"ip POST /users/create 5",
+		"ip POST /users/create 0/1m",
+		"ip POST /users/create 5/soon",
+	} {
+		_, err := parseRateLimitRule(invalid)
+		assert.Error(t, err, invalid)
+	}
+	_, err = LoadConfig([]string{"-rate_limit.rules", "ip * * 10"})
+	assert.Error(t, err)
+}
+
+// TestRateLimit ensures requests are limited per player and per IP, while ops are only limited by their own rules
+func (s *RouteTestSuite) TestRateLimit() {
+	session := s.createSession()
+	user := s.createUser()
+	token := s.userToken(user)
+	feedback := gin.H{"sessionId": session.ID, "userId": user.ID, "rating": 0}
+	// X-User-ID can be set by anyone, so it doesn't take from the player's bucket
+	for i := 0; i < 6; i++ {
+		w := s.request("POST", "/sessions/feedback/create", feedback, UserIDHeader, user.ID.String())
+		s.Equal(http.StatusBadRequest, w.Code)
+		s.Equal("30", w.Header().Get("RateLimit-Limit"))
+	}
+	for i := 0; i < 5; i++ {
+		w := s.request("POST", "/sessions/feedback/create", feedback, UserTokenHeader, token)
+		s.Equal(http.StatusBadRequest, w.Code)
+		s.Equal("5", w.Header().Get("RateLimit-Limit"))
+		s.Equal(strconv.Itoa(4-i), w.Header().Get("RateLimit-Remaining"))
+	}
+	w := s.request("POST", "/sessions/feedback/create", feedback, UserTokenHeader, token)
+	s.Equal(http.StatusTooManyRequests, w.Code)
+	s.Equal("12", w.Header().Get("Retry-After"))
+	s.Equal("60", w.Header().Get("RateLimit-Reset"))
+	var response gin.H
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Equal("Too many requests - retry in 12 seconds", response["error"])
+	// Other players (and requests without a player) are only limited by the IP limit
+	w = s.request("POST", "/sessions/feedback/create", feedback, UserTokenHeader, s.userToken(s.createUser()))
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Equal("4", w.Header().Get("RateLimit-Remaining"))
+	w = s.request("POST", "/sessions/feedback/create", feedback)
+	s.Equal(http.StatusBadRequest, w.Code)
+	s.Equal("30", w.Header().Get("RateLimit-Limit"))
+
+	// The IP limit of /users/create (two users were created above)
+	for i := 0; i < 18; i++ {
+		s.createUser()
+	}
+	s.Equal(http.StatusTooManyRequests, s.request("POST", "/users/create", nil).Code)
+	w = s.request("POST", "/users/create", nil, APIKeyHeader, testOpsAPIKey)
+	s.Equal(200, w.Code)
+	s.Empty(w.Header().Get("RateLimit-Limit"))
+	// Routes without their own rule share the wildcard limit
+	w = s.request("GET", "/sessions", nil)
+	s.Equal("600", w.Header().Get("RateLimit-Limit"))
+}
+
+// TestRateLimitForwardedFor ensures clients can't reset their IP limit (or change the IP they are audited as) by sending
+// an X-Forwarded-For header
+func (s *RouteTestSuite) TestRateLimitForwardedFor() {
+	send := func(i int) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "/users/create", nil)
+		s.Require().NoError(err)
+		req.RemoteAddr = "203.0.113.7:4000"
+		req.Header.Set("X-Forwarded-For", "198.51.100."+strconv.Itoa(i))
+		w := httptest.NewRecorder()
+		s.router.ServeHTTP(w, req)
+		return w
+	}
+	for i := 0; i < 20; i++ {
+		s.Require().Equal(http.StatusOK, send(i).Code)
+	}
+	s.Equal(http.StatusTooManyRequests, send(20).Code)
+	for _, entry := range s.auditLog("resourceType=" + AuditResourceUser) {
+		s.Equal("203.0.113.7", entry.IP)
+	}
+}
+
+// TestTrustedProxies ensures the client IP is only taken from the X-Forwarded-For header of trusted proxies
+func TestTrustedProxies(t *testing.T) {
+	r := gin.New()
+	assert.NoError(t, setTrustedProxies(r, []string{"10.0.0.0/8"}))
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+	for remoteAddr, ip := range map[string]string{"10.1.2.3:4000": "198.51.100.1", "203.0.113.7:4000": "203.0.113.7"} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("X-Forwarded-For", "198.51.100.1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		assert.Equal(t, ip, w.Body.String(), remoteAddr)
+	}
+	assert.Error(t, setTrustedProxies(r, []string{"proxy"}))
+}
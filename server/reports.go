@@ -0,0 +1,222 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Reasons a player can give when reporting feedback
+const (
+	ReportReasonSpam       = "spam"
+	ReportReasonHarassment = "harassment"
+	ReportReasonHateSpeech = "hate_speech"
+	ReportReasonCheating   = "cheating"
+	ReportReasonOffTopic   = "off_topic"
+	ReportReasonOther      = "other"
+)
+
+// reportReasonIsValid checks if the given value is one of the report reasons
+func reportReasonIsValid(reason string) bool {
+	switch reason {
+	case ReportReasonSpam, ReportReasonHarassment, ReportReasonHateSpeech, ReportReasonCheating, ReportReasonOffTopic, ReportReasonOther:
+		return true
+	}
+	return false
+}
+
+// FeedbackReport database model representing a player's report of abusive SessionFeedback - each player can report a given feedback once
+type FeedbackReport struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	CustomModel
+	// FK
+	SessionFeedbackID uuid.UUID `gorm:"uniqueIndex:idx_feedback_reports_reporter" json:"sessionFeedbackId"`
+	// FK - the User who reported the feedback
+	ReporterID uuid.UUID `gorm:"uniqueIndex:idx_feedback_reports_reporter" json:"reporterId"`
+	// One of spam, harassment, hate_speech, cheating, off_topic or other
+	Reason string `gorm:"not null" json:"reason"`
+	// Optional free-text explanation from the reporter
+	Details string `json:"details"`
+}
+
+// CreateFeedbackReportInput represents the fields expected when the feedback report endpoint is hit with a POST request
+type CreateFeedbackReportInput struct {
+	Reason  string `json:"reason"`
+	Details string `json:"details"`
+}
+
+// CreateFeedbackReport handles POST /feedback/:id/reports - records the report of the player authenticated by the user
+// token and hides the feedback once it has been reported by moderation.report_threshold different players
+func CreateFeedbackReport(c *gin.Context) {
+	// The reporter is the authenticated player - players can't report on behalf of others
+	reporterID := authenticatedUserID(c)
+	if reporterID == uuid.Nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "A user token is required to report feedback"})
+		return
+	}
+	var input CreateFeedbackReportInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !reportReasonIsValid(input.Reason) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "reason must be one of spam, harassment, hate_speech, cheating, off_topic or other"})
+		return
+	}
+	feedbackID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SessionFeedback ID"})
+		return
+	}
+
+	// Players can only report feedback they are able to see
+	var sessionFeedback SessionFeedback
+	if err := GetDB(c).Scopes(visibleFeedback(c)).Where("id = ?", feedbackID).Find(&sessionFeedback).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if sessionFeedback.ID == uuid.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "SessionFeedback does not exist"})
+		return
+	}
+
+	threshold := GetConfig(c).Moderation.ReportThreshold
+	report := FeedbackReport{
+		ID:                uuid.NewV4(),
+		SessionFeedbackID: sessionFeedback.ID,
+		ReporterID:        reporterID,
+		Reason:            input.Reason,
+		Details:           input.Details,
+	}
+	duplicate := false
+	err = GetDB(c).Transaction(func(tx *gorm.DB) error {
+		var existing int64
+		if err := tx.Model(&FeedbackReport{}).Where("session_feedback_id = ? AND reporter_id = ?", report.SessionFeedbackID, report.ReporterID).Count(&existing).Error; err != nil {
+			return err
+		}
+		if existing > 0 {
+			duplicate = true
+			return nil
+		}
+		if err := tx.Create(&report).Error; err != nil {
+			return err
+		}
+		if err := recordAudit(tx, c, AuditActionCreate, AuditResourceFeedbackReport, report.ID, nil, &report); err != nil {
+			return err
+		}
+		var reports int64
+		if err := tx.Model(&FeedbackReport{}).Where("session_feedback_id = ?", report.SessionFeedbackID).Count(&reports).Error; err != nil {
+			return err
+		}
+		if threshold <= 0 || reports < int64(threshold) {
+			return nil
+		}
+		// The feedback is read again, and only hidden if it wasn't updated since, so that a moderation decision made by
+		// the ops team in the meantime (e.g., approving it despite the reports) isn't overwritten
+		var current SessionFeedback
+		if err := tx.Where("id = ?", sessionFeedback.ID).Find(&current).Error; err != nil {
+			return err
+		}
+		if current.ModerationStatus != ModerationApproved {
+			return nil
+		}
+		before := current
+		current.ModerationStatus = ModerationHidden
+		current.ModerationReason = fmt.Sprintf("Hidden automatically after %d player reports", reports)
+		result := tx.Model(&current).Where("updated_at = ?", before.UpdatedAt).
+			Select("moderation_status", "moderation_reason", "updated_at").Updates(&current)
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return recordAudit(tx, c, AuditActionUpdate, AuditResourceSessionFeedback, current.ID, &before, &current)
+	})
+	// A concurrent report by the same player passes the check above, but not the unique index
+	if isUniqueViolation(err) {
+		duplicate = true
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if duplicate {
+		c.JSON(http.StatusConflict, gin.H{"success": false, "message": "This user has already reported this feedback"})
+		return
+	}
+	GetListCache(c).Invalidate()
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Thank you for your report!", "report": &report})
+}
+
+// ReportedFeedback summarizes the reports left for a single SessionFeedback record
+type ReportedFeedback struct {
+	SessionFeedback SessionFeedback `json:"sessionFeedback"`
+	ReportCount     int64           `json:"reportCount"`
+	// Number of reports per reason
+	Reasons        map[string]int64 `json:"reasons"`
+	LastReportedAt time.Time        `json:"lastReportedAt"`
+}
+
+// getReportedFeedback handles GET /ops/reports - lists reported feedback with report counts, most reported first
+func getReportedFeedback(c *gin.Context) {
+	type reasonCount struct {
+		SessionFeedbackID uuid.UUID
+		Reason            string
+		Count             int64
+		LastReportedAt    string
+	}
+	var counts []reasonCount
+	// SELECT session_feedback_id, reason, count(*), max(created_at) FROM feedback_reports GROUP BY session_feedback_id, reason
+	err := GetDB(c).Model(&FeedbackReport{}).
+		Select("session_feedback_id, reason, count(*) AS count, max(created_at) AS last_reported_at").
+		Group("session_feedback_id, reason").
+		Scan(&counts).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	summaries := map[uuid.UUID]*ReportedFeedback{}
+	var ids []string
+	for _, count := range counts {
+		summary, ok := summaries[count.SessionFeedbackID]
+		if !ok {
+			summary = &ReportedFeedback{Reasons: map[string]int64{}}
+			summaries[count.SessionFeedbackID] = summary
+			ids = append(ids, count.SessionFeedbackID.String())
+		}
+		summary.ReportCount += count.Count
+		summary.Reasons[count.Reason] = count.Count
+		if lastReportedAt, err := parseSQLiteTime(count.LastReportedAt); err == nil && lastReportedAt.After(summary.LastReportedAt) {
+			summary.LastReportedAt = lastReportedAt
+		}
+	}
+
+	var records []SessionFeedback
+	if len(ids) > 0 {
+		if err := GetDB(c).Where("id IN ?", ids).Find(&records).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	reported := make([]ReportedFeedback, 0, len(records))
+	for _, record := range records {
+		summary := summaries[record.ID]
+		summary.SessionFeedback = record
+		reported = append(reported, *summary)
+	}
+	sortReportedFeedback(reported)
+	c.JSON(http.StatusOK, gin.H{"reported": reported})
+}
+
+// sortReportedFeedback orders reported feedback by report count (descending), then by the most recent report
+func sortReportedFeedback(reported []ReportedFeedback) {
+	sort.Slice(reported, func(i, j int) bool {
+		if reported[i].ReportCount != reported[j].ReportCount {
+			return reported[i].ReportCount > reported[j].ReportCount
+		}
+		return reported[i].LastReportedAt.After(reported[j].LastReportedAt)
+	})
+}
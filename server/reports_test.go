@@ -0,0 +1,113 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+type GetReportedFeedbackJSON struct {
+	Reported []ReportedFeedback `json:"reported"`
+}
+
+// TestReportFeedback ensures reports are validated, de-duplicated per reporter and hide feedback once the threshold is reached
+func (s *RouteTestSuite) TestReportFeedback() {
+	session := s.createSession()
+	feedback := s.createFeedback(session, s.createUser(), 1, "You all are bad at this game")
+	path := "/feedback/" + feedback.ID.String() + "/reports"
+
+	// Reporters are the players authenticated by their user token, whatever the body says
+	reporter := s.createUser()
+	s.Equal(http.StatusUnauthorized, s.request("POST", path, gin.H{"reporterId": reporter.ID, "reason": ReportReasonSpam}).Code)
+	s.Equal(http.StatusUnauthorized, s.request("POST", path, gin.H{"reason": ReportReasonSpam}, UserTokenHeader, "forged").Code)
+	token := s.userToken(reporter)
+	s.Equal(http.StatusBadRequest, s.request("POST", path, gin.H{"reason": "boring"}, UserTokenHeader, token).Code)
+	s.Equal(http.StatusNotFound, s.request("POST", "/feedback/"+session.ID.String()+"/reports", gin.H{"reason": ReportReasonSpam}, UserTokenHeader, token).Code)
+
+	w := s.request("POST", path, gin.H{"reporterId": s.createUser().ID, "reason": ReportReasonHarassment}, UserTokenHeader, token)
+	s.Require().Equal(200, w.Code)
+	s.Contains(w.Body.String(), reporter.ID.String())
+	s.Equal(http.StatusConflict, s.request("POST", path, gin.H{"reason": ReportReasonSpam}, UserTokenHeader, token).Code)
+	s.Equal(200, s.request("POST", path, gin.H{"reason": ReportReasonHarassment}, UserTokenHeader, s.userToken(s.createUser())).Code)
+
+	// Still visible below the threshold (3 reports in the mock config)
+	var feedbackResponse GetFeedbackJSON
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &feedbackResponse))
+	s.Len(feedbackResponse.Feedback, 1)
+
+	s.Equal(200, s.request("POST", path, gin.H{"reason": ReportReasonSpam, "details": "Not about the game"}, UserTokenHeader, s.userToken(s.createUser())).Code)
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &feedbackResponse))
+	s.Len(feedbackResponse.Feedback, 0)
+
+	// Hidden feedback can no longer be reported by players
+	s.Equal(http.StatusNotFound, s.request("POST", path, gin.H{"reason": ReportReasonSpam}, UserTokenHeader, s.userToken(s.createUser())).Code)
+}
+
+// TestReportUniqueViolation ensures a report that slips past the duplicate check is still rejected as a duplicate
+func TestReportUniqueViolation(t *testing.T) {
+	db := initMockDB()
+	report := FeedbackReport{ID: uuid.NewV4(), SessionFeedbackID: uuid.NewV4(), ReporterID: uuid.NewV4(), Reason: ReportReasonSpam}
+	assert.NoError(t, db.Create(&report).Error)
+	report.ID = uuid.NewV4()
+	err := db.Create(&report).Error
+	assert.Error(t, err)
+	assert.True(t, isUniqueViolation(err))
+	assert.False(t, isUniqueViolation(nil))
+}
+
+// TestReportAutoHideKeepsModeration ensures a report reaching the threshold doesn't overwrite a moderation decision made
+// after the reported feedback was read
+func (s *RouteTestSuite) TestReportAutoHideKeepsModeration() {
+	feedback := s.createFeedback(s.createSession(), s.createUser(), 1, "awful")
+	path := "/feedback/" + feedback.ID.String() + "/reports"
+	for i := 0; i < 2; i++ {
+		s.Require().Equal(200, s.request("POST", path, gin.H{"reason": ReportReasonSpam}, UserTokenHeader, s.userToken(s.createUser())).Code)
+	}
+	// The ops team rejects the feedback while the third report is being recorded
+	s.Require().NoError(s.db.Callback().Create().After("gorm:create").Register("test:moderate", func(tx *gorm.DB) {
+		if tx.Statement.Table == "feedback_reports" {
+			tx.Session(&gorm.Session{}).Model(&SessionFeedback{}).Where("id = ?", feedback.ID).
+				Updates(map[string]interface{}{"moderation_status": ModerationRejected, "moderation_reason": "Reviewed"})
+		}
+	}))
+	defer s.db.Callback().Create().Remove("test:moderate")
+	token := s.userToken(s.createUser())
+	s.Require().Equal(200, s.request("POST", path, gin.H{"reason": ReportReasonSpam}, UserTokenHeader, token).Code)
+
+	var moderated SessionFeedback
+	s.Require().NoError(s.db.Where("id = ?", feedback.ID).Find(&moderated).Error)
+	s.Equal(ModerationRejected, moderated.ModerationStatus)
+	s.Equal("Reviewed", moderated.ModerationReason)
+}
+
+// TestReportedFeedbackList ensures ops can list reported feedback with counts, most reported first
+func (s *RouteTestSuite) TestReportedFeedbackList() {
+	session := s.createSession()
+	once := s.createFeedback(session, s.createUser(), 2, "meh")
+	twice := s.createFeedback(session, s.createUser(), 1, "awful")
+	s.createFeedback(session, s.createUser(), 5, "great")
+
+	s.Equal(200, s.request("POST", "/feedback/"+once.ID.String()+"/reports", gin.H{"reason": ReportReasonOffTopic}, UserTokenHeader, s.userToken(s.createUser())).Code)
+	s.Equal(200, s.request("POST", "/feedback/"+twice.ID.String()+"/reports", gin.H{"reason": ReportReasonSpam}, UserTokenHeader, s.userToken(s.createUser())).Code)
+	s.Equal(200, s.request("POST", "/feedback/"+twice.ID.String()+"/reports", gin.H{"reason": ReportReasonHarassment}, UserTokenHeader, s.userToken(s.createUser())).Code)
+
+	s.Equal(http.StatusUnauthorized, s.request("GET", "/ops/reports", nil).Code)
+	w := s.request("GET", "/ops/reports", nil, APIKeyHeader, testOpsAPIKey)
+	s.Equal(200, w.Code)
+	var response GetReportedFeedbackJSON
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Require().Len(response.Reported, 2)
+	s.Equal(twice.ID, response.Reported[0].SessionFeedback.ID)
+	s.Equal(int64(2), response.Reported[0].ReportCount)
+	s.Equal(map[string]int64{ReportReasonSpam: 1, ReportReasonHarassment: 1}, response.Reported[0].Reasons)
+	s.False(response.Reported[0].LastReportedAt.IsZero())
+	s.Equal(once.ID, response.Reported[1].SessionFeedback.ID)
+	s.Equal(int64(1), response.Reported[1].ReportCount)
+}
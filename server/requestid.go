@@ -0,0 +1,45 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ContextKeyRequestID is the key name for the ID of the request within the Gin context
+const ContextKeyRequestID = "requestID"
+
+// RequestIDHeader carries the ID of a request - sent by the client (e.g., a proxy) or generated, and echoed in the response
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength is the longest request ID accepted from a client
+const maxRequestIDLength = 128
+
+// requestIDIsValid checks that a request ID sent by a client is short and printable, so it can be logged and stored as is
+func requestIDIsValid(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		if r <= ' ' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// GetRequestID retrieves the ID of the request ("" outside of requests)
+func GetRequestID(c *gin.Context) string {
+	return c.GetString(ContextKeyRequestID)
+}
+
+// adds the request ID middleware - every request gets an ID, which is echoed in the X-Request-ID response header
+func addRequestIDMiddleware(r *gin.Engine) {
+	r.Use(func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !requestIDIsValid(id) {
+			id = uuid.NewV4().String()
+		}
+		c.Set(ContextKeyRequestID, id)
+		c.Header(RequestIDHeader, id)
+	})
+}
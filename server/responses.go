@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Visibility of a FeedbackResponse
+const (
+	// ResponseVisibilityPublic responses are embedded in every read of the feedback
+	ResponseVisibilityPublic = "public"
+	// ResponseVisibilityPrivate responses are only visible to ops and the player who left the feedback
+	ResponseVisibilityPrivate = "private"
+)
+
+// FeedbackResponse database model representing a reply from an ops team member to a SessionFeedback record
+type FeedbackResponse struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	CustomModel
+	// FK
+	SessionFeedbackID uuid.UUID `gorm:"index" json:"sessionFeedbackId"`
+	// Name of the ops API key used to post the reply
+	Author string `gorm:"not null" json:"author"`
+	Body   string `gorm:"not null" json:"body"`
+	// Either public or private
+	Visibility string `gorm:"not null;default:public" json:"visibility"`
+}
+
+// CreateFeedbackResponseInput represents the fields expected when the feedback response endpoint is hit with a POST request
+type CreateFeedbackResponseInput struct {
+	Body string `json:"body"`
+	// Either public or private (defaults to public)
+	Visibility string `json:"visibility"`
+}
+
+// visibleResponses is a preload condition limiting embedded FeedbackResponse records to what the caller may see - ops see
+// every response, everyone else only sees public responses
+func visibleResponses(c *gin.Context) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		if isOps(c) {
+			return db.Order("created_at")
+		}
+		return db.Where("visibility = ?", ResponseVisibilityPublic).Order("created_at")
+	}
+}
+
+// CreateFeedbackResponse handles POST /ops/feedback/:id/responses - posts a reply from an ops team member
+func CreateFeedbackResponse(c *gin.Context) {
+	var input CreateFeedbackResponseInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Visibility == "" {
+		input.Visibility = ResponseVisibilityPublic
+	}
+	if strings.TrimSpace(input.Body) == "" || (input.Visibility != ResponseVisibilityPublic && input.Visibility != ResponseVisibilityPrivate) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "body must be defined and visibility must be public or private"})
+		return
+	}
+	feedbackID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SessionFeedback ID"})
+		return
+	}
+	var sessionFeedback SessionFeedback
+	if err := GetDB(c).Where("id = ?", feedbackID).Find(&sessionFeedback).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if sessionFeedback.ID == uuid.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"success": false, "message": "SessionFeedback does not exist"})
+		return
+	}
+	response := FeedbackResponse{
+		ID:                uuid.NewV4(),
+		SessionFeedbackID: sessionFeedback.ID,
+		Author:            GetIdentity(c).Name,
+		Body:              input.Body,
+		Visibility:        input.Visibility,
+	}
+	// The feedback is touched too, as the responses are part of its representation (and so of its ETag)
+	err = GetDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&response).Error; err != nil {
+			return err
+		}
+		if err := recordAudit(tx, c, AuditActionCreate, AuditResourceFeedbackResponse, response.ID, nil, &response); err != nil {
+			return err
+		}
+		return tx.Model(&sessionFeedback).Update("updated_at", time.Now()).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	GetListCache(c).Invalidate()
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Response posted", "response": &response})
+}
+
+// getUserFeedbackResponses handles GET /users/:id/feedback/responses - lists the responses to the feedback left by the
+// given user, oldest first
+//
+// Private responses are only listed for the player themselves (authenticated by their user token) and ops - everyone
+// else only sees the public responses. Responses to feedback that isn't approved are only listed for ops.
+func getUserFeedbackResponses(c *gin.Context) {
+	userID, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User ID"})
+		return
+	}
+	var responses []FeedbackResponse
+	// SELECT feedback_responses.* FROM feedback_responses JOIN session_feedbacks ON ... WHERE session_feedbacks.user_id = ?
+	query := GetDB(c).
+		Joins("JOIN session_feedbacks ON session_feedbacks.id = feedback_responses.session_feedback_id").
+		Where("session_feedbacks.user_id = ?", userID)
+	if !isOps(c) {
+		// Like the feedback itself, responses to feedback held back by moderation are only listed for ops
+		query = query.Where("session_feedbacks.moderation_status = ?", ModerationApproved)
+		if authenticatedUserID(c) != userID {
+			query = query.Where("feedback_responses.visibility = ?", ResponseVisibilityPublic)
+		}
+	}
+	err = query.Order("feedback_responses.created_at").Find(&responses).Error
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"responses": &responses})
+}
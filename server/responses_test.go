@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type GetFeedbackResponsesJSON struct {
+	Responses []FeedbackResponse `json:"responses"`
+}
+
+// TestFeedbackResponses ensures ops replies are embedded in feedback reads according to their visibility
+func (s *RouteTestSuite) TestFeedbackResponses() {
+	session := s.createSession()
+	player := s.createUser()
+	feedback := s.createFeedback(session, player, 2, "Matchmaking put me against much better players")
+	other := s.createFeedback(session, s.createUser(), 4, "Fun")
+	path := "/ops/feedback/" + feedback.ID.String() + "/responses"
+
+	s.Equal(http.StatusUnauthorized, s.request("POST", path, gin.H{"body": "Thanks!"}).Code)
+	s.Equal(http.StatusBadRequest, s.request("POST", path, gin.H{"body": " "}, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusBadRequest, s.request("POST", path, gin.H{"body": "Thanks!", "visibility": "secret"}, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusNotFound, s.request("POST", "/ops/feedback/"+session.ID.String()+"/responses", gin.H{"body": "Thanks!"}, APIKeyHeader, testOpsAPIKey).Code)
+
+	w := s.request("POST", path, gin.H{"body": "We are tuning matchmaking in the next patch"}, APIKeyHeader, testOpsAPIKey)
+	s.Equal(200, w.Code)
+	s.Equal(200, s.request("POST", path, gin.H{"body": "Sent you a code for your trouble", "visibility": ResponseVisibilityPrivate}, APIKeyHeader, testOpsAPIKey).Code)
+
+	// Public reads only embed public responses
+	var feedbackResponse GetFeedbackJSON
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String(), nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &feedbackResponse))
+	s.Require().Len(feedbackResponse.Feedback, 2)
+	for _, record := range feedbackResponse.Feedback {
+		if record.ID == other.ID {
+			s.Empty(record.Responses)
+			continue
+		}
+		s.Require().Len(record.Responses, 1)
+		s.Equal("We are tuning matchmaking in the next patch", record.Responses[0].Body)
+		s.Equal("tester", record.Responses[0].Author)
+	}
+
+	// Ops reads embed every response
+	w = s.request("GET", "/sessions/feedback?sessionId="+session.ID.String()+"&rating=2", nil, APIKeyHeader, testOpsAPIKey)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &feedbackResponse))
+	s.Require().Len(feedbackResponse.Feedback, 1)
+	s.Len(feedbackResponse.Feedback[0].Responses, 2)
+
+	// The player (and ops) can list every response to their own feedback
+	path = "/users/" + player.ID.String() + "/feedback/responses"
+	var responses GetFeedbackResponsesJSON
+	for _, headers := range [][]string{{UserTokenHeader, s.userToken(player)}, {APIKeyHeader, testOpsAPIKey}} {
+		w = s.request("GET", path, nil, headers...)
+		s.Equal(200, w.Code)
+		s.NoError(json.Unmarshal(w.Body.Bytes(), &responses))
+		s.Require().Len(responses.Responses, 2)
+		s.Equal(ResponseVisibilityPublic, responses.Responses[0].Visibility)
+		s.Equal(ResponseVisibilityPrivate, responses.Responses[1].Visibility)
+	}
+
+	// Anyone else only sees the public responses
+	for _, headers := range [][]string{nil, {UserIDHeader, player.ID.String()}, {UserTokenHeader, s.userToken(s.createUser())}} {
+		w = s.request("GET", path, nil, headers...)
+		s.Equal(200, w.Code)
+		s.NoError(json.Unmarshal(w.Body.Bytes(), &responses))
+		s.Require().Len(responses.Responses, 1, headers)
+		s.Equal(ResponseVisibilityPublic, responses.Responses[0].Visibility)
+	}
+
+	w = s.request("GET", "/users/"+s.createUser().ID.String()+"/feedback/responses", nil)
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &responses))
+	s.Len(responses.Responses, 0)
+
+	// Once the feedback is hidden, its responses are only listed for ops
+	s.Require().NoError(s.db.Model(&SessionFeedback{}).Where("id = ?", feedback.ID).Update("moderation_status", ModerationHidden).Error)
+	for _, headers := range [][]string{nil, {UserTokenHeader, s.userToken(player)}, {APIKeyHeader, testOpsAPIKey}} {
+		w = s.request("GET", path, nil, headers...)
+		s.Equal(200, w.Code)
+		s.NoError(json.Unmarshal(w.Body.Bytes(), &responses))
+		if len(headers) > 0 && headers[0] == APIKeyHeader {
+			s.Len(responses.Responses, 2)
+		} else {
+			s.Empty(responses.Responses, headers)
+		}
+	}
+}
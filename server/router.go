@@ -1,6 +1,7 @@
 package server
 
 import (
+	"io"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -12,16 +13,12 @@ import (
 // ContextKeyDB is the key name for the database within the Gin context
 const ContextKeyDB = "db"
 
-// SetupRouter completes setup of the router, middleware, db middleware and routes and returns the default Engine instance
-func SetupRouter() *gin.Engine {
-	r := gin.Default()
-	addMiddleware(r)
-	addDatabaseMiddleware(r)
-	addRoutes(r)
-	return r
-}
+// ContextKeyConfig is the key name for the configuration within the Gin context
+const ContextKeyConfig = "config"
 
 // GetDB retrieves the database from the request context
+//
+// The returned DB carries the request's context.Context so that queries are traced as children of the request span.
 func GetDB(c *gin.Context) *gorm.DB {
 	value, ok := c.Get(ContextKeyDB)
 	if !ok {
@@ -31,7 +28,20 @@ func GetDB(c *gin.Context) *gorm.DB {
 	if !ok {
 		panic("database was not the correct type")
 	}
-	return db
+	return db.WithContext(c.Request.Context())
+}
+
+// GetConfig retrieves the configuration from the request context
+func GetConfig(c *gin.Context) *Config {
+	value, ok := c.Get(ContextKeyConfig)
+	if !ok {
+		panic("config not found in context")
+	}
+	cfg, ok := value.(*Config)
+	if !ok {
+		panic("config was not the correct type")
+	}
+	return cfg
 }
 
 // adds basic middleware
@@ -45,9 +55,31 @@ func addMiddleware(r *gin.Engine) {
 	r.Use(gin.Recovery())
 }
 
+// adds the configuration to the context, it can be retrieved in routes by using GetConfig
+func addConfigMiddleware(r *gin.Engine, cfg *Config) {
+	r.Use(func(c *gin.Context) {
+		c.Set(ContextKeyConfig, cfg)
+	})
+}
+
+// adds authentication middleware (callers are identified by their API key, if they send one)
+func addAuthMiddleware(r *gin.Engine, cfg AuthConfig) {
+	r.Use(authenticate(cfg))
+}
+
+// adds the user token authentication middleware - added after the database middleware, as tokens are looked up in the
+// database
+func addUserAuthMiddleware(r *gin.Engine) {
+	r.Use(authenticateUser())
+}
+
+// adds tracing middleware (a span is started for every request)
+func addTracingMiddleware(r *gin.Engine, tracer *Tracer) {
+	r.Use(Tracing(tracer))
+}
+
 // adds the database to the context, it can be retrieved in routes by using GetDB
-func addDatabaseMiddleware(r *gin.Engine) {
-	db := initDB()
+func addDatabaseMiddleware(r *gin.Engine, db *gorm.DB) {
 	// Add database to our context
 	r.Use(func(c *gin.Context) {
 		c.Set(ContextKeyDB, db)
@@ -97,6 +129,17 @@ func getAllUsers(c *gin.Context, records *[]User) {
 	GetDB(c).Find(&records)
 }
 
+// allRecordsNotModified handles conditional GETs of the unfiltered lists (see listNotModified) - reports true when it
+// responded (with a 304, or a 500 if the version couldn't be read) and the handler must return
+func allRecordsNotModified(c *gin.Context, model interface{}) bool {
+	version, err := queryListVersion(func() *gorm.DB { return GetDB(c).Model(model) })
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return true
+	}
+	return listNotModified(c, listETag(c, version, FormatJSON), version.LastModified)
+}
+
 // TODO: Make all endpoints support filtering (eventually)
 // getResources is a convenience method used to contain the logic (at a high level) for all GET endpoints
 func GetResources(c *gin.Context) {
@@ -104,15 +147,21 @@ func GetResources(c *gin.Context) {
 	var sessions []Session
 	switch c.FullPath() {
 	case "/sessions":
+		if allRecordsNotModified(c, &Session{}) {
+			return
+		}
 		getAllSessions(c, &sessions)
 		c.JSON(http.StatusOK, gin.H{"sessions": sessions})
 		return
 	case "/users":
+		if allRecordsNotModified(c, &User{}) {
+			return
+		}
 		getAllUsers(c, &users)
 		c.JSON(http.StatusOK, gin.H{"users": users})
 		return
 	case "/sessions/feedback":
-		sfg := NewSessionFeedbackGetter(getAllSessionFeedback, getSessionFeedbackByRating, getSessionFeedbackBySessionId, getSessionFeedbackBySessionIdAndRating)
+		sfg := NewSessionFeedbackGetter(getFilteredSessionFeedback, getSessionFeedbackRows, getSessionFeedbackVersion)
 		getSessionFeedback(c, *sfg)
 		return
 	default:
@@ -121,10 +170,54 @@ func GetResources(c *gin.Context) {
 	}
 }
 
+// newSession builds a Session record, linking it to the FeedbackForm picked by the input (an unknown form is returned as
+// inputError)
+func newSession(db *gorm.DB, input CreateSessionInput) (Session, error) {
+	session := Session{ID: uuid.NewV4(), GameMode: input.GameMode}
+	if input.GameMode == "" && input.FeedbackFormID == uuid.Nil {
+		return session, nil
+	}
+	form, err := findFeedbackForm(db, input.FeedbackFormID, input.GameMode)
+	if err != nil {
+		return session, err
+	}
+	if form.ID != uuid.Nil {
+		session.GameMode = form.GameMode
+		session.FeedbackFormID = &form.ID
+	} else if input.FeedbackFormID != uuid.Nil {
+		return session, invalidInput("FeedbackForm does not exist")
+	}
+	return session, nil
+}
+
 func CreateSession(c *gin.Context) {
-	var session Session
-	session.ID = uuid.NewV4()
-	if err := GetDB(c).Create(&session).Error; err != nil {
+	// The body is optional - sessions without a game mode get generic feedback only
+	var input CreateSessionInput
+	if c.Request.Body != nil && c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&input); err != nil && err != io.EOF {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	session, err := newSession(GetDB(c), input)
+	if _, ok := err.(inputError); ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = GetDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&session).Error; err != nil {
+			return err
+		}
+		if err := recordAudit(tx, c, AuditActionCreate, AuditResourceSession, session.ID, nil, &session); err != nil {
+			return err
+		}
+		return recordEvent(tx, AggregateSession, session.ID, EventSessionCreated, gin.H{"session": &session})
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -132,6 +225,28 @@ func CreateSession(c *gin.Context) {
 
 }
 
+// GetSession handles GET /sessions/:id - responds with a 304 if the client's copy is current (If-None-Match)
+func GetSession(c *gin.Context) {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Session ID"})
+		return
+	}
+	var session Session
+	if err := GetDB(c).Where("id = ?", id).Find(&session).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if session.ID == uuid.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session does not exist"})
+		return
+	}
+	if notModified(c, resourceETag(session.ID, session.UpdatedAt)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"session": &session})
+}
+
 func DeleteSession(c *gin.Context) {
 	query := c.Request.URL.Query()
 	var session Session
@@ -144,11 +259,26 @@ func DeleteSession(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "Session does not exist"})
 		return
 	}
-	// Attempt to delete the user (return an error if something bad happens)
-	if err := GetDB(c).Delete(&Session{}, query["id"]).Error; err != nil {
+	if !preconditionMet(c, resourceETag(session.ID, session.UpdatedAt)) {
+		return
+	}
+	// Attempt to delete the session, unless it was updated since it was read (return an error if something bad happens)
+	var result *gorm.DB
+	err := GetDB(c).Transaction(func(tx *gorm.DB) error {
+		result = tx.Where("id = ? AND updated_at = ?", session.ID, session.UpdatedAt).Delete(&Session{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return recordAudit(tx, c, AuditActionDelete, AuditResourceSession, session.ID, &session, nil)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if result.RowsAffected == 0 {
+		preconditionFailed(c, "")
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Session deleted successfully!"})
 }
 
@@ -159,8 +289,8 @@ func CreateSessionFeedback(c *gin.Context) {
 		return
 	}
 	// If any required fields are invalid, return before doing any processing
-	if input.Rating < 1 || input.Rating > 5 || input.SessionID == uuid.Nil || input.UserID == uuid.Nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid values for query parameters - sessionId and userId must be defined and rating must be 1 - 5"})
+	if err := validateSessionFeedbackInput(&input, GetConfig(c).Feedback); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 	var sessionFeedback SessionFeedback
@@ -173,28 +303,46 @@ func CreateSessionFeedback(c *gin.Context) {
 	var session Session
 	// Defines session with the first Session record found by the given input.SessionID
 	GetDB(c).First(&session, input.SessionID)
-	var user User
-	// Defines user with the first User record found by the given input.UserID
-	GetDB(c).First(&user, input.UserID)
-	sessionFeedback.ID = uuid.NewV4()
-	sessionFeedback.Rating = input.Rating
-	sessionFeedback.Comment = input.Comment
-	session.SessionFeedback = []SessionFeedback{sessionFeedback}
-	// Update the session with the feedback (inserts the feedback record into the DB)
-	if err := GetDB(c).Updates(&session).Error; err != nil {
+	// Answers are checked against the form the session was created with
+	form, err := sessionFeedbackForm(GetDB(c), session)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	// Update the user with the feedback (doesn't perform insert this time since it already exists - just updates the User record)
-	user.SessionFeedback = []SessionFeedback{sessionFeedback}
-	if err := GetDB(c).Updates(&user).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	sessionFeedback, err = newSessionFeedback(input, form, GetModerator(c), GetAnalyzer(c))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := GetDB(c).Where("id = ?", sessionFeedback.ID).Find(&sessionFeedback).Error; err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"success": false, "message": err.Error()})
+	var user User
+	// Defines user with the first User record found by the given input.UserID
+	GetDB(c).First(&user, input.UserID)
+	// The feedback and its event are saved together
+	err = GetDB(c).Transaction(func(tx *gorm.DB) error {
+		session.SessionFeedback = []SessionFeedback{sessionFeedback}
+		// Update the session with the feedback (inserts the feedback record into the DB)
+		if err := tx.Updates(&session).Error; err != nil {
+			return err
+		}
+		// Update the user with the feedback (doesn't perform insert this time since it already exists - just updates the User record)
+		user.SessionFeedback = []SessionFeedback{sessionFeedback}
+		if err := tx.Updates(&user).Error; err != nil {
+			return err
+		}
+		if err := tx.Scopes(feedbackDetails).Where("id = ?", sessionFeedback.ID).Find(&sessionFeedback).Error; err != nil {
+			return err
+		}
+		if err := recordAudit(tx, c, AuditActionCreate, AuditResourceSessionFeedback, sessionFeedback.ID, nil, &sessionFeedback); err != nil {
+			return err
+		}
+		return recordEvent(tx, AggregateSessionFeedback, sessionFeedback.ID, EventFeedbackCreated, gin.H{"sessionFeedback": &sessionFeedback})
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	GetListCache(c).Invalidate()
+	publishFeedback(c, sessionFeedback)
 	c.JSON(200, gin.H{"success": true, "message": "Thank you for your feedback!", "sessionFeedback": &sessionFeedback})
 	return
 }
@@ -211,11 +359,30 @@ func DeleteSessionFeedback(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "SessionFeedback does not exist"})
 		return
 	}
-	// Attempt to delete the user (return an error if something bad happens)
-	if err := GetDB(c).Delete(&SessionFeedback{}, query["id"]).Error; err != nil {
+	if !preconditionMet(c, resourceETag(sessionFeedback.ID, sessionFeedback.UpdatedAt)) {
+		return
+	}
+	// Attempt to delete the feedback, unless it was updated since it was read (return an error if something bad happens)
+	var result *gorm.DB
+	err := GetDB(c).Transaction(func(tx *gorm.DB) error {
+		result = tx.Where("id = ? AND updated_at = ?", sessionFeedback.ID, sessionFeedback.UpdatedAt).Delete(&SessionFeedback{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if err := recordAudit(tx, c, AuditActionDelete, AuditResourceSessionFeedback, sessionFeedback.ID, &sessionFeedback, nil); err != nil {
+			return err
+		}
+		return recordEvent(tx, AggregateSessionFeedback, sessionFeedback.ID, EventFeedbackDeleted, gin.H{"sessionFeedback": &sessionFeedback})
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if result.RowsAffected == 0 {
+		preconditionFailed(c, "")
+		return
+	}
+	GetListCache(c).Invalidate()
 	c.JSON(http.StatusOK, gin.H{"success": true, "message": "SessionFeedback deleted successfully!"})
 	return
 }
@@ -223,7 +390,13 @@ func DeleteSessionFeedback(c *gin.Context) {
 func CreateUser(c *gin.Context) {
 	var user User
 	user.ID = uuid.NewV4()
-	if err := GetDB(c).Create(&user).Error; err != nil {
+	err := GetDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&user).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, c, AuditActionCreate, AuditResourceUser, user.ID, nil, &user)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
@@ -231,6 +404,71 @@ func CreateUser(c *gin.Context) {
 	return
 }
 
+// GetUser handles GET /users/:id - responds with a 304 if the client's copy is current (If-None-Match), and a 410 if
+// the user was erased
+func GetUser(c *gin.Context) {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User ID"})
+		return
+	}
+	var user User
+	if err := GetDB(c).Where("id = ?", id).Find(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user.ID == uuid.Nil {
+		userNotFound(c, id)
+		return
+	}
+	if notModified(c, resourceETag(user.ID, user.UpdatedAt)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"user": &user})
+}
+
+// IssueUserToken handles POST /users/:id/token - issues the token a player authenticates with (X-User-Token), replacing
+// the previous one
+//
+// Tokens are issued by the game servers once they have signed the player in, which is why the route is one of the game
+// server routes - and since a new token replaces the previous one, it also requires a game server (or ops) API key or
+// a verified client certificate.
+func IssueUserToken(c *gin.Context) {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid User ID"})
+		return
+	}
+	var user User
+	if err := GetDB(c).Where("id = ?", id).Find(&user).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if user.ID == uuid.Nil {
+		userNotFound(c, id)
+		return
+	}
+	token, hash, err := newUserToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	err = GetDB(c).Transaction(func(tx *gorm.DB) error {
+		before := user
+		if err := tx.Model(&user).Update("token_hash", hash).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, c, AuditActionUpdate, AuditResourceUser, user.ID, &before, &user)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	// The response holds the token, so it isn't stored for Idempotency-Key replays
+	skipIdempotencyStore(c)
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Token issued", "token": token})
+}
+
 func DeleteUser(c *gin.Context) {
 	query := c.Request.URL.Query()
 	var user User
@@ -243,11 +481,26 @@ func DeleteUser(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"success": false, "message": "User does not exist"})
 		return
 	}
-	// Attempt to delete the user (return an error if something bad happens)
-	if err := GetDB(c).Delete(&User{}, query["id"]).Error; err != nil {
+	if !preconditionMet(c, resourceETag(user.ID, user.UpdatedAt)) {
+		return
+	}
+	// Attempt to delete the user, unless it was updated since it was read (return an error if something bad happens)
+	var result *gorm.DB
+	err := GetDB(c).Transaction(func(tx *gorm.DB) error {
+		result = tx.Where("id = ? AND updated_at = ?", user.ID, user.UpdatedAt).Delete(&User{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		return recordAudit(tx, c, AuditActionDelete, AuditResourceUser, user.ID, &user, nil)
+	})
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	if result.RowsAffected == 0 {
+		preconditionFailed(c, "")
+		return
+	}
 	c.JSON(http.StatusOK, gin.H{"success": true, "message": "User deleted successfully!"})
 	return
 }
@@ -255,14 +508,56 @@ func DeleteUser(c *gin.Context) {
 // adds routes to the server
 func addRoutes(r *gin.Engine) {
 	r.GET("/ping", ping)
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+	r.GET("/status", status)
 	r.GET("/users", GetResources)
+	r.GET("/users/:id", GetUser)
+	r.GET("/users/:id/feedback/responses", getUserFeedbackResponses)
 	r.GET("/sessions", GetResources)
+	r.GET("/sessions/:id", GetSession)
+	r.GET("/forms", getFeedbackForms)
 	// TODO: Look into how to do wildcards in routes with gin
 	r.GET("/sessions/feedback", GetResources)
 	r.POST("/users/create", CreateUser)
-	r.POST("/sessions/create", CreateSession)
+	r.POST("/users/create/batch", CreateUsersBatch)
+	// Routes used by game servers (service-to-service) - these require a client certificate when mutual TLS is configured
+	gameServer := r.Group("/", requireClientCert())
+	gameServer.POST("/users/:id/token", requireTokenIssuer(), IssueUserToken)
+	gameServer.POST("/sessions/create", CreateSession)
+	gameServer.POST("/sessions/create/batch", CreateSessionsBatch)
+	gameServer.POST("/sessions/create/with-feedback", CreateSessionWithFeedback)
+	gameServer.POST("/sessions/feedback/create/batch", CreateSessionFeedbackBatch)
 	r.POST("/sessions/feedback/create", CreateSessionFeedback)
 	r.DELETE("/users", DeleteUser)
 	r.DELETE("/sessions", DeleteSession)
 	r.DELETE("/sessions/feedback", DeleteSessionFeedback)
+	r.GET("/feedback/search", searchFeedback)
+	r.GET("/feedback/stream", streamFeedback)
+	r.GET("/feedback/:id", getFeedbackByID)
+	r.GET("/feedback/stats", getFeedbackStats)
+	r.POST("/feedback/:id/reports", CreateFeedbackReport)
+
+	// Routes used by the ops team - these require an ops API key
+	ops := r.Group("/ops", requireOps())
+	ops.GET("/moderation/queue", getModerationQueue)
+	ops.PUT("/feedback/:id/moderation", UpdateModeration)
+	ops.GET("/reports", getReportedFeedback)
+	ops.POST("/feedback/:id/responses", CreateFeedbackResponse)
+	ops.POST("/forms", CreateFeedbackForm)
+	ops.POST("/import/:kind", ImportRecords)
+	ops.GET("/live", liveSessions)
+	ops.POST("/webhooks", CreateWebhook)
+	ops.GET("/webhooks", getWebhooks)
+	ops.GET("/webhooks/:id", getWebhook)
+	ops.DELETE("/webhooks/:id", DeleteWebhook)
+	ops.GET("/webhooks/:id/deliveries", getWebhookDeliveries)
+
+	// The audit log is only readable with an ops API key too
+	r.GET("/audit", requireOps(), getAuditLog)
+
+	// Player data requests are handled by the ops team
+	r.GET("/users/:id/export", requireOps(), exportUserData)
+	r.POST("/users/:id/erasure", requireOps(), EraseUser)
+	r.GET("/users/:id/erasure", requireOps(), getUserErasure)
 }
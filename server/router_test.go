@@ -8,6 +8,7 @@ import (
 	"net/http/httptest"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	uuid "github.com/satori/go.uuid"
@@ -19,6 +20,8 @@ import (
 type RouteTestSuite struct {
 	suite.Suite
 	router *gin.Engine
+	// db is the database of the router, for tests that change it behind the API
+	db *gorm.DB
 }
 
 type KeyValuePair struct {
@@ -65,10 +68,49 @@ func TestRouteSuite(t *testing.T) {
 	suite.Run(t, new(RouteTestSuite))
 }
 
+// testOpsAPIKey is the ops API key accepted by the mock router
+const testOpsAPIKey = "test-ops-key"
+
+// testGameServerAPIKey is the game server API key accepted by the mock router
+const testGameServerAPIKey = "test-game-server-key"
+
+// mockConfig returns the configuration used by the mock router
+func mockConfig() *Config {
+	cfg := DefaultConfig()
+	cfg.Auth.OpsAPIKeys = []string{"tester:" + testOpsAPIKey}
+	cfg.Auth.GameServerAPIKeys = []string{"match-server:" + testGameServerAPIKey}
+	cfg.Moderation.BlockedWords = []string{"cheater"}
+	cfg.Moderation.BlockedPatterns = []string{`(?i)https?://`}
+	cfg.ListCache.TTL = time.Minute
+	return cfg
+}
+
 func SetupMockRouter(s *RouteTestSuite) *gin.Engine {
+	cfg := mockConfig()
+	moderator, err := NewBlocklistModerator(cfg.Moderation)
+	if err != nil {
+		panic(err)
+	}
+	limiter, err := newRateLimiter(cfg.RateLimit, NewMemoryRateLimitStore())
+	if err != nil {
+		panic(err)
+	}
 	r := gin.Default()
+	if err := setTrustedProxies(r, cfg.Server.TrustedProxies); err != nil {
+		panic(err)
+	}
 	addMiddleware(r)
+	addRequestIDMiddleware(r)
+	addConfigMiddleware(r, cfg)
+	addAuthMiddleware(r, cfg.Auth)
 	addMockDatabaseMiddleware(r, s)
+	addUserAuthMiddleware(r)
+	addRateLimitMiddleware(r, limiter)
+	addIdempotencyMiddleware(r, cfg.Idempotency)
+	addModerationMiddleware(r, moderator)
+	addAnalysisMiddleware(r, NewLexiconAnalyzer())
+	addListCacheMiddleware(r, NewListCache(cfg.ListCache))
+	addFeedbackHubMiddleware(r, NewFeedbackHub())
 	addRoutes(r)
 	return r
 }
@@ -83,12 +125,7 @@ func initMockDB() *gorm.DB {
 	}
 
 	// Migrate the schema
-	err = gdb.AutoMigrate(
-		&Counter{},
-		&User{},
-		&Session{},
-		&SessionFeedback{},
-	)
+	err = gdb.AutoMigrate(migrationModels()...)
 	if err != nil {
 		panic(err)
 	}
@@ -97,6 +134,12 @@ func initMockDB() *gorm.DB {
 
 func addMockDatabaseMiddleware(r *gin.Engine, s *RouteTestSuite) {
 	gdb := initMockDB()
+	s.db = gdb
+	searcher, err := newFeedbackSearcher(gdb)
+	if err != nil {
+		panic(err)
+	}
+	addSearchMiddleware(r, searcher)
 
 	// Add database to our context
 	r.Use(func(c *gin.Context) {
@@ -154,6 +197,22 @@ func (s *RouteTestSuite) TestCreateUser() {
 	s.NotEqual(response.User.ID, uuid.Nil)
 }
 
+// TestIssueUserToken ensures only game servers (and ops) can issue user tokens, and that a new token replaces the old one
+func (s *RouteTestSuite) TestIssueUserToken() {
+	user := s.createUser()
+	path := "/users/" + user.ID.String() + "/token"
+	token := s.userToken(user)
+	s.Equal(http.StatusUnauthorized, s.request("POST", path, nil).Code)
+	s.Equal(http.StatusUnauthorized, s.request("POST", path, nil, UserTokenHeader, token).Code)
+	s.Equal(http.StatusUnauthorized, s.request("POST", path, nil, UserIDHeader, user.ID.String()).Code)
+	// The rejected requests didn't replace the token
+	s.Equal(http.StatusOK, s.request("GET", "/ping", nil, UserTokenHeader, token).Code)
+
+	s.Equal(http.StatusOK, s.request("POST", path, nil, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusUnauthorized, s.request("GET", "/ping", nil, UserTokenHeader, token).Code)
+	s.Equal(http.StatusNotFound, s.request("POST", "/users/"+uuid.NewV4().String()+"/token", nil, APIKeyHeader, testGameServerAPIKey).Code)
+}
+
 func (s *RouteTestSuite) TestGetUsersRouteNoData() {
 
 	// See https://golang.org/pkg/net/http/httptest/#ResponseRecorder
@@ -292,3 +351,137 @@ func (s *RouteTestSuite) TestGetSessionFeedbackRouteNoData() {
 	// Ensure the Feedback array is empty when the DB is in a fresh state
 	s.Assert().Equal(response.Feedback, make([]SessionFeedback, 0))
 }
+
+// TestHealthz ensures the liveness probe always responds with 200
+func (s *RouteTestSuite) TestHealthz() {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	s.NoError(err)
+	s.router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+}
+
+// TestReadyz ensures the readiness probe reports ready when the database is reachable and migrated
+func (s *RouteTestSuite) TestReadyz() {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	s.NoError(err)
+	s.router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	var response struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Equal("ok", response.Status)
+	s.Equal("ok", response.Checks["database"])
+	s.Equal("ok", response.Checks["migrations"])
+}
+
+// TestStatus ensures the status endpoint reports build information and database details
+func (s *RouteTestSuite) TestStatus() {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/status", nil)
+	s.NoError(err)
+	s.router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	var response struct {
+		Version  string `json:"version"`
+		Commit   string `json:"commit"`
+		Database struct {
+			Driver string                 `json:"driver"`
+			Pool   map[string]interface{} `json:"pool"`
+		} `json:"database"`
+	}
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Equal(Version, response.Version)
+	s.Equal(Commit, response.Commit)
+	s.Equal("sqlite", response.Database.Driver)
+	s.Contains(response.Database.Pool, "openConnections")
+}
+
+// TestReadyzUnmigrated ensures the readiness probe fails when the schema has not been migrated
+func (s *RouteTestSuite) TestReadyzUnmigrated() {
+	gdb, err := gorm.Open(sqlite.Open("file::memory:"), &gorm.Config{})
+	s.NoError(err)
+	r := gin.New()
+	addConfigMiddleware(r, DefaultConfig())
+	r.Use(func(c *gin.Context) {
+		c.Set(ContextKeyDB, gdb)
+	})
+	addRoutes(r)
+
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	s.NoError(err)
+	r.ServeHTTP(w, req)
+	s.Equal(http.StatusServiceUnavailable, w.Code)
+}
+
+// request sends a request to the mock router, with an optional JSON body and headers given as alternating names and values
+func (s *RouteTestSuite) request(method string, path string, body interface{}, headers ...string) *httptest.ResponseRecorder {
+	var reader *bytes.Buffer
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		s.Require().NoError(err)
+		reader = bytes.NewBuffer(encoded)
+	} else {
+		reader = bytes.NewBuffer(nil)
+	}
+	req, err := http.NewRequest(method, path, reader)
+	s.Require().NoError(err)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+// createUser creates a User through the API
+func (s *RouteTestSuite) createUser() User {
+	w := s.request("POST", "/users/create", nil)
+	s.Require().Equal(200, w.Code)
+	var response CreateUserJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.User
+}
+
+// userToken issues a token for a User through the API (sent in the X-User-Token header)
+func (s *RouteTestSuite) userToken(user User) string {
+	w := s.request("POST", "/users/"+user.ID.String()+"/token", nil, APIKeyHeader, testGameServerAPIKey)
+	s.Require().Equal(200, w.Code, w.Body.String())
+	var response struct {
+		Token string `json:"token"`
+	}
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Token
+}
+
+// createSession creates a Session through the API
+func (s *RouteTestSuite) createSession() Session {
+	w := s.request("POST", "/sessions/create", nil)
+	s.Require().Equal(200, w.Code)
+	var response CreateSessionJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Session
+}
+
+// createFeedback creates a SessionFeedback through the API
+func (s *RouteTestSuite) createFeedback(session Session, user User, rating int, comment string) SessionFeedback {
+	w := s.request("POST", "/sessions/feedback/create", gin.H{
+		"sessionId": session.ID,
+		"userId":    user.ID,
+		"rating":    rating,
+		"comment":   comment,
+	})
+	s.Require().Equal(200, w.Code, w.Body.String())
+	var response CreateSessionFeedbackJSON
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.SessionFeedback
+}
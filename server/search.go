@@ -0,0 +1,425 @@
+package server
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// ContextKeySearcher is the key name for the FeedbackSearcher within the Gin context
+const ContextKeySearcher = "searcher"
+
+// Markers wrapped around the matched terms in search snippets
+const (
+	snippetOpen  = "<mark>"
+	snippetClose = "</mark>"
+	// The snippets are built with these control characters around the matched terms, which are only replaced with the
+	// markup once the rest of the snippet has been HTML escaped
+	snippetStart = "\x02"
+	snippetEnd   = "\x03"
+	// snippetWords is the (approximate) number of words in a snippet
+	snippetWords = 12
+)
+
+// Limits of GET /feedback/search
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+	maxSearchTerms     = 16
+)
+
+// searchTerm is a single word or phrase of a search query
+type searchTerm struct {
+	Text string
+	// Prefix terms match any word starting with the text (e.g., lag* matches "laggy")
+	Prefix bool
+}
+
+// searchQuery is a parsed search query - every group must match, and a group matches when any of its terms match
+type searchQuery [][]searchTerm
+
+// parseSearchQuery parses the q parameter of GET /feedback/search:
+//   - words are all required: lag crash
+//   - "quoted text" matches a phrase: "rubber banding"
+//   - a trailing * matches a prefix: disconn*
+//   - OR between two terms matches either of them: lag OR crash
+func parseSearchQuery(q string) (searchQuery, error) {
+	var query searchQuery
+	or := false
+	terms := 0
+	for rest := strings.TrimSpace(q); rest != ""; rest = strings.TrimSpace(rest) {
+		var term searchTerm
+		if rest[0] == '"' {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated phrase in search query")
+			}
+			term.Text = strings.Join(strings.Fields(rest[1:end+1]), " ")
+			rest = rest[end+2:]
+		} else {
+			end := strings.IndexAny(rest, " \t\n\"")
+			if end < 0 {
+				end = len(rest)
+			}
+			term.Text = rest[:end]
+			rest = rest[end:]
+			if term.Text == "OR" {
+				if len(query) == 0 || or {
+					return nil, fmt.Errorf("OR must be placed between two search terms")
+				}
+				or = true
+				continue
+			}
+		}
+		if strings.HasPrefix(rest, "*") {
+			term.Prefix = true
+			rest = rest[1:]
+		} else if strings.HasSuffix(term.Text, "*") {
+			term.Prefix = true
+			term.Text = strings.TrimRight(term.Text, "*")
+		}
+		if term.Text == "" {
+			continue
+		}
+		if terms++; terms > maxSearchTerms {
+			return nil, fmt.Errorf("Search queries can have at most %d terms", maxSearchTerms)
+		}
+		if or {
+			query[len(query)-1] = append(query[len(query)-1], term)
+			or = false
+		} else {
+			query = append(query, []searchTerm{term})
+		}
+	}
+	if or {
+		return nil, fmt.Errorf("OR must be placed between two search terms")
+	}
+	if len(query) == 0 {
+		return nil, fmt.Errorf("q must contain at least one search term")
+	}
+	return query, nil
+}
+
+// searchHit is a SessionFeedback record matched by a search, with the matching part of its comment highlighted
+type searchHit struct {
+	ID      uuid.UUID
+	Snippet string
+}
+
+// FeedbackSearcher finds SessionFeedback records whose comment matches a search query
+//
+// The given query is already limited to the feedback the caller may see (and the filters they asked for); implementations
+// add the comment match and return the hits in order of relevance.
+type FeedbackSearcher interface {
+	Search(db *gorm.DB, query searchQuery, limit int) ([]searchHit, error)
+}
+
+// newFeedbackSearcher picks the best searcher for the database - SQLite's FTS5 extension when it is available (the
+// service is built with the sqlite_fts5 tag), otherwise a LIKE based fallback
+func newFeedbackSearcher(db *gorm.DB) (FeedbackSearcher, error) {
+	if db.Dialector.Name() != "sqlite" {
+		return likeSearcher{}, nil
+	}
+	var fts5 int
+	if err := db.Raw("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Row().Scan(&fts5); err != nil {
+		return nil, err
+	}
+	if fts5 == 0 {
+		log.Info("SQLite was built without FTS5 - falling back to LIKE queries for feedback search")
+		return likeSearcher{}, dropFTSIndex(db)
+	}
+	return newFTSSearcher(db)
+}
+
+// dropFTSIndex drops the triggers and keys of an FTS5 index left by a build with FTS5, as the triggers would make every
+// write to session_feedbacks fail without it - session_feedback_fts itself can't be dropped without the FTS5 module, but it is
+// no longer written to, and it is rebuilt once FTS5 is available again (as its keys are gone)
+func dropFTSIndex(db *gorm.DB) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range ftsDropTriggers {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// ftsSearcher searches an FTS5 index of feedback comments that is kept up to date by triggers
+//
+// session_feedbacks has a UUID primary key, so its rowid is implicit and may be renumbered by VACUUM - the index is
+// keyed by session_feedback_search_keys instead, which gives each feedback a stable integer key (an INTEGER PRIMARY KEY
+// is never renumbered).
+type ftsSearcher struct{}
+
+// ftsSchema creates the index, its keys and the triggers maintaining them
+var ftsSchema = []string{
+	`CREATE TABLE IF NOT EXISTS session_feedback_search_keys (
+		search_key INTEGER PRIMARY KEY AUTOINCREMENT,
+		session_feedback_id TEXT NOT NULL UNIQUE
+	)`,
+	`CREATE VIRTUAL TABLE IF NOT EXISTS session_feedback_fts USING fts5(comment)`,
+	`CREATE TRIGGER IF NOT EXISTS session_feedback_fts_insert AFTER INSERT ON session_feedbacks BEGIN
+		INSERT INTO session_feedback_search_keys(session_feedback_id) VALUES (new.id);
+		INSERT INTO session_feedback_fts(rowid, comment)
+			SELECT search_key, new.comment FROM session_feedback_search_keys WHERE session_feedback_id = new.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS session_feedback_fts_delete AFTER DELETE ON session_feedbacks BEGIN
+		DELETE FROM session_feedback_fts WHERE rowid = (SELECT search_key FROM session_feedback_search_keys WHERE session_feedback_id = old.id);
+		DELETE FROM session_feedback_search_keys WHERE session_feedback_id = old.id;
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS session_feedback_fts_update AFTER UPDATE OF comment ON session_feedbacks BEGIN
+		UPDATE session_feedback_fts SET comment = new.comment
+			WHERE rowid = (SELECT search_key FROM session_feedback_search_keys WHERE session_feedback_id = old.id);
+	END`,
+}
+
+// ftsDropTriggers drops the triggers maintaining the index and its keys - the rest of the schema doesn't need the FTS5
+// module to be dropped
+var ftsDropTriggers = []string{
+	`DROP TRIGGER IF EXISTS session_feedback_fts_insert`,
+	`DROP TRIGGER IF EXISTS session_feedback_fts_delete`,
+	`DROP TRIGGER IF EXISTS session_feedback_fts_update`,
+	`DROP TABLE IF EXISTS session_feedback_search_keys`,
+}
+
+// ftsRebuild drops the index (including the rowid keyed index of earlier versions), then indexes every feedback
+var ftsRebuild = append(ftsDropTriggers, `DROP TABLE IF EXISTS session_feedback_fts`)
+
+// ftsBackfill indexes the feedback that was left before the index existed
+var ftsBackfill = []string{
+	`INSERT INTO session_feedback_search_keys(session_feedback_id) SELECT id FROM session_feedbacks ORDER BY created_at`,
+	`INSERT INTO session_feedback_fts(rowid, comment)
+		SELECT session_feedback_search_keys.search_key, session_feedbacks.comment FROM session_feedback_search_keys
+		JOIN session_feedbacks ON session_feedbacks.id = session_feedback_search_keys.session_feedback_id`,
+}
+
+// newFTSSearcher creates the FTS5 index (and the triggers maintaining it) unless they already exist - an index built by
+// an earlier version is rebuilt
+func newFTSSearcher(db *gorm.DB) (FeedbackSearcher, error) {
+	var statements []string
+	if !db.Migrator().HasTable("session_feedback_search_keys") {
+		statements = append(statements, ftsRebuild...)
+		statements = append(statements, ftsSchema...)
+		statements = append(statements, ftsBackfill...)
+	} else {
+		statements = ftsSchema
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		for _, statement := range statements {
+			if err := tx.Exec(statement).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ftsSearcher{}, nil
+}
+
+// matchExpression converts the query to an FTS5 MATCH expression - every term is quoted so user input can't use FTS5 syntax
+func (ftsSearcher) matchExpression(query searchQuery) string {
+	groups := make([]string, 0, len(query))
+	for _, group := range query {
+		terms := make([]string, 0, len(group))
+		for _, term := range group {
+			quoted := `"` + strings.ReplaceAll(term.Text, `"`, `""`) + `"`
+			if term.Prefix {
+				quoted += "*"
+			}
+			terms = append(terms, quoted)
+		}
+		groups = append(groups, "("+strings.Join(terms, " OR ")+")")
+	}
+	return strings.Join(groups, " AND ")
+}
+
+// Search ranks the matches with FTS5's bm25 function and uses its snippet function to highlight them
+func (s ftsSearcher) Search(db *gorm.DB, query searchQuery, limit int) ([]searchHit, error) {
+	var hits []searchHit
+	err := db.Table("session_feedback_fts").
+		Select("session_feedbacks.id AS id, snippet(session_feedback_fts, 0, ?, ?, '...', ?) AS snippet", snippetStart, snippetEnd, snippetWords).
+		Joins("JOIN session_feedback_search_keys ON session_feedback_search_keys.search_key = session_feedback_fts.rowid").
+		Joins("JOIN session_feedbacks ON session_feedbacks.id = session_feedback_search_keys.session_feedback_id").
+		Where("session_feedback_fts MATCH ?", s.matchExpression(query)).
+		Order("session_feedback_fts.rank").
+		Limit(limit).
+		Scan(&hits).Error
+	for i := range hits {
+		hits[i].Snippet = markSnippet(hits[i].Snippet)
+	}
+	return hits, err
+}
+
+// likeSearcher matches comments with LIKE - it works with every database but can't rank matches (the newest feedback is
+// returned first) and also matches inside words
+type likeSearcher struct{}
+
+// likeEscaper escapes the LIKE wildcards in search terms
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Search adds a LIKE condition per term and builds the snippets itself
+func (likeSearcher) Search(db *gorm.DB, query searchQuery, limit int) ([]searchHit, error) {
+	db = db.Model(&SessionFeedback{}).Select("session_feedbacks.id, session_feedbacks.comment")
+	for _, group := range query {
+		conditions := make([]string, 0, len(group))
+		args := make([]interface{}, 0, len(group))
+		for _, term := range group {
+			conditions = append(conditions, `session_feedbacks.comment LIKE ? ESCAPE '\'`)
+			args = append(args, "%"+likeEscaper.Replace(term.Text)+"%")
+		}
+		db = db.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+	var records []SessionFeedback
+	if err := db.Order("session_feedbacks.created_at DESC").Limit(limit).Find(&records).Error; err != nil {
+		return nil, err
+	}
+	pattern := highlightPattern(query)
+	hits := make([]searchHit, 0, len(records))
+	for _, record := range records {
+		hits = append(hits, searchHit{ID: record.ID, Snippet: highlightSnippet(record.Comment, pattern)})
+	}
+	return hits, nil
+}
+
+// highlightPattern builds a case-insensitive regex matching any term of the query
+func highlightPattern(query searchQuery) *regexp.Regexp {
+	var alternatives []string
+	for _, group := range query {
+		for _, term := range group {
+			alternative := regexp.QuoteMeta(term.Text)
+			alternative = strings.ReplaceAll(alternative, " ", `\s+`)
+			if term.Prefix {
+				alternative += `\w*`
+			}
+			alternatives = append(alternatives, alternative)
+		}
+	}
+	return regexp.MustCompile(`(?i)(` + strings.Join(alternatives, "|") + `)`)
+}
+
+// highlightSnippet cuts about snippetWords words around the first match out of the comment and highlights the matches -
+// the same output format as the FTS5 searcher
+func highlightSnippet(comment string, pattern *regexp.Regexp) string {
+	words := strings.Fields(comment)
+	first := 0
+	if loc := pattern.FindStringIndex(comment); loc != nil {
+		first = len(strings.Fields(comment[:loc[0]]))
+		// A match in the middle of a word still belongs to that word
+		if loc[0] > 0 && !strings.ContainsAny(comment[loc[0]-1:loc[0]], " \t\n\r") && first > 0 {
+			first--
+		}
+	}
+	start := first - snippetWords/4
+	if start < 0 {
+		start = 0
+	}
+	end := start + snippetWords
+	if end > len(words) {
+		end = len(words)
+	}
+	snippet := pattern.ReplaceAllString(strings.Join(words[start:end], " "), snippetStart+"$1"+snippetEnd)
+	if start > 0 {
+		snippet = "..." + snippet
+	}
+	if end < len(words) {
+		snippet += "..."
+	}
+	return markSnippet(snippet)
+}
+
+// snippetMarkup replaces the snippet markers with the markup around the matched terms
+var snippetMarkup = strings.NewReplacer(snippetStart, snippetOpen, snippetEnd, snippetClose)
+
+// markSnippet HTML escapes a snippet (comments are player-written text), then marks the matched terms - the marks are
+// the only markup a snippet can contain
+func markSnippet(snippet string) string {
+	return snippetMarkup.Replace(html.EscapeString(snippet))
+}
+
+// adds the feedback searcher to the context, it can be retrieved in routes by using GetSearcher
+func addSearchMiddleware(r *gin.Engine, searcher FeedbackSearcher) {
+	r.Use(func(c *gin.Context) {
+		c.Set(ContextKeySearcher, searcher)
+	})
+}
+
+// GetSearcher retrieves the feedback searcher from the request context
+func GetSearcher(c *gin.Context) FeedbackSearcher {
+	value, ok := c.Get(ContextKeySearcher)
+	if !ok {
+		panic("searcher not found in context")
+	}
+	searcher, ok := value.(FeedbackSearcher)
+	if !ok {
+		panic("searcher was not the correct type")
+	}
+	return searcher
+}
+
+// SearchResult is a SessionFeedback record matched by GET /feedback/search
+type SearchResult struct {
+	SessionFeedback SessionFeedback `json:"sessionFeedback"`
+	// The matching part of the comment, HTML escaped, with the matched terms wrapped in <mark></mark>
+	Snippet string `json:"snippet"`
+}
+
+// searchFeedback handles GET /feedback/search - finds feedback whose comment matches the q parameter (see
+// parseSearchQuery), most relevant first; the filters of GET /sessions/feedback can be combined with the search
+func searchFeedback(c *gin.Context) {
+	query, err := parseSearchQuery(c.Query("q"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	filter, err := parseSessionFeedbackFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	limit := defaultSearchLimit
+	if value := c.Query("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > maxSearchLimit {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Limit must be an integer from 1 through %d", maxSearchLimit)})
+			return
+		}
+	}
+	hits, err := GetSearcher(c).Search(GetDB(c).Scopes(visibleFeedback(c), filter.scope), query, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	results := make([]SearchResult, 0, len(hits))
+	if len(hits) > 0 {
+		ids := make([]string, 0, len(hits))
+		for _, hit := range hits {
+			ids = append(ids, hit.ID.String())
+		}
+		var records []SessionFeedback
+		if err := feedbackQuery(c).Where("session_feedbacks.id IN ?", ids).Find(&records).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		byID := make(map[uuid.UUID]SessionFeedback, len(records))
+		for _, record := range records {
+			byID[record.ID] = record
+		}
+		for _, hit := range hits {
+			if record, ok := byID[hit.ID]; ok {
+				results = append(results, SearchResult{SessionFeedback: record, Snippet: hit.Snippet})
+			}
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"results": &results})
+}
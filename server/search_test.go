@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+type SearchFeedbackJSON struct {
+	Results []SearchResult `json:"results"`
+}
+
+// TestParseSearchQuery ensures words, phrases, prefixes and OR are parsed into groups of terms
+func TestParseSearchQuery(t *testing.T) {
+	query, err := parseSearchQuery(`lag OR crash* "rubber  banding" server`)
+	assert.NoError(t, err)
+	assert.Equal(t, searchQuery{
+		{{Text: "lag"}, {Text: "crash", Prefix: true}},
+		{{Text: "rubber banding"}},
+		{{Text: "server"}},
+	}, query)
+	assert.Equal(t, `("lag" OR "crash"*) AND ("rubber banding") AND ("server")`, ftsSearcher{}.matchExpression(query))
+
+	// FTS5 operators are searched for as plain words
+	query, err = parseSearchQuery(`NOT lag NEAR(crash)`)
+	assert.NoError(t, err)
+	assert.Equal(t, `("NOT") AND ("lag") AND ("NEAR(crash)")`, ftsSearcher{}.matchExpression(query))
+
+	for _, invalid := range []string{"", "   ", "OR lag", "lag OR", "lag OR OR crash", `"unterminated`, strings.Repeat("a ", maxSearchTerms+1)} {
+		_, err := parseSearchQuery(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// TestHighlightSnippet ensures the fallback snippets highlight every match and are cut around the first one
+func TestHighlightSnippet(t *testing.T) {
+	query, err := parseSearchQuery("lag OR disconn*")
+	assert.NoError(t, err)
+	pattern := highlightPattern(query)
+	assert.Equal(t, "So much <mark>LAG</mark>, then I got <mark>disconnected</mark>", highlightSnippet("So much LAG, then I got disconnected", pattern))
+	long := "one two three four five six seven eight nine ten eleven twelve thirteen fourteen lag fifteen sixteen seventeen eighteen nineteen twenty"
+	assert.Equal(t, "...twelve thirteen fourteen <mark>lag</mark> fifteen sixteen seventeen eighteen nineteen twenty", highlightSnippet(long, pattern))
+	assert.Equal(t, "one two three four five six seven eight nine ten eleven twelve...", highlightSnippet(strings.Replace(long, "lag", "", 1)+" x", pattern))
+
+	// Comments are escaped, so the marks are the only markup
+	assert.Equal(t, "&lt;img src=x onerror=alert(1)&gt; <mark>lag</mark> &amp; more", highlightSnippet("<img src=x onerror=alert(1)> lag & more", pattern))
+}
+
+// TestSearchFeedback ensures comments can be searched, combined with the feedback filters, and only visible feedback is returned
+func (s *RouteTestSuite) TestSearchFeedback() {
+	session := s.createSession()
+	laggy := s.createFeedback(session, s.createUser(), 2, "Terrible lag all match long")
+	crashed := s.createFeedback(session, s.createUser(), 1, "The game crashed twice during the final round")
+	s.createFeedback(s.createSession(), s.createUser(), 3, "Some lag but the new map is great")
+	s.createFeedback(session, s.createUser(), 5, "Great match, no complaints")
+	s.createFeedback(session, s.createUser(), 1, "Lag everywhere, what a cheater fest")
+
+	search := func(query string) []SearchResult {
+		w := s.request("GET", "/feedback/search?"+query, nil)
+		s.Require().Equal(200, w.Code, w.Body.String())
+		var response SearchFeedbackJSON
+		s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Results
+	}
+	q := func(value string) string { return "q=" + url.QueryEscape(value) }
+
+	// The flagged "cheater" comment is only found by ops
+	s.Len(search(q("lag")), 2)
+	if results := search(q("lag") + "&sessionId=" + session.ID.String()); s.Len(results, 1) {
+		s.Equal(laggy.ID, results[0].SessionFeedback.ID)
+		s.Contains(results[0].Snippet, "<mark>lag</mark>")
+	}
+	s.Len(search(q("lag OR crashed")+"&sessionId="+session.ID.String()), 2)
+	if results := search(q("crash*") + "&rating=1"); s.Len(results, 1) {
+		s.Equal(crashed.ID, results[0].SessionFeedback.ID)
+		s.Contains(results[0].Snippet, "<mark>crashed</mark>")
+	}
+	s.Len(search(q(`"final round"`)), 1)
+	s.Empty(search(q(`"round final"`)))
+	s.Len(search(q("great")), 2)
+	s.Len(search(q("great")+"&limit=1"), 1)
+
+	w := s.request("GET", "/feedback/search?"+q("lag"), nil, APIKeyHeader, testOpsAPIKey)
+	var response SearchFeedbackJSON
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	s.Len(response.Results, 3)
+
+	for _, invalid := range []string{"", q("OR"), q("lag") + "&rating=9", q("lag") + "&limit=0"} {
+		s.Equal(http.StatusBadRequest, s.request("GET", "/feedback/search?"+invalid, nil).Code, invalid)
+	}
+}
+
+// TestFTSSearcher ensures the FTS5 index is built from existing feedback and kept up to date (skipped unless the tests
+// are run with -tags sqlite_fts5)
+func TestFTSSearcher(t *testing.T) {
+	db := initMockDB()
+	feedback := SessionFeedback{ID: uuid.NewV4(), Rating: 2, Comment: "Constant rubber banding on the docks map", ModerationStatus: ModerationApproved}
+	assert.NoError(t, db.Create(&feedback).Error)
+	searcher, err := newFTSSearcher(db)
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		t.Skip("SQLite was built without FTS5")
+	}
+	assert.NoError(t, err)
+
+	query, _ := parseSearchQuery(`"rubber banding" dock*`)
+	hits, err := searcher.Search(db.Model(&SessionFeedback{}), query, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 1) {
+		assert.Equal(t, feedback.ID, hits[0].ID)
+		assert.Equal(t, "Constant <mark>rubber banding</mark> on the <mark>docks</mark> map", hits[0].Snippet)
+	}
+
+	// The index is keyed by a stable key, so it stays in sync when VACUUM renumbers the rowids of session_feedbacks
+	other := SessionFeedback{ID: uuid.NewV4(), Rating: 4, Comment: "<b>Great</b> docks", ModerationStatus: ModerationApproved}
+	assert.NoError(t, db.Create(&other).Error)
+	assert.NoError(t, db.Delete(&SessionFeedback{}, "id = ?", feedback.ID).Error)
+	assert.NoError(t, db.Create(&feedback).Error)
+	assert.NoError(t, db.Exec("VACUUM").Error)
+	hits, err = searcher.Search(db.Model(&SessionFeedback{}), query, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 1) {
+		assert.Equal(t, feedback.ID, hits[0].ID)
+	}
+	docks, _ := parseSearchQuery("docks")
+	hits, err = searcher.Search(db.Model(&SessionFeedback{}), docks, 10)
+	assert.NoError(t, err)
+	assert.Len(t, hits, 2)
+	for _, hit := range hits {
+		if hit.ID == other.ID {
+			assert.Equal(t, "&lt;b&gt;Great&lt;/b&gt; <mark>docks</mark>", hit.Snippet)
+		}
+	}
+
+	assert.NoError(t, db.Model(&feedback).Update("comment", "Fixed now").Error)
+	hits, err = searcher.Search(db.Model(&SessionFeedback{}), query, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, hits)
+	assert.NoError(t, db.Delete(&feedback).Error)
+}
+
+// TestFTSSearcherRebuild ensures an index keyed by the rowid of session_feedbacks (built by earlier versions) is rebuilt
+func TestFTSSearcherRebuild(t *testing.T) {
+	db := initMockDB()
+	err := db.Exec(`CREATE VIRTUAL TABLE session_feedback_fts USING fts5(comment, content='session_feedbacks', content_rowid='rowid')`).Error
+	if err != nil && strings.Contains(err.Error(), "no such module: fts5") {
+		t.Skip("SQLite was built without FTS5")
+	}
+	assert.NoError(t, err)
+	assert.NoError(t, db.Exec(`CREATE TRIGGER session_feedback_fts_insert AFTER INSERT ON session_feedbacks BEGIN
+		INSERT INTO session_feedback_fts(rowid, comment) VALUES (new.rowid, new.comment);
+	END`).Error)
+	feedback := SessionFeedback{ID: uuid.NewV4(), Rating: 2, Comment: "Lag everywhere", ModerationStatus: ModerationApproved}
+	assert.NoError(t, db.Create(&feedback).Error)
+
+	searcher, err := newFTSSearcher(db)
+	assert.NoError(t, err)
+	query, _ := parseSearchQuery("lag")
+	hits, err := searcher.Search(db.Model(&SessionFeedback{}), query, 10)
+	assert.NoError(t, err)
+	if assert.Len(t, hits, 1) {
+		assert.Equal(t, feedback.ID, hits[0].ID)
+	}
+	// Inserts go through the new trigger only
+	assert.NoError(t, db.Create(&SessionFeedback{ID: uuid.NewV4(), Rating: 1, Comment: "More lag", ModerationStatus: ModerationApproved}).Error)
+	hits, err = searcher.Search(db.Model(&SessionFeedback{}), query, 10)
+	assert.NoError(t, err)
+	assert.Len(t, hits, 2)
+	_, err = newFTSSearcher(db)
+	assert.NoError(t, err)
+}
+
+// TestLikeSearcherDropsFTSIndex ensures the triggers of an index left by a build with FTS5 are dropped when falling back to
+// LIKE queries, so writes to session_feedbacks don't need the FTS5 module (skipped when the tests are run with
+// -tags sqlite_fts5)
+func TestLikeSearcherDropsFTSIndex(t *testing.T) {
+	db := initMockDB()
+	if _, err := newFTSSearcher(db); err == nil {
+		t.Skip("SQLite was built with FTS5")
+	}
+	assert.NoError(t, db.Exec(`CREATE TABLE session_feedback_search_keys (id INTEGER PRIMARY KEY, session_feedback_id TEXT NOT NULL UNIQUE)`).Error)
+	assert.NoError(t, db.Exec(`CREATE TRIGGER session_feedback_fts_insert AFTER INSERT ON session_feedbacks BEGIN
+		INSERT INTO session_feedback_fts(rowid, comment) VALUES (new.rowid, new.comment);
+	END`).Error)
+	assert.NoError(t, db.Exec(`CREATE TRIGGER session_feedback_fts_update AFTER UPDATE OF comment ON session_feedbacks BEGIN
+		INSERT INTO session_feedback_fts(rowid, comment) VALUES (new.rowid, new.comment);
+	END`).Error)
+	assert.NoError(t, db.Exec(`CREATE TRIGGER session_feedback_fts_delete AFTER DELETE ON session_feedbacks BEGIN
+		DELETE FROM session_feedback_fts WHERE rowid = old.rowid;
+	END`).Error)
+	feedback := SessionFeedback{ID: uuid.NewV4(), Rating: 2, Comment: "Lag everywhere", ModerationStatus: ModerationApproved}
+	assert.Error(t, db.Create(&feedback).Error)
+
+	searcher, err := newFeedbackSearcher(db)
+	assert.NoError(t, err)
+	assert.IsType(t, likeSearcher{}, searcher)
+	var triggers int64
+	assert.NoError(t, db.Raw("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND tbl_name = 'session_feedbacks'").Row().Scan(&triggers))
+	assert.Zero(t, triggers)
+	assert.False(t, db.Migrator().HasTable("session_feedback_search_keys"))
+
+	assert.NoError(t, db.Create(&feedback).Error)
+	assert.NoError(t, db.Model(&feedback).Update("comment", "Lag fixed").Error)
+	query, _ := parseSearchQuery("lag")
+	hits, err := searcher.Search(db.Model(&SessionFeedback{}), query, 10)
+	assert.NoError(t, err)
+	assert.Len(t, hits, 1)
+	assert.NoError(t, db.Delete(&feedback).Error)
+}
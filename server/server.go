@@ -1,12 +1,41 @@
 package server
 
-import "os"
+import (
+	"net/http"
 
-// GetBindAddress gets the value for the PORT environment variable, if it exists - if not, defaults to port 8080
-func GetBindAddress() string {
-	port, found := os.LookupEnv("PORT")
-	if !found {
-		port = "8080"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// NewHTTPServer creates an http.Server for the given handler with the configured address, timeouts and TLS settings applied
+//
+// When TLS is enabled, HTTP/2 is negotiated automatically; without TLS, HTTP/2 can be served in cleartext by enabling h2c.
+func NewHTTPServer(cfg ServerConfig, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:              cfg.Address(),
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := newTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		srv.TLSConfig = tlsConfig
+	} else if cfg.H2C {
+		srv.Handler = h2c.NewHandler(handler, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+	return srv, nil
+}
+
+// ListenAndServe starts srv, serving TLS if NewHTTPServer configured it
+func ListenAndServe(srv *http.Server) error {
+	if srv.TLSConfig != nil {
+		// The certificate is provided by srv.TLSConfig.GetCertificate
+		return srv.ListenAndServeTLS("", "")
 	}
-	return ":" + port
+	return srv.ListenAndServe()
 }
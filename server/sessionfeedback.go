@@ -1,16 +1,21 @@
 package server
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
 )
 
-type SessionFeedbackGetterAll func(c *gin.Context, records *[]SessionFeedback)
-type SessionFeedbackGetterByRating func(c *gin.Context, rating int, records *[]SessionFeedback)
-type SessionFeedbackGetterBySessionID func(c *gin.Context, sessionID string, records *[]SessionFeedback)
-type SessionFeedbackGetterBySessionIDAndRating func(c *gin.Context, sessionID string, rating int, records *[]SessionFeedback)
+// SessionFeedbackGetterFiltered gets the SessionFeedback records matching the given filter
+type SessionFeedbackGetterFiltered func(c *gin.Context, filter SessionFeedbackFilter, records *[]SessionFeedback) error
 
 // SessionFeedbackGetter facilitates getting SessionFeedback
 //
@@ -23,87 +28,423 @@ type SessionFeedbackGetterBySessionIDAndRating func(c *gin.Context, sessionID st
 //
 // See https://stackoverflow.com/questions/19167970/mock-functions-in-go
 type SessionFeedbackGetter struct {
-	all                      SessionFeedbackGetterAll
-	by_rating                SessionFeedbackGetterByRating
-	by_session_id            SessionFeedbackGetterBySessionID
-	by_session_id_and_rating SessionFeedbackGetterBySessionIDAndRating
+	filtered SessionFeedbackGetterFiltered
+	rows     SessionFeedbackGetterRows
+	version  SessionFeedbackGetterVersion
 }
 
-func NewSessionFeedbackGetter(getAll SessionFeedbackGetterAll, byRating SessionFeedbackGetterByRating, bySessionID SessionFeedbackGetterBySessionID, bySessionIDAndRating SessionFeedbackGetterBySessionIDAndRating) *SessionFeedbackGetter {
+// SessionFeedbackGetterVersion gets the version of the SessionFeedback records matching the given filter (used for the
+// ETag and Last-Modified headers)
+type SessionFeedbackGetterVersion func(c *gin.Context, filter SessionFeedbackFilter) (listVersion, error)
+
+func NewSessionFeedbackGetter(filtered SessionFeedbackGetterFiltered, rows SessionFeedbackGetterRows, version SessionFeedbackGetterVersion) *SessionFeedbackGetter {
 	return &SessionFeedbackGetter{
-		all:                      getAll,
-		by_rating:                byRating,
-		by_session_id:            bySessionID,
-		by_session_id_and_rating: bySessionIDAndRating,
+		filtered: filtered,
+		rows:     rows,
+		version:  version,
+	}
+}
+
+// SessionFeedbackFilter holds the filters accepted by the session feedback endpoint - zero values match everything
+type SessionFeedbackFilter struct {
+	SessionID string
+	// 1 - 5, or 0 for any rating
+	Rating int
+	// Dimension name => required score for that dimension
+	Scores map[string]int
+	// Tags the feedback must have (all of them)
+	Tags []string
+	// positive, neutral or negative (empty for any sentiment)
+	Sentiment string
+	// Topics the comment must mention (all of them)
+	Topics []string
+}
+
+// parseSessionFeedbackFilter reads the filter from the query parameters:
+//   - sessionId: only feedback for the given session
+//   - rating: only feedback with the given rating
+//   - score[<dimension>]: only feedback with the given score for a dimension (e.g., score[matchmaking]=2)
+//   - tag: only feedback with the given tag (repeat to require several tags)
+//   - sentiment: only feedback whose comment has the given sentiment (positive, neutral or negative)
+//   - topic: only feedback whose comment mentions the given topic (repeat to require several topics)
+func parseSessionFeedbackFilter(c *gin.Context) (SessionFeedbackFilter, error) {
+	var filter SessionFeedbackFilter
+	query := c.Request.URL.Query()
+	if sessionID := query["sessionId"]; sessionID != nil {
+		filter.SessionID = sessionID[0]
+	}
+	if rating := query["rating"]; rating != nil {
+		ratingInt, err := strconv.Atoi(rating[0])
+		if err != nil || !ratingIsValid(ratingInt) {
+			return filter, fmt.Errorf("Rating must be an integer from 1 through 5")
+		}
+		filter.Rating = ratingInt
+	}
+	dimensions := GetConfig(c).Feedback.Dimensions
+	for dimension, score := range c.QueryMap("score") {
+		if !dimensionIsValid(dimensions, dimension) {
+			return filter, fmt.Errorf("Unknown feedback dimension %q", dimension)
+		}
+		scoreInt, err := strconv.Atoi(score)
+		if err != nil || !ratingIsValid(scoreInt) {
+			return filter, fmt.Errorf("Scores must be integers from 1 through 5")
+		}
+		if filter.Scores == nil {
+			filter.Scores = map[string]int{}
+		}
+		filter.Scores[dimension] = scoreInt
+	}
+	for _, tag := range query["tag"] {
+		normalized, ok := normalizeTag(tag)
+		if !ok {
+			return filter, fmt.Errorf("Invalid tag %q", tag)
+		}
+		filter.Tags = append(filter.Tags, normalized)
+	}
+	if sentiment := query["sentiment"]; sentiment != nil {
+		if !sentimentIsValid(sentiment[0]) {
+			return filter, fmt.Errorf("Sentiment must be one of positive, neutral or negative")
+		}
+		filter.Sentiment = sentiment[0]
+	}
+	for _, topic := range query["topic"] {
+		if !tagPattern.MatchString(topic) {
+			return filter, fmt.Errorf("Invalid topic %q", topic)
+		}
+		filter.Topics = append(filter.Topics, topic)
+	}
+	return filter, nil
+}
+
+// scope applies the filter to a SessionFeedback query
+func (f SessionFeedbackFilter) scope(db *gorm.DB) *gorm.DB {
+	if f.SessionID != "" {
+		db = db.Where("session_feedbacks.session_id = ?", f.SessionID)
+	}
+	if f.Rating != 0 {
+		db = db.Where("session_feedbacks.rating = ?", f.Rating)
+	}
+	// Sort the dimensions so the generated SQL is stable
+	dimensions := make([]string, 0, len(f.Scores))
+	for dimension := range f.Scores {
+		dimensions = append(dimensions, dimension)
+	}
+	sort.Strings(dimensions)
+	for _, dimension := range dimensions {
+		db = db.Where("EXISTS (SELECT 1 FROM feedback_scores WHERE feedback_scores.session_feedback_id = session_feedbacks.id AND feedback_scores.dimension = ? AND feedback_scores.score = ?)", dimension, f.Scores[dimension])
+	}
+	for _, tag := range f.Tags {
+		db = db.Where("EXISTS (SELECT 1 FROM feedback_tags WHERE feedback_tags.session_feedback_id = session_feedbacks.id AND feedback_tags.tag = ?)", tag)
+	}
+	if f.Sentiment != "" {
+		db = db.Where("session_feedbacks.sentiment = ?", f.Sentiment)
+	}
+	for _, topic := range f.Topics {
+		db = db.Where("EXISTS (SELECT 1 FROM feedback_topics WHERE feedback_topics.session_feedback_id = session_feedbacks.id AND feedback_topics.topic = ?)", topic)
+	}
+	return db
+}
+
+// FeedbackScore database model representing the score given to a single feedback dimension (e.g., matchmaking)
+type FeedbackScore struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"-"`
+	// FK
+	SessionFeedbackID uuid.UUID `gorm:"uniqueIndex:idx_feedback_scores_dimension" json:"-"`
+	// One of the configured feedback dimensions
+	Dimension string `gorm:"not null;uniqueIndex:idx_feedback_scores_dimension" json:"dimension"`
+	// A score of 1 to 5 (1 being the "worst", 5 being the "best")
+	Score int `gorm:"not null" json:"score"`
+}
+
+// FeedbackTag database model representing a free-form tag attached to SessionFeedback
+type FeedbackTag struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"-"`
+	// FK
+	SessionFeedbackID uuid.UUID `gorm:"uniqueIndex:idx_feedback_tags_tag" json:"-"`
+	Tag               string    `gorm:"not null;uniqueIndex:idx_feedback_tags_tag;index" json:"tag"`
+}
+
+// maxTagLength is the longest tag accepted (after normalization)
+const maxTagLength = 32
+
+var tagPattern = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// normalizeTag lower-cases a tag and replaces whitespace with dashes, reporting whether the result is a valid tag
+func normalizeTag(tag string) (string, bool) {
+	normalized := strings.ToLower(strings.Join(strings.Fields(tag), "-"))
+	if normalized == "" || len(normalized) > maxTagLength || !tagPattern.MatchString(normalized) {
+		return "", false
+	}
+	return normalized, true
+}
+
+// dimensionIsValid checks if the given dimension is one of the configured feedback dimensions
+func dimensionIsValid(dimensions []string, dimension string) bool {
+	for _, configured := range dimensions {
+		if configured == dimension {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSessionFeedbackInput checks the fields of a CreateSessionFeedbackInput, normalizing its tags in place
+//
+// The returned error message is safe to show to the client.
+func validateSessionFeedbackInput(input *CreateSessionFeedbackInput, cfg FeedbackConfig) error {
+	if !ratingIsValid(input.Rating) || input.SessionID == uuid.Nil || input.UserID == uuid.Nil {
+		return fmt.Errorf("Invalid values for query parameters - sessionId and userId must be defined and rating must be 1 - 5")
+	}
+	for dimension, score := range input.Scores {
+		if !dimensionIsValid(cfg.Dimensions, dimension) {
+			return fmt.Errorf("Unknown feedback dimension %q - must be one of %s", dimension, strings.Join(cfg.Dimensions, ", "))
+		}
+		if !ratingIsValid(score) {
+			return fmt.Errorf("Score for %q must be 1 - 5", dimension)
+		}
+	}
+	seen := map[string]bool{}
+	var tags []string
+	for _, tag := range input.Tags {
+		normalized, ok := normalizeTag(tag)
+		if !ok {
+			return fmt.Errorf("Invalid tag %q - tags must be at most %d letters, digits, dashes or underscores", tag, maxTagLength)
+		}
+		if !seen[normalized] {
+			seen[normalized] = true
+			tags = append(tags, normalized)
+		}
+	}
+	if len(tags) > cfg.MaxTags {
+		return fmt.Errorf("At most %d tags can be given", cfg.MaxTags)
+	}
+	input.Tags = tags
+	return nil
+}
+
+// newFeedbackScoresAndTags builds the related records for the scores and tags of a validated input
+func newFeedbackScoresAndTags(input CreateSessionFeedbackInput) ([]FeedbackScore, []FeedbackTag) {
+	var scores []FeedbackScore
+	for dimension, score := range input.Scores {
+		scores = append(scores, FeedbackScore{ID: uuid.NewV4(), Dimension: dimension, Score: score})
 	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Dimension < scores[j].Dimension })
+	var tags []FeedbackTag
+	for _, tag := range input.Tags {
+		tags = append(tags, FeedbackTag{ID: uuid.NewV4(), Tag: tag})
+	}
+	return scores, tags
+}
+
+// sessionFeedbackForm gets the FeedbackForm the session was created with (nil when the session has no form)
+func sessionFeedbackForm(db *gorm.DB, session Session) (*FeedbackForm, error) {
+	if session.FeedbackFormID == nil {
+		return nil, nil
+	}
+	form, err := findFeedbackForm(db, *session.FeedbackFormID, "")
+	if err != nil {
+		return nil, err
+	}
+	return &form, nil
+}
+
+// newSessionFeedback builds the SessionFeedback record for an input that passed validateSessionFeedbackInput, with its
+// scores, tags, form answers and topics - the comment and free-text answers are moderated, the comment is analyzed, and
+// the answers are checked against the session's form (the returned error message is safe to show to the client)
+func newSessionFeedback(input CreateSessionFeedbackInput, form *FeedbackForm, moderator Moderator, analyzer Analyzer) (SessionFeedback, error) {
+	var sessionFeedback SessionFeedback
+	answers, err := validateAnswers(form, input.Answers)
+	if err != nil {
+		return sessionFeedback, err
+	}
+	sessionFeedback.ID = uuid.NewV4()
+	sessionFeedback.SessionID = input.SessionID
+	sessionFeedback.UserID = input.UserID
+	sessionFeedback.Rating = input.Rating
+	sessionFeedback.Comment = input.Comment
+	sessionFeedback.Scores, sessionFeedback.Tags = newFeedbackScoresAndTags(input)
+	sessionFeedback.Answers = answers
+	// Flagged comments (and free-text answers) are held back from public reads until an ops team member reviews them
+	moderation := moderateFeedback(moderator, input.Comment, form, answers)
+	sessionFeedback.ModerationStatus = moderation.Status
+	sessionFeedback.ModerationReason = moderation.Reason
+	applyAnalysis(&sessionFeedback, analyzer.Analyze(input.Comment))
+	return sessionFeedback, nil
+}
+
+// feedbackBuilder builds the SessionFeedback records of the batch and import endpoints, which (unlike
+// CreateSessionFeedback) require the session and user to exist
+type feedbackBuilder struct {
+	cfg       FeedbackConfig
+	moderator Moderator
+	analyzer  Analyzer
+	// forms caches the FeedbackForm of each session (nil for sessions without a form)
+	forms map[uuid.UUID]*FeedbackForm
 }
 
-// getSessionFeedbackBySessionIdAndRating gets SessionFeedback records filtered by SessionID and Rating
-func getSessionFeedbackBySessionIdAndRating(c *gin.Context, sessionID string, rating int, records *[]SessionFeedback) {
-	// SELECT * FROM session_feedbacks WHERE session_id = ? AND rating = ?
-	GetDB(c).Where("session_id = ? AND rating = ?", sessionID, rating).Find(&records)
+func newFeedbackBuilder(cfg FeedbackConfig, moderator Moderator, analyzer Analyzer) *feedbackBuilder {
+	return &feedbackBuilder{cfg: cfg, moderator: moderator, analyzer: analyzer, forms: map[uuid.UUID]*FeedbackForm{}}
 }
 
-// getSessionFeedbackBySessionId gets SessionFeedback records filtered by the given SessionID
-func getSessionFeedbackBySessionId(c *gin.Context, sessionID string, records *[]SessionFeedback) {
-	// SELECT * FROM session_feedbacks WHERE session_id = ?
-	GetDB(c).Where("session_id = ?", sessionID).Find(&records)
+// build validates the input and builds its SessionFeedback record - invalid input, unknown sessions or users and
+// duplicate feedback are returned as inputError
+//
+// The one feedback per user per session rule is checked against tx, so feedback created earlier in the same
+// transaction counts.
+func (b *feedbackBuilder) build(tx *gorm.DB, input CreateSessionFeedbackInput) (SessionFeedback, error) {
+	if err := validateSessionFeedbackInput(&input, b.cfg); err != nil {
+		return SessionFeedback{}, inputError{err}
+	}
+	var user User
+	if err := tx.Where("id = ?", input.UserID).Find(&user).Error; err != nil {
+		return SessionFeedback{}, err
+	}
+	if user.ID == uuid.Nil {
+		return SessionFeedback{}, invalidInput("User does not exist")
+	}
+	form, ok := b.forms[input.SessionID]
+	if !ok {
+		var session Session
+		if err := tx.Where("id = ?", input.SessionID).Find(&session).Error; err != nil {
+			return SessionFeedback{}, err
+		}
+		if session.ID == uuid.Nil {
+			return SessionFeedback{}, invalidInput("Session does not exist")
+		}
+		var err error
+		if form, err = sessionFeedbackForm(tx, session); err != nil {
+			return SessionFeedback{}, err
+		}
+		b.forms[input.SessionID] = form
+	}
+	var existing int64
+	if err := tx.Model(&SessionFeedback{}).Where("session_id = ? AND user_id = ?", input.SessionID, input.UserID).Count(&existing).Error; err != nil {
+		return SessionFeedback{}, err
+	}
+	if existing > 0 {
+		return SessionFeedback{}, invalidInput("This user has already provided feedback for the given session")
+	}
+	sessionFeedback, err := newSessionFeedback(input, form, b.moderator, b.analyzer)
+	if err != nil {
+		return SessionFeedback{}, inputError{err}
+	}
+	return sessionFeedback, nil
 }
 
-// getSessionFeedbackByRating gets SessionFeedback records fultered by the given rating (includes all sessions)
-func getSessionFeedbackByRating(c *gin.Context, rating int, records *[]SessionFeedback) {
-	// SELECT * FROM session_feedbacks WHERE rating = ?
-	GetDB(c).Where("rating = ?", rating).Find(&records)
+// feedbackDetails is a scope embedding the dimension scores, tags, form answers and topics in SessionFeedback queries
+func feedbackDetails(db *gorm.DB) *gorm.DB {
+	return db.
+		Preload("Scores", func(db *gorm.DB) *gorm.DB { return db.Order("dimension") }).
+		Preload("Tags", func(db *gorm.DB) *gorm.DB { return db.Order("tag") }).
+		Preload("Answers", func(db *gorm.DB) *gorm.DB { return db.Order("position") }).
+		Preload("Topics", func(db *gorm.DB) *gorm.DB { return db.Order("topic") })
 }
 
-func getAllSessionFeedback(c *gin.Context, records *[]SessionFeedback) {
-	// SELECT * FROM session_feedbacks
-	GetDB(c).Find(&records)
+// feedbackQuery starts a SessionFeedback query limited to the feedback the caller may see, with the ops team's replies
+// and the feedback details embedded
+func feedbackQuery(c *gin.Context) *gorm.DB {
+	return GetDB(c).
+		Scopes(visibleFeedback(c), feedbackDetails).
+		Preload("Responses", visibleResponses(c))
 }
 
-// getSessionFeedback handles the logic for GET requests sent to the /sessions/feedback endpoint - accepts sessionId and/or rating as query parameters
+// getFeedbackByID handles GET /feedback/:id - gets a single SessionFeedback record the caller may see, responding with
+// a 304 if the client's copy is current (If-None-Match)
+func getFeedbackByID(c *gin.Context) {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid SessionFeedback ID"})
+		return
+	}
+	// What the caller may see depends on their credentials
+	c.Header("Vary", "Authorization, "+APIKeyHeader)
+	var sessionFeedback SessionFeedback
+	if err := feedbackQuery(c).Where("session_feedbacks.id = ?", id).Find(&sessionFeedback).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if sessionFeedback.ID == uuid.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "SessionFeedback does not exist"})
+		return
+	}
+	if notModified(c, resourceETag(sessionFeedback.ID, sessionFeedback.UpdatedAt)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sessionFeedback": &sessionFeedback})
+}
+
+// getFilteredSessionFeedback gets the SessionFeedback records matching the given filter
+func getFilteredSessionFeedback(c *gin.Context, filter SessionFeedbackFilter, records *[]SessionFeedback) error {
+	// SELECT * FROM session_feedbacks WHERE session_id = ? AND rating = ? AND EXISTS (...)
+	return feedbackQuery(c).Scopes(filter.scope).Find(records).Error
+}
+
+// getSessionFeedbackVersion gets the version of the SessionFeedback records matching the given filter that the caller may see
+func getSessionFeedbackVersion(c *gin.Context, filter SessionFeedbackFilter) (listVersion, error) {
+	return queryListVersion(func() *gorm.DB {
+		return GetDB(c).Model(&SessionFeedback{}).Scopes(visibleFeedback(c), filter.scope)
+	})
+}
+
+// getSessionFeedback handles the logic for GET requests sent to the /sessions/feedback endpoint - accepts the filters
+// described by parseSessionFeedbackFilter as query parameters
+//
+// The feedback is returned as JSON unless CSV or NDJSON is requested with the format query parameter (or the Accept
+// header), in which case it is streamed (see exportSessionFeedback).
+//
+// Only approved feedback is returned unless the request was made with an ops API key (see visibleFeedback). Replies from
+// the ops team are embedded in each record (see visibleResponses).
+//
+// Responses have ETag and Last-Modified headers, and requests with a current If-None-Match get a 304. JSON listings are
+// served from the ListCache when it's enabled.
 func getSessionFeedback(c *gin.Context, sfg SessionFeedbackGetter) {
-	var records []SessionFeedback
-	query := c.Request.URL.Query()
-	var sessionID = query["sessionId"]
-	var rating = query["rating"]
-	if sessionID != nil || rating != nil { // Query is filtered by sessionId and/or rating
-		if sessionID != nil && rating != nil { // By sessionId and rating
-			if ratingInt, err := strconv.Atoi(rating[0]); err == nil {
-				if ratingIsValid(ratingInt) {
-					sfg.by_session_id_and_rating(c, sessionID[0], ratingInt, &records)
-					c.JSON(200, gin.H{"feedback": &records})
-					return
-				} else {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Rating must be an integer from 1 through 5"})
-					return
-				}
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
-			}
-		} else if sessionID == nil && rating != nil { // By rating only
-			if ratingInt, err := strconv.Atoi(rating[0]); err == nil {
-				if ratingIsValid(ratingInt) {
-					sfg.by_rating(c, ratingInt, &records)
-					c.JSON(200, gin.H{"feedback": &records})
-					return
-				} else {
-					c.JSON(http.StatusBadRequest, gin.H{"error": "Rating must be an integer from 1 through 5"})
-					return
-				}
-			} else {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				return
+	filter, err := parseSessionFeedbackFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	format, err := feedbackFormat(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// What the caller may see depends on their credentials, and the format on the Accept header
+	c.Header("Vary", "Accept, Authorization, "+APIKeyHeader)
+	cache := GetListCache(c)
+	key := listCacheKey(c)
+	if format == FormatJSON {
+		if entry, _, ok := cache.get(key); ok {
+			if !listNotModified(c, entry.etag, entry.lastModified) {
+				c.Data(http.StatusOK, gin.MIMEJSON+"; charset=utf-8", entry.body)
 			}
-		} else if sessionID != nil && rating == nil { // By sessionId only
-			sfg.by_session_id(c, sessionID[0], &records)
-			c.JSON(200, gin.H{"feedback": &records})
 			return
 		}
-	} else { // Unfiltered query
-		sfg.all(c, &records)
-		c.JSON(200, gin.H{"feedback": &records})
+	}
+	// The generation is read before the database, so that a listing invalidated while it's read isn't cached
+	_, generation, _ := cache.get(key)
+	version, err := sfg.version(c, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	etag := listETag(c, version, format)
+	if listNotModified(c, etag, version.LastModified) {
+		return
+	}
+	if format != FormatJSON {
+		exportSessionFeedback(c, sfg, filter, format)
+		return
+	}
+	var records []SessionFeedback
+	if err := sfg.filtered(c, filter, &records); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	body, err := json.Marshal(gin.H{"feedback": &records})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	cache.put(key, generation, listCacheEntry{etag: etag, lastModified: version.LastModified, body: body})
+	c.Data(http.StatusOK, gin.MIMEJSON+"; charset=utf-8", body)
 }
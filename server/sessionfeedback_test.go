@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TestFeedbackScoresAndTags ensures dimension scores and tags are validated, stored and returned with the feedback
+func (s *RouteTestSuite) TestFeedbackScoresAndTags() {
+	session := s.createSession()
+	user := s.createUser()
+	create := func(scores gin.H, tags []string) *http.Response {
+		w := s.request("POST", "/sessions/feedback/create", gin.H{
+			"sessionId": session.ID,
+			"userId":    user.ID,
+			"rating":    3,
+			"scores":    scores,
+			"tags":      tags,
+		})
+		return w.Result()
+	}
+	s.Equal(http.StatusBadRequest, create(gin.H{"graphics": 3}, nil).StatusCode)
+	s.Equal(http.StatusBadRequest, create(gin.H{"matchmaking": 6}, nil).StatusCode)
+	s.Equal(http.StatusBadRequest, create(nil, []string{"not a tag!"}).StatusCode)
+	s.Equal(http.StatusBadRequest, create(nil, []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"}).StatusCode)
+
+	w := s.request("POST", "/sessions/feedback/create", gin.H{
+		"sessionId": session.ID,
+		"userId":    user.ID,
+		"rating":    3,
+		"scores":    gin.H{"performance": 2, "matchmaking": 4},
+		"tags":      []string{"Lag", "great map", "lag"},
+	})
+	s.Equal(200, w.Code, w.Body.String())
+	var response CreateSessionFeedbackJSON
+	s.NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	feedback := response.SessionFeedback
+	s.Require().Len(feedback.Scores, 2)
+	s.Equal("matchmaking", feedback.Scores[0].Dimension)
+	s.Equal(4, feedback.Scores[0].Score)
+	s.Equal("performance", feedback.Scores[1].Dimension)
+	s.Equal(2, feedback.Scores[1].Score)
+	s.Require().Len(feedback.Tags, 2)
+	s.Equal("great-map", feedback.Tags[0].Tag)
+	s.Equal("lag", feedback.Tags[1].Tag)
+}
+
+// TestFilterSessionFeedback ensures feedback can be filtered by rating, dimension scores and tags
+func (s *RouteTestSuite) TestFilterSessionFeedback() {
+	session := s.createSession()
+	create := func(rating int, scores gin.H, tags []string) SessionFeedback {
+		w := s.request("POST", "/sessions/feedback/create", gin.H{
+			"sessionId": session.ID,
+			"userId":    s.createUser().ID,
+			"rating":    rating,
+			"scores":    scores,
+			"tags":      tags,
+		})
+		s.Require().Equal(200, w.Code, w.Body.String())
+		var response CreateSessionFeedbackJSON
+		s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+		return response.SessionFeedback
+	}
+	laggy := create(2, gin.H{"performance": 1, "matchmaking": 4}, []string{"lag", "crash"})
+	unbalanced := create(2, gin.H{"balance": 1, "matchmaking": 4}, []string{"lag"})
+	create(5, nil, nil)
+
+	get := func(query string) []SessionFeedback {
+		w := s.request("GET", "/sessions/feedback?sessionId="+session.ID.String()+query, nil)
+		s.Require().Equal(200, w.Code, w.Body.String())
+		var response GetFeedbackJSON
+		s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Feedback
+	}
+	s.Len(get(""), 3)
+	s.Len(get("&rating=2"), 2)
+	s.Len(get("&score[matchmaking]=4"), 2)
+	if feedback := get("&score[matchmaking]=4&score[performance]=1"); s.Len(feedback, 1) {
+		s.Equal(laggy.ID, feedback[0].ID)
+	}
+	s.Len(get("&tag=lag"), 2)
+	if feedback := get("&tag=LAG&tag=crash"); s.Len(feedback, 1) {
+		s.Equal(laggy.ID, feedback[0].ID)
+		s.Len(feedback[0].Scores, 2)
+		s.Len(feedback[0].Tags, 2)
+	}
+	if feedback := get("&rating=2&score[balance]=1&tag=lag"); s.Len(feedback, 1) {
+		s.Equal(unbalanced.ID, feedback[0].ID)
+	}
+	s.Empty(get("&tag=lag&rating=5"))
+
+	for _, invalid := range []string{"&rating=two", "&rating=6", "&score[graphics]=3", "&score[balance]=0", "&tag=%21%21"} {
+		w := s.request("GET", "/sessions/feedback?sessionId="+session.ID.String()+invalid, nil)
+		s.Equal(http.StatusBadRequest, w.Code, invalid)
+	}
+}
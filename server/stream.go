@@ -0,0 +1,255 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+)
+
+// ContextKeyFeedbackHub is the key name for the FeedbackHub within the Gin context
+const ContextKeyFeedbackHub = "feedbackHub"
+
+// feedbackStreamBuffer is the number of records buffered per stream - a stream that falls further behind is closed, and
+// the client catches up from the database when it reconnects
+const feedbackStreamBuffer = 64
+
+// feedbackReplayPageSize is the number of records read at once when replaying the feedback a client missed
+const feedbackReplayPageSize = 500
+
+// feedbackStreamRetry is the reconnection delay sent to clients
+const feedbackStreamRetry = 3 * time.Second
+
+// FeedbackHub broadcasts newly created SessionFeedback records to the open feedback streams of this instance
+type FeedbackHub struct {
+	mu          sync.Mutex
+	subscribers map[*feedbackSubscription]struct{}
+}
+
+// feedbackSubscription receives the records published to the hub - the channel is closed when the subscriber falls
+// behind or unsubscribes
+type feedbackSubscription struct {
+	records chan SessionFeedback
+}
+
+// NewFeedbackHub creates a FeedbackHub without subscribers
+func NewFeedbackHub() *FeedbackHub {
+	return &FeedbackHub{subscribers: map[*feedbackSubscription]struct{}{}}
+}
+
+// Subscribe starts receiving the published records
+func (h *FeedbackHub) Subscribe() *feedbackSubscription {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	subscription := &feedbackSubscription{records: make(chan SessionFeedback, feedbackStreamBuffer)}
+	h.subscribers[subscription] = struct{}{}
+	return subscription
+}
+
+// Unsubscribe stops receiving records
+func (h *FeedbackHub) Unsubscribe(subscription *feedbackSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[subscription]; ok {
+		delete(h.subscribers, subscription)
+		close(subscription.records)
+	}
+}
+
+// Publish sends the given records to every subscriber without blocking - subscribers that can't keep up are dropped
+func (h *FeedbackHub) Publish(records ...SessionFeedback) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for subscription := range h.subscribers {
+		for _, record := range records {
+			select {
+			case subscription.records <- record:
+				continue
+			default:
+			}
+			delete(h.subscribers, subscription)
+			close(subscription.records)
+			break
+		}
+	}
+}
+
+// matches checks if a record matches the filter - the in-memory counterpart of scope, used for records that are pushed
+// to streams rather than read from the database
+func (f SessionFeedbackFilter) matches(record SessionFeedback) bool {
+	if f.SessionID != "" && f.SessionID != record.SessionID.String() {
+		return false
+	}
+	if f.Rating != 0 && f.Rating != record.Rating {
+		return false
+	}
+	for dimension, score := range f.Scores {
+		found := false
+		for _, recordScore := range record.Scores {
+			found = found || (recordScore.Dimension == dimension && recordScore.Score == score)
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, tag := range f.Tags {
+		found := false
+		for _, recordTag := range record.Tags {
+			found = found || recordTag.Tag == tag
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Sentiment != "" && f.Sentiment != record.Sentiment {
+		return false
+	}
+	for _, topic := range f.Topics {
+		found := false
+		for _, recordTopic := range record.Topics {
+			found = found || recordTopic.Topic == topic
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// feedbackVisible checks if the caller may see a record - the in-memory counterpart of visibleFeedback
+func feedbackVisible(c *gin.Context, record SessionFeedback) bool {
+	if isOps(c) {
+		status := c.Query("moderationStatus")
+		return status == "" || status == record.ModerationStatus
+	}
+	return record.ModerationStatus == ModerationApproved
+}
+
+// replayFeedback gets the next page of records the caller may see that were created after the given record, oldest first
+func replayFeedback(c *gin.Context, filter SessionFeedbackFilter, after SessionFeedback) ([]SessionFeedback, error) {
+	var records []SessionFeedback
+	err := feedbackQuery(c).
+		Scopes(filter.scope).
+		Where("(session_feedbacks.created_at > ? OR (session_feedbacks.created_at = ? AND session_feedbacks.id > ?))", after.CreatedAt, after.CreatedAt, after.ID).
+		Order("session_feedbacks.created_at, session_feedbacks.id").
+		Limit(feedbackReplayPageSize).
+		Find(&records).Error
+	return records, err
+}
+
+// streamFeedback handles GET /feedback/stream - pushes SessionFeedback records as they are created, as Server-Sent
+// Events, accepting the same filters as getSessionFeedback
+//
+// Each event is named "feedback", has the record as its data and the record's ID as its ID. Clients reconnecting with
+// a Last-Event-ID header (as browsers do automatically) first get the records created since that event. Streams are
+// closed after stream.max_duration (so that they end before the server's write timeout) and when the client can't keep
+// up - clients are expected to reconnect.
+func streamFeedback(c *gin.Context) {
+	filter, err := parseSessionFeedbackFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	var last SessionFeedback
+	if lastEventID := c.GetHeader("Last-Event-ID"); lastEventID != "" {
+		id, err := uuid.FromString(lastEventID)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+		// Unknown (e.g., deleted) records can't be resumed from, so the stream starts with new records only
+		if err := GetDB(c).Where("id = ?", id).Find(&last).Error; err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	// Subscribe before replaying, so that nothing created in between is missed
+	hub := GetFeedbackHub(c)
+	subscription := hub.Subscribe()
+	defer hub.Unsubscribe(subscription)
+
+	cfg := GetConfig(c).Stream
+	c.Header("Content-Type", sse.ContentType)
+	c.Header("Cache-Control", "no-cache")
+	// Disables response buffering in nginx
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	fmt.Fprintf(c.Writer, "retry: %d\n\n", feedbackStreamRetry/time.Millisecond)
+	c.Writer.Flush()
+
+	replayed := map[uuid.UUID]bool{}
+	for last.ID != uuid.Nil {
+		records, err := replayFeedback(c, filter, last)
+		if err != nil {
+			c.Render(-1, sse.Event{Event: "error", Data: gin.H{"error": err.Error()}})
+			return
+		}
+		for _, record := range records {
+			c.Render(-1, sse.Event{Id: record.ID.String(), Event: "feedback", Data: record})
+			replayed[record.ID] = true
+		}
+		c.Writer.Flush()
+		if len(records) < feedbackReplayPageSize {
+			break
+		}
+		last = records[len(records)-1]
+	}
+
+	heartbeat := time.NewTicker(cfg.Heartbeat)
+	defer heartbeat.Stop()
+	deadline := time.NewTimer(cfg.MaxDuration)
+	defer deadline.Stop()
+	for {
+		select {
+		case record, ok := <-subscription.records:
+			if !ok {
+				return
+			}
+			if replayed[record.ID] || !feedbackVisible(c, record) || !filter.matches(record) {
+				continue
+			}
+			c.Render(-1, sse.Event{Id: record.ID.String(), Event: "feedback", Data: record})
+			c.Writer.Flush()
+		case <-heartbeat.C:
+			// Comments keep idle connections from being closed by proxies
+			if _, err := c.Writer.WriteString(": keep-alive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		case <-deadline.C:
+			return
+		case <-c.Request.Context().Done():
+			return
+		}
+	}
+}
+
+// publishFeedback pushes newly created records to the open feedback streams
+func publishFeedback(c *gin.Context, records ...SessionFeedback) {
+	GetFeedbackHub(c).Publish(records...)
+}
+
+// GetFeedbackHub retrieves the FeedbackHub from the request context
+func GetFeedbackHub(c *gin.Context) *FeedbackHub {
+	value, ok := c.Get(ContextKeyFeedbackHub)
+	if !ok {
+		panic("feedback hub not found in context")
+	}
+	hub, ok := value.(*FeedbackHub)
+	if !ok {
+		panic("feedback hub was not the correct type")
+	}
+	return hub
+}
+
+// adds the FeedbackHub to the context, it can be retrieved in routes by using GetFeedbackHub
+func addFeedbackHubMiddleware(r *gin.Engine, hub *FeedbackHub) {
+	r.Use(func(c *gin.Context) {
+		c.Set(ContextKeyFeedbackHub, hub)
+	})
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// streamEvent is a Server-Sent Event read from a feedback stream
+type streamEvent struct {
+	ID       string
+	Event    string
+	Feedback SessionFeedback
+}
+
+// openStream opens a feedback stream on a test server, returning the events as they arrive
+func (s *RouteTestSuite) openStream(server *httptest.Server, path string, headers ...string) (<-chan streamEvent, func()) {
+	req, err := http.NewRequest("GET", server.URL+path, nil)
+	s.Require().NoError(err)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	s.Require().NoError(err)
+	s.Require().Equal(200, resp.StatusCode)
+	s.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	events := make(chan streamEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		var event streamEvent
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "id:"):
+				event.ID = strings.TrimPrefix(line, "id:")
+			case strings.HasPrefix(line, "event:"):
+				event.Event = strings.TrimPrefix(line, "event:")
+			case strings.HasPrefix(line, "data:"):
+				json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event.Feedback)
+			case line == "" && event.Event != "":
+				events <- event
+				event = streamEvent{}
+			}
+		}
+	}()
+	return events, func() { resp.Body.Close() }
+}
+
+// nextEvent waits for the next event of a stream
+func (s *RouteTestSuite) nextEvent(events <-chan streamEvent) streamEvent {
+	select {
+	case event, ok := <-events:
+		s.Require().True(ok, "stream closed")
+		return event
+	case <-time.After(5 * time.Second):
+		s.FailNow("no event received")
+	}
+	return streamEvent{}
+}
+
+// TestFeedbackFilterMatches ensures records pushed to streams are filtered like records read from the database
+func TestFeedbackFilterMatches(t *testing.T) {
+	sessionID := uuid.NewV4()
+	record := SessionFeedback{
+		SessionID: sessionID,
+		Rating:    2,
+		Scores:    []FeedbackScore{{Dimension: "performance", Score: 1}},
+		Tags:      []FeedbackTag{{Tag: "lag"}, {Tag: "close-game"}},
+		Sentiment: SentimentNegative,
+		Topics:    []FeedbackTopic{{Topic: "lag"}},
+	}
+	assert.True(t, SessionFeedbackFilter{}.matches(record))
+	assert.True(t, SessionFeedbackFilter{
+		SessionID: sessionID.String(),
+		Rating:    2,
+		Scores:    map[string]int{"performance": 1},
+		Tags:      []string{"lag", "close-game"},
+		Sentiment: SentimentNegative,
+		Topics:    []string{"lag"},
+	}.matches(record))
+	assert.False(t, SessionFeedbackFilter{SessionID: uuid.NewV4().String()}.matches(record))
+	assert.False(t, SessionFeedbackFilter{Rating: 3}.matches(record))
+	assert.False(t, SessionFeedbackFilter{Scores: map[string]int{"performance": 2}}.matches(record))
+	assert.False(t, SessionFeedbackFilter{Tags: []string{"lag", "toxic"}}.matches(record))
+	assert.False(t, SessionFeedbackFilter{Sentiment: SentimentPositive}.matches(record))
+	assert.False(t, SessionFeedbackFilter{Topics: []string{"matchmaking"}}.matches(record))
+}
+
+// TestFeedbackHub ensures subscribers that fall behind are dropped instead of blocking the publisher
+func TestFeedbackHub(t *testing.T) {
+	hub := NewFeedbackHub()
+	fast, slow := hub.Subscribe(), hub.Subscribe()
+	for i := 0; i < feedbackStreamBuffer+1; i++ {
+		hub.Publish(SessionFeedback{Rating: 1})
+		if i < feedbackStreamBuffer {
+			<-fast.records
+		}
+	}
+	// The slow subscriber's channel is closed once its buffer is drained
+	received := 0
+	for range slow.records {
+		received++
+	}
+	assert.Equal(t, feedbackStreamBuffer, received)
+	assert.Len(t, fast.records, 1)
+	hub.Unsubscribe(slow)
+	hub.Unsubscribe(fast)
+	assert.Empty(t, hub.subscribers)
+}
+
+// TestFeedbackStream ensures new feedback is pushed to matching streams, and that streams can be resumed
+func (s *RouteTestSuite) TestFeedbackStream() {
+	server := httptest.NewServer(s.router)
+	defer server.Close()
+	session := s.createSession()
+
+	events, closeStream := s.openStream(server, "/feedback/stream?sessionId="+session.ID.String()+"&rating=5")
+	s.createFeedback(session, s.createUser(), 4, "")
+	s.createFeedback(s.createSession(), s.createUser(), 5, "")
+	// Flagged feedback isn't pushed to public streams
+	s.createFeedback(session, s.createUser(), 5, "cheater!")
+	first := s.createFeedback(session, s.createUser(), 5, "Great game")
+	event := s.nextEvent(events)
+	s.Equal("feedback", event.Event)
+	s.Equal(first.ID.String(), event.ID)
+	s.Equal(first.ID, event.Feedback.ID)
+	s.Equal("Great game", event.Feedback.Comment)
+	closeStream()
+
+	// Feedback created while disconnected is replayed on reconnection
+	second := s.createFeedback(session, s.createUser(), 5, "")
+	s.createFeedback(session, s.createUser(), 3, "")
+	events, closeStream = s.openStream(server, "/feedback/stream?sessionId="+session.ID.String()+"&rating=5", "Last-Event-ID", first.ID.String())
+	defer closeStream()
+	s.Equal(second.ID.String(), s.nextEvent(events).ID)
+	third := s.createFeedback(session, s.createUser(), 5, "")
+	s.Equal(third.ID.String(), s.nextEvent(events).ID)
+
+	// Ops see flagged feedback too
+	opsEvents, closeOpsStream := s.openStream(server, "/feedback/stream", APIKeyHeader, testOpsAPIKey)
+	defer closeOpsStream()
+	flagged := s.createFeedback(session, s.createUser(), 1, "cheater!")
+	s.Equal(flagged.ID.String(), s.nextEvent(opsEvents).ID)
+
+	s.Equal(http.StatusBadRequest, s.request("GET", "/feedback/stream?rating=9", nil).Code)
+	s.Equal(http.StatusBadRequest, s.request("GET", "/feedback/stream", nil, "Last-Event-ID", "nope").Code)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+)
+
+// certReloader serves the certificate (and client CA pool) from disk, reloading them whenever the files change
+//
+// Files are checked lazily during TLS handshakes (at most once per interval), so no background goroutine is needed.
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	interval     time.Duration
+
+	mu          sync.Mutex
+	cert        *tls.Certificate
+	clientCAs   *x509.CertPool
+	modTimes    map[string]time.Time
+	lastChecked time.Time
+}
+
+// newCertReloader loads the certificate, key and (optional) client CA bundle, failing if any of them are invalid
+func newCertReloader(cfg TLSConfig) (*certReloader, error) {
+	r := &certReloader{
+		certFile:     cfg.CertFile,
+		keyFile:      cfg.KeyFile,
+		clientCAFile: cfg.ClientCAFile,
+		interval:     cfg.ReloadInterval,
+		modTimes:     map[string]time.Time{},
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files lists every file the reloader watches
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+// load reads every file from disk - must be called with r.mu held (or before the reloader is shared)
+func (r *certReloader) load() error {
+	modTimes := map[string]time.Time{}
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return err
+		}
+		modTimes[file] = info.ModTime()
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pem, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%s does not contain any PEM encoded certificates", r.clientCAFile)
+		}
+	}
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+// maybeReload reloads the files if the check interval has passed and any of them changed since they were last loaded
+//
+// A failed reload (e.g., the certificate was replaced before the key) is logged and the previous files stay in use.
+func (r *certReloader) maybeReload() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.lastChecked) < r.interval {
+		return
+	}
+	r.lastChecked = time.Now()
+	changed := false
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil || !info.ModTime().Equal(r.modTimes[file]) {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return
+	}
+	if err := r.load(); err != nil {
+		log.WithField("error", err.Error()).Error("Failed to reload TLS certificates - continuing with the previous certificates")
+		return
+	}
+	log.Info("Reloaded TLS certificates")
+}
+
+// getCertificate is used as tls.Config.GetCertificate
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.maybeReload()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.cert, nil
+}
+
+// getConfigForClient is used as tls.Config.GetConfigForClient so that a reloaded client CA bundle takes effect
+func (r *certReloader) getConfigForClient(base *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		r.maybeReload()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		cfg := base.Clone()
+		cfg.GetConfigForClient = nil
+		cfg.ClientCAs = r.clientCAs
+		return cfg, nil
+	}
+}
+
+// newTLSConfig builds the server's tls.Config - client certificates are verified when given (and a client CA is
+// configured), but only the routes guarded by requireClientCert reject requests that do not present one
+func newTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	reloader, err := newCertReloader(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+		// Set explicitly since configs returned by GetConfigForClient don't get HTTP/2 added by net/http
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if cfg.ClientCAFile != "" {
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		tlsConfig.GetConfigForClient = reloader.getConfigForClient(tlsConfig)
+	}
+	return tlsConfig, nil
+}
+
+// requireClientCert middleware - rejects requests that did not present a verified client certificate when mutual TLS is
+// configured (server.tls.client_ca_file); it does nothing when mutual TLS is not configured
+func requireClientCert() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if GetConfig(c).Server.TLS.ClientCAFile == "" {
+			return
+		}
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "A verified client certificate is required for this route"})
+			return
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/http2"
+)
+
+// testCA is a throwaway certificate authority used to issue server and client certificates in tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA() (*testCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}, nil
+}
+
+// issue creates a certificate/key pair (PEM encoded) signed by the CA
+func (ca *testCA) issue(commonName string, serial int64, usage x509.ExtKeyUsage) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), nil
+}
+
+type TLSTestSuite struct {
+	suite.Suite
+	dir    string
+	ca     *testCA
+	cfg    *Config
+	server *http.Server
+	addr   string
+}
+
+func TestTLSSuite(t *testing.T) {
+	suite.Run(t, new(TLSTestSuite))
+}
+
+// writeServerCert issues a server certificate with the given serial number and writes it (and its key) to disk
+func (s *TLSTestSuite) writeServerCert(serial int64) {
+	certPEM, keyPEM, err := s.ca.issue("localhost", serial, x509.ExtKeyUsageServerAuth)
+	s.Require().NoError(err)
+	s.Require().NoError(ioutil.WriteFile(s.cfg.Server.TLS.CertFile, certPEM, 0600))
+	s.Require().NoError(ioutil.WriteFile(s.cfg.Server.TLS.KeyFile, keyPEM, 0600))
+}
+
+// SetupTest starts a TLS server (with mutual TLS enabled) using freshly issued certificates
+func (s *TLSTestSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "tls")
+	s.Require().NoError(err)
+	s.ca, err = newTestCA()
+	s.Require().NoError(err)
+
+	s.cfg = DefaultConfig()
+	s.cfg.Server.TLS.CertFile = filepath.Join(s.dir, "server.pem")
+	s.cfg.Server.TLS.KeyFile = filepath.Join(s.dir, "server-key.pem")
+	s.cfg.Server.TLS.ClientCAFile = filepath.Join(s.dir, "ca.pem")
+	// Check for changes on every handshake so the reload test doesn't need to wait
+	s.cfg.Server.TLS.ReloadInterval = 0
+	s.Require().NoError(ioutil.WriteFile(s.cfg.Server.TLS.ClientCAFile, s.ca.pem, 0600))
+	s.writeServerCert(2)
+
+	r := gin.New()
+	addConfigMiddleware(r, s.cfg)
+	gdb := initMockDB()
+	r.Use(func(c *gin.Context) {
+		c.Set(ContextKeyDB, gdb)
+	})
+	addRoutes(r)
+
+	s.server, err = NewHTTPServer(s.cfg.Server, r)
+	s.Require().NoError(err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	s.Require().NoError(err)
+	s.addr = listener.Addr().String()
+	go s.server.ServeTLS(listener, "", "")
+}
+
+func (s *TLSTestSuite) TearDownTest() {
+	s.server.Close()
+	os.RemoveAll(s.dir)
+}
+
+// client creates an HTTP client that trusts the test CA, optionally presenting a client certificate
+func (s *TLSTestSuite) client(withClientCert bool) *http.Client {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.ca.cert)
+	tlsConfig := &tls.Config{RootCAs: roots}
+	if withClientCert {
+		certPEM, keyPEM, err := s.ca.issue("game-server", 3, x509.ExtKeyUsageClientAuth)
+		s.Require().NoError(err)
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		s.Require().NoError(err)
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Transport: &http2.Transport{TLSClientConfig: tlsConfig}}
+}
+
+// TestHTTP2OverTLS ensures public routes are served over HTTP/2 without a client certificate
+func (s *TLSTestSuite) TestHTTP2OverTLS() {
+	resp, err := s.client(false).Get("https://" + s.addr + "/ping")
+	s.Require().NoError(err)
+	defer resp.Body.Close()
+	s.Equal(200, resp.StatusCode)
+	s.Equal(2, resp.ProtoMajor)
+}
+
+// TestGameServerRoutesRequireClientCert ensures game server routes reject requests without a verified client certificate
+func (s *TLSTestSuite) TestGameServerRoutesRequireClientCert() {
+	resp, err := s.client(false).Post("https://"+s.addr+"/sessions/create", "application/json", nil)
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(http.StatusUnauthorized, resp.StatusCode)
+
+	resp, err = s.client(true).Post("https://"+s.addr+"/sessions/create", "application/json", nil)
+	s.Require().NoError(err)
+	resp.Body.Close()
+	s.Equal(200, resp.StatusCode)
+}
+
+// TestCertificateReload ensures a replaced certificate is served to new connections without restarting the server
+func (s *TLSTestSuite) TestCertificateReload() {
+	serial := func() int64 {
+		resp, err := s.client(false).Get("https://" + s.addr + "/ping")
+		s.Require().NoError(err)
+		defer resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].SerialNumber.Int64()
+	}
+	s.Equal(int64(2), serial())
+
+	s.writeServerCert(4)
+	// Make sure the modification time changes even on filesystems with coarse timestamps
+	later := time.Now().Add(time.Minute)
+	s.Require().NoError(os.Chtimes(s.cfg.Server.TLS.CertFile, later, later))
+	s.Require().NoError(os.Chtimes(s.cfg.Server.TLS.KeyFile, later, later))
+	s.Equal(int64(4), serial())
+}
+
+// TestH2C ensures HTTP/2 is served in cleartext when h2c is enabled
+func TestH2C(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Server.H2C = true
+	r := gin.New()
+	r.GET("/ping", ping)
+	srv, err := NewHTTPServer(cfg.Server, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := client.Get("http://" + listener.Addr().String() + "/ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("expected HTTP/2, got %s", resp.Proto)
+	}
+}
@@ -0,0 +1,591 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Span kinds (values match the OTLP SpanKind enum)
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+// Span status codes (values match the OTLP StatusCode enum)
+const (
+	SpanStatusUnset = 0
+	SpanStatusOK    = 1
+	SpanStatusError = 2
+)
+
+// TraceparentHeader is the W3C Trace Context header used to propagate traces between services
+const TraceparentHeader = "traceparent"
+
+// TraceID uniquely identifies a trace (shared by every span in the trace)
+type TraceID [16]byte
+
+// SpanID uniquely identifies a span within a trace
+type SpanID [8]byte
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether the TraceID is non-zero (an all-zero ID is invalid per the W3C spec)
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether the SpanID is non-zero (an all-zero ID is invalid per the W3C spec)
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// Span represents a single timed operation (an HTTP request, a database query, etc.)
+type Span struct {
+	Name         string
+	Kind         int
+	TraceID      TraceID
+	SpanID       SpanID
+	ParentSpanID SpanID
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]interface{}
+	StatusCode   int
+	StatusMsg    string
+
+	tracer *Tracer
+	mu     sync.Mutex
+	ended  bool
+}
+
+// SetAttribute records a key/value pair on the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Attributes[key] = value
+}
+
+// SetError marks the span as failed with the given error
+func (s *Span) SetError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.StatusCode = SpanStatusError
+	s.StatusMsg = err.Error()
+}
+
+// End finishes the span and hands it off to the tracer for export - calling End more than once is a no-op
+func (s *Span) End() {
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+	if s.tracer != nil {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Traceparent renders the span as a W3C traceparent header value
+func (s *Span) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// SpanExporter sends finished spans somewhere (stdout, a file, an OTLP collector, etc.)
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+type spanContextKey struct{}
+
+// SpanFromContext returns the active span stored in ctx, if there is one
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+	span, _ := ctx.Value(spanContextKey{}).(*Span)
+	return span
+}
+
+// remoteParent is used to carry a parent span that was received from another service via traceparent
+type remoteParent struct {
+	traceID TraceID
+	spanID  SpanID
+}
+
+type remoteParentKey struct{}
+
+// Tracer creates spans and exports them in batches from a background goroutine
+//
+// A Tracer with a nil exporter still creates spans (so trace IDs are propagated to clients) but never exports them.
+type Tracer struct {
+	exporter      SpanExporter
+	batchSize     int
+	flushInterval time.Duration
+
+	mu       sync.Mutex
+	pending  []*Span
+	kick     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// NewTracer creates a Tracer that exports finished spans using the given exporter
+func NewTracer(exporter SpanExporter) *Tracer {
+	t := &Tracer{
+		exporter:      exporter,
+		batchSize:     512,
+		flushInterval: time.Second,
+		kick:          make(chan struct{}, 1),
+		done:          make(chan struct{}),
+	}
+	if exporter != nil {
+		t.wg.Add(1)
+		go t.loop()
+	}
+	return t
+}
+
+// NewTracerFromConfig creates a Tracer using the exporter selected in the tracing config
+func NewTracerFromConfig(cfg TracingConfig) (*Tracer, error) {
+	switch cfg.Exporter {
+	case "stdout":
+		return NewTracer(NewWriterExporter(os.Stdout)), nil
+	case "file":
+		exporter, err := NewFileExporter(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		return NewTracer(exporter), nil
+	case "otlp":
+		return NewTracer(NewOTLPExporter(cfg.OTLPEndpoint)), nil
+	default:
+		return NewTracer(nil), nil
+	}
+}
+
+// Start creates a new span as a child of the span in ctx (or of a remote parent, or as a new root) and returns a context holding it
+func (t *Tracer) Start(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: map[string]interface{}{},
+		tracer:     t,
+	}
+	if parent := SpanFromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else if remote, ok := ctx.Value(remoteParentKey{}).(remoteParent); ok {
+		span.TraceID = remote.traceID
+		span.ParentSpanID = remote.spanID
+	} else {
+		_, _ = rand.Read(span.TraceID[:])
+	}
+	_, _ = rand.Read(span.SpanID[:])
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// Flush exports every span that has ended so far
+func (t *Tracer) Flush(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	t.mu.Lock()
+	batch := t.pending
+	t.pending = nil
+	t.mu.Unlock()
+	if len(batch) == 0 {
+		return nil
+	}
+	return t.exporter.ExportSpans(ctx, batch)
+}
+
+// Shutdown stops the background exporter, flushes any remaining spans and shuts down the exporter
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t.exporter == nil {
+		return nil
+	}
+	t.stopOnce.Do(func() { close(t.done) })
+	t.wg.Wait()
+	if err := t.Flush(ctx); err != nil {
+		return err
+	}
+	return t.exporter.Shutdown(ctx)
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	if t.exporter == nil {
+		return
+	}
+	t.mu.Lock()
+	t.pending = append(t.pending, span)
+	full := len(t.pending) >= t.batchSize
+	t.mu.Unlock()
+	if full {
+		select {
+		case t.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) loop() {
+	defer t.wg.Done()
+	ticker := time.NewTicker(t.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		case <-t.kick:
+		}
+		if err := t.Flush(context.Background()); err != nil {
+			log.WithField("error", err.Error()).Warn("Failed to export spans")
+		}
+	}
+}
+
+// parseTraceparent parses a W3C traceparent header value (e.g., "00-<trace-id>-<parent-id>-<flags>")
+func parseTraceparent(value string) (TraceID, SpanID, bool) {
+	var traceID TraceID
+	var spanID SpanID
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, spanID, false
+	}
+	// Version 00 must have exactly four fields - future versions may append more
+	if parts[0] == "00" && len(parts) != 4 {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, spanID, false
+	}
+	if _, err := hex.Decode(spanID[:], []byte(parts[2])); err != nil {
+		return traceID, spanID, false
+	}
+	if !traceID.IsValid() || !spanID.IsValid() {
+		return traceID, spanID, false
+	}
+	return traceID, spanID, true
+}
+
+// Tracing middleware - starts a server span for every request, continuing any trace passed in the traceparent header
+func Tracing(tracer *Tracer) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ctx := c.Request.Context()
+		if traceID, spanID, ok := parseTraceparent(c.GetHeader(TraceparentHeader)); ok {
+			ctx = context.WithValue(ctx, remoteParentKey{}, remoteParent{traceID: traceID, spanID: spanID})
+		}
+		route := c.FullPath()
+		if route == "" {
+			route = c.Request.URL.Path
+		}
+		ctx, span := tracer.Start(ctx, c.Request.Method+" "+route, SpanKindServer)
+		span.SetAttribute("http.method", c.Request.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("http.target", c.Request.URL.String())
+		c.Request = c.Request.WithContext(ctx)
+		c.Header(TraceparentHeader, span.Traceparent())
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttribute("http.status_code", status)
+		if status >= http.StatusInternalServerError {
+			span.SetError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+		span.End()
+	}
+}
+
+// gormSpanKey is the context key of the span of a gorm statement
+type gormSpanKey struct{}
+
+// gormSpan is the span of a gorm statement, kept in the statement context along with the context it replaced
+type gormSpan struct {
+	span   *Span
+	parent context.Context
+}
+
+// registerTracingCallbacks adds gorm callbacks that wrap every query in a client span
+//
+// The parent span is taken from the statement context, so queries need to be run on a DB returned by GetDB (which
+// carries the request context) in order to be attached to the request span.
+func registerTracingCallbacks(db *gorm.DB, tracer *Tracer) error {
+	before := func(operation string) func(*gorm.DB) {
+		return func(tx *gorm.DB) {
+			parent := tx.Statement.Context
+			if parent == nil {
+				parent = context.Background()
+			}
+			ctx, span := tracer.Start(parent, "gorm."+operation, SpanKindClient)
+			span.SetAttribute("db.system", tx.Dialector.Name())
+			span.SetAttribute("db.operation", operation)
+			tx.Statement.Context = context.WithValue(ctx, gormSpanKey{}, gormSpan{span: span, parent: parent})
+		}
+	}
+	after := func(tx *gorm.DB) {
+		if tx.Statement.Context == nil {
+			return
+		}
+		value, ok := tx.Statement.Context.Value(gormSpanKey{}).(gormSpan)
+		if !ok {
+			return
+		}
+		span := value.span
+		if tx.Statement.Table != "" {
+			span.SetAttribute("db.sql.table", tx.Statement.Table)
+		}
+		span.SetAttribute("db.statement", tx.Statement.SQL.String())
+		span.SetAttribute("db.rows_affected", tx.Statement.RowsAffected)
+		if tx.Error != nil && tx.Error != gorm.ErrRecordNotFound {
+			span.SetError(tx.Error)
+		}
+		span.End()
+		// Later operations of the statement get their own span under the original parent
+		tx.Statement.Context = value.parent
+	}
+
+	callbacks := db.Callback()
+	errs := []error{
+		callbacks.Create().Before("gorm:create").Register("tracing:before_create", before("create")),
+		callbacks.Create().After("gorm:create").Register("tracing:after_create", after),
+		callbacks.Query().Before("gorm:query").Register("tracing:before_query", before("query")),
+		callbacks.Query().After("gorm:query").Register("tracing:after_query", after),
+		callbacks.Update().Before("gorm:update").Register("tracing:before_update", before("update")),
+		callbacks.Update().After("gorm:update").Register("tracing:after_update", after),
+		callbacks.Delete().Before("gorm:delete").Register("tracing:before_delete", before("delete")),
+		callbacks.Delete().After("gorm:delete").Register("tracing:after_delete", after),
+		callbacks.Row().Before("gorm:row").Register("tracing:before_row", before("row")),
+		callbacks.Row().After("gorm:row").Register("tracing:after_row", after),
+		callbacks.Raw().Before("gorm:raw").Register("tracing:before_raw", before("raw")),
+		callbacks.Raw().After("gorm:raw").Register("tracing:after_raw", after),
+	}
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// jsonSpan is the line-delimited JSON representation written by the WriterExporter
+type jsonSpan struct {
+	Name         string                 `json:"name"`
+	Kind         int                    `json:"kind"`
+	TraceID      string                 `json:"traceId"`
+	SpanID       string                 `json:"spanId"`
+	ParentSpanID string                 `json:"parentSpanId,omitempty"`
+	StartTime    time.Time              `json:"startTime"`
+	EndTime      time.Time              `json:"endTime"`
+	DurationMS   float64                `json:"durationMs"`
+	Attributes   map[string]interface{} `json:"attributes"`
+	StatusCode   int                    `json:"statusCode"`
+	StatusMsg    string                 `json:"statusMessage,omitempty"`
+}
+
+// WriterExporter writes spans as line-delimited JSON to an io.Writer (e.g., stdout or a file)
+type WriterExporter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// NewWriterExporter creates a WriterExporter that writes to w
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// NewFileExporter creates a WriterExporter that appends to the file at path
+func NewFileExporter(path string) (*WriterExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterExporter{w: f, closer: f}, nil
+}
+
+// ExportSpans writes each span as a single JSON line
+func (e *WriterExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	encoder := json.NewEncoder(e.w)
+	for _, span := range spans {
+		span.mu.Lock()
+		out := jsonSpan{
+			Name:       span.Name,
+			Kind:       span.Kind,
+			TraceID:    span.TraceID.String(),
+			SpanID:     span.SpanID.String(),
+			StartTime:  span.StartTime,
+			EndTime:    span.EndTime,
+			DurationMS: float64(span.EndTime.Sub(span.StartTime)) / float64(time.Millisecond),
+			Attributes: span.Attributes,
+			StatusCode: span.StatusCode,
+			StatusMsg:  span.StatusMsg,
+		}
+		if span.ParentSpanID.IsValid() {
+			out.ParentSpanID = span.ParentSpanID.String()
+		}
+		err := encoder.Encode(out)
+		span.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Shutdown closes the underlying file (if the exporter owns one)
+func (e *WriterExporter) Shutdown(ctx context.Context) error {
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
+
+// OTLPExporter sends spans to an OpenTelemetry collector using OTLP/HTTP with JSON encoding
+type OTLPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewOTLPExporter creates an OTLPExporter that posts to <endpoint>/v1/traces
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint:    strings.TrimRight(endpoint, "/") + "/v1/traces",
+		serviceName: "codingtest",
+		client:      &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type otlpKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes"`
+	Status            struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+// OTLPTraceRequest is the body of an OTLP/HTTP JSON export request (only the fields this service writes are modeled)
+type OTLPTraceRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// otlpValue converts an attribute value into an OTLP AnyValue
+func otlpValue(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case string:
+		return map[string]interface{}{"stringValue": v}
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int:
+		return map[string]interface{}{"intValue": strconv.FormatInt(int64(v), 10)}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]interface{}{"doubleValue": v}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+// ExportSpans posts the spans to the collector in a single request
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	var scopeSpans otlpScopeSpans
+	scopeSpans.Scope.Name = "codingtest/server"
+	for _, span := range spans {
+		span.mu.Lock()
+		out := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+		}
+		if span.ParentSpanID.IsValid() {
+			out.ParentSpanID = span.ParentSpanID.String()
+		}
+		for key, value := range span.Attributes {
+			out.Attributes = append(out.Attributes, otlpKeyValue{Key: key, Value: otlpValue(value)})
+		}
+		out.Status.Code = span.StatusCode
+		out.Status.Message = span.StatusMsg
+		span.mu.Unlock()
+		scopeSpans.Spans = append(scopeSpans.Spans, out)
+	}
+	var resourceSpans otlpResourceSpans
+	resourceSpans.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpValue(e.serviceName)}}
+	resourceSpans.ScopeSpans = []otlpScopeSpans{scopeSpans}
+
+	body, err := json.Marshal(OTLPTraceRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("OTLP collector responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Shutdown is a no-op for the OTLPExporter
+func (e *OTLPExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
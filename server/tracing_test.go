@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/suite"
+)
+
+type TracingTestSuite struct {
+	suite.Suite
+	collector *httptest.Server
+	tracer    *Tracer
+	router    *gin.Engine
+
+	mu    sync.Mutex
+	spans []otlpSpan
+}
+
+func TestTracingSuite(t *testing.T) {
+	suite.Run(t, new(TracingTestSuite))
+}
+
+// SetupTest starts an in-process OTLP collector and a router that exports spans to it
+func (s *TracingTestSuite) SetupTest() {
+	s.spans = nil
+	s.collector = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.Equal("/v1/traces", r.URL.Path)
+		var request OTLPTraceRequest
+		s.NoError(json.NewDecoder(r.Body).Decode(&request))
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for _, resourceSpans := range request.ResourceSpans {
+			for _, scopeSpans := range resourceSpans.ScopeSpans {
+				s.spans = append(s.spans, scopeSpans.Spans...)
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	s.tracer = NewTracer(NewOTLPExporter(s.collector.URL))
+
+	s.router = gin.New()
+	addConfigMiddleware(s.router, DefaultConfig())
+	addTracingMiddleware(s.router, s.tracer)
+	gdb := initMockDB()
+	s.NoError(registerTracingCallbacks(gdb, s.tracer))
+	s.router.Use(func(c *gin.Context) {
+		c.Set(ContextKeyDB, gdb)
+	})
+	addRoutes(s.router)
+}
+
+func (s *TracingTestSuite) TearDownTest() {
+	s.NoError(s.tracer.Shutdown(context.Background()))
+	s.collector.Close()
+}
+
+// TestParseTraceparent ensures only well-formed traceparent headers are accepted
+func (s *TracingTestSuite) TestParseTraceparent() {
+	traceID, spanID, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.True(ok)
+	s.Equal("4bf92f3577b34da6a3ce929d0e0e4736", traceID.String())
+	s.Equal("00f067aa0ba902b7", spanID.String())
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-zzf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	} {
+		_, _, ok := parseTraceparent(invalid)
+		s.False(ok, invalid)
+	}
+}
+
+// TestRequestAndQuerySpans ensures a request produces a server span continuing the incoming trace, with database spans as its children
+func (s *TracingTestSuite) TestRequestAndQuerySpans() {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "/users", nil)
+	s.NoError(err)
+	req.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	s.router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	traceID, _, ok := parseTraceparent(w.Header().Get(TraceparentHeader))
+	s.True(ok)
+	s.Equal("4bf92f3577b34da6a3ce929d0e0e4736", traceID.String())
+
+	s.NoError(s.tracer.Flush(context.Background()))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var server *otlpSpan
+	var queries []otlpSpan
+	for i := range s.spans {
+		switch s.spans[i].Name {
+		case "GET /users":
+			server = &s.spans[i]
+		case "gorm.query":
+			queries = append(queries, s.spans[i])
+		}
+	}
+	s.Require().NotNil(server)
+	s.Equal(SpanKindServer, server.Kind)
+	s.Equal("4bf92f3577b34da6a3ce929d0e0e4736", server.TraceID)
+	s.Equal("00f067aa0ba902b7", server.ParentSpanID)
+
+	// The version of the list (for the ETag) is read before the users
+	s.Require().Len(queries, 2)
+	for _, query := range queries {
+		s.Equal(SpanKindClient, query.Kind)
+		s.Equal(server.TraceID, query.TraceID)
+		s.Equal(server.SpanID, query.ParentSpanID)
+	}
+}
+
+// TestNewRootSpan ensures a request without a traceparent header starts a new trace
+func (s *TracingTestSuite) TestNewRootSpan() {
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("POST", "/sessions/create", nil)
+	s.NoError(err)
+	s.router.ServeHTTP(w, req)
+	s.Equal(200, w.Code)
+
+	traceID, spanID, ok := parseTraceparent(w.Header().Get(TraceparentHeader))
+	s.True(ok)
+
+	s.NoError(s.tracer.Flush(context.Background()))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found bool
+	for _, span := range s.spans {
+		s.Equal(traceID.String(), span.TraceID)
+		if span.Name == "POST /sessions/create" {
+			found = true
+			s.Equal(spanID.String(), span.SpanID)
+			s.Empty(span.ParentSpanID)
+		}
+	}
+	s.True(found)
+}
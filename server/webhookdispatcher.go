@@ -0,0 +1,176 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"gorm.io/gorm"
+)
+
+// Headers sent with webhook requests
+const (
+	// WebhookSignatureHeader has the HMAC-SHA256 signature of the request, as "t=<unix time>,v1=<hex signature>" - the
+	// signature covers "<unix time>.<body>", so receivers can reject old requests being replayed
+	WebhookSignatureHeader = "X-Webhook-Signature"
+	// WebhookEventHeader has the event type (e.g., feedback.created)
+	WebhookEventHeader = "X-Webhook-Event"
+	// WebhookDeliveryHeader has the ID of the event - retries of a delivery send the same ID
+	WebhookDeliveryHeader = "X-Webhook-Delivery"
+)
+
+// webhookBatchSize is the most deliveries sent per poll
+const webhookBatchSize = 50
+
+// signWebhook computes the value of the signature header of a webhook request
+func signWebhook(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp.Unix())
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%x", timestamp.Unix(), mac.Sum(nil))
+}
+
+// WebhookDispatcher sends the pending webhook deliveries in the background, retrying failed deliveries with exponential
+// backoff
+//
+// Deliveries are claimed before they are sent, so that several instances can run dispatchers against the same database.
+// Receivers may still get an event more than once (e.g., when the instance stops before recording the outcome).
+type WebhookDispatcher struct {
+	db     *gorm.DB
+	cfg    WebhookConfig
+	client *http.Client
+	// now is replaced in tests - times are kept in UTC so that they compare correctly in the database
+	now func() time.Time
+
+	*poller
+}
+
+// NewWebhookDispatcher creates a dispatcher - call Start to send deliveries in the background
+func NewWebhookDispatcher(db *gorm.DB, cfg WebhookConfig) *WebhookDispatcher {
+	return &WebhookDispatcher{
+		db:     db,
+		cfg:    cfg,
+		client: &http.Client{Timeout: cfg.Timeout},
+		now:    func() time.Time { return time.Now().UTC() },
+		poller: newPoller(),
+	}
+}
+
+// Start sends the due deliveries every poll interval until Shutdown is called (a zero interval disables delivery)
+func (d *WebhookDispatcher) Start() {
+	d.start(d.cfg.PollInterval, func(ctx context.Context) {
+		// Requests in flight are cancelled on shutdown - their deliveries are retried later
+		if _, err := d.dispatchDue(ctx); err != nil {
+			log.WithFields(log.Fields{"error": err.Error()}).Error("Failed to send webhook deliveries")
+		}
+	})
+}
+
+// dispatchDue sends the deliveries that are due, returning how many were sent
+func (d *WebhookDispatcher) dispatchDue(ctx context.Context) (int, error) {
+	var due []WebhookDelivery
+	err := d.db.Where("status = ? AND next_attempt_at <= ?", WebhookDeliveryPending, d.now()).
+		Order("next_attempt_at").Limit(webhookBatchSize).Find(&due).Error
+	if err != nil {
+		return 0, err
+	}
+	sent := 0
+	for _, delivery := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		claimed, err := d.claim(&delivery)
+		if err != nil {
+			return sent, err
+		}
+		if !claimed {
+			continue
+		}
+		if err := d.deliver(ctx, delivery); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
+
+// claim pushes the next attempt of a delivery back while it's being sent, so that other dispatchers skip it - reports
+// false if another dispatcher claimed it first
+func (d *WebhookDispatcher) claim(delivery *WebhookDelivery) (bool, error) {
+	lease := d.now().Add(2 * d.cfg.Timeout)
+	result := d.db.Model(&WebhookDelivery{}).
+		Where("id = ? AND status = ? AND next_attempt_at = ?", delivery.ID, WebhookDeliveryPending, delivery.NextAttemptAt).
+		Update("next_attempt_at", lease)
+	if result.Error != nil {
+		return false, result.Error
+	}
+	delivery.NextAttemptAt = lease
+	return result.RowsAffected == 1, nil
+}
+
+// deliver sends a delivery and records the outcome - only database errors are returned
+func (d *WebhookDispatcher) deliver(ctx context.Context, delivery WebhookDelivery) error {
+	var webhook WebhookSubscription
+	if err := d.db.Where("id = ?", delivery.SubscriptionID).Find(&webhook).Error; err != nil {
+		return err
+	}
+	now := d.now()
+	updates := map[string]interface{}{"attempts": delivery.Attempts + 1, "last_attempt_at": now}
+	if webhook.ID == uuid.Nil {
+		updates["status"] = WebhookDeliveryFailed
+		updates["last_error"] = "Webhook was deleted"
+		return d.db.Model(&delivery).Updates(updates).Error
+	}
+
+	status, err := d.send(ctx, webhook, delivery, now)
+	updates["response_status"] = status
+	switch {
+	case err == nil && status >= 200 && status < 300:
+		updates["status"] = WebhookDeliverySucceeded
+		updates["delivered_at"] = now
+		updates["last_error"] = ""
+	default:
+		if err != nil {
+			updates["last_error"] = err.Error()
+		} else {
+			updates["last_error"] = fmt.Sprintf("Receiver responded with %d", status)
+		}
+		if delivery.Attempts+1 >= d.cfg.MaxAttempts {
+			updates["status"] = WebhookDeliveryFailed
+		} else {
+			updates["next_attempt_at"] = now.Add(exponentialBackoff(d.cfg.RetryBackoff, d.cfg.MaxBackoff, delivery.Attempts+1))
+		}
+	}
+	return d.db.Model(&delivery).Updates(updates).Error
+}
+
+// send posts the payload of a delivery to the webhook, returning the response status
+func (d *WebhookDispatcher) send(ctx context.Context, webhook WebhookSubscription, delivery WebhookDelivery, now time.Time) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "codingtest-webhooks")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, delivery.EventID.String())
+	req.Header.Set(WebhookSignatureHeader, signWebhook(webhook.Secret, now, body))
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	// Drain (a bit of) the body so that the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	return resp.StatusCode, nil
+}
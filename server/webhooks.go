@@ -0,0 +1,367 @@
+package server
+
+import (
+	"crypto/rand"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"gorm.io/gorm"
+)
+
+// Statuses of a WebhookDelivery
+const (
+	// WebhookDeliveryPending deliveries are sent (or retried) by the dispatcher once they are due
+	WebhookDeliveryPending = "pending"
+	// WebhookDeliverySucceeded deliveries got a 2xx response
+	WebhookDeliverySucceeded = "succeeded"
+	// WebhookDeliveryFailed deliveries were given up after the configured number of attempts
+	WebhookDeliveryFailed = "failed"
+)
+
+// webhookEventIsValid checks if webhooks can subscribe to the given event
+func webhookEventIsValid(event string) bool {
+	switch event {
+	case EventFeedbackCreated, EventFeedbackDeleted, EventSessionCreated:
+		return true
+	}
+	return false
+}
+
+// WebhookEventList is a list of events stored as a comma-separated column
+type WebhookEventList []string
+
+// Value implements driver.Valuer
+func (l WebhookEventList) Value() (driver.Value, error) {
+	return strings.Join(l, ","), nil
+}
+
+// Scan implements sql.Scanner
+func (l *WebhookEventList) Scan(value interface{}) error {
+	var raw string
+	switch value := value.(type) {
+	case string:
+		raw = value
+	case []byte:
+		raw = string(value)
+	case nil:
+	default:
+		return fmt.Errorf("unsupported type %T for WebhookEventList", value)
+	}
+	*l = nil
+	if raw != "" {
+		*l = strings.Split(raw, ",")
+	}
+	return nil
+}
+
+// contains checks if the list has the given event
+func (l WebhookEventList) contains(event string) bool {
+	for _, e := range l {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookSubscription database model representing a URL notified of events
+type WebhookSubscription struct {
+	ID uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	CustomModel
+	URL         string           `gorm:"not null" json:"url"`
+	Events      WebhookEventList `gorm:"type:text;not null" json:"events"`
+	Description string           `json:"description,omitempty"`
+	// Feedback events are only sent for ratings in this range (0 for no bound) - other events are always sent
+	MinRating int `gorm:"not null;default:0" json:"minRating,omitempty"`
+	MaxRating int `gorm:"not null;default:0" json:"maxRating,omitempty"`
+	// Key of the HMAC signature of the payloads (only returned when the subscription is created)
+	Secret string `gorm:"not null" json:"-"`
+}
+
+// matches checks if the subscription wants the given event - rating is 0 for events without a rating
+func (w WebhookSubscription) matches(event string, rating int) bool {
+	if !w.Events.contains(event) {
+		return false
+	}
+	if rating == 0 {
+		return true
+	}
+	return (w.MinRating == 0 || rating >= w.MinRating) && (w.MaxRating == 0 || rating <= w.MaxRating)
+}
+
+// WebhookDelivery database model representing the delivery of an event to a webhook, with its outcome
+type WebhookDelivery struct {
+	ID             uuid.UUID `gorm:"type:uuid;primary_key;" json:"id"`
+	SubscriptionID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_webhook_deliveries_event" json:"webhookId"`
+	// ID of the outbox event, shared by its deliveries to different webhooks so receivers can ignore repeated deliveries
+	EventID uuid.UUID `gorm:"type:uuid;not null;uniqueIndex:idx_webhook_deliveries_event" json:"eventId"`
+	Event   string    `gorm:"not null" json:"event"`
+	Payload string    `gorm:"not null" json:"-"`
+	Status  string    `gorm:"not null;index" json:"status"`
+	// Number of requests sent so far
+	Attempts      int        `gorm:"not null;default:0" json:"attempts"`
+	NextAttemptAt time.Time  `gorm:"index" json:"nextAttemptAt"`
+	LastAttemptAt *time.Time `json:"lastAttemptAt,omitempty"`
+	// Status code of the last response (0 if the request failed)
+	ResponseStatus int        `json:"responseStatus,omitempty"`
+	LastError      string     `json:"lastError,omitempty"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+}
+
+// WebhookPayload is the body of a webhook request
+type WebhookPayload struct {
+	ID        uuid.UUID       `json:"id"`
+	Event     string          `json:"event"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// webhookEventRating gets the rating of the feedback of a feedback event (0 for other events)
+func webhookEventRating(event OutboxEvent) int {
+	var data struct {
+		SessionFeedback *struct {
+			Rating int `json:"rating"`
+		} `json:"sessionFeedback"`
+	}
+	if json.Unmarshal([]byte(event.Payload), &data) != nil || data.SessionFeedback == nil {
+		return 0
+	}
+	return data.SessionFeedback.Rating
+}
+
+// queueWebhookDeliveries creates a pending delivery of the event for every webhook subscribed to it - webhooks that
+// already have a delivery of the event are skipped, so an event can be queued again after a failure
+func queueWebhookDeliveries(db *gorm.DB, event OutboxEvent) error {
+	var subscriptions []WebhookSubscription
+	if err := db.Find(&subscriptions).Error; err != nil {
+		return err
+	}
+	var queued []uuid.UUID
+	if err := db.Model(&WebhookDelivery{}).Where("event_id = ?", event.EventID).Pluck("subscription_id", &queued).Error; err != nil {
+		return err
+	}
+	skip := map[uuid.UUID]bool{}
+	for _, id := range queued {
+		skip[id] = true
+	}
+	body, err := json.Marshal(WebhookPayload{ID: event.EventID, Event: event.Event, CreatedAt: event.CreatedAt, Data: json.RawMessage(event.Payload)})
+	if err != nil {
+		return err
+	}
+	rating := webhookEventRating(event)
+	var deliveries []WebhookDelivery
+	for _, subscription := range subscriptions {
+		if skip[subscription.ID] || !subscription.matches(event.Event, rating) {
+			continue
+		}
+		deliveries = append(deliveries, WebhookDelivery{
+			ID:             uuid.NewV4(),
+			SubscriptionID: subscription.ID,
+			EventID:        event.EventID,
+			Event:          event.Event,
+			Payload:        string(body),
+			Status:         WebhookDeliveryPending,
+			NextAttemptAt:  time.Now().UTC(),
+		})
+	}
+	if len(deliveries) == 0 {
+		return nil
+	}
+	return db.Create(&deliveries).Error
+}
+
+// CreateWebhookInput represents the fields expected when an ops team member subscribes a URL to events
+type CreateWebhookInput struct {
+	URL         string   `json:"url"`
+	Events      []string `json:"events"`
+	Description string   `json:"description"`
+	MinRating   int      `json:"minRating"`
+	MaxRating   int      `json:"maxRating"`
+	// Generated when empty
+	Secret string `json:"secret"`
+}
+
+// validateWebhookInput checks the URL, events and rating range of a new webhook
+func validateWebhookInput(input CreateWebhookInput) error {
+	target, err := url.Parse(input.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if len(input.Events) == 0 {
+		return fmt.Errorf("At least one event is required")
+	}
+	for _, event := range input.Events {
+		if !webhookEventIsValid(event) {
+			return fmt.Errorf("Unknown event %q - must be one of feedback.created, feedback.deleted or session.created", event)
+		}
+	}
+	if (input.MinRating != 0 && !ratingIsValid(input.MinRating)) || (input.MaxRating != 0 && !ratingIsValid(input.MaxRating)) {
+		return fmt.Errorf("minRating and maxRating must be from 1 through 5")
+	}
+	if input.MinRating != 0 && input.MaxRating != 0 && input.MinRating > input.MaxRating {
+		return fmt.Errorf("minRating must not be greater than maxRating")
+	}
+	return nil
+}
+
+// CreateWebhook handles POST /ops/webhooks - subscribes a URL to events, returning the secret the payloads are signed with
+func CreateWebhook(c *gin.Context) {
+	var input CreateWebhookInput
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := validateWebhookInput(input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if input.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		input.Secret = hex.EncodeToString(secret)
+	}
+	webhook := WebhookSubscription{
+		ID:          uuid.NewV4(),
+		URL:         input.URL,
+		Events:      input.Events,
+		Description: input.Description,
+		MinRating:   input.MinRating,
+		MaxRating:   input.MaxRating,
+		Secret:      input.Secret,
+	}
+	err := GetDB(c).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&webhook).Error; err != nil {
+			return err
+		}
+		return recordAudit(tx, c, AuditActionCreate, AuditResourceWebhook, webhook.ID, nil, &webhook)
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Webhook created", "webhook": &webhook, "secret": webhook.Secret})
+}
+
+// getWebhooks handles GET /ops/webhooks - lists the webhooks, oldest first
+func getWebhooks(c *gin.Context) {
+	var webhooks []WebhookSubscription
+	if err := GetDB(c).Order("created_at").Find(&webhooks).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhooks": &webhooks})
+}
+
+// findWebhook gets the webhook with the ID in the path, responding with an error and reporting false if it can't
+func findWebhook(c *gin.Context, webhook *WebhookSubscription) bool {
+	id, err := uuid.FromString(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid Webhook ID"})
+		return false
+	}
+	if err := GetDB(c).Where("id = ?", id).Find(webhook).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	if webhook.ID == uuid.Nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook does not exist"})
+		return false
+	}
+	return true
+}
+
+// getWebhook handles GET /ops/webhooks/:id
+func getWebhook(c *gin.Context) {
+	var webhook WebhookSubscription
+	if !findWebhook(c, &webhook) {
+		return
+	}
+	if notModified(c, resourceETag(webhook.ID, webhook.UpdatedAt)) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"webhook": &webhook})
+}
+
+// DeleteWebhook handles DELETE /ops/webhooks/:id - deliveries that are still pending are given up
+func DeleteWebhook(c *gin.Context) {
+	var webhook WebhookSubscription
+	if !findWebhook(c, &webhook) {
+		return
+	}
+	if !preconditionMet(c, resourceETag(webhook.ID, webhook.UpdatedAt)) {
+		return
+	}
+	var result *gorm.DB
+	err := GetDB(c).Transaction(func(tx *gorm.DB) error {
+		result = tx.Where("id = ? AND updated_at = ?", webhook.ID, webhook.UpdatedAt).Delete(&WebhookSubscription{})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return result.Error
+		}
+		if err := recordAudit(tx, c, AuditActionDelete, AuditResourceWebhook, webhook.ID, &webhook, nil); err != nil {
+			return err
+		}
+		return tx.Model(&WebhookDelivery{}).
+			Where("subscription_id = ? AND status = ?", webhook.ID, WebhookDeliveryPending).
+			Updates(map[string]interface{}{"status": WebhookDeliveryFailed, "last_error": "Webhook was deleted"}).Error
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if result.RowsAffected == 0 {
+		preconditionFailed(c, "")
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "message": "Webhook deleted successfully!"})
+}
+
+// maxWebhookDeliveries is the most deliveries listed at once
+const maxWebhookDeliveries = 500
+
+// getWebhookDeliveries handles GET /ops/webhooks/:id/deliveries - lists the deliveries of a webhook, newest first
+//
+// Accepts the status (pending, succeeded or failed) and limit (100 by default) query parameters.
+func getWebhookDeliveries(c *gin.Context) {
+	var webhook WebhookSubscription
+	if !findWebhook(c, &webhook) {
+		return
+	}
+	limit := 100
+	if raw := c.Query("limit"); raw != "" {
+		var err error
+		if limit, err = strconv.Atoi(raw); err != nil || limit < 1 || limit > maxWebhookDeliveries {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Limit must be an integer from 1 through %d", maxWebhookDeliveries)})
+			return
+		}
+	}
+	query := GetDB(c).Where("subscription_id = ?", webhook.ID)
+	if status := c.Query("status"); status != "" {
+		switch status {
+		case WebhookDeliveryPending, WebhookDeliverySucceeded, WebhookDeliveryFailed:
+		default:
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Status must be one of pending, succeeded or failed"})
+			return
+		}
+		query = query.Where("status = ?", status)
+	}
+	var deliveries []WebhookDelivery
+	if err := query.Order("created_at DESC").Limit(limit).Find(&deliveries).Error; err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deliveries": &deliveries})
+}
@@ -0,0 +1,291 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+// webhookRequest is a request received by a test webhook receiver
+type webhookRequest struct {
+	Header  http.Header
+	Body    []byte
+	Payload struct {
+		ID    uuid.UUID `json:"id"`
+		Event string    `json:"event"`
+		Data  struct {
+			SessionFeedback SessionFeedback `json:"sessionFeedback"`
+			Session         Session         `json:"session"`
+		} `json:"data"`
+	}
+}
+
+// webhookReceiver is a test server recording the webhook requests it receives, answering with the queued statuses
+// (200 once they run out)
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	requests []webhookRequest
+	statuses []int
+}
+
+// newWebhookReceiver starts a webhook receiver - close it when done
+func newWebhookReceiver(statuses ...int) *webhookReceiver {
+	receiver := &webhookReceiver{statuses: statuses}
+	receiver.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := webhookRequest{Header: r.Header}
+		request.Body, _ = ioutil.ReadAll(r.Body)
+		json.Unmarshal(request.Body, &request.Payload)
+		receiver.mu.Lock()
+		defer receiver.mu.Unlock()
+		receiver.requests = append(receiver.requests, request)
+		status := http.StatusOK
+		if len(receiver.statuses) > 0 {
+			status, receiver.statuses = receiver.statuses[0], receiver.statuses[1:]
+		}
+		w.WriteHeader(status)
+	}))
+	return receiver
+}
+
+// received returns the requests received so far
+func (r *webhookReceiver) received() []webhookRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhookRequest(nil), r.requests...)
+}
+
+// createWebhook subscribes a URL to events, returning the webhook and its secret
+func (s *RouteTestSuite) createWebhook(input gin.H) (WebhookSubscription, string) {
+	w := s.request("POST", "/ops/webhooks", input, APIKeyHeader, testOpsAPIKey)
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Webhook WebhookSubscription `json:"webhook"`
+		Secret  string              `json:"secret"`
+	}
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Webhook, response.Secret
+}
+
+// webhookDeliveries lists the deliveries of a webhook
+func (s *RouteTestSuite) webhookDeliveries(webhook WebhookSubscription, query string) []WebhookDelivery {
+	w := s.request("GET", "/ops/webhooks/"+webhook.ID.String()+"/deliveries"+query, nil, APIKeyHeader, testOpsAPIKey)
+	s.Require().Equal(http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Deliveries []WebhookDelivery `json:"deliveries"`
+	}
+	s.Require().NoError(json.Unmarshal(w.Body.Bytes(), &response))
+	return response.Deliveries
+}
+
+// testWebhookConfig is the configuration of the dispatchers of the tests - they are driven by dispatchDue
+func testWebhookConfig() WebhookConfig {
+	return WebhookConfig{Timeout: 5 * time.Second, MaxAttempts: 3, RetryBackoff: time.Minute, MaxBackoff: time.Hour}
+}
+
+// TestWebhookMatches ensures the rating range only filters feedback events
+func TestWebhookMatches(t *testing.T) {
+	webhook := WebhookSubscription{
+		Events:    WebhookEventList{EventFeedbackCreated, EventSessionCreated},
+		MinRating: 2,
+		MaxRating: 4,
+	}
+	assert.True(t, webhook.matches(EventFeedbackCreated, 2))
+	assert.True(t, webhook.matches(EventFeedbackCreated, 4))
+	assert.False(t, webhook.matches(EventFeedbackCreated, 1))
+	assert.False(t, webhook.matches(EventFeedbackCreated, 5))
+	assert.True(t, webhook.matches(EventSessionCreated, 0))
+	assert.False(t, webhook.matches(EventFeedbackDeleted, 3))
+	assert.True(t, WebhookSubscription{Events: WebhookEventList{EventFeedbackDeleted}}.matches(EventFeedbackDeleted, 1))
+}
+
+// TestWebhookBackoff ensures the delay between attempts doubles up to the maximum
+func TestWebhookBackoff(t *testing.T) {
+	assert.Equal(t, time.Minute, exponentialBackoff(time.Minute, 5*time.Minute, 1))
+	assert.Equal(t, 2*time.Minute, exponentialBackoff(time.Minute, 5*time.Minute, 2))
+	assert.Equal(t, 4*time.Minute, exponentialBackoff(time.Minute, 5*time.Minute, 3))
+	assert.Equal(t, 5*time.Minute, exponentialBackoff(time.Minute, 5*time.Minute, 4))
+	assert.Equal(t, 5*time.Minute, exponentialBackoff(time.Minute, 5*time.Minute, 40))
+}
+
+// TestWebhooks ensures subscribed events are delivered with a valid signature, and listed in the delivery log
+func (s *RouteTestSuite) TestWebhooks() {
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+	webhook, secret := s.createWebhook(gin.H{
+		"url":       receiver.URL,
+		"events":    []string{EventFeedbackCreated, EventFeedbackDeleted},
+		"minRating": 4,
+		"secret":    "shh",
+	})
+	s.Equal("shh", secret)
+	s.Equal(WebhookEventList{EventFeedbackCreated, EventFeedbackDeleted}, webhook.Events)
+	_, generated := s.createWebhook(gin.H{"url": receiver.URL + "/sessions", "events": []string{EventSessionCreated}})
+	s.Len(generated, 64)
+
+	// Only the feedback in the rating range and the new session are delivered
+	session := s.createSession()
+	s.createFeedback(session, s.createUser(), 2, "")
+	feedback := s.createFeedback(session, s.createUser(), 5, "Great game")
+	s.Equal(3, s.publishEvents(newWebhookSink(s.db)))
+	dispatcher := NewWebhookDispatcher(s.db, testWebhookConfig())
+	sent, err := dispatcher.dispatchDue(context.Background())
+	s.Require().NoError(err)
+	s.Equal(2, sent)
+
+	requests := receiver.received()
+	s.Require().Len(requests, 2)
+	var request webhookRequest
+	for _, r := range requests {
+		if r.Payload.Event == EventSessionCreated {
+			s.Equal(session.ID, r.Payload.Data.Session.ID)
+		} else {
+			request = r
+		}
+	}
+	s.Equal(EventFeedbackCreated, request.Payload.Event)
+	s.Equal(feedback.ID, request.Payload.Data.SessionFeedback.ID)
+	s.Equal("Great game", request.Payload.Data.SessionFeedback.Comment)
+	s.Equal(EventFeedbackCreated, request.Header.Get(WebhookEventHeader))
+	s.Equal(request.Payload.ID.String(), request.Header.Get(WebhookDeliveryHeader))
+
+	// The signature is an HMAC of the timestamp and the body
+	var timestamp int64
+	var signature string
+	_, err = fmt.Sscanf(strings.Replace(request.Header.Get(WebhookSignatureHeader), ",v1=", " ", 1), "t=%d %s", &timestamp, &signature)
+	s.Require().NoError(err)
+	s.InDelta(time.Now().Unix(), timestamp, 60)
+	mac := hmac.New(sha256.New, []byte("shh"))
+	fmt.Fprintf(mac, "%d.%s", timestamp, request.Body)
+	s.Equal(hex.EncodeToString(mac.Sum(nil)), signature)
+
+	deliveries := s.webhookDeliveries(webhook, "")
+	s.Require().Len(deliveries, 1)
+	s.Equal(WebhookDeliverySucceeded, deliveries[0].Status)
+	s.Equal(1, deliveries[0].Attempts)
+	s.Equal(http.StatusOK, deliveries[0].ResponseStatus)
+	s.NotNil(deliveries[0].DeliveredAt)
+
+	// Nothing is sent twice, and deletions are delivered too
+	sent, err = dispatcher.dispatchDue(context.Background())
+	s.Require().NoError(err)
+	s.Equal(0, sent)
+	etag := s.etag("/feedback/"+feedback.ID.String(), APIKeyHeader, testOpsAPIKey)
+	s.Equal(http.StatusOK, s.request("DELETE", "/sessions/feedback?id="+feedback.ID.String(), nil, "If-Match", etag).Code)
+	s.publishEvents(newWebhookSink(s.db))
+	sent, err = dispatcher.dispatchDue(context.Background())
+	s.Require().NoError(err)
+	s.Equal(1, sent)
+	requests = receiver.received()
+	s.Equal(EventFeedbackDeleted, requests[len(requests)-1].Payload.Event)
+	s.Equal(feedback.ID, requests[len(requests)-1].Payload.Data.SessionFeedback.ID)
+	s.Len(s.webhookDeliveries(webhook, "?status=succeeded"), 2)
+	s.Len(s.webhookDeliveries(webhook, "?limit=1"), 1)
+}
+
+// TestWebhookRetries ensures failed deliveries are retried with backoff until they succeed or run out of attempts
+func (s *RouteTestSuite) TestWebhookRetries() {
+	receiver := newWebhookReceiver(http.StatusInternalServerError, http.StatusServiceUnavailable)
+	defer receiver.Close()
+	webhook, _ := s.createWebhook(gin.H{"url": receiver.URL, "events": []string{EventSessionCreated}})
+	s.createSession()
+	s.publishEvents(newWebhookSink(s.db))
+
+	now := time.Now().UTC()
+	dispatcher := NewWebhookDispatcher(s.db, testWebhookConfig())
+	dispatcher.now = func() time.Time { return now }
+	dispatch := func() int {
+		sent, err := dispatcher.dispatchDue(context.Background())
+		s.Require().NoError(err)
+		return sent
+	}
+	s.Equal(1, dispatch())
+	deliveries := s.webhookDeliveries(webhook, "")
+	s.Require().Len(deliveries, 1)
+	s.Equal(WebhookDeliveryPending, deliveries[0].Status)
+	s.Equal(1, deliveries[0].Attempts)
+	s.Equal(http.StatusInternalServerError, deliveries[0].ResponseStatus)
+	s.Equal("Receiver responded with 500", deliveries[0].LastError)
+	s.WithinDuration(now.Add(time.Minute), deliveries[0].NextAttemptAt, time.Millisecond)
+
+	// Retries wait for the backoff, which doubles after every attempt
+	s.Equal(0, dispatch())
+	now = now.Add(time.Minute)
+	s.Equal(1, dispatch())
+	now = now.Add(time.Minute)
+	s.Equal(0, dispatch())
+	now = now.Add(time.Minute)
+	s.Equal(1, dispatch())
+	deliveries = s.webhookDeliveries(webhook, "")
+	s.Equal(WebhookDeliverySucceeded, deliveries[0].Status)
+	s.Equal(3, deliveries[0].Attempts)
+	s.Empty(deliveries[0].LastError)
+	s.Len(receiver.received(), 3)
+
+	// Deliveries are given up after the last attempt
+	receiver.Close()
+	s.createSession()
+	s.publishEvents(newWebhookSink(s.db))
+	for i := 0; i < 3; i++ {
+		s.Equal(1, dispatch())
+		now = now.Add(time.Hour)
+	}
+	s.Equal(0, dispatch())
+	failed := s.webhookDeliveries(webhook, "?status=failed")
+	s.Require().Len(failed, 1)
+	s.Equal(3, failed[0].Attempts)
+	s.Zero(failed[0].ResponseStatus)
+	s.NotEmpty(failed[0].LastError)
+}
+
+// TestWebhookManagement ensures webhooks are validated, and deleted with their pending deliveries
+func (s *RouteTestSuite) TestWebhookManagement() {
+	invalid := []gin.H{
+		{"url": "ftp://example.com", "events": []string{EventSessionCreated}},
+		{"url": "/hooks", "events": []string{EventSessionCreated}},
+		{"url": "https://example.com"},
+		{"url": "https://example.com", "events": []string{"session.deleted"}},
+		{"url": "https://example.com", "events": []string{EventFeedbackCreated}, "minRating": 6},
+		{"url": "https://example.com", "events": []string{EventFeedbackCreated}, "minRating": 4, "maxRating": 2},
+	}
+	for _, input := range invalid {
+		s.Equal(http.StatusBadRequest, s.request("POST", "/ops/webhooks", input, APIKeyHeader, testOpsAPIKey).Code, input)
+	}
+	s.Equal(http.StatusUnauthorized, s.request("GET", "/ops/webhooks", nil).Code)
+
+	webhook, _ := s.createWebhook(gin.H{"url": "https://example.com/hooks", "events": []string{EventSessionCreated}})
+	w := s.request("GET", "/ops/webhooks", nil, APIKeyHeader, testOpsAPIKey)
+	s.Equal(http.StatusOK, w.Code)
+	s.Contains(w.Body.String(), "https://example.com/hooks")
+	// The secret is only returned when the webhook is created
+	s.NotContains(w.Body.String(), "secret")
+	s.createSession()
+	s.publishEvents(newWebhookSink(s.db))
+
+	path := "/ops/webhooks/" + webhook.ID.String()
+	s.Equal(http.StatusPreconditionRequired, s.request("DELETE", path, nil, APIKeyHeader, testOpsAPIKey).Code)
+	etag := s.etag(path, APIKeyHeader, testOpsAPIKey)
+	s.Equal(http.StatusOK, s.request("DELETE", path, nil, APIKeyHeader, testOpsAPIKey, "If-Match", etag).Code)
+	s.Equal(http.StatusNotFound, s.request("GET", path, nil, APIKeyHeader, testOpsAPIKey).Code)
+	s.Equal(http.StatusBadRequest, s.request("GET", "/ops/webhooks/nope", nil, APIKeyHeader, testOpsAPIKey).Code)
+
+	var deliveries []WebhookDelivery
+	s.Require().NoError(s.db.Where("subscription_id = ?", webhook.ID).Find(&deliveries).Error)
+	s.Require().Len(deliveries, 1)
+	s.Equal(WebhookDeliveryFailed, deliveries[0].Status)
+	s.Equal("Webhook was deleted", deliveries[0].LastError)
+}